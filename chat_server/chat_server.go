@@ -1,14 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"os"
+	"log/slog"
+	"net/netip"
 	"sync"
+	"time"
 
+	"github.com/toastsandwich/epoll-learn/pkg/control"
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+	"github.com/toastsandwich/epoll-learn/pkg/metrics"
+	"github.com/toastsandwich/epoll-learn/pkg/pool"
 	"golang.org/x/sys/unix"
 )
 
-const MAXACTIVECONNS = 100_000
+const (
+	MAXACTIVECONNS = 100_000 // default ChatServerOpts.MaxConns
+	// default ChatServerOpts.BufferSize
+	MAXBUFFERSIZE = 4096
+)
 
 func SockIPv4ToString(s unix.Sockaddr) string {
 	switch a := s.(type) {
@@ -19,197 +34,689 @@ func SockIPv4ToString(s unix.Sockaddr) string {
 	}
 }
 
+var ErrServerClosed = errors.New("chat server closed")
+
+type ChatServerOpts struct {
+	Addr string
+	Port int // 0 picks a free port, see ChatServer.Addr
+	// ListenFd is a listening socket to serve on instead of binding Addr and Port, one
+	// handed over by the process being upgraded, see package upgrade. 0 binds.
+	ListenFd int
+
+	// Trigger is how epoll reports ready sockets, level by default. Edge triggered the loop
+	// drains every socket until EAGAIN, level triggered it reads loop.LEVELREADS times per
+	// user and accepts loop.LEVELACCEPTS connections per wakeup.
+	Trigger loop.Trigger
+
+	// MaxConns caps connected users, MAXACTIVECONNS by default. OverLimit is what happens
+	// past it, by default loop.Reject: the client is told SERVERFULL and disconnected.
+	// loop.Pause stops accepting until a user leaves, new clients wait in the listen backlog.
+	MaxConns  int
+	OverLimit loop.OverLimit
+
+	// BufferSize is how much one read takes, also the longest line kept before it is
+	// flushed as is. MAXBUFFERSIZE by default.
+	BufferSize int
+
+	Logger  *slog.Logger      // defaults to logging.Default()
+	Metrics *metrics.Registry // defaults to a registry of its own, see ChatServer.Metrics
+}
+
 type ChatServer struct {
 	SocketAddrInet4 unix.SockaddrInet4
 
 	Fd      int // fd for server
 	epollFd int // fd for epoll instance
+	wakeFd  int // eventfd written by Close to stop Serve, and by Shutdown
+	trigger loop.Trigger
+
+	maxConns     int            // under mu, see Reload
+	overLimit    loop.OverLimit // under mu, see Reload
+	acceptPaused bool           // the listener is out of epoll for loop.Pause, under mu
+	// closed to accept and drop a connection when out of descriptors, see loop.SpareFd
+	spare   *loop.SpareFd
+	bufSize int
+
+	ActiveUserMap map[int]*User
 
-	ActiveUserMap map[int]string
+	bp      *pool.Pool
+	log     *slog.Logger
+	reg     *metrics.Registry
+	metrics *chatMetrics
 
-	bp *BufferPool
+	serving  bool
+	closed   bool
+	draining bool // set by Shutdown, under mu
+	done     chan struct{}
 
 	mu sync.RWMutex
 }
 
-func NewChatServer(a, b, c, d byte, port int) *ChatServer {
+func NewChatServer(opts *ChatServerOpts) (*ChatServer, error) {
 	ch := &ChatServer{}
 
-	addr := [4]byte{a, b, c, d}
-	copy(ch.SocketAddrInet4.Addr[:], addr[:])
-	ch.SocketAddrInet4.Port = port
+	if opts.ListenFd == 0 {
+		addr, err := netip.ParseAddr(opts.Addr)
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("invalid ipv4 address %q", opts.Addr)
+		}
+		ch.SocketAddrInet4.Addr = addr.As4()
+		ch.SocketAddrInet4.Port = opts.Port
+	}
 
-	ch.ActiveUserMap = make(map[int]string)
+	ch.ActiveUserMap = make(map[int]*User)
+	ch.done = make(chan struct{})
+	ch.trigger = cmp.Or(opts.Trigger, loop.Level)
 
-	ch.bp = NewBufferPool(true)
-	ifErrExit(ch.bindAndListen(), "error binding and listening")
-	ifErrExit(ch.setupEpollAndEvents(), "error setting up epoll and its events")
-	return ch
+	if opts.MaxConns < 0 {
+		return nil, fmt.Errorf("max connections %d, want 0 for the default or more", opts.MaxConns)
+	}
+	ch.maxConns = cmp.Or(opts.MaxConns, MAXACTIVECONNS)
+	if _, err := loop.ParseOverLimit(string(opts.OverLimit)); err != nil {
+		return nil, err
+	}
+	ch.overLimit = cmp.Or(opts.OverLimit, loop.Reject)
+	if opts.BufferSize < 0 {
+		return nil, fmt.Errorf("buffer size %d, want 0 for the default or more", opts.BufferSize)
+	}
+	ch.bufSize = cmp.Or(opts.BufferSize, MAXBUFFERSIZE)
+
+	ch.log = opts.Logger
+	if ch.log == nil {
+		ch.log = logging.Default()
+	}
+
+	ch.bp = pool.New(true)
+	ch.reg = opts.Metrics
+	if ch.reg == nil {
+		ch.reg = metrics.NewRegistry()
+	}
+	ch.metrics = newChatMetrics(ch.reg, ch)
+	var err error
+	if ch.spare, err = loop.NewSpareFd(); err != nil {
+		return nil, err
+	}
+	if opts.ListenFd != 0 {
+		if err := loop.AdoptListener(opts.ListenFd); err != nil {
+			ch.spare.Close()
+			return nil, fmt.Errorf("error adopting listener: %w", err)
+		}
+		ch.Fd = opts.ListenFd
+	} else if err := ch.bindAndListen(); err != nil {
+		ch.spare.Close()
+		return nil, fmt.Errorf("error binding and listening on %s: %w", SockIPv4ToString(&ch.SocketAddrInet4), err)
+	}
+	if err := ch.setupEpollAndEvents(); err != nil {
+		ch.cleanup()
+		return nil, fmt.Errorf("error setting up epoll and its events: %w", err)
+	}
+	return ch, nil
 }
 
 func (c *ChatServer) bindAndListen() error {
 	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
 	if err != nil {
-		return err
+		return fmt.Errorf("socket: %w", err)
 	}
 	c.Fd = fd
 
 	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
-		return err
+		unix.Close(fd)
+		return fmt.Errorf("setsockopt SO_REUSEADDR: %w", err)
 	}
 
 	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
-		return err
+		unix.Close(fd)
+		return fmt.Errorf("setsockopt SO_REUSEPORT: %w", err)
 	}
 
 	if err := unix.SetNonblock(fd, true); err != nil {
-		return err
+		unix.Close(fd)
+		return fmt.Errorf("set nonblock: %w", err)
 	}
 
-	fmt.Println("chat server started to listen on", SockIPv4ToString(&c.SocketAddrInet4))
-
 	if err := unix.Bind(fd, &c.SocketAddrInet4); err != nil {
-		return err
+		unix.Close(fd)
+		return fmt.Errorf("bind: %w", err)
 	}
 
-	return unix.Listen(fd, 4096) // max pending connections can be 2048
+	if err := unix.Listen(fd, 4096); err != nil { // max pending connections can be 2048
+		unix.Close(fd)
+		return fmt.Errorf("listen: %w", err)
+	}
+	return nil
+}
+
+// Metrics returns the registry the server reports to.
+func (c *ChatServer) Metrics() *metrics.Registry { return c.reg }
+
+// Addr returns the address the server is listening on, useful when port was 0.
+func (c *ChatServer) Addr() string {
+	sa, err := unix.Getsockname(c.Fd)
+	if err != nil {
+		return ""
+	}
+	return SockIPv4ToString(sa)
 }
 
 func (c *ChatServer) setupEpollAndEvents() error {
+	c.epollFd, c.wakeFd = -1, -1
 	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
 	if err != nil {
-		return err
+		return fmt.Errorf("epoll_create1: %w", err)
 	}
 
 	c.epollFd = epfd
 
-	serverAcceptEvent := &unix.EpollEvent{
+	if err := c.watchListener(); err != nil {
+		return fmt.Errorf("adding listener to epoll: %w", err)
+	}
+
+	wakeFd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("eventfd: %w", err)
+	}
+	c.wakeFd = wakeFd
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wakeFd, &unix.EpollEvent{
+		Fd:     int32(wakeFd),
+		Events: unix.EPOLLIN,
+	}); err != nil {
+		return fmt.Errorf("adding eventfd to epoll: %w", err)
+	}
+	return nil
+}
+
+// watchListener adds the listener to epoll, at start and when accepting resumes.
+func (c *ChatServer) watchListener() error {
+	return unix.EpollCtl(c.epollFd, unix.EPOLL_CTL_ADD, c.Fd, &unix.EpollEvent{
 		Fd:     int32(c.Fd),
-		Events: unix.EPOLLIN | unix.EPOLLERR | unix.EPOLLRDHUP | unix.EPOLLHUP,
+		Events: c.trigger.Events(unix.EPOLLIN | unix.EPOLLERR | unix.EPOLLRDHUP | unix.EPOLLHUP),
+	})
+}
+
+// accept takes pending connections until EAGAIN, or as many as the trigger mode allows per
+// wakeup, or until MaxConns with loop.Pause.
+func (c *ChatServer) accept() {
+	accepts := c.trigger.Accepts()
+	for i := 0; accepts == 0 || i < accepts; i++ {
+		if c.pauseAccepting() {
+			return
+		}
+		cfd, csockaddr, err := unix.Accept4(c.Fd, loop.AcceptFlags)
+		if err != nil {
+			if err == unix.EINTR || err == unix.ECONNABORTED {
+				continue
+			}
+			if loop.OutOfFds(err) {
+				c.log.Warn("out of file descriptors, dropping a pending connection", logging.Err(err))
+				if c.spare.Shed(c.Fd) {
+					c.metrics.shed.Inc()
+					continue
+				}
+				return
+			}
+			if err != unix.EAGAIN {
+				c.log.Error("error accepting connection", logging.Err(err))
+			}
+			return
+		}
+		sockString := SockIPv4ToString(csockaddr)
+		if c.full() {
+			c.reject(cfd, sockString)
+			continue
+		}
+		u := NewUser(sockString, logging.Conn(c.log, cfd, sockString))
+		u.log.Debug("new connection")
+		c.metrics.accepted.Inc()
+
+		c.mu.Lock()
+		c.ActiveUserMap[cfd] = u
+		c.mu.Unlock()
+
+		if err := unix.EpollCtl(c.epollFd, unix.EPOLL_CTL_ADD, cfd, &unix.EpollEvent{
+			Fd:     int32(cfd),
+			Events: c.trigger.Events(unix.EPOLLERR | unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLHUP),
+		}); err != nil {
+			u.log.Error("error adding connection to epoll", logging.Err(err))
+			c.CloseClient(cfd)
+		}
 	}
-	return unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, c.Fd, serverAcceptEvent)
 }
 
-func (c *ChatServer) accept() error {
-	cfd, csockaddr, err := unix.Accept(c.Fd)
-	if err != nil {
-		return err
+// full reports whether MaxConns users are connected.
+func (c *ChatServer) full() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.ActiveUserMap) >= c.maxConns
+}
+
+// SERVERFULL is what a client past MaxConns is told with loop.Reject.
+const SERVERFULL = "* server full, try again later\n"
+
+// reject tells a client past MaxConns the server is full and disconnects it.
+func (c *ChatServer) reject(fd int, peer string) {
+	unix.Write(fd, []byte(SERVERFULL))
+	unix.Close(fd)
+	c.metrics.rejected.Inc()
+	c.log.Debug("server full, rejected", slog.String(logging.KeyPeer, peer))
+}
+
+// pauseAccepting takes the listener out of epoll once MaxConns users are connected with
+// loop.Pause, it reports whether it did. resumeAccepting puts it back.
+func (c *ChatServer) pauseAccepting() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.overLimit != loop.Pause || len(c.ActiveUserMap) < c.maxConns {
+		return false
+	}
+	if err := unix.EpollCtl(c.epollFd, unix.EPOLL_CTL_DEL, c.Fd, nil); err != nil {
+		c.log.Error("error pausing accepts", logging.Err(err))
+		return false
 	}
-	sockString := SockIPv4ToString(csockaddr)
-	fmt.Println("new connection from: ", sockString)
+	c.acceptPaused = true
+	c.metrics.acceptPauses.Inc()
+	c.log.Debug("connection limit reached, pausing accepts", slog.Int("users", len(c.ActiveUserMap)))
+	return true
+}
 
+// Serve, accepts incoming connection, read messages from them and broadcasts them.
+// It returns nil once Close is called.
+func (c *ChatServer) Serve() error {
 	c.mu.Lock()
-	c.ActiveUserMap[cfd] = sockString
+	if c.closed {
+		c.mu.Unlock()
+		return ErrServerClosed
+	}
+	c.serving = true
 	c.mu.Unlock()
+	defer close(c.done)
+	defer c.cleanup()
 
-	return unix.EpollCtl(c.epollFd, unix.EPOLL_CTL_ADD, cfd, &unix.EpollEvent{
-		Fd:     int32(cfd),
-		Events: unix.EPOLLERR | unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLHUP,
-	})
-}
+	c.log.Info("chat server started to listen", slog.String("addr", c.Addr()))
 
-// Serve, accepts incoming connection, read messages from them and broadcasts them.
-func (c *ChatServer) Serve() {
+	events := make([]unix.EpollEvent, 100000)
 	// serve waits for events for happens and adjusts
 	for {
-		events := make([]unix.EpollEvent, 100000)
 		n, err := unix.EpollWait(c.epollFd, events, -1) // wait forever
-		// ifErrExit(err, "error waiting for events to happen")
 		if err != nil {
 			if err == unix.EINTR {
-				fmt.Println("error waiting for events:", err)
 				continue
 			}
+			return fmt.Errorf("error waiting for events: %w", err)
 		}
+		c.metrics.wakeups.Inc()
+		c.metrics.eventsPerWakeup.Observe(float64(n))
 		for i := range n {
 			event := events[i]
 			evtFd, evts := event.Fd, event.Events
 			switch {
-			case evtFd == int32(c.Fd):
-				if err := c.accept(); err != nil {
-					fmt.Println("error accepting connection:", err)
+			case evtFd == int32(c.wakeFd):
+				if c.isClosed() {
+					return nil
 				}
+				c.drain()
+
+			case evtFd == int32(c.Fd):
+				c.accept()
 
 			case evts&unix.EPOLLERR != 0:
+				log := c.userLog(int(evtFd))
 				errNo, err := unix.GetsockoptInt(int(evtFd), unix.SOL_SOCKET, unix.SO_ERROR)
 				if err != nil {
-					fmt.Println("error getting socket error number:", err)
+					log.Warn("error getting socket error number", logging.Err(err))
 				} else {
-					fmt.Println("error from epoll:", unix.Errno(errNo))
+					log.Warn("error from epoll", logging.Err(unix.Errno(errNo)))
 				}
 				c.CloseClient(int(evtFd))
 			case evts&unix.EPOLLHUP != 0:
-			case evts&unix.EPOLLRDHUP != 0: // this means that client has closed the connection.
 				c.CloseClient(int(evtFd))
-				continue
 
-			case evts&unix.EPOLLIN != 0:
-				buf := c.bp.GetBuffer()
-				n, err := unix.Read(int(evtFd), buf)
-				if err != nil {
-					fmt.Println("error reading from cient:", err)
-					continue
-				}
-				c.broadcast(int(evtFd), buf[:n])
-				c.bp.PutBuffer(buf)
+			// a client that closed the connection (EPOLLRDHUP) may have sent its last
+			// lines with it, reading ends with EOF and closes.
+			case evts&(unix.EPOLLIN|unix.EPOLLRDHUP) != 0:
+				c.read(int(evtFd))
 			}
 		}
 	}
 }
 
-func (c *ChatServer) broadcast(from int, b []byte) {
-	// TODO: snapshot all available fds execpt the one it is from
-	fds := make([]int, 0, len(c.ActiveUserMap))
-	who := ""
+// read reads what fd sent, until EAGAIN when edge triggered and loop.LEVELREADS times when
+// level triggered, the next wakeup reads what is left.
+func (c *ChatServer) read(fd int) {
+	buf := c.bp.Get(c.bufSize)
+	defer c.bp.Put(buf)
+	reads := c.trigger.Reads()
+	for i := 0; reads == 0 || i < reads; i++ {
+		n, err := unix.Read(fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if err != unix.EAGAIN {
+				c.userLog(fd).Warn("error reading from client", logging.Err(err))
+			}
+			return
+		}
+		if n == 0 {
+			c.CloseClient(fd)
+			return
+		}
+		c.handleInput(fd, buf[:n])
+	}
+}
+
+// handleInput splits whatever was read into lines, a line is either a command or a message.
+// incomplete lines wait in the user's pending buffer for the next read.
+func (c *ChatServer) handleInput(from int, b []byte) {
 	c.mu.RLock()
-	if _, ok := c.ActiveUserMap[from]; !ok {
+	u, ok := c.ActiveUserMap[from]
+	c.mu.RUnlock()
+	if !ok {
 		return
 	}
-	for fd := range c.ActiveUserMap {
-		if from == fd {
-			who = c.ActiveUserMap[fd]
+
+	u.bytesRead.Add(int64(len(b)))
+	c.metrics.bytesRead.Add(len(b))
+	readAt := time.Now()
+	u.pending = append(u.pending, b...)
+	for {
+		line, rest, found := bytes.Cut(u.pending, []byte("\n"))
+		if !found {
+			break
+		}
+		c.handleLine(from, u, bytes.TrimSuffix(line, []byte("\r")))
+		c.metrics.messageDuration.ObserveSince(readAt)
+		u.pending = rest
+	}
+
+	// a client that never sends a newline should not make us hold on to its bytes forever
+	if len(u.pending) >= c.bufSize {
+		c.handleLine(from, u, u.pending)
+		u.pending = nil
+	}
+	if len(u.pending) == 0 {
+		u.pending = nil
+	}
+}
+
+func (c *ChatServer) handleLine(from int, u *User, line []byte) {
+	if len(line) == 0 {
+		return
+	}
+
+	cmd, arg, _ := bytes.Cut(line, []byte(" "))
+	arg = bytes.TrimSpace(arg)
+	switch string(cmd) {
+	case CMDNICK:
+		if len(arg) == 0 {
+			c.reply(from, "* usage: /nick <name>\n")
+			return
+		}
+		old := u.Name()
+		c.mu.Lock()
+		u.Nick = string(arg)
+		c.mu.Unlock()
+		c.broadcast(-1, u.Room, []byte(fmt.Sprintf("* %s is now known as %s\n", old, u.Nick)))
+
+	case CMDJOIN:
+		if len(arg) == 0 {
+			c.reply(from, "* usage: /join <room>\n")
+			return
+		}
+		left, room := u.Room, roomKey(string(arg))
+		if left == room {
+			return
+		}
+		c.mu.Lock()
+		u.Room = room
+		c.mu.Unlock()
+		c.broadcast(-1, left, []byte(fmt.Sprintf("* %s left %s\n", u.Name(), roomName(left))))
+		c.broadcast(-1, room, []byte(fmt.Sprintf("* %s joined %s\n", u.Name(), roomName(room))))
+
+	default:
+		c.broadcast(from, u.Room, []byte(fmt.Sprintf("%s says, %s\n", u.Name(), line)))
+	}
+}
+
+// broadcast writes msg to everyone in room except from, pass from as -1 to include everyone.
+func (c *ChatServer) broadcast(from int, room string, msg []byte) {
+	c.mu.RLock()
+	fds := make([]int, 0, len(c.ActiveUserMap))
+	for fd, u := range c.ActiveUserMap {
+		if from == fd || u.Room != room {
 			continue
 		}
 		fds = append(fds, fd)
 	}
 	c.mu.RUnlock()
 
-	msg := []byte(fmt.Sprintf("%s says, %s", who, string(b)))
 	for i := range fds {
-		_, err := unix.Write(fds[i], msg)
-		if err != nil {
-			switch err {
-			case unix.EAGAIN:
-				continue
-			case unix.EPIPE:
-			case unix.ECONNRESET:
-				c.CloseClient(fds[i])
-			default:
-				fmt.Println("error while broadcasting", err)
-			}
+		c.reply(fds[i], string(msg))
+	}
+}
 
+func (c *ChatServer) reply(fd int, msg string) {
+	n, err := unix.Write(fd, []byte(msg))
+	if n > 0 {
+		c.metrics.bytesWritten.Add(n)
+		c.mu.RLock()
+		if u, ok := c.ActiveUserMap[fd]; ok {
+			u.bytesWritten.Add(int64(n))
+		}
+		c.mu.RUnlock()
+	}
+	if err != nil {
+		switch err {
+		case unix.EAGAIN:
+		case unix.EPIPE, unix.ECONNRESET:
+			c.CloseClient(fd)
+		default:
+			c.userLog(fd).Warn("error while broadcasting", logging.Err(err))
 		}
 	}
 }
 
+// userLog is the connection scoped logger for fd, or the server's if fd is not a user.
+func (c *ChatServer) userLog(fd int) *slog.Logger {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if u, ok := c.ActiveUserMap[fd]; ok {
+		return u.log
+	}
+	return c.log
+}
+
+// Close stops Serve and waits for it to return, every client is disconnected.
 func (c *ChatServer) Close() {
-	unix.Close(c.epollFd)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	serving := c.serving
+	c.mu.Unlock()
+
+	if !serving {
+		c.cleanup()
+		return
+	}
+	c.wake()
+	<-c.done
+}
+
+// wake makes Serve look at whether it is closed or draining.
+func (c *ChatServer) wake() {
+	var one [8]byte
+	binary.NativeEndian.PutUint64(one[:], 1)
+	unix.Write(c.wakeFd, one[:])
+}
+
+func (c *ChatServer) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
+
+// RESTARTING is what every user is told when Shutdown starts.
+const RESTARTING = "* server restarting, reconnect to carry on\n"
+
+// Shutdown stops accepting, tells every user the server is restarting and waits for them
+// to leave, for an upgrade to a new process, see package upgrade. Users still here after
+// timeout are disconnected as Close does.
+func (c *ChatServer) Shutdown(timeout time.Duration) {
+	c.mu.Lock()
+	start := c.serving && !c.closed && !c.draining
+	c.draining = true
+	c.mu.Unlock()
+	if !start {
+		c.Close()
+		return
+	}
+	c.log.Info("draining users", slog.Int("users", c.users()), slog.Duration("timeout", timeout))
+	c.wake()
+
+	deadline := time.Now().Add(timeout)
+	for c.users() > 0 && time.Now().Before(deadline) {
+		time.Sleep(DRAININTERVAL)
+	}
+	if n := c.users(); n > 0 {
+		c.log.Warn("drain timed out, disconnecting users", slog.Int("users", n))
+	}
+	c.Close()
+}
+
+// DRAININTERVAL is how often Shutdown checks whether everyone left.
+const DRAININTERVAL = 10 * time.Millisecond
+
+func (c *ChatServer) users() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.ActiveUserMap)
+}
+
+// drain runs on Serve once Shutdown woke it, the listener leaves epoll and users are told.
+func (c *ChatServer) drain() {
+	var buf [8]byte
+	unix.Read(c.wakeFd, buf[:]) // level triggered, it would wake Serve again
+
+	c.mu.Lock()
+	if !c.acceptPaused {
+		if err := unix.EpollCtl(c.epollFd, unix.EPOLL_CTL_DEL, c.Fd, nil); err != nil {
+			c.log.Error("error stopping accepts", logging.Err(err))
+		}
+		c.acceptPaused = true
+	}
+	fds := make([]int, 0, len(c.ActiveUserMap))
+	for fd := range c.ActiveUserMap {
+		fds = append(fds, fd)
+	}
+	c.mu.Unlock()
+	for _, fd := range fds {
+		c.reply(fd, RESTARTING)
+	}
+}
+
+func (c *ChatServer) cleanup() {
+	c.mu.Lock()
+	for fd := range c.ActiveUserMap {
+		unix.Close(fd)
+	}
+	clear(c.ActiveUserMap)
+	c.mu.Unlock()
+
+	if c.wakeFd >= 0 {
+		unix.Close(c.wakeFd)
+	}
+	if c.epollFd >= 0 {
+		unix.Close(c.epollFd)
+	}
 	unix.Close(c.Fd)
+	c.spare.Close()
 }
 
 // close client handles the remove from epoll intrest list as well.
 func (c *ChatServer) CloseClient(fd int) {
 	unix.EpollCtl(c.epollFd, unix.EPOLL_CTL_DEL, fd, nil)
-	unix.Close(fd)
 
+	// out of the map before the fd is closed and can be reused, see Kick
 	c.mu.Lock()
+	u, ok := c.ActiveUserMap[fd]
 	delete(c.ActiveUserMap, fd)
+	c.resumeAccepting()
 	c.mu.Unlock()
+	unix.Close(fd)
+	if ok {
+		u.log.Debug("connection closed", logging.Bytes(int(u.bytesRead.Load())))
+	}
 }
 
-func ifErrExit(err error, msg string) {
-	if err != nil {
-		fmt.Println(msg+":", err)
-		os.Exit(1)
+// resumeAccepting puts the listener paused by pauseAccepting back in epoll once below
+// MaxConns, or once Reload raised the limit or stopped pausing. callers hold mu.
+func (c *ChatServer) resumeAccepting() {
+	if !c.acceptPaused || c.draining {
+		return
 	}
+	if c.overLimit == loop.Pause && len(c.ActiveUserMap) >= c.maxConns {
+		return
+	}
+	// epoll reports a backlog that built up while paused, edge triggered too
+	if err := c.watchListener(); err != nil {
+		c.log.Error("error resuming accepts", logging.Err(err))
+		return
+	}
+	c.acceptPaused = false
+	c.log.Debug("below connection limit, resuming accepts")
 }
+
+// Reload applies the options that can change while serving, MaxConns and OverLimit, both
+// at once or neither. The others need a new server and are ignored. Connected users stay,
+// past a lowered MaxConns they are left to leave on their own.
+func (c *ChatServer) Reload(opts *ChatServerOpts) error {
+	if opts.MaxConns < 0 {
+		return fmt.Errorf("max connections %d, want 0 for the default or more", opts.MaxConns)
+	}
+	if _, err := loop.ParseOverLimit(string(opts.OverLimit)); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxConns = cmp.Or(opts.MaxConns, MAXACTIVECONNS)
+	c.overLimit = cmp.Or(opts.OverLimit, loop.Reject)
+	c.resumeAccepting()
+	return nil
+}
+
+// Conns describes the connected users, for the control socket. the state is who they are
+// and where.
+func (c *ChatServer) Conns() []control.ConnInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	infos := make([]control.ConnInfo, 0, len(c.ActiveUserMap))
+	for fd, u := range c.ActiveUserMap {
+		infos = append(infos, control.ConnInfo{
+			Fd:           fd,
+			Peer:         u.Addr,
+			Age:          time.Since(u.connectedAt),
+			BytesRead:    u.bytesRead.Load(),
+			BytesWritten: u.bytesWritten.Load(),
+			State:        fmt.Sprintf("%s in %s", u.Name(), roomName(u.Room)),
+		})
+	}
+	return infos
+}
+
+// Kick hangs up on the user at fd from any goroutine, Serve sees the hangup and closes it
+// as if they left.
+func (c *ChatServer) Kick(fd int) error {
+	// CloseClient takes the fd out of the map before closing it, it is still ours under mu
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.ActiveUserMap[fd]; !ok {
+		return fmt.Errorf("no user with fd %d", fd)
+	}
+	return unix.Shutdown(fd, unix.SHUT_RDWR)
+}
+
+// PoolStats are the counters of the pool read buffers come from.
+func (c *ChatServer) PoolStats() pool.Stats { return c.bp.Stats() }
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/chat_server/client"
+	"github.com/toastsandwich/epoll-learn/pkg/bench"
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+	"golang.org/x/sys/unix"
+)
+
+// testTrigger is how the servers under test are told about ready sockets,
+// TestChatServerEdgeTriggered reruns chatSuite edge triggered.
+var testTrigger = loop.Level
+
+func startChatServer(t testing.TB) *ChatServer {
+	t.Helper()
+	return startChatServerOpts(t, &ChatServerOpts{})
+}
+
+// startChatServerOpts fills in a loopback address, a free port, testTrigger and a silent logger.
+func startChatServerOpts(t testing.TB, opts *ChatServerOpts) *ChatServer {
+	t.Helper()
+	opts.Addr, opts.Trigger, opts.Logger = "127.0.0.1", testTrigger, logging.Discard()
+	ch, err := NewChatServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errC := make(chan error, 1)
+	go func() { errC <- ch.Serve() }()
+	t.Cleanup(func() {
+		ch.Close()
+		if err := <-errC; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	return ch
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type rawConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, ch *ChatServer) *rawConn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", ch.Addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawConn{conn, bufio.NewReader(conn)}
+}
+
+func (c *rawConn) readLine(t *testing.T) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading line: %v", err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func (c *rawConn) expectNothing(t *testing.T) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if line, err := c.r.ReadString('\n'); err == nil {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestChatServerAccepts(t *testing.T) {
+	ch := startChatServer(t)
+	for range 5 {
+		dial(t, ch)
+	}
+	waitFor(t, "5 users", func() bool { return ch.users() == 5 })
+}
+
+func TestChatServerBroadcast(t *testing.T) {
+	ch := startChatServer(t)
+	a, b, c := dial(t, ch), dial(t, ch), dial(t, ch)
+	waitFor(t, "3 users", func() bool { return ch.users() == 3 })
+
+	a.Write([]byte("hello everyone\n"))
+	want := a.LocalAddr().String() + " says, hello everyone"
+	for _, conn := range []*rawConn{b, c} {
+		if got := conn.readLine(t); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	a.expectNothing(t)
+}
+
+func TestChatServerPartialLines(t *testing.T) {
+	ch := startChatServer(t)
+	a, b := dial(t, ch), dial(t, ch)
+	waitFor(t, "2 users", func() bool { return ch.users() == 2 })
+
+	a.Write([]byte("/nick al"))
+	time.Sleep(20 * time.Millisecond)
+	a.Write([]byte("ice\nfirst\nsec"))
+	time.Sleep(20 * time.Millisecond)
+	a.Write([]byte("ond\r\n"))
+
+	for _, want := range []string{
+		"* " + a.LocalAddr().String() + " is now known as alice",
+		"alice says, first",
+		"alice says, second",
+	} {
+		if got := b.readLine(t); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestChatServerRooms(t *testing.T) {
+	ch := startChatServer(t)
+
+	alice, err := client.Connect(ch.Addr(), &client.Options{Nick: "alice", Room: "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := client.Connect(ch.Addr(), &client.Options{Nick: "bob", Room: "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	// wait for bob to be in the room before talking
+	for ev := range alice.Messages() {
+		if ev.Kind == client.EventNotice && ev.Text == "bob joined go" {
+			break
+		}
+	}
+	lobby := dial(t, ch)
+	waitFor(t, "3 users", func() bool { return ch.users() == 3 })
+	if err := alice.Send("anyone here?"); err != nil {
+		t.Fatal(err)
+	}
+	for ev := range bob.Messages() {
+		if ev.Kind == client.EventMessage {
+			if ev.From != "alice" || ev.Text != "anyone here?" {
+				t.Fatalf("unexpected message %+v", ev)
+			}
+			break
+		}
+	}
+	lobby.expectNothing(t)
+}
+
+func TestChatServerDisconnect(t *testing.T) {
+	ch := startChatServer(t)
+	a, b := dial(t, ch), dial(t, ch)
+	waitFor(t, "2 users", func() bool { return ch.users() == 2 })
+
+	a.Close()
+	waitFor(t, "1 user", func() bool { return ch.users() == 1 })
+
+	// the server keeps serving whoever is left
+	c := dial(t, ch)
+	waitFor(t, "2 users", func() bool { return ch.users() == 2 })
+	c.Write([]byte("still up\n"))
+	if got := b.readLine(t); !strings.HasSuffix(got, "says, still up") {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestNewChatServerErrors(t *testing.T) {
+	if _, err := NewChatServer(&ChatServerOpts{Addr: "not an ip"}); err == nil {
+		t.Fatal("expected an error for a bad address")
+	}
+	if _, err := NewChatServer(&ChatServerOpts{Addr: "192.0.2.1", Logger: logging.Discard()}); err == nil {
+		t.Fatal("expected an error binding an address we do not own")
+	}
+	if _, err := NewChatServer(&ChatServerOpts{Addr: "127.0.0.1", MaxConns: -1}); err == nil {
+		t.Fatal("expected an error for a negative connection limit")
+	}
+	if _, err := NewChatServer(&ChatServerOpts{Addr: "127.0.0.1", OverLimit: "drop"}); err == nil {
+		t.Fatal("expected an error for an unknown over limit behaviour")
+	}
+	if _, err := NewChatServer(&ChatServerOpts{Addr: "127.0.0.1", BufferSize: -1}); err == nil {
+		t.Fatal("expected an error for a negative buffer size")
+	}
+}
+
+func TestChatServerMetrics(t *testing.T) {
+	ch := startChatServer(t)
+	a, b := dial(t, ch), dial(t, ch)
+	waitFor(t, "2 users", func() bool { return ch.users() == 2 })
+	a.Write([]byte("one\ntwo\n"))
+	b.readLine(t)
+	b.readLine(t)
+
+	var out strings.Builder
+	if err := ch.Metrics().WriteText(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"chat_connections_accepted_total 2\n",
+		"chat_connections_active 2\n",
+		"chat_read_bytes_total 8\n",
+		"chat_message_duration_seconds_count 2\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// TestChatServerBurst connects more users at once than a level triggered loop accepts per
+// wakeup, then one of them writes more lines in one go than are read per wakeup.
+func TestChatServerBurst(t *testing.T) {
+	ch := startChatServer(t)
+	conns := make([]*rawConn, 2*loop.LEVELACCEPTS)
+	for i := range conns {
+		conns[i] = dial(t, ch)
+	}
+	waitFor(t, "every user", func() bool { return ch.users() == len(conns) })
+
+	a, b := conns[0], conns[1]
+	a.Write([]byte("/nick a\n"))
+	b.readLine(t)
+	var burst strings.Builder
+	lines := 2 * loop.LEVELREADS * MAXBUFFERSIZE / 64
+	for i := range lines {
+		fmt.Fprintf(&burst, "%063d\n", i)
+	}
+	a.Write([]byte(burst.String()))
+	for i := range lines {
+		if got, want := b.readLine(t), fmt.Sprintf("a says, %063d", i); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+// TestChatServerHalfClose sends a line and shuts down its write side in one go, the hang up
+// comes with the line still to read and it is broadcast before the user goes.
+func TestChatServerHalfClose(t *testing.T) {
+	ch := startChatServer(t)
+	a, b := dial(t, ch), dial(t, ch)
+	waitFor(t, "2 users", func() bool { return ch.users() == 2 })
+
+	a.Write([]byte("last words\n"))
+	a.Conn.(*net.TCPConn).CloseWrite()
+	if got := b.readLine(t); !strings.HasSuffix(got, "says, last words") {
+		t.Fatalf("got %q", got)
+	}
+	waitFor(t, "1 user", func() bool { return ch.users() == 1 })
+}
+
+func TestChatServerMaxConnsReject(t *testing.T) {
+	ch := startChatServerOpts(t, &ChatServerOpts{MaxConns: 2})
+	a, b := dial(t, ch), dial(t, ch)
+	waitFor(t, "2 users", func() bool { return ch.users() == 2 })
+
+	over := dial(t, ch)
+	if got := over.readLine(t); got+"\n" != SERVERFULL {
+		t.Fatalf("over the limit got %q", got)
+	}
+	if _, err := over.r.ReadString('\n'); err == nil {
+		t.Fatal("rejected connection left open")
+	}
+
+	// the two let in still talk, and a freed slot takes a new user
+	a.Write([]byte("hi\n"))
+	b.readLine(t)
+	a.Close()
+	waitFor(t, "1 user", func() bool { return ch.users() == 1 })
+	dial(t, ch)
+	waitFor(t, "2 users", func() bool { return ch.users() == 2 })
+}
+
+func TestChatServerMaxConnsPause(t *testing.T) {
+	ch := startChatServerOpts(t, &ChatServerOpts{MaxConns: 2, OverLimit: loop.Pause})
+	a, b := dial(t, ch), dial(t, ch)
+	waitFor(t, "2 users", func() bool { return ch.users() == 2 })
+
+	// the third waits in the backlog and hears nothing until a slot frees up
+	c := dial(t, ch)
+	c.Write([]byte("waiting\n"))
+	b.expectNothing(t)
+	if n := ch.users(); n != 2 {
+		t.Fatalf("%d users, limit 2", n)
+	}
+
+	a.Close()
+	if got, want := b.readLine(t), c.LocalAddr().String()+" says, waiting"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// TestChatServerReload raises the limit a client waits on, then lowers it with
+// loop.Reject, the users in meanwhile stay.
+func TestChatServerReload(t *testing.T) {
+	ch := startChatServerOpts(t, &ChatServerOpts{MaxConns: 1, OverLimit: loop.Pause})
+	a := dial(t, ch)
+	waitFor(t, "1 user", func() bool { return ch.users() == 1 })
+	b := dial(t, ch)
+	b.Write([]byte("waiting\n"))
+	a.expectNothing(t)
+
+	if err := ch.Reload(&ChatServerOpts{MaxConns: 2, OverLimit: loop.Pause}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a.readLine(t), b.LocalAddr().String()+" says, waiting"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if err := ch.Reload(&ChatServerOpts{MaxConns: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := dial(t, ch).readLine(t); got+"\n" != SERVERFULL {
+		t.Fatalf("over the reloaded limit got %q", got)
+	}
+	a.Write([]byte("still here\n"))
+	b.readLine(t)
+
+	if err := ch.Reload(&ChatServerOpts{MaxConns: -1}); err == nil {
+		t.Fatal("no error reloading a negative limit")
+	}
+}
+
+// TestChatServerKick lists who is connected and kicks one of them, the other stays.
+func TestChatServerKick(t *testing.T) {
+	ch := startChatServer(t)
+	a, b := dial(t, ch), dial(t, ch)
+	a.Write([]byte("/nick alice\n"))
+	b.readLine(t)
+	var fd int
+	waitFor(t, "alice listed", func() bool {
+		for _, c := range ch.Conns() {
+			if c.State == "alice in lobby" && c.BytesRead > 0 {
+				fd = c.Fd
+			}
+		}
+		return fd != 0
+	})
+
+	if err := ch.Kick(fd); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "alice kicked", func() bool { return ch.users() == 1 })
+	if conns := ch.Conns(); len(conns) != 1 || conns[0].Peer != b.LocalAddr().String() || conns[0].BytesWritten == 0 {
+		t.Fatalf("left %+v", conns)
+	}
+	if err := ch.Kick(fd); err == nil {
+		t.Fatal("kicked a user who left")
+	}
+}
+
+// TestChatServerShutdown tells users it is restarting and returns once they have left,
+// nobody new gets in meanwhile.
+func TestChatServerShutdown(t *testing.T) {
+	ch := startChatServer(t)
+	a, b := dial(t, ch), dial(t, ch)
+	waitFor(t, "2 users", func() bool { return ch.users() == 2 })
+
+	done := make(chan struct{})
+	go func() {
+		ch.Shutdown(5 * time.Second)
+		close(done)
+	}()
+	for _, conn := range []*rawConn{a, b} {
+		if got := conn.readLine(t); got+"\n" != RESTARTING {
+			t.Fatalf("got %q during shutdown", got)
+		}
+	}
+	late := dial(t, ch)
+	late.Write([]byte("anyone?\n"))
+	b.expectNothing(t)
+
+	a.Close()
+	b.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown still waiting after everyone left")
+	}
+	if _, err := net.DialTimeout("tcp", ch.Addr(), time.Second); err == nil {
+		t.Fatal("accepting after Shutdown")
+	}
+}
+
+func TestChatServerShutdownTimeout(t *testing.T) {
+	ch := startChatServer(t)
+	stays := dial(t, ch)
+	waitFor(t, "1 user", func() bool { return ch.users() == 1 })
+
+	start := time.Now()
+	ch.Shutdown(100 * time.Millisecond)
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("Shutdown returned after %v, before the timeout", d)
+	}
+	stays.readLine(t)
+	if _, err := stays.r.ReadString('\n'); err == nil {
+		t.Fatal("user still connected after Shutdown")
+	}
+}
+
+// TestChatServerListenFd serves on a listener opened elsewhere, as handed over by an upgrade.
+func TestChatServerListenFd(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+	unix.Listen(fd, 16)
+	ch := startChatServerOpts(t, &ChatServerOpts{ListenFd: fd})
+	dial(t, ch)
+	waitFor(t, "1 user", func() bool { return ch.users() == 1 })
+}
+
+func TestChatServerEdgeTriggered(t *testing.T) {
+	testTrigger = loop.Edge
+	defer func() { testTrigger = loop.Level }()
+
+	for _, tt := range []struct {
+		name string
+		test func(*testing.T)
+	}{
+		{"Accepts", TestChatServerAccepts},
+		{"Broadcast", TestChatServerBroadcast},
+		{"PartialLines", TestChatServerPartialLines},
+		{"Rooms", TestChatServerRooms},
+		{"Disconnect", TestChatServerDisconnect},
+		{"Metrics", TestChatServerMetrics},
+		{"Burst", TestChatServerBurst},
+		{"HalfClose", TestChatServerHalfClose},
+		{"MaxConnsReject", TestChatServerMaxConnsReject},
+		{"MaxConnsPause", TestChatServerMaxConnsPause},
+		{"Reload", TestChatServerReload},
+		{"Kick", TestChatServerKick},
+		{"Shutdown", TestChatServerShutdown},
+	} {
+		t.Run(tt.name, tt.test)
+	}
+}
+
+// BenchmarkChatServer has pairs of users in rooms of their own, one says ping and waits for
+// the other's pong, against each trigger mode and, for comparison, the goroutine per
+// connection server of package bench.
+func BenchmarkChatServer(b *testing.B) {
+	for _, name := range []string{string(loop.Level), string(loop.Edge), "net"} {
+		b.Run(name, func(b *testing.B) {
+			var addr string
+			if name == "net" {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer ln.Close()
+				go bench.NewChatServer().Serve(ln)
+				addr = ln.Addr().String()
+			} else {
+				testTrigger = loop.Trigger(name)
+				defer func() { testTrigger = loop.Level }()
+				addr = startChatServer(b).Addr()
+			}
+			var (
+				rooms atomic.Int64
+				hist  bench.Histogram
+			)
+			b.ReportAllocs()
+			b.SetParallelism(4)
+			b.RunParallel(func(pb *testing.PB) {
+				room := fmt.Sprintf("bench-%d", rooms.Add(1))
+				asker, err := joinBench(addr, room)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer asker.conn.Close()
+				answerer, err := joinBench(addr, room)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer answerer.conn.Close()
+				if err := asker.waitLine(" joined "); err != nil {
+					b.Error(err)
+					return
+				}
+				go func() {
+					for answerer.waitLine("says, ping") == nil {
+						answerer.conn.Write([]byte("pong\n"))
+					}
+				}()
+				for pb.Next() {
+					start := time.Now()
+					asker.conn.Write([]byte("ping\n"))
+					if err := asker.waitLine("says, pong"); err != nil {
+						b.Error(err)
+						return
+					}
+					hist.Record(time.Since(start))
+				}
+			})
+			hist.Report(b)
+		})
+	}
+}
+
+// benchUser is a user of BenchmarkChatServer.
+type benchUser struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// joinBench connects a user and moves it to room.
+func joinBench(addr, room string) (*benchUser, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	u := &benchUser{conn: conn, r: bufio.NewReader(conn)}
+	fmt.Fprintf(conn, "%s %s\n", CMDJOIN, room)
+	return u, u.waitLine(" joined ")
+}
+
+// waitLine reads lines until one with s in it.
+func (u *benchUser) waitLine(s string) error {
+	for {
+		line, err := u.r.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(line), s) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,328 @@
+// Package client talks to the chat server over its line protocol.
+//
+// Every line sent is either a command (/nick, /join) or a message for the current room.
+// The server answers with "<who> says, <text>" for messages and "* <text>" for notices.
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var (
+	ErrClosed       = errors.New("client closed")
+	ErrNotConnected = errors.New("not connected to chat server")
+	ErrCommand      = errors.New("message starts with /, the server would take it for a command, use SetNick or Join")
+	ErrName         = errors.New("nick or room is empty or has whitespace")
+)
+
+type EventKind int
+
+const (
+	EventMessage      EventKind = iota // someone said something in our room
+	EventNotice                        // server notice, joins, leaves and nick changes
+	EventConnected                     // (re)connected, nick and room have been restored
+	EventDisconnected                  // connection lost, the client is backing off
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventMessage:
+		return "message"
+	case EventNotice:
+		return "notice"
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+type Event struct {
+	Kind EventKind
+	From string // sender for messages, empty otherwise
+	Text string
+	Err  error // set for EventDisconnected
+
+	At time.Time // when the client received it
+}
+
+// ParseLine turns one line from the server (without the newline) into an event.
+func ParseLine(line string) Event {
+	ev := Event{At: time.Now()}
+	if text, ok := strings.CutPrefix(line, "* "); ok {
+		ev.Kind, ev.Text = EventNotice, text
+		return ev
+	}
+	if from, text, ok := strings.Cut(line, " says, "); ok {
+		ev.Kind, ev.From, ev.Text = EventMessage, from, text
+		return ev
+	}
+	ev.Kind, ev.Text = EventNotice, line
+	return ev
+}
+
+type Options struct {
+	Nick string // set after every (re)connect, if not empty
+	Room string // joined after every (re)connect, if not empty
+
+	DialTimeout time.Duration
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+
+	NoReconnect bool // give up on the first disconnect
+	EventBuffer int  // size of the Messages channel
+}
+
+func (o *Options) withDefaults() Options {
+	opts := Options{}
+	if o != nil {
+		opts = *o
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 10 * time.Second
+	}
+	if opts.EventBuffer == 0 {
+		opts.EventBuffer = 256
+	}
+	return opts
+}
+
+type Client struct {
+	addr string
+	opts Options
+
+	conn net.Conn
+	nick string
+	room string
+
+	events chan Event
+	done   chan struct{}
+
+	closeOnce sync.Once
+	mu        sync.Mutex
+	wg        sync.WaitGroup
+}
+
+// Connect dials addr and keeps the connection alive until Close is called.
+// The first dial is not retried, so a wrong address fails fast. A Nick or Room with
+// whitespace is refused with ErrName.
+func Connect(addr string, opts *Options) (*Client, error) {
+	c := &Client{
+		addr: addr,
+		opts: opts.withDefaults(),
+		done: make(chan struct{}),
+	}
+	c.nick, c.room = c.opts.Nick, c.opts.Room
+	for _, name := range []string{c.nick, c.room} {
+		if name != "" && !validName(name) {
+			return nil, ErrName
+		}
+	}
+	c.events = make(chan Event, c.opts.EventBuffer)
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	c.wg.Go(func() { c.run(conn) })
+	return c, nil
+}
+
+// Messages delivers parsed events from the server, it is closed after Close.
+func (c *Client) Messages() <-chan Event { return c.events }
+
+// SetNick changes the client's nick, one that is empty or has whitespace is refused with
+// ErrName, a newline in it would send the server another command.
+func (c *Client) SetNick(nick string) error {
+	if !validName(nick) {
+		return ErrName
+	}
+	if err := c.writeLine(fmt.Sprintf("/nick %s", nick)); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.nick = nick
+	c.mu.Unlock()
+	return nil
+}
+
+// Join moves the client to room, refused with ErrName as SetNick.
+func (c *Client) Join(room string) error {
+	if !validName(room) {
+		return ErrName
+	}
+	if err := c.writeLine(fmt.Sprintf("/join %s", room)); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.room = room
+	c.mu.Unlock()
+	return nil
+}
+
+func validName(s string) bool {
+	return s != "" && !strings.ContainsFunc(s, unicode.IsSpace)
+}
+
+// Send says text in the current room, newlines split it into several messages. A line
+// starting with / is refused with ErrCommand, commands only go out through SetNick and Join.
+func (c *Client) Send(text string) error {
+	for line := range strings.Lines(text) {
+		if strings.HasPrefix(line, "/") {
+			return ErrCommand
+		}
+	}
+	return c.writeLine(text)
+}
+
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.mu.Unlock()
+	})
+	c.wg.Wait()
+	return nil
+}
+
+func (c *Client) writeLine(line string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	_, err := c.conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// dial connects and restores nick and room, then publishes the connection.
+func (c *Client) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, c.opts.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var hello strings.Builder
+	if c.nick != "" {
+		fmt.Fprintf(&hello, "/nick %s\n", c.nick)
+	}
+	if c.room != "" {
+		fmt.Fprintf(&hello, "/join %s\n", c.room)
+	}
+	if hello.Len() > 0 {
+		if _, err := conn.Write([]byte(hello.String())); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+func (c *Client) run(conn net.Conn) {
+	defer close(c.events)
+
+	for {
+		c.emit(Event{Kind: EventConnected, At: time.Now()})
+		err := c.readLoop(conn)
+
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+
+		if c.closed() {
+			return
+		}
+		c.emit(Event{Kind: EventDisconnected, Err: err, At: time.Now()})
+		if c.opts.NoReconnect {
+			return
+		}
+
+		if conn = c.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+func (c *Client) readLoop(conn net.Conn) error {
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		if !c.emit(ParseLine(strings.TrimSuffix(sc.Text(), "\r"))) {
+			return ErrClosed
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return net.ErrClosed
+}
+
+// reconnect retries with exponential backoff and jitter, it returns nil once the client is closed.
+func (c *Client) reconnect() net.Conn {
+	backoff := c.opts.MinBackoff
+	for {
+		wait := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(wait):
+		}
+
+		conn, err := c.dial()
+		if err == nil {
+			if c.closed() {
+				conn.Close()
+				return nil
+			}
+			return conn
+		}
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+	}
+}
+
+func (c *Client) emit(ev Event) bool {
+	select {
+	case c.events <- ev:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
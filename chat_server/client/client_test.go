@@ -0,0 +1,60 @@
+package client
+
+import "testing"
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		kind EventKind
+		from string
+		text string
+	}{
+		{"alice says, hi", EventMessage, "alice", "hi"},
+		{"127.0.0.1:5000 says, a says, b", EventMessage, "127.0.0.1:5000", "a says, b"},
+		{"alice says, ", EventMessage, "alice", ""},
+		{"* bob joined go", EventNotice, "", "bob joined go"},
+		{"* x says, y", EventNotice, "", "x says, y"},
+		{"something else", EventNotice, "", "something else"},
+	}
+	for _, tt := range tests {
+		ev := ParseLine(tt.line)
+		if ev.Kind != tt.kind || ev.From != tt.from || ev.Text != tt.text {
+			t.Errorf("ParseLine(%q) = %v %q %q, want %v %q %q", tt.line, ev.Kind, ev.From, ev.Text, tt.kind, tt.from, tt.text)
+		}
+	}
+}
+
+func TestSendRefusesCommands(t *testing.T) {
+	c := &Client{done: make(chan struct{})}
+	for _, text := range []string{"/nick mallory", "/join ops", "hello\n/join ops", "/"} {
+		if err := c.Send(text); err != ErrCommand {
+			t.Errorf("Send(%q) = %v, want ErrCommand", text, err)
+		}
+	}
+	// a slash elsewhere is just text, the client is not connected
+	if err := c.Send("and/or /nick"); err != ErrNotConnected {
+		t.Errorf("Send = %v, want ErrNotConnected", err)
+	}
+}
+
+func TestNamesRefuseWhitespace(t *testing.T) {
+	c := &Client{done: make(chan struct{})}
+	for _, name := range []string{"", "bob\n/join ops", "bob\r", "two words", "tab\t"} {
+		if err := c.SetNick(name); err != ErrName {
+			t.Errorf("SetNick(%q) = %v, want ErrName", name, err)
+		}
+		if err := c.Join(name); err != ErrName {
+			t.Errorf("Join(%q) = %v, want ErrName", name, err)
+		}
+	}
+	if _, err := Connect("127.0.0.1:1", &Options{Nick: "bob\n/join ops"}); err != ErrName {
+		t.Errorf("Connect = %v, want ErrName", err)
+	}
+	// a fine name goes as far as the missing connection
+	if err := c.SetNick("bob"); err != ErrNotConnected {
+		t.Errorf("SetNick = %v, want ErrNotConnected", err)
+	}
+	if err := c.Join("go"); err != ErrNotConnected {
+		t.Errorf("Join = %v, want ErrNotConnected", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/chat_server/client"
+)
+
+// The client package is tested here, against a ChatServer in the same process, the server
+// is package main and cannot be imported by the client's own tests.
+
+// quickBackoff reconnects within tens of milliseconds.
+var quickBackoff = client.Options{MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+// nextEvent waits for an event of kind, skipping others.
+func nextEvent(t *testing.T, c *client.Client, kind client.EventKind) client.Event {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case ev, ok := <-c.Messages():
+			if !ok {
+				t.Fatalf("events closed waiting for %v", kind)
+			}
+			if ev.Kind == kind {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no %v event", kind)
+		}
+	}
+}
+
+// userFd waits for a user in state, "<name> in <room>", and returns their fd.
+func userFd(t *testing.T, ch *ChatServer, state string) int {
+	t.Helper()
+	var fd int
+	waitFor(t, state, func() bool {
+		for _, c := range ch.Conns() {
+			if c.State == state {
+				fd = c.Fd
+			}
+		}
+		return fd != 0
+	})
+	return fd
+}
+
+// TestClientReconnect drops the client, it comes back with the nick and room it was
+// given and hears the room again.
+func TestClientReconnect(t *testing.T) {
+	ch := startChatServer(t)
+	opts := quickBackoff
+	opts.Nick, opts.Room = "alice", "go"
+	alice, err := client.Connect(ch.Addr(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	nextEvent(t, alice, client.EventConnected)
+
+	if err := ch.Kick(userFd(t, ch, "alice in go")); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, alice, client.EventDisconnected); ev.Err == nil {
+		t.Fatal("disconnected without an error")
+	}
+	nextEvent(t, alice, client.EventConnected)
+	userFd(t, ch, "alice in go")
+
+	bob, err := client.Connect(ch.Addr(), &client.Options{Nick: "bob", Room: "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	userFd(t, ch, "bob in go")
+	bob.Send("welcome back")
+	if ev := nextEvent(t, alice, client.EventMessage); ev.From != "bob" || ev.Text != "welcome back" {
+		t.Fatalf("got %+v", ev)
+	}
+}
+
+// TestClientRejoin changes nick and room after connecting, a reconnect restores those and
+// not the ones in Options.
+func TestClientRejoin(t *testing.T) {
+	ch := startChatServer(t)
+	opts := quickBackoff
+	opts.Room = "go"
+	c, err := client.Connect(ch.Addr(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	nextEvent(t, c, client.EventConnected)
+	if err := c.SetNick("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Join("rust"); err != nil {
+		t.Fatal(err)
+	}
+
+	ch.Kick(userFd(t, ch, "carol in rust"))
+	nextEvent(t, c, client.EventDisconnected)
+	nextEvent(t, c, client.EventConnected)
+	userFd(t, ch, "carol in rust")
+}
+
+// TestClientCloseStopsReconnect closes a client backing off from a server that is gone,
+// Close returns, the events end and nothing dials again.
+func TestClientCloseStopsReconnect(t *testing.T) {
+	ch := startChatServer(t)
+	opts := quickBackoff
+	c, err := client.Connect(ch.Addr(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, c, client.EventConnected)
+	// accepted by Serve, not only by the kernel, or Close could come before Serve starts
+	waitFor(t, "the client accepted", func() bool { return len(ch.Conns()) == 1 })
+	ch.Close()
+	nextEvent(t, c, client.EventDisconnected)
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	for ev := range c.Messages() {
+		if ev.Kind == client.EventConnected {
+			t.Fatal("connected after Close")
+		}
+	}
+	if err := c.Send("anyone?"); err != client.ErrClosed {
+		t.Fatalf("Send after Close: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/config"
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+)
+
+// Config is everything the chat server can be told, in a -config file or by flag, see
+// -print-config for the keys and defaults.
+type Config struct {
+	Listen struct {
+		Addr string `config:"addr" flag:"addr" help:"ipv4 address to listen on"`
+		Port int    `config:"port" flag:"port" help:"port to listen on"`
+	} `config:"listen"`
+	Admin struct {
+		Addr string `config:"addr" flag:"admin-addr" help:"ipv4 address serving /metrics"`
+		Port int    `config:"port" flag:"admin-port" help:"port serving /metrics"`
+		// owner only, see package control
+		Socket string `config:"socket" flag:"admin-socket" help:"unix socket taking control commands, empty for none"`
+	} `config:"admin"`
+
+	Timeouts struct {
+		Drain time.Duration `config:"drain" flag:"drain-timeout" reload:"live" help:"how long an upgraded process waits for users to leave"`
+	} `config:"timeouts"`
+
+	Loop struct {
+		Trigger loop.Trigger `config:"trigger" flag:"trigger" help:"epoll trigger mode, edge or level"`
+	} `config:"loop"`
+
+	Buffers struct {
+		Size int `config:"size" flag:"buffer-size" help:"bytes per read and longest line kept, 0 for the default"`
+	} `config:"buffers"`
+
+	Limits struct {
+		MaxConns  int            `config:"max_conns" flag:"max-conns" reload:"live" help:"most connected users, 0 for the default"`
+		OverLimit loop.OverLimit `config:"over_limit" flag:"over-limit" reload:"live" help:"past -max-conns, reject with a message or pause accepting"`
+	} `config:"limits"`
+
+	TLS config.TLS `config:"tls"`
+	Log config.Log `config:"log"`
+}
+
+func defaultConfig() Config {
+	var c Config
+	c.Listen.Addr, c.Listen.Port = "0.0.0.0", 9000
+	c.Admin.Addr, c.Admin.Port = "127.0.0.1", ADMINPORT
+	c.Admin.Socket = "/tmp/epoll-learn-chat.sock"
+	c.Timeouts.Drain = time.Minute
+	c.Loop.Trigger = loop.Level
+	c.Buffers.Size = MAXBUFFERSIZE
+	c.Limits.MaxConns = MAXACTIVECONNS
+	c.Limits.OverLimit = loop.Reject
+	c.Log.Format = "text"
+	return c
+}
+
+func (c *Config) Validate() error {
+	for _, err := range []error{
+		config.Addr("listen.addr", c.Listen.Addr),
+		config.Port("listen.port", c.Listen.Port),
+		config.Addr("admin.addr", c.Admin.Addr),
+		config.Port("admin.port", c.Admin.Port),
+		config.NotNegative("buffers.size", c.Buffers.Size),
+		config.NotNegative("limits.max_conns", c.Limits.MaxConns),
+		c.TLS.Validate(),
+		c.Log.Validate(),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if c.Timeouts.Drain < 0 {
+		return config.Errorf("timeouts.drain", "%v, want 0 or more", c.Timeouts.Drain)
+	}
+	if _, err := loop.ParseTrigger(string(c.Loop.Trigger)); err != nil {
+		return config.Errorf("loop.trigger", "%v", err)
+	}
+	if _, err := loop.ParseOverLimit(string(c.Limits.OverLimit)); err != nil {
+		return config.Errorf("limits.over_limit", "%v", err)
+	}
+	return nil
+}
+
+// opts returns the server options for c, listenFd is 0 to bind.
+func (c *Config) opts(listenFd int) *ChatServerOpts {
+	return &ChatServerOpts{
+		Addr:       c.Listen.Addr,
+		Port:       c.Listen.Port,
+		ListenFd:   listenFd,
+		Trigger:    c.Loop.Trigger,
+		MaxConns:   c.Limits.MaxConns,
+		OverLimit:  c.Limits.OverLimit,
+		BufferSize: c.Buffers.Size,
+	}
+}
+
+// reload reads the config again on SIGHUP and applies what can change while serving, the
+// log level and limits, all of it or none. Other changes are logged as needing a restart
+// and left as they were, cfg is what runs.
+func reload(src *config.Source, cfg *Config, ch *ChatServer, level *slog.LevelVar, log *slog.Logger) {
+	next := defaultConfig()
+	if err := src.Read(&next); err != nil {
+		log.Error("error reloading config, keeping the running one", logging.Err(err))
+		return
+	}
+	running := *cfg
+	applied, restart := config.Reload(&running, &next)
+	if len(restart) > 0 {
+		log.Warn("config changes need a restart", slog.Any("keys", restart))
+	}
+	if len(applied) == 0 {
+		log.Info("config reloaded, nothing to apply")
+		return
+	}
+	if err := ch.Reload(running.opts(0)); err != nil {
+		log.Error("error applying config, keeping the running one", logging.Err(err))
+		return
+	}
+	level.Set(running.Log.Level)
+	*cfg = running
+	log.Info("config reloaded", slog.Any("applied", applied))
+}
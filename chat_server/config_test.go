@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/toastsandwich/epoll-learn/pkg/config"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+)
+
+func TestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.yaml")
+	os.WriteFile(path, []byte("listen:\n  port: 9300\nloop:\n  trigger: edge\nbuffers:\n  size: 512\n"), 0o600)
+
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("chat", flag.ContinueOnError)
+	if _, err := config.FromArgs(fs, []string{"-config", path, "-max-conns", "10"}, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	opts := cfg.opts(0)
+	if opts.Port != 9300 || opts.Trigger != loop.Edge || opts.BufferSize != 512 || opts.MaxConns != 10 || opts.OverLimit != loop.Reject {
+		t.Fatalf("opts %+v", opts)
+	}
+
+	cfg = defaultConfig()
+	fs = flag.NewFlagSet("chat", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var ke *config.KeyError
+	if _, err := config.FromArgs(fs, []string{"-trigger", "both"}, &cfg); !errors.As(err, &ke) || ke.Key != "loop.trigger" {
+		t.Fatalf("bad trigger: %v, want an error naming loop.trigger", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/toastsandwich/epoll-learn/pkg/control"
+)
+
+// listenControl serves the control socket at path, shutdown sends on stopC for main to
+// drain as for an upgrade.
+func listenControl(path string, ch *ChatServer, level *slog.LevelVar, log *slog.Logger, stopC chan<- struct{}) (*control.Server, error) {
+	ctl, err := control.Listen(path, log)
+	if err != nil {
+		return nil, err
+	}
+	ctl.HandleConns(ch.Conns, ch.Kick)
+	ctl.HandleLogLevel(level)
+	ctl.Handle("stats", "user count and buffer pool counters", func(w io.Writer, args []string) error {
+		fmt.Fprintf(w, "users %d\n", ch.users())
+		return control.WritePoolStats(w, "read buffer", ch.PoolStats())
+	})
+	ctl.Handle("shutdown", "tell users we are restarting, exit once they left", func(w io.Writer, args []string) error {
+		select {
+		case stopC <- struct{}{}:
+		default:
+			return fmt.Errorf("already shutting down")
+		}
+		_, err := io.WriteString(w, "draining\n")
+		return err
+	})
+	return ctl, nil
+}
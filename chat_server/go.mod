@@ -1,5 +1,14 @@
 module github.com/toastsandwich/chat_server
 
-go 1.25.2
+go 1.25.3
 
-require golang.org/x/sys v0.37.0
+require (
+	github.com/toastsandwich/epoll-learn/http1.0_server v0.0.0
+	github.com/toastsandwich/epoll-learn/pkg v0.0.0
+	golang.org/x/sys v0.37.0
+)
+
+replace (
+	github.com/toastsandwich/epoll-learn/http1.0_server => ../http1.0_server
+	github.com/toastsandwich/epoll-learn/pkg => ../pkg
+)
@@ -1,7 +1,159 @@
 package main
 
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	server "github.com/toastsandwich/epoll-learn/http1.0_server"
+	"github.com/toastsandwich/epoll-learn/pkg/config"
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/systemd"
+	"github.com/toastsandwich/epoll-learn/pkg/upgrade"
+	"golang.org/x/sys/unix"
+)
+
+const ADMINPORT = 9101 // default admin.port
+
 func main() {
-	ch := NewChatServer(0, 0, 0, 0, 9000)
-	ch.Serve()
-	ch.Close()
+	cfg := defaultConfig()
+	src, err := config.FromArgs(flag.CommandLine, os.Args[1:], &cfg)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading config:", err)
+		os.Exit(2)
+	}
+	if src.PrintConfig {
+		config.Print(os.Stdout, &cfg)
+		return
+	}
+
+	level := new(slog.LevelVar)
+	log := logging.New(cfg.Log.Options(level))
+
+	// started by SIGUSR2 in an older process, its listeners are ours
+	upg, err := upgrade.New()
+	if err != nil {
+		log.Error("error reading upgrade environment", logging.Err(err))
+		os.Exit(1)
+	}
+	listenFd, _ := upg.Fd("chat")
+	adminFd, _ := upg.Fd("admin")
+	// or socket activated, FileDescriptorName=chat and admin, a lone socket needs no name
+	activated, err := systemd.Listeners()
+	if err != nil {
+		log.Error("error reading systemd listeners", logging.Err(err))
+		os.Exit(1)
+	}
+	if listenFd == 0 {
+		listenFd = systemd.Named(activated, "chat")
+		if listenFd == 0 && len(activated) == 1 {
+			listenFd = activated[0].Fd
+		}
+	}
+	if adminFd == 0 {
+		adminFd = systemd.Named(activated, "admin")
+	}
+
+	opts := cfg.opts(listenFd)
+	opts.Logger = log
+	ch, err := NewChatServer(opts)
+	if err != nil {
+		log.Error("error starting chat server", logging.Err(err))
+		os.Exit(1)
+	}
+
+	// metrics are served by the epoll http server, on loopback only
+	admin, err := server.NewHTTPServer(&server.HTTPServerOpts{Addr: cfg.Admin.Addr, Port: cfg.Admin.Port, ListenFd: adminFd, Workers: 1, Logger: log})
+	if err != nil {
+		log.Error("error starting admin server", logging.Err(err))
+		os.Exit(1)
+	}
+	ch.Metrics().GoRuntime()
+	admin.HandleFunc("/metrics", server.MetricsHandler(ch.Metrics()))
+	go func() {
+		if err := admin.ListenAndServe(); err != nil {
+			log.Error("admin server stopped", logging.Err(err))
+		}
+	}()
+	defer admin.Close()
+
+	stopC := make(chan struct{}, 1)
+	if cfg.Admin.Socket != "" {
+		ctl, err := listenControl(cfg.Admin.Socket, ch, level, log, stopC)
+		if err != nil {
+			log.Error("error creating control socket", logging.Err(err))
+			os.Exit(1)
+		}
+		go func() {
+			if err := ctl.Serve(); err != nil {
+				log.Error("control socket stopped", logging.Err(err))
+			}
+		}()
+		defer ctl.Close()
+	}
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, unix.SIGINT, unix.SIGTERM, unix.SIGUSR2, unix.SIGHUP)
+
+	errC := make(chan error, 1)
+	go func() { errC <- ch.Serve() }()
+	if err := upg.Ready(); err != nil {
+		log.Error("error telling the old process we are up", logging.Err(err))
+	}
+	if _, err := systemd.Notify(systemd.READY); err != nil {
+		log.Warn("error notifying systemd", logging.Err(err))
+	}
+	stopWatchdog := make(chan struct{})
+	defer close(stopWatchdog)
+	if _, err := systemd.Watchdog(stopWatchdog); err != nil {
+		log.Warn("error starting systemd watchdog", logging.Err(err))
+	}
+
+	for {
+		select {
+		case sig := <-sigC:
+			if sig == unix.SIGHUP {
+				systemd.Notify(systemd.RELOADING)
+				reload(src, &cfg, ch, level, log)
+				systemd.Notify(systemd.READY)
+				continue
+			}
+			if sig == unix.SIGUSR2 {
+				// a new binary takes the listeners, this one waits for its users to move over
+				pid, err := upg.Upgrade(map[string]int{"chat": ch.Fd, "admin": admin.Fd})
+				if err != nil {
+					log.Error("upgrade failed, still serving", logging.Err(err))
+					continue
+				}
+				log.Info("upgraded, draining", slog.Int("pid", pid))
+				// the child is the service now, NotifyAccess=all lets it say so
+				systemd.Notify(fmt.Sprintf("MAINPID=%d", pid))
+				admin.Close()
+				ch.Shutdown(cfg.Timeouts.Drain)
+				return
+			}
+			log.Info("shutting down", slog.String("signal", sig.String()))
+			systemd.Notify(systemd.STOPPING)
+			ch.Close()
+			return
+		case <-stopC:
+			log.Info("shutting down, waiting for users to leave", slog.Duration("timeout", cfg.Timeouts.Drain))
+			systemd.Notify(systemd.STOPPING)
+			admin.Close()
+			ch.Shutdown(cfg.Timeouts.Drain)
+			return
+		case err := <-errC:
+			if err != nil {
+				log.Error("chat server stopped", logging.Err(err))
+			}
+			ch.Close()
+			return
+		}
+	}
 }
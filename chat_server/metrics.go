@@ -0,0 +1,36 @@
+package main
+
+import "github.com/toastsandwich/epoll-learn/pkg/metrics"
+
+type chatMetrics struct {
+	accepted        *metrics.Counter
+	bytesRead       *metrics.Counter
+	bytesWritten    *metrics.Counter
+	wakeups         *metrics.Counter
+	eventsPerWakeup *metrics.Histogram
+	messageDuration *metrics.Histogram
+	rejected        *metrics.Counter
+	shed            *metrics.Counter
+	acceptPauses    *metrics.Counter
+}
+
+func newChatMetrics(reg *metrics.Registry, c *ChatServer) *chatMetrics {
+	m := &chatMetrics{
+		accepted:        reg.Counter("chat_connections_accepted_total", "Connections accepted by the chat server."),
+		bytesRead:       reg.Counter("chat_read_bytes_total", "Bytes read from chat clients."),
+		bytesWritten:    reg.Counter("chat_written_bytes_total", "Bytes written to chat clients."),
+		wakeups:         reg.Counter("chat_epoll_wakeups_total", "Times epoll_wait returned with events."),
+		eventsPerWakeup: reg.Histogram("chat_epoll_events_per_wakeup", "Events returned by a single epoll_wait.", metrics.ExponentialBuckets(1, 2, 11)),
+		messageDuration: reg.Histogram("chat_message_duration_seconds", "Time from reading a line to broadcasting it.", metrics.LatencyBuckets),
+		rejected:        reg.Counter("chat_connections_rejected_total", "Connections turned away over the connection limit."),
+		shed:            reg.Counter("chat_connections_shed_total", "Pending connections dropped because the process ran out of file descriptors."),
+		acceptPauses:    reg.Counter("chat_accept_pauses_total", "Times accepting stopped at the connection limit."),
+	}
+	reg.GaugeFunc("chat_connections_active", "Users in ActiveUserMap.", func() float64 {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return float64(len(c.ActiveUserMap))
+	})
+	c.bp.RegisterMetrics(reg, "chat")
+	return m
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// commands understood by the chat server, anything else on a line is a message.
+const (
+	CMDNICK = "/nick"
+	CMDJOIN = "/join"
+)
+
+// User is one connected client, until it sets a nick it is known by its address.
+// An empty Room is the lobby, where everyone starts.
+type User struct {
+	Addr string
+	Nick string
+	Room string
+
+	pending     []byte // bytes read after the last newline
+	connectedAt time.Time
+	// counted by the loop, read by the control socket, see ChatServer.Conns
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+
+	log *slog.Logger // scoped with fd and peer
+}
+
+func NewUser(addr string, log *slog.Logger) *User {
+	return &User{Addr: addr, connectedAt: time.Now(), log: log}
+}
+
+func (u *User) Name() string {
+	if u.Nick != "" {
+		return u.Nick
+	}
+	return u.Addr
+}
+
+const LOBBY = "lobby"
+
+func roomName(room string) string {
+	if room == "" {
+		return LOBBY
+	}
+	return room
+}
+
+func roomKey(name string) string {
+	if name == LOBBY {
+		return ""
+	}
+	return name
+}
@@ -1,40 +1,215 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/toastsandwich/chat_server/client"
+	"github.com/toastsandwich/epoll-learn/pkg/bench"
 )
 
-func dialToChatServerAndSendHI(wg *sync.WaitGroup) {
-	defer wg.Done()
-	conn, err := net.Dial("tcp", "192.168.1.4:9000")
+// every load message starts with this tag followed by the send time in unix nanos,
+// so any receiver can work out how long the fan-out took.
+const MSGTAG = "lt"
+
+type Config struct {
+	Target   string
+	Conns    int
+	Ramp     int           // new connections per second
+	Rate     float64       // messages per second per connection
+	Size     int           // bytes per message, including the tag and timestamp
+	Duration time.Duration // how long to send once every connection is up
+	Drain    time.Duration // how long to keep reading after sending stops
+	Room     string
+	Format   string
+}
+
+func parseFlags() *Config {
+	cfg := &Config{}
+	flag.StringVar(&cfg.Target, "target", "127.0.0.1:9000", "chat server address")
+	flag.IntVar(&cfg.Conns, "conns", 1000, "number of connections")
+	flag.IntVar(&cfg.Ramp, "ramp", 500, "connections opened per second")
+	flag.Float64Var(&cfg.Rate, "rate", 1, "messages per second per connection")
+	flag.IntVar(&cfg.Size, "size", 64, "message size in bytes")
+	flag.DurationVar(&cfg.Duration, "duration", 10*time.Second, "send duration once ramp up is done")
+	flag.DurationVar(&cfg.Drain, "drain", 2*time.Second, "time to wait for in flight messages")
+	flag.StringVar(&cfg.Room, "room", "", "room to join, lobby if empty")
+	flag.StringVar(&cfg.Format, "format", "text", "report format, text or json")
+	flag.Parse()
+	return cfg
+}
+
+func (cfg *Config) validate() error {
+	switch {
+	case cfg.Conns <= 0:
+		return fmt.Errorf("-conns must be positive")
+	case cfg.Ramp <= 0 || cfg.Ramp > 1e6:
+		return fmt.Errorf("-ramp must be between 0 and 1e6")
+	case cfg.Rate <= 0 || cfg.Rate > 1e6:
+		return fmt.Errorf("-rate must be between 0 and 1e6")
+	case cfg.Size < len(newMessage(time.Now(), 0)):
+		return fmt.Errorf("-size must be at least %d", len(newMessage(time.Now(), 0)))
+	case cfg.Format != "text" && cfg.Format != "json":
+		return fmt.Errorf("-format must be text or json")
+	}
+	return nil
+}
+
+func newMessage(at time.Time, size int) string {
+	msg := MSGTAG + " " + strconv.FormatInt(at.UnixNano(), 10) + " "
+	if pad := size - len(msg); pad > 0 {
+		msg += strings.Repeat("x", pad)
+	}
+	return msg
+}
+
+func parseMessage(text string) (time.Time, bool) {
+	tag, rest, _ := strings.Cut(text, " ")
+	if tag != MSGTAG {
+		return time.Time{}, false
+	}
+	ts, _, _ := strings.Cut(rest, " ")
+	nanos, err := strconv.ParseInt(ts, 10, 64)
 	if err != nil {
-		fmt.Println("error dialing:", err)
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+type LoadTest struct {
+	cfg *Config
+
+	stop chan struct{} // closed when senders must stop
+	done chan struct{} // closed when readers must stop
+
+	connected   atomic.Int64
+	dialErrors  atomic.Int64
+	writeErrors atomic.Int64
+	disconnects atomic.Int64
+	sent        atomic.Int64
+	received    atomic.Int64
+	bytesSent   atomic.Int64
+	bytesRecvd  atomic.Int64
+	badMessages atomic.Int64
+	latency     bench.Histogram // every client's, see bench.Histogram.Record
+
+	wg sync.WaitGroup
+}
+
+func NewLoadTest(cfg *Config) *LoadTest {
+	return &LoadTest{
+		cfg:  cfg,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+func (lt *LoadTest) Run() *Report {
+	start := time.Now()
+	tick := time.NewTicker(time.Second / time.Duration(lt.cfg.Ramp))
+	for range lt.cfg.Conns {
+		<-tick.C
+		lt.wg.Go(lt.worker)
+	}
+	tick.Stop()
+	rampedAt := time.Now()
+	// connections send as soon as they are up, rates only count what came after ramp up
+	sent, received := lt.sent.Load(), lt.received.Load()
+
+	time.Sleep(lt.cfg.Duration)
+	close(lt.stop)
+	steady := window{
+		elapsed:  time.Since(rampedAt),
+		sent:     lt.sent.Load() - sent,
+		received: lt.received.Load() - received,
+	}
+
+	time.Sleep(lt.cfg.Drain)
+	close(lt.done)
+	lt.wg.Wait()
+
+	return lt.report(rampedAt.Sub(start), steady)
+}
+
+func (lt *LoadTest) worker() {
+	c, err := client.Connect(lt.cfg.Target, &client.Options{Room: lt.cfg.Room, NoReconnect: true})
+	if err != nil {
+		lt.dialErrors.Add(1)
 		return
 	}
-	for range 1000 {
-		msg := fmt.Sprintf("Hi from %s\n", conn.LocalAddr().String())
-		_, err := conn.Write([]byte(msg))
-		if err != nil {
-			fmt.Println("error writing message:", err)
+	lt.connected.Add(1)
+	defer c.Close()
+
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		lt.read(c)
+	}()
+
+	interval := time.Duration(float64(time.Second) / lt.cfg.Rate)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-lt.stop:
+			<-lt.done
+			c.Close()
+			<-readerDone
+			return
+		case <-readerDone:
+			return
+		case now := <-tick.C:
+			msg := newMessage(now, lt.cfg.Size)
+			if err := c.Send(msg); err != nil {
+				lt.writeErrors.Add(1)
+				continue
+			}
+			lt.sent.Add(1)
+			lt.bytesSent.Add(int64(len(msg) + 1))
 		}
 	}
-	conn.Close()
 }
 
-func TestChatServer() {
-	wg := &sync.WaitGroup{}
-
-	for range 10_000 {
-		wg.Add(1)
-		go dialToChatServerAndSendHI(wg)
-		time.Sleep(1 * time.Millisecond)
+func (lt *LoadTest) read(c *client.Client) {
+	for ev := range c.Messages() {
+		switch ev.Kind {
+		case client.EventDisconnected:
+			select {
+			case <-lt.done:
+			default:
+				lt.disconnects.Add(1)
+			}
+			return
+		case client.EventMessage:
+			lt.bytesRecvd.Add(int64(len(ev.From) + len(" says, ") + len(ev.Text) + 1))
+			sentAt, ok := parseMessage(ev.Text)
+			if !ok {
+				lt.badMessages.Add(1)
+				continue
+			}
+			lt.received.Add(1)
+			lt.latency.Record(ev.At.Sub(sentAt))
+		}
 	}
-	wg.Wait()
 }
 
 func main() {
-	TestChatServer()
+	cfg := parseFlags()
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	report := NewLoadTest(cfg).Run()
+	if err := report.Write(os.Stdout, cfg.Format); err != nil {
+		fmt.Fprintln(os.Stderr, "error writing report:", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessage(t *testing.T) {
+	at := time.Unix(1700000000, 123456789)
+	tests := []struct {
+		size int
+		want string
+	}{
+		{0, "lt 1700000000123456789 "},
+		{23, "lt 1700000000123456789 "},
+		{26, "lt 1700000000123456789 xxx"},
+	}
+	for _, tt := range tests {
+		msg := newMessage(at, tt.size)
+		if msg != tt.want {
+			t.Errorf("newMessage(%d) = %q, want %q", tt.size, msg, tt.want)
+			continue
+		}
+		if got, ok := parseMessage(msg); !ok || !got.Equal(at) {
+			t.Errorf("parseMessage(%q) = %v, %v", msg, got, ok)
+		}
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		text string
+		ok   bool
+		want int64
+	}{
+		{"lt 42", true, 42},
+		{"lt 42 xxxx", true, 42},
+		{"lt 42x", false, 0},
+		{"lt", false, 0},
+		{"lt  42", false, 0},
+		{"ltx 42", false, 0},
+		{"hello there", false, 0},
+		{"", false, 0},
+	}
+	for _, tt := range tests {
+		got, ok := parseMessage(tt.text)
+		if ok != tt.ok || ok && got.UnixNano() != tt.want {
+			t.Errorf("parseMessage(%q) = %v, %v", tt.text, got.UnixNano(), ok)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	good := func() *Config {
+		return &Config{Conns: 10, Ramp: 5, Rate: 1, Size: 64, Format: "text"}
+	}
+	tests := []struct {
+		name   string
+		change func(*Config)
+		err    string // substring, empty if valid
+	}{
+		{"defaults", func(*Config) {}, ""},
+		{"json", func(c *Config) { c.Format = "json" }, ""},
+		{"no conns", func(c *Config) { c.Conns = 0 }, "-conns"},
+		{"no ramp", func(c *Config) { c.Ramp = 0 }, "-ramp"},
+		{"ramp too fast", func(c *Config) { c.Ramp = 2e6 }, "-ramp"},
+		{"no rate", func(c *Config) { c.Rate = 0 }, "-rate"},
+		{"rate too fast", func(c *Config) { c.Rate = 2e6 }, "-rate"},
+		{"size below the header", func(c *Config) { c.Size = 4 }, "-size"},
+		{"format", func(c *Config) { c.Format = "xml" }, "-format"},
+	}
+	for _, tt := range tests {
+		cfg := good()
+		tt.change(cfg)
+		err := cfg.validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error about %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+// TestReportRates works out rates over the window after ramp up, not the totals.
+func TestReportRates(t *testing.T) {
+	lt := NewLoadTest(&Config{Conns: 2})
+	lt.sent.Store(150)
+	lt.received.Store(300)
+	r := lt.report(5*time.Second, window{elapsed: 10 * time.Second, sent: 100, received: 200})
+	if r.Elapsed != 10*time.Second || r.RampUp != 5*time.Second {
+		t.Fatalf("elapsed %s, ramp up %s", r.Elapsed, r.RampUp)
+	}
+	if r.SendRate != 10 || r.RecvRate != 20 {
+		t.Fatalf("rates %v sent/s, %v received/s, want 10 and 20", r.SendRate, r.RecvRate)
+	}
+	if r.Sent != 150 || r.Received != 300 || r.FanOut != 2 {
+		t.Fatalf("totals %d sent, %d received, fan out %v", r.Sent, r.Received, r.FanOut)
+	}
+}
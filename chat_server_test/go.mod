@@ -0,0 +1,16 @@
+module github.com/toastsandwich/chat_server_test
+
+go 1.25.3
+
+require (
+	github.com/toastsandwich/chat_server v0.0.0-00010101000000-000000000000
+	github.com/toastsandwich/epoll-learn/pkg v0.0.0
+)
+
+require golang.org/x/sys v0.37.0 // indirect
+
+replace (
+	github.com/toastsandwich/chat_server => ../chat_server
+	github.com/toastsandwich/epoll-learn/http1.0_server => ../http1.0_server
+	github.com/toastsandwich/epoll-learn/pkg => ../pkg
+)
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+type Latency struct {
+	P50  time.Duration `json:"p50_ns"`
+	P90  time.Duration `json:"p90_ns"`
+	P99  time.Duration `json:"p99_ns"`
+	P999 time.Duration `json:"p999_ns"`
+	Max  time.Duration `json:"max_ns"`
+}
+
+type Report struct {
+	Target    string        `json:"target"`
+	Conns     int           `json:"conns"`
+	Connected int64         `json:"connected"`
+	RampUp    time.Duration `json:"ramp_up_ns"`
+	Elapsed   time.Duration `json:"elapsed_ns"` // sending once ramp up was done
+
+	Sent          int64   `json:"messages_sent"`
+	Received      int64   `json:"messages_received"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+	SendRate      float64 `json:"sent_per_sec"` // over Elapsed, not counting ramp up
+	RecvRate      float64 `json:"received_per_sec"`
+	FanOut        float64 `json:"fan_out"` // deliveries per message sent
+
+	Latency Latency `json:"fan_out_latency"`
+
+	DialErrors  int64 `json:"dial_errors"`
+	WriteErrors int64 `json:"write_errors"`
+	Disconnects int64 `json:"disconnects"`
+	BadMessages int64 `json:"bad_messages"`
+}
+
+// window is what was sent and received while every connection was up.
+type window struct {
+	elapsed        time.Duration
+	sent, received int64
+}
+
+func (lt *LoadTest) report(rampUp time.Duration, steady window) *Report {
+	hist := &lt.latency
+	r := &Report{
+		Target:        lt.cfg.Target,
+		Conns:         lt.cfg.Conns,
+		Connected:     lt.connected.Load(),
+		RampUp:        rampUp,
+		Elapsed:       steady.elapsed,
+		Sent:          lt.sent.Load(),
+		Received:      lt.received.Load(),
+		BytesSent:     lt.bytesSent.Load(),
+		BytesReceived: lt.bytesRecvd.Load(),
+		DialErrors:    lt.dialErrors.Load(),
+		WriteErrors:   lt.writeErrors.Load(),
+		Disconnects:   lt.disconnects.Load(),
+		BadMessages:   lt.badMessages.Load(),
+		Latency: Latency{
+			P50:  hist.Percentile(50),
+			P90:  hist.Percentile(90),
+			P99:  hist.Percentile(99),
+			P999: hist.Percentile(99.9),
+			Max:  hist.Max(),
+		},
+	}
+	if secs := steady.elapsed.Seconds(); secs > 0 {
+		r.SendRate = float64(steady.sent) / secs
+		r.RecvRate = float64(steady.received) / secs
+	}
+	if r.Sent > 0 {
+		r.FanOut = float64(r.Received) / float64(r.Sent)
+	}
+	return r
+}
+
+func (r *Report) Write(w io.Writer, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "target\t%s\n", r.Target)
+	fmt.Fprintf(tw, "connections\t%d/%d (ramp up %s)\n", r.Connected, r.Conns, r.RampUp.Round(time.Millisecond))
+	fmt.Fprintf(tw, "elapsed\t%s after ramp up\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(tw, "sent\t%d msgs, %d bytes, %.1f msgs/s\n", r.Sent, r.BytesSent, r.SendRate)
+	fmt.Fprintf(tw, "received\t%d msgs, %d bytes, %.1f msgs/s\n", r.Received, r.BytesReceived, r.RecvRate)
+	fmt.Fprintf(tw, "fan out\t%.2f deliveries per message\n", r.FanOut)
+	fmt.Fprintf(tw, "latency\tp50 %s  p90 %s  p99 %s  p99.9 %s  max %s\n",
+		r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.P999, r.Latency.Max)
+	fmt.Fprintf(tw, "errors\tdial %d, write %d, disconnects %d, malformed %d\n",
+		r.DialErrors, r.WriteErrors, r.Disconnects, r.BadMessages)
+	return tw.Flush()
+}
@@ -0,0 +1,10 @@
+package main
+
+import "github.com/toastsandwich/epoll-learn/pkg/pool"
+
+const (
+	BUFFEERSIZE = 4096      // default EchoServerOpts.BufferSize
+	ECHOPENDING = 256 << 10 // echoed bytes a connection holds for a client that reads slowly
+)
+
+var bufferPool = pool.New(false)
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/toastsandwich/epoll-learn/pkg/config"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+)
+
+// Config is everything the echo server can be told, in a -config file or by flag, see
+// -print-config for the keys and defaults.
+type Config struct {
+	Listen struct {
+		Addr    string  `config:"addr" flag:"addr" help:"ipv4 address to listen on"`
+		Port    int     `config:"port" flag:"port" help:"port to listen on"`
+		Network Network `config:"network" flag:"network" help:"tcp, udp or both on the same port"`
+	} `config:"listen"`
+	Admin struct {
+		Addr string `config:"addr" flag:"admin-addr" help:"ipv4 address serving /metrics"`
+		Port int    `config:"port" flag:"admin-port" help:"port serving /metrics"`
+	} `config:"admin"`
+
+	Loop struct {
+		Backend loop.Backend `config:"backend" flag:"backend" help:"event loop, epoll or io_uring"`
+		Trigger loop.Trigger `config:"trigger" flag:"trigger" help:"epoll trigger mode, edge or level"`
+	} `config:"loop"`
+
+	Buffers struct {
+		Size int `config:"size" flag:"buffer-size" help:"bytes per read, 0 for the default"`
+	} `config:"buffers"`
+
+	// more ports, each with the service named, 0 is off
+	Services struct {
+		Discard int `config:"discard" flag:"discard-port" help:"port for discard (RFC 863), 0 is off"`
+		Chargen int `config:"chargen" flag:"chargen-port" help:"port for chargen (RFC 864), 0 is off"`
+		Daytime int `config:"daytime" flag:"daytime-port" help:"port for daytime (RFC 867), 0 is off"`
+	} `config:"services"`
+
+	Proxy struct {
+		Upstream string `config:"upstream" flag:"proxy-upstream" help:"ipv4 host:port to relay connections to, echo when empty"`
+		Relay    Relay  `config:"relay" flag:"proxy-relay" help:"how relayed bytes move, splice or copy"`
+	} `config:"proxy"`
+
+	TLS config.TLS `config:"tls"`
+	Log config.Log `config:"log"`
+}
+
+func defaultConfig() Config {
+	var c Config
+	c.Listen.Addr, c.Listen.Port = "0.0.0.0", 9000
+	c.Listen.Network = TCP
+	c.Admin.Addr, c.Admin.Port = "127.0.0.1", ADMINPORT
+	c.Loop.Backend, c.Loop.Trigger = loop.Epoll, loop.Level
+	c.Buffers.Size = BUFFEERSIZE
+	c.Proxy.Relay = Splice
+	c.Log.Format = "text"
+	return c
+}
+
+func (c *Config) Validate() error {
+	for _, err := range []error{
+		config.Addr("listen.addr", c.Listen.Addr),
+		config.Port("listen.port", c.Listen.Port),
+		config.Addr("admin.addr", c.Admin.Addr),
+		config.Port("admin.port", c.Admin.Port),
+		config.NotNegative("buffers.size", c.Buffers.Size),
+		config.Port("services.discard", c.Services.Discard),
+		config.Port("services.chargen", c.Services.Chargen),
+		config.Port("services.daytime", c.Services.Daytime),
+		c.TLS.Validate(),
+		c.Log.Validate(),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := loop.ParseBackend(string(c.Loop.Backend)); err != nil {
+		return config.Errorf("loop.backend", "%v", err)
+	}
+	if _, err := loop.ParseTrigger(string(c.Loop.Trigger)); err != nil {
+		return config.Errorf("loop.trigger", "%v", err)
+	}
+	network, err := ParseNetwork(string(c.Listen.Network))
+	if err != nil {
+		return config.Errorf("listen.network", "%v", err)
+	}
+	udp := network == UDP || network == Both
+	uring := c.Loop.Backend == loop.Uring || c.Loop.Backend == "uring"
+	if udp && uring {
+		return config.Errorf("listen.network", "udp echo runs on epoll only")
+	}
+	if uring && len(c.services()) > 0 {
+		return config.Errorf("services", "services other than echo run on epoll only")
+	}
+	if _, err := ParseRelay(string(c.Proxy.Relay)); err != nil {
+		return config.Errorf("proxy.relay", "%v", err)
+	}
+	if c.Proxy.Upstream != "" {
+		if _, err := parseUpstream(c.Proxy.Upstream); err != nil {
+			return config.Errorf("proxy.upstream", "%v", err)
+		}
+		if uring {
+			return config.Errorf("proxy.upstream", "the tcp proxy runs on epoll only")
+		}
+		if udp {
+			return config.Errorf("proxy.upstream", "the tcp proxy takes tcp only")
+		}
+	}
+	return nil
+}
+
+// services are the ones given a port.
+func (c *Config) services() []Service {
+	var svcs []Service
+	for _, svc := range []Service{
+		{Discard, c.Services.Discard},
+		{Chargen, c.Services.Chargen},
+		{Daytime, c.Services.Daytime},
+	} {
+		if svc.Port != 0 {
+			svcs = append(svcs, svc)
+		}
+	}
+	return svcs
+}
+
+func (c *Config) opts() *EchoServerOpts {
+	return &EchoServerOpts{
+		Addr:       c.Listen.Addr,
+		Port:       c.Listen.Port,
+		Network:    c.Listen.Network,
+		Backend:    c.Loop.Backend,
+		Trigger:    c.Loop.Trigger,
+		BufferSize: c.Buffers.Size,
+		Upstream:   c.Proxy.Upstream,
+		Relay:      c.Proxy.Relay,
+		Services:   c.services(),
+	}
+}
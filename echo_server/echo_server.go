@@ -0,0 +1,586 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+	"github.com/toastsandwich/epoll-learn/pkg/metrics"
+	"github.com/toastsandwich/epoll-learn/pkg/ringbuf"
+	"golang.org/x/sys/unix"
+)
+
+var ErrServerClosed = errors.New("echo server closed")
+
+type EchoServerOpts struct {
+	Addr string
+	Port int // 0 picks a free port, see EchoServer.Addr
+	// Network is tcp by default, udp echoes datagrams instead and both does both on Port.
+	// Datagrams are epoll only.
+	Network Network
+
+	// Backend picks the event loop, epoll by default. io_uring falls back to epoll with a
+	// warning when the kernel lacks something it needs.
+	Backend loop.Backend
+	// Trigger is how epoll reports ready sockets, level by default. Edge triggered the loop
+	// drains every socket until EAGAIN, level triggered it reads loop.LEVELREADS times per
+	// connection and accepts loop.LEVELACCEPTS connections per wakeup.
+	Trigger loop.Trigger
+
+	// BufferSize is how much one read takes, BUFFEERSIZE by default. io_uring registers
+	// URINGBUFFERS of it.
+	BufferSize int
+
+	// Upstream makes the server a tcp proxy, every connection is relayed to this ipv4
+	// host:port instead of echoed. Epoll only.
+	Upstream string
+	// Relay is how proxied bytes move, Splice by default.
+	Relay Relay
+
+	// Services are more ports to answer on, each with its protocol, on Addr and Network
+	// like Port, which echoes. Epoll only.
+	Services []Service
+
+	Logger  *slog.Logger      // defaults to logging.Default()
+	Metrics *metrics.Registry // defaults to a registry of its own, see EchoServer.Metrics
+}
+
+type EchoServer struct {
+	addr unix.SockaddrInet4
+
+	Fd    int // listening socket, -1 for udp only
+	udpFd int // -1 for tcp only
+	// every listening and udp socket, Fd and udpFd and those of the services
+	listeners map[int]*listener
+	services  []Service
+	epollFd   int // this is the epoll instance fd
+	wakeFd    int // eventfd written by Close to stop Serve
+
+	backend loop.Backend
+	trigger loop.Trigger
+	bufSize int
+	// the io_uring loop reads wakeFd into it, the kernel writes it after the call that asked,
+	// so it lives here on the heap where the loop goroutine's stack cannot move it away
+	uringWake [8]byte
+
+	network     Network
+	batch       *loop.Batch // the datagrams being answered
+	chargenLine int         // the line of the pattern the next chargen datagram gets
+
+	upstream     *unix.SockaddrInet4 // nil when echoing
+	upstreamAddr string
+	relay        Relay
+	proxied      map[int]*proxyConn // by client and by upstream fd
+
+	log     *slog.Logger
+	conns   map[int]*conn // connected clients
+	reg     *metrics.Registry
+	metrics *echoMetrics
+
+	serving bool
+	closed  bool
+	done    chan struct{}
+
+	mu sync.Mutex
+}
+
+// NewEchoServer binds and listens on opts.Addr:opts.Port.
+func NewEchoServer(opts *EchoServerOpts) (*EchoServer, error) {
+	s := &EchoServer{
+		Fd:        -1,
+		udpFd:     -1,
+		epollFd:   -1,
+		wakeFd:    -1,
+		listeners: make(map[int]*listener),
+		conns:     make(map[int]*conn),
+		proxied:   make(map[int]*proxyConn),
+		done:      make(chan struct{}),
+		log:       opts.Logger,
+	}
+	if s.log == nil {
+		s.log = logging.Default()
+	}
+	s.reg = opts.Metrics
+	if s.reg == nil {
+		s.reg = metrics.NewRegistry()
+	}
+	s.metrics = newEchoMetrics(s.reg)
+
+	addr, err := netip.ParseAddr(opts.Addr)
+	if err != nil || !addr.Is4() {
+		return nil, fmt.Errorf("invalid ipv4 address %q", opts.Addr)
+	}
+	s.addr.Addr = addr.As4()
+	s.addr.Port = opts.Port
+
+	s.trigger = cmp.Or(opts.Trigger, loop.Level)
+	if opts.BufferSize < 0 {
+		return nil, fmt.Errorf("buffer size %d, want 0 for the default or more", opts.BufferSize)
+	}
+	s.bufSize = cmp.Or(opts.BufferSize, BUFFEERSIZE)
+	s.backend, err = loop.Resolve(opts.Backend)
+	if err != nil {
+		s.log.Warn("io_uring unavailable, using epoll", logging.Err(err))
+	}
+	if s.network, err = ParseNetwork(string(opts.Network)); err != nil {
+		return nil, err
+	}
+	s.network = cmp.Or(s.network, TCP)
+	if s.network != TCP && s.backend == loop.Uring {
+		return nil, errors.New("udp echo runs on epoll only")
+	}
+	for _, svc := range opts.Services {
+		if _, err := ParseProtocol(string(svc.Protocol)); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.Services) > 0 && s.backend == loop.Uring {
+		return nil, errors.New("services other than echo run on epoll only")
+	}
+	s.services = opts.Services
+	if opts.Upstream != "" {
+		if s.network != TCP {
+			return nil, errors.New("the tcp proxy takes tcp only")
+		}
+		if s.backend == loop.Uring {
+			return nil, errors.New("the tcp proxy runs on epoll only")
+		}
+		if s.upstream, err = parseUpstream(opts.Upstream); err != nil {
+			return nil, err
+		}
+		s.upstreamAddr = opts.Upstream
+	}
+	if s.relay, err = ParseRelay(string(opts.Relay)); err != nil {
+		return nil, err
+	}
+	s.relay = cmp.Or(s.relay, Splice)
+
+	if err := s.socketBindListen(); err != nil {
+		s.cleanup()
+		return nil, fmt.Errorf("error listening on %s:%d: %w", opts.Addr, opts.Port, err)
+	}
+	if err := s.setupEpoll(); err != nil {
+		s.cleanup()
+		return nil, fmt.Errorf("error setting up epoll: %w", err)
+	}
+	return s, nil
+}
+
+// socketBindListen opens the echo port and those of the services, for tcp, udp or both.
+func (s *EchoServer) socketBindListen() error {
+	for i, svc := range append([]Service{{Protocol: Echo, Port: s.addr.Port}}, s.services...) {
+		port := svc.Port
+		if s.network != UDP {
+			l := &listener{fd: -1, proto: svc.Protocol, proxy: i == 0 && s.upstream != nil}
+			err := s.listenTCP(l, port)
+			if l.fd >= 0 {
+				s.listeners[l.fd] = l
+			}
+			if err != nil {
+				return fmt.Errorf("%s port %d: %w", svc.Protocol, port, err)
+			}
+			if i == 0 {
+				s.Fd = l.fd
+			}
+			// udp takes the port tcp got, a port 0 service ends up on one port for both
+			sa, err := unix.Getsockname(l.fd)
+			if err != nil {
+				return fmt.Errorf("getsockname: %w", err)
+			}
+			port = sa.(*unix.SockaddrInet4).Port
+		}
+		if s.network != TCP {
+			l := &listener{fd: -1, proto: svc.Protocol, udp: true}
+			err := s.bindUDP(l, port)
+			if l.fd >= 0 {
+				s.listeners[l.fd] = l
+			}
+			if err != nil {
+				return fmt.Errorf("%s udp port %d: %w", svc.Protocol, port, err)
+			}
+			if i == 0 {
+				s.udpFd = l.fd
+			}
+		}
+	}
+	if s.network != TCP {
+		s.batch = loop.NewBatch(UDPBATCH, UDPMAXDATAGRAM)
+	}
+	return nil
+}
+
+func (s *EchoServer) listenTCP(l *listener, port int) error {
+	srvfd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return fmt.Errorf("socket: %w", err)
+	}
+	l.fd = srvfd
+
+	// set server fd to non block so it doesnot block forever while reading
+	if err := unix.SetNonblock(srvfd, true); err != nil {
+		return fmt.Errorf("set nonblock: %w", err)
+	}
+	if err := unix.SetsockoptInt(srvfd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return fmt.Errorf("setsockopt SO_REUSEADDR: %w", err)
+	}
+	addr := s.addr
+	addr.Port = port
+	if err := unix.Bind(srvfd, &addr); err != nil {
+		return fmt.Errorf("bind: %w", err)
+	}
+	if err := unix.Listen(srvfd, unix.SOMAXCONN); err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	return nil
+}
+
+func (s *EchoServer) setupEpoll() error {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("epoll_create1: %w", err)
+	}
+	s.epollFd = epfd
+
+	// now register events to this epfd
+	for fd := range s.listeners {
+		if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{
+			Events: s.trigger.Events(eventTypes),
+			Fd:     int32(fd),
+		}); err != nil {
+			return fmt.Errorf("adding listener to epoll: %w", err)
+		}
+	}
+
+	s.wakeFd, err = unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("eventfd: %w", err)
+	}
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, s.wakeFd, &unix.EpollEvent{
+		Events: unix.EPOLLIN,
+		Fd:     int32(s.wakeFd),
+	}); err != nil {
+		return fmt.Errorf("adding eventfd to epoll: %w", err)
+	}
+	return nil
+}
+
+const eventTypes = unix.EPOLLIN | unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLRDHUP
+
+// Metrics returns the registry the server reports to.
+func (s *EchoServer) Metrics() *metrics.Registry { return s.reg }
+
+// Addr returns the address the server is listening on, tcp and udp alike.
+func (s *EchoServer) Addr() string {
+	fd := s.Fd
+	if fd < 0 {
+		fd = s.udpFd
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return ""
+	}
+	return sockaddrString(sa)
+}
+
+// ServiceAddr returns the address the service answering proto is on, "" for none.
+func (s *EchoServer) ServiceAddr(proto Protocol) string {
+	for _, l := range s.listeners {
+		if l.proto != proto || l.fd == s.Fd || l.fd == s.udpFd {
+			continue
+		}
+		if sa, err := unix.Getsockname(l.fd); err == nil {
+			return sockaddrString(sa)
+		}
+	}
+	return ""
+}
+
+func sockaddrString(sa unix.Sockaddr) string {
+	if a, ok := sa.(*unix.SockaddrInet4); ok {
+		return netip.AddrPortFrom(netip.AddrFrom4(a.Addr), uint16(a.Port)).String()
+	}
+	return "unknown"
+}
+
+// Serve echoes everything it reads, it returns nil once Close is called.
+func (s *EchoServer) Serve() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.serving = true
+	s.mu.Unlock()
+	defer close(s.done)
+	defer s.cleanup()
+
+	log := s.log
+	if s.upstream != nil {
+		log = log.With(slog.String("upstream", s.upstreamAddr), slog.String("relay", string(s.relay)))
+	}
+	log.Info("echo server is now listening", slog.String("addr", s.Addr()), slog.String("network", string(s.network)), slog.String("backend", string(s.backend)))
+	for _, svc := range s.services {
+		log.Info("answering "+string(svc.Protocol), slog.String("addr", s.ServiceAddr(svc.Protocol)))
+	}
+	if s.backend == loop.Uring {
+		return s.serveUring()
+	}
+
+	epfd := s.epollFd
+	events := make([]unix.EpollEvent, 100) // monitor at max 100 events
+	for {
+		n, err := unix.EpollWait(epfd, events, -1) // block forever
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return fmt.Errorf("error waiting for events: %w", err)
+		}
+		s.metrics.wakeups.Inc()
+		s.metrics.eventsPerWakeup.Observe(float64(n))
+		for i := range n {
+			evt := events[i]
+			efd := int(evt.Fd) // this is event fd
+			if efd == s.wakeFd {
+				return nil
+			}
+			// if the events is of a listener, then we have an incoming connection.
+			if l := s.listeners[efd]; l != nil {
+				if l.udp {
+					s.datagrams(l)
+				} else {
+					s.accept(l)
+				}
+				continue
+			}
+			if pc := s.proxied[efd]; pc != nil {
+				s.proxyEvent(pc, efd, evt.Events)
+				continue
+			}
+			c := s.conns[efd]
+			if c == nil {
+				continue // closed by an earlier event of this wakeup, an upstream with its client
+			}
+			if evt.Events&(unix.EPOLLERR|unix.EPOLLHUP) != 0 {
+				s.closeClient(efd)
+				continue
+			}
+			// we are getting data from clients, get a buffer from poll and read the data and echo it
+			switch c.proto {
+			case Echo:
+				// a peer hang up leaves its last bytes to echo, reading ends with EOF and closes.
+				s.echo(efd, c)
+			case Discard:
+				s.discard(efd)
+			case Chargen:
+				s.chargen(efd, c, evt.Events)
+			}
+		}
+	}
+}
+
+// accept takes pending connections until EAGAIN, or as many as the trigger mode allows per wakeup.
+func (s *EchoServer) accept(l *listener) {
+	accepts := s.trigger.Accepts()
+	for i := 0; accepts == 0 || i < accepts; i++ {
+		clntfd, csockaddr, err := unix.Accept4(l.fd, loop.AcceptFlags)
+		if err != nil {
+			if err == unix.EINTR || err == unix.ECONNABORTED {
+				continue
+			}
+			if err != unix.EAGAIN {
+				s.log.Error("error accepting connection", logging.Err(err))
+			}
+			return
+		}
+		peer := sockaddrString(csockaddr)
+		log := logging.Conn(s.log, clntfd, peer)
+
+		if l.proto == Daytime {
+			// the answer fits an empty socket buffer, nothing to wait for
+			n, _ := unix.Write(clntfd, daytime())
+			s.metrics.bytesWritten.Add(max(n, 0))
+			s.metrics.accepted.Inc()
+			unix.Close(clntfd)
+			log.Debug("told the time")
+			continue
+		}
+
+		// now add the client fd to event poll, with its upstream when proxying
+		if l.proxy {
+			if err := s.startProxy(clntfd, log); err != nil {
+				log.Error("error proxying connection", logging.Err(err))
+				unix.Close(clntfd)
+				continue
+			}
+		} else if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_ADD, clntfd, &unix.EpollEvent{
+			Events: s.trigger.Events(connEvents(l.proto)),
+			Fd:     int32(clntfd),
+		}); err != nil {
+			log.Error("error adding connection to epoll", logging.Err(err))
+			unix.Close(clntfd)
+			continue
+		}
+		s.conns[clntfd] = &conn{peer: peer, proto: l.proto, events: connEvents(l.proto)}
+		log.Debug("new connection", slog.String("protocol", string(l.proto)))
+		s.metrics.accepted.Inc()
+		s.metrics.active.Inc()
+	}
+}
+
+// echo reads into the connection's pending output and writes it back, until EAGAIN when
+// edge triggered and loop.LEVELREADS reads when level triggered. What the client does not
+// take yet stays pending, at most ECHOPENDING bytes, and the connection waits for EPOLLOUT
+// instead of reading more, the client's sends then back up in its own socket and every
+// byte comes back in order however slowly it reads.
+func (s *EchoServer) echo(efd int, c *conn) {
+	log := s.connLog(efd)
+	if c.out == nil {
+		c.out = ringbuf.New(bufferPool, s.bufSize, ECHOPENDING)
+	}
+	reads := s.trigger.Reads()
+	for {
+		var n int
+		var rerr error
+		if !c.eof {
+			n, rerr = c.out.ReadFromFdN(efd, reads)
+			if n > 0 && c.out.Len() == n {
+				c.readAt = time.Now()
+			}
+			s.metrics.bytesRead.Add(n)
+		}
+		written, err := c.out.WriteToFd(efd)
+		s.metrics.bytesWritten.Add(written)
+		if err != nil {
+			log.Warn("error writing to connection", logging.Err(err), slog.Int("pending", c.out.Len()))
+			s.closeClient(efd)
+			return
+		}
+		if written > 0 {
+			log.Debug("echoed", logging.Bytes(written))
+			if c.out.Len() == 0 {
+				s.metrics.echoDuration.ObserveSince(c.readAt)
+			}
+		}
+		switch {
+		case rerr == io.EOF: // this means that client is done with server
+			c.eof = true
+		case rerr != nil && rerr != ringbuf.ErrFull:
+			log.Warn("error reading from connection", logging.Err(rerr))
+			s.closeClient(efd)
+			return
+		}
+		if c.eof && c.out.Len() == 0 {
+			s.closeClient(efd)
+			return
+		}
+		// edge triggered a read that stopped on a full buffer is all that says the socket
+		// has more, go on while the writes keep up
+		if rerr == ringbuf.ErrFull && c.out.Len() == 0 && reads == 0 {
+			continue
+		}
+		break
+	}
+	if c.out.Len() == 0 {
+		c.out.Release() // an idle connection holds no buffer
+	}
+	s.arm(efd, c)
+}
+
+// arm waits for reads while there is room for them, and for writes while output is pending.
+func (s *EchoServer) arm(fd int, c *conn) {
+	var events uint32 = unix.EPOLLERR | unix.EPOLLHUP
+	if !c.eof && (c.out == nil || c.out.Free() > 0) {
+		events |= unix.EPOLLIN | unix.EPOLLRDHUP
+	}
+	if c.out != nil && c.out.Len() > 0 {
+		events |= unix.EPOLLOUT
+	}
+	if events == c.events {
+		return
+	}
+	if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{
+		Events: s.trigger.Events(events),
+		Fd:     int32(fd),
+	}); err != nil {
+		s.connLog(fd).Warn("error changing epoll events", logging.Err(err))
+		s.closeClient(fd)
+		return
+	}
+	c.events = events
+}
+
+func (s *EchoServer) connLog(fd int) *slog.Logger {
+	peer := ""
+	if c := s.conns[fd]; c != nil {
+		peer = c.peer
+	}
+	return logging.Conn(s.log, fd, peer)
+}
+
+func (s *EchoServer) closeClient(fd int) {
+	unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_DEL, fd, nil)
+	unix.Close(fd)
+	s.connLog(fd).Debug("connection closed")
+	if c, ok := s.conns[fd]; ok {
+		if c.out != nil {
+			c.out.Release()
+		}
+		delete(s.conns, fd)
+		s.metrics.active.Dec()
+	}
+}
+
+// Close stops Serve and waits for it to return.
+func (s *EchoServer) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	serving := s.serving
+	s.mu.Unlock()
+
+	if !serving {
+		s.cleanup()
+		return
+	}
+	var one [8]byte
+	binary.NativeEndian.PutUint64(one[:], 1)
+	unix.Write(s.wakeFd, one[:])
+	<-s.done
+}
+
+func (s *EchoServer) cleanup() {
+	for fd, pc := range s.proxied {
+		if fd == pc.client {
+			pc.release()
+		}
+	}
+	clear(s.proxied)
+	for fd, c := range s.conns {
+		unix.Close(fd)
+		if c.out != nil {
+			c.out.Release()
+		}
+	}
+	clear(s.conns)
+	// the map stays, ServiceAddr reads it from other goroutines
+	for fd := range s.listeners {
+		unix.Close(fd)
+	}
+	for _, fd := range []int{s.wakeFd, s.epollFd} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
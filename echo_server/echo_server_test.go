@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/bench"
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+	"github.com/toastsandwich/epoll-learn/pkg/uring"
+)
+
+// startEchoServer runs a server on loopback with opts for its loop, and a silent logger.
+func startEchoServer(t testing.TB, opts EchoServerOpts) *EchoServer {
+	t.Helper()
+	opts.Addr, opts.Logger = "127.0.0.1", logging.Discard()
+	s, err := NewEchoServer(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errC := make(chan error, 1)
+	go func() { errC <- s.Serve() }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-errC; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	return s
+}
+
+// forEachLoop runs f on epoll level and edge triggered, and on io_uring if the kernel has it.
+func forEachLoop(t *testing.T, f func(t *testing.T, opts EchoServerOpts)) {
+	for _, opts := range []EchoServerOpts{
+		{Backend: loop.Epoll, Trigger: loop.Level},
+		{Backend: loop.Epoll, Trigger: loop.Edge},
+		{Backend: loop.Uring},
+	} {
+		name := string(opts.Backend)
+		if opts.Trigger != "" {
+			name += "-" + string(opts.Trigger)
+		}
+		t.Run(name, func(t *testing.T) {
+			if opts.Backend == loop.Uring {
+				if err := uring.Supported(); err != nil {
+					t.Skip(err)
+				}
+			}
+			f(t, opts)
+		})
+	}
+}
+
+func dial(t testing.TB, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestEchoServerEchoes(t *testing.T) {
+	forEachLoop(t, func(t *testing.T, opts EchoServerOpts) {
+		s := startEchoServer(t, opts)
+		conn := dial(t, s.Addr())
+
+		for _, msg := range []string{"hello\n", "a", "second message"} {
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != msg {
+				t.Fatalf("echoed %q, want %q", got, msg)
+			}
+		}
+	})
+}
+
+func TestEchoServerManyClients(t *testing.T) {
+	forEachLoop(t, func(t *testing.T, opts EchoServerOpts) {
+		s := startEchoServer(t, opts)
+
+		conns := make([]net.Conn, 20)
+		for i := range conns {
+			conns[i] = dial(t, s.Addr())
+		}
+		for i, conn := range conns {
+			msg := bytes.Repeat([]byte{byte('a' + i)}, 100)
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("client %d got someone else's bytes: %q", i, got)
+			}
+		}
+	})
+}
+
+func TestEchoServerSurvivesDisconnect(t *testing.T) {
+	forEachLoop(t, func(t *testing.T, opts EchoServerOpts) {
+		s := startEchoServer(t, opts)
+
+		gone := dial(t, s.Addr())
+		gone.Write([]byte("bye"))
+		gone.Close()
+
+		conn := dial(t, s.Addr())
+		if _, err := conn.Write([]byte("still there?")); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len("still there?"))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// TestEchoServerBurst opens more connections at once than a level triggered loop accepts per
+// wakeup, each sending more than it reads per wakeup, nothing may be left behind in either mode.
+func TestEchoServerBurst(t *testing.T) {
+	forEachLoop(t, func(t *testing.T, opts EchoServerOpts) {
+		s := startEchoServer(t, opts)
+
+		const conns = 2 * loop.LEVELACCEPTS
+		errC := make(chan error, conns)
+		for i := range conns {
+			conn := dial(t, s.Addr())
+			msg := bytes.Repeat([]byte{byte(i)}, 4*loop.LEVELREADS*BUFFEERSIZE)
+			go func() {
+				go conn.Write(msg)
+				got := make([]byte, len(msg))
+				if _, err := io.ReadFull(conn, got); err != nil {
+					errC <- err
+					return
+				}
+				if !bytes.Equal(got, msg) {
+					errC <- fmt.Errorf("client %d got someone else's bytes", i)
+					return
+				}
+				errC <- nil
+			}()
+		}
+		for range conns {
+			if err := <-errC; err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestEchoServerHalfClose sends and shuts down its write side in one go, the hang up comes
+// with bytes still to read and they are echoed before the connection closes.
+func TestEchoServerHalfClose(t *testing.T) {
+	forEachLoop(t, func(t *testing.T, opts EchoServerOpts) {
+		s := startEchoServer(t, opts)
+		conn := dial(t, s.Addr())
+
+		msg := bytes.Repeat([]byte("last words "), 1000)
+		conn.Write(msg)
+		conn.(*net.TCPConn).CloseWrite()
+		got, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("echoed %d bytes before closing, want %d", len(got), len(msg))
+		}
+	})
+}
+
+// TestEchoServerSlowReader sends megabytes on a few connections at once and reads them back
+// slowly at first, the server has to hold what the clients do not take yet and echo every
+// byte in order.
+func TestEchoServerSlowReader(t *testing.T) {
+	forEachLoop(t, func(t *testing.T, opts EchoServerOpts) {
+		s := startEchoServer(t, opts)
+
+		const conns = 4
+		errC := make(chan error, conns)
+		for i := range conns {
+			conn := dial(t, s.Addr())
+			conn.SetDeadline(time.Now().Add(20 * time.Second))
+			data := make([]byte, 8<<20)
+			for j := range data {
+				data[j] = byte(i + j*7)
+			}
+			go func() {
+				go conn.Write(data)
+				got := make([]byte, 0, len(data))
+				buf := make([]byte, 16<<10)
+				for len(got) < len(data) {
+					n, err := conn.Read(buf)
+					if err != nil {
+						errC <- fmt.Errorf("client %d after %d bytes: %w", i, len(got), err)
+						return
+					}
+					got = append(got, buf[:n]...)
+					if len(got) < 1<<20 {
+						time.Sleep(time.Millisecond)
+					}
+				}
+				if !bytes.Equal(got, data) {
+					errC <- fmt.Errorf("client %d: echoed bytes differ", i)
+					return
+				}
+				errC <- nil
+			}()
+		}
+		for range conns {
+			if err := <-errC; err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestEchoServerStalledReader sends without reading until its writes block, the server's
+// pending output and both socket buffers full, and then reads everything it got through.
+func TestEchoServerStalledReader(t *testing.T) {
+	forEachLoop(t, func(t *testing.T, opts EchoServerOpts) {
+		s := startEchoServer(t, opts)
+		conn := dial(t, s.Addr())
+
+		var sent bytes.Buffer
+		chunk := make([]byte, 64<<10)
+		for i := 0; ; i++ {
+			for j := range chunk {
+				chunk[j] = byte(i + j)
+			}
+			conn.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+			n, err := conn.Write(chunk)
+			sent.Write(chunk[:n])
+			if err != nil {
+				break
+			}
+		}
+		if sent.Len() < ECHOPENDING {
+			t.Fatalf("writes blocked after %d bytes", sent.Len())
+		}
+		got := make([]byte, sent.Len())
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, sent.Bytes()) {
+			t.Fatal("echoed bytes differ")
+		}
+		// and the connection still echoes
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("after"))
+		if _, err := io.ReadFull(conn, got[:5]); err != nil || string(got[:5]) != "after" {
+			t.Fatalf("got %q, %v", got[:5], err)
+		}
+	})
+}
+
+func TestEchoServerMetrics(t *testing.T) {
+	forEachLoop(t, func(t *testing.T, opts EchoServerOpts) {
+		s := startEchoServer(t, opts)
+		conn := dial(t, s.Addr())
+		conn.Write([]byte("12345"))
+		io.ReadFull(conn, make([]byte, 5))
+
+		var out strings.Builder
+		if err := s.Metrics().WriteText(&out); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"echo_connections_accepted_total 1\n",
+			"echo_connections_active 1\n",
+			"echo_read_bytes_total 5\n",
+			"echo_written_bytes_total 5\n",
+			"echo_duration_seconds_count 1\n",
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("metrics missing %q:\n%s", want, out.String())
+			}
+		}
+	})
+}
+
+func TestEchoServerUringBulk(t *testing.T) {
+	if err := uring.Supported(); err != nil {
+		t.Skip(err)
+	}
+	s := startEchoServer(t, EchoServerOpts{Backend: loop.Uring})
+	conn := dial(t, s.Addr())
+
+	// more than every provided buffer together, read slowly so recv runs out of them
+	data := bytes.Repeat([]byte("0123456789abcdef"), (8<<20)/16)
+	go conn.Write(data)
+	got := make([]byte, 0, len(data))
+	buf := make([]byte, 32<<10)
+	for len(got) < len(data) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("after %d bytes: %v", len(got), err)
+		}
+		got = append(got, buf[:n]...)
+		if len(got) < 1<<20 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echoed bytes differ")
+	}
+}
+
+// BenchmarkEchoServer ping-pongs 512 bytes on one connection per goroutine, against each
+// backend and, for comparison, the goroutine per connection server of package bench.
+func BenchmarkEchoServer(b *testing.B) {
+	for _, name := range []string{string(loop.Epoll), string(loop.Uring), "net"} {
+		b.Run(name, func(b *testing.B) {
+			var addr string
+			switch backend := loop.Backend(name); backend {
+			case loop.Epoll, loop.Uring:
+				if backend == loop.Uring {
+					if err := uring.Supported(); err != nil {
+						b.Skip(err)
+					}
+				}
+				addr = startEchoServer(b, EchoServerOpts{Backend: backend}).Addr()
+			default:
+				addr = serveNet(b, bench.ServeEcho)
+			}
+			msg := bytes.Repeat([]byte("x"), 512)
+			var hist bench.Histogram
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+				got := make([]byte, len(msg))
+				for pb.Next() {
+					start := time.Now()
+					if _, err := conn.Write(msg); err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := io.ReadFull(conn, got); err != nil {
+						b.Error(err)
+						return
+					}
+					hist.Record(time.Since(start))
+				}
+			})
+			hist.Report(b)
+		})
+	}
+}
+
+// serveNet runs serve on a loopback listener closed when b is done, and returns its address.
+func serveNet(b *testing.B, serve func(net.Listener) error) string {
+	b.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ln.Close() })
+	go serve(ln)
+	return ln.Addr().String()
+}
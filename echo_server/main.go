@@ -1,136 +1,61 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
-	"sync"
 
-	"golang.org/x/sys/unix"
+	server "github.com/toastsandwich/epoll-learn/http1.0_server"
+	"github.com/toastsandwich/epoll-learn/pkg/config"
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
 )
 
-const BUFFEERSIZE = 4096
+const ADMINPORT = 9102 // default admin.port
 
-type BufferPool struct {
-	sync.Pool
-	Secure bool
-}
-
-func CreateBufferPool(secure bool) *BufferPool {
-	return &BufferPool{
-		sync.Pool{
-			New: func() any {
-				fmt.Println("buffer pool just create a new buffer")
-				return make([]byte, BUFFEERSIZE)
-			},
-		},
-		secure,
+func main() {
+	cfg := defaultConfig()
+	src, err := config.FromArgs(flag.CommandLine, os.Args[1:], &cfg)
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-}
-
-func (b *BufferPool) get() []byte {
-	return b.Get().([]byte)
-}
-
-func (b *BufferPool) put(p []byte) {
-	if b.Secure {
-		for i := range p {
-			p[i] = 0
-		}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading config:", err)
+		os.Exit(2)
+	}
+	if src.PrintConfig {
+		config.Print(os.Stdout, &cfg)
+		return
 	}
-	b.Put(p)
-}
-
-var bufferPool = CreateBufferPool(false)
-
-func socket_bind_listen() {
-	srvfd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
-	ifError(err)
-	defer unix.Close(srvfd)
-	unix.SetNonblock(srvfd, true) // set server fd to non block so it doesnot block forever while reading
-
-	ifError(unix.SetsockoptInt(srvfd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1))
-
-	addr := unix.SockaddrInet4{Port: 9000}
-	copy(addr.Addr[:], []byte{0, 0, 0, 0})
-
-	ifError(unix.Bind(srvfd, &addr))
-	ifError(unix.Listen(srvfd, 10))
-	fmt.Println("echo server is now listening at 0.0.0.0:9000")
-	// this is the epoll instance fd
-	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
-	ifError(err)
-
-	// now register events to this epfd
-	eventTypes := unix.EPOLLIN | unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLRDHUP
-	ifError(unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, srvfd, &unix.EpollEvent{
-		Events: uint32(eventTypes),
-		Fd:     int32(srvfd),
-	}))
-
-	events := make([]unix.EpollEvent, 100) // monitor at max 100 events
-	for {
-		n, err := unix.EpollWait(epfd, events, -1) // block forever
-		if err != nil {
-			if err == unix.EINTR {
-				continue
-			}
-			ifError(err)
-		}
-		for i := range n {
-			evt := events[i]
-			efd := int(evt.Fd) // this is event fd
-			if evt.Events&(unix.EPOLLERR|unix.EPOLLHUP|unix.EPOLLRDHUP) != 0 {
-				unix.Close(efd)
-				unix.EpollCtl(epfd, unix.EPOLL_CTL_DEL, efd, nil)
-				continue
-			}
-			// if the events is of server fd, then we have an incoming connection.
-			if efd == srvfd {
-				clntfd, csockaddr, err := unix.Accept(efd)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
 
-				// now add the client fd to event poll
-				ifError(unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, clntfd, &unix.EpollEvent{
-					Events: uint32(eventTypes),
-					Fd:     int32(clntfd),
-				}))
+	level := new(slog.LevelVar)
+	log := logging.New(cfg.Log.Options(level))
 
-				fmt.Println("new connection from", csockaddr.(*unix.SockaddrInet4).Addr)
-			} else { // we are getting data from clients, get a buffer from poll and read the data and echo it
-				buf := bufferPool.get()
-				n, err := unix.Read(efd, buf)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
-				if n == 0 { // this means that client is done with server
-					unix.Close(efd)
-					ifError(unix.EpollCtl(epfd, unix.EPOLL_CTL_DEL, efd, nil))
-					bufferPool.put(buf)
-					continue
-				}
-				_, err = unix.Write(efd, buf[:n])
-				if err != nil {
-					fmt.Println(err)
-					bufferPool.put(buf)
-					continue
-				}
-				bufferPool.put(buf)
-			}
-		}
+	opts := cfg.opts()
+	opts.Logger = log
+	s, err := NewEchoServer(opts)
+	if err != nil {
+		log.Error("error starting echo server", logging.Err(err))
+		os.Exit(1)
 	}
-}
 
-func ifError(err error) {
+	// metrics are served by the epoll http server, on loopback only
+	admin, err := server.NewHTTPServer(&server.HTTPServerOpts{Addr: cfg.Admin.Addr, Port: cfg.Admin.Port, Workers: 1, Logger: log})
 	if err != nil {
-		fmt.Println(err)
+		log.Error("error starting admin server", logging.Err(err))
 		os.Exit(1)
 	}
-}
+	s.Metrics().GoRuntime()
+	admin.HandleFunc("/metrics", server.MetricsHandler(s.Metrics()))
+	go func() {
+		if err := admin.ListenAndServe(); err != nil {
+			log.Error("admin server stopped", logging.Err(err))
+		}
+	}()
+	defer admin.Close()
 
-func main() {
-	socket_bind_listen()
+	if err := s.Serve(); err != nil {
+		log.Error("echo server stopped", logging.Err(err))
+	}
 }
@@ -0,0 +1,45 @@
+package main
+
+import "github.com/toastsandwich/epoll-learn/pkg/metrics"
+
+type echoMetrics struct {
+	accepted        *metrics.Counter
+	active          *metrics.Gauge
+	bytesRead       *metrics.Counter
+	bytesWritten    *metrics.Counter
+	wakeups         *metrics.Counter
+	eventsPerWakeup *metrics.Histogram
+	echoDuration    *metrics.Histogram
+
+	datagramsRead    *metrics.Counter
+	datagramsWritten *metrics.Counter
+	datagramsDropped *metrics.Counter
+
+	proxyConnects      *metrics.Counter
+	proxyConnectErrors *metrics.Counter
+	proxyUp            *metrics.Counter
+	proxyDown          *metrics.Counter
+}
+
+func newEchoMetrics(reg *metrics.Registry) *echoMetrics {
+	m := &echoMetrics{
+		accepted:        reg.Counter("echo_connections_accepted_total", "Connections accepted by the echo server."),
+		active:          reg.Gauge("echo_connections_active", "Connections currently open."),
+		bytesRead:       reg.Counter("echo_read_bytes_total", "Bytes read from echo clients."),
+		bytesWritten:    reg.Counter("echo_written_bytes_total", "Bytes echoed back to clients."),
+		wakeups:         reg.Counter("echo_epoll_wakeups_total", "Times epoll_wait returned with events."),
+		eventsPerWakeup: reg.Histogram("echo_epoll_events_per_wakeup", "Events returned by a single epoll_wait.", metrics.ExponentialBuckets(1, 2, 11)),
+		echoDuration:    reg.Histogram("echo_duration_seconds", "Time from reading bytes to writing them back.", metrics.LatencyBuckets),
+
+		datagramsRead:    reg.Counter("echo_datagrams_received_total", "Datagrams read from udp clients."),
+		datagramsWritten: reg.Counter("echo_datagrams_sent_total", "Datagrams echoed back to udp clients."),
+		datagramsDropped: reg.Counter("echo_datagrams_dropped_total", "Datagrams not echoed, the socket had no room or the send failed."),
+
+		proxyConnects:      reg.Counter("echo_proxy_upstream_connects_total", "Upstream connections opened in proxy mode."),
+		proxyConnectErrors: reg.Counter("echo_proxy_upstream_connect_errors_total", "Upstream connections that failed to connect."),
+		proxyUp:            reg.Counter("echo_proxy_upstream_bytes_total", "Bytes relayed from clients to the upstream."),
+		proxyDown:          reg.Counter("echo_proxy_downstream_bytes_total", "Bytes relayed from the upstream to clients."),
+	}
+	bufferPool.RegisterMetrics(reg, "echo")
+	return m
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/metrics"
+	"github.com/toastsandwich/epoll-learn/pkg/ringbuf"
+	"golang.org/x/sys/unix"
+)
+
+// Relay is how the tcp proxy moves bytes between a client and its upstream.
+type Relay string
+
+const (
+	// Splice moves bytes through a pipe with splice(2), they never come up to user space.
+	// A connection that cannot get its pipes copies instead.
+	Splice Relay = "splice"
+	// Copy reads into a buffer and writes it out, the way echo does.
+	Copy Relay = "copy"
+)
+
+// ParseRelay accepts splice or copy. An empty s gives an empty Relay, the server then picks
+// its own default.
+func ParseRelay(s string) (Relay, error) {
+	switch Relay(s) {
+	case "":
+		return "", nil
+	case Splice, Copy:
+		return Relay(s), nil
+	}
+	return "", fmt.Errorf("unknown relay %q, want splice or copy", s)
+}
+
+const RELAYLIMIT = 64 << 10 // bytes buffered per direction when copying, a pipe's default size
+
+// proxyEvents registers both sockets of a proxied connection edge triggered whatever the
+// trigger mode, they wait for writes as well as reads and level triggered a socket with room
+// to write would wake the loop on every wait.
+const proxyEvents = unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLRDHUP | unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLET
+
+// parseUpstream takes an ipv4 host:port.
+func parseUpstream(addr string) (*unix.SockaddrInet4, error) {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil || !ap.Addr().Is4() || ap.Port() == 0 {
+		return nil, fmt.Errorf("invalid upstream %q, want an ipv4 host:port", addr)
+	}
+	return &unix.SockaddrInet4{Addr: ap.Addr().As4(), Port: int(ap.Port())}, nil
+}
+
+// proxyConn is a client and the upstream connection opened for it.
+type proxyConn struct {
+	client, upstream int
+	connected        bool
+	up, down         relayDir // client to upstream, upstream to client
+}
+
+// relayDir moves bytes one way, through a pipe when splicing and a buffer when copying.
+type relayDir struct {
+	from, to int
+
+	pipe      [2]int // read and write end
+	piped     int    // bytes in the pipe
+	pipeSize  int
+	buf       *ringbuf.Buffer
+	relayed   *metrics.Counter
+	eof, shut bool // from sent everything, and to was told with shutdown SHUT_WR
+}
+
+// startProxy connects to the upstream for the accepted client and adds both to epoll, the
+// client's bytes wait in its socket until the connect is done.
+func (s *EchoServer) startProxy(client int, log *slog.Logger) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("upstream socket: %w", err)
+	}
+	// bytes are passed on as they come, Nagle would hold small ones back on either side
+	unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+	unix.SetsockoptInt(client, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+
+	pc := &proxyConn{client: client, upstream: fd}
+	pc.up = relayDir{from: client, to: fd, pipe: [2]int{-1, -1}, relayed: s.metrics.proxyUp}
+	pc.down = relayDir{from: fd, to: client, pipe: [2]int{-1, -1}, relayed: s.metrics.proxyDown}
+	for _, d := range []*relayDir{&pc.up, &pc.down} {
+		if s.relay == Copy {
+			d.initCopy(s.bufSize)
+		} else if err := d.initPipe(); err != nil {
+			log.Debug("no pipe for splice, copying", logging.Err(err))
+			d.initCopy(s.bufSize)
+		}
+	}
+
+	s.metrics.proxyConnects.Inc()
+	if err := unix.Connect(fd, s.upstream); err != nil && err != unix.EINPROGRESS {
+		s.metrics.proxyConnectErrors.Inc()
+		pc.release()
+		return fmt.Errorf("connecting to upstream %s: %w", s.upstreamAddr, err)
+	}
+	for _, fd := range []int{client, fd} {
+		if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: proxyEvents, Fd: int32(fd)}); err != nil {
+			unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_DEL, client, nil)
+			pc.release()
+			return fmt.Errorf("adding to epoll: %w", err)
+		}
+	}
+	s.proxied[client], s.proxied[fd] = pc, pc
+	return nil
+}
+
+// proxyEvent handles events on either socket of pc, the connect finishing and then bytes to
+// move in whichever direction can.
+func (s *EchoServer) proxyEvent(pc *proxyConn, fd int, events uint32) {
+	log := s.connLog(pc.client)
+	if !pc.connected {
+		if fd == pc.client {
+			if events&(unix.EPOLLERR|unix.EPOLLHUP) != 0 {
+				s.closeProxy(pc)
+			}
+			return
+		}
+		if events&(unix.EPOLLOUT|unix.EPOLLERR|unix.EPOLLHUP) == 0 {
+			return
+		}
+		if err := sockErr(fd); err != nil {
+			s.metrics.proxyConnectErrors.Inc()
+			log.Warn("error connecting to upstream", slog.String("upstream", s.upstreamAddr), logging.Err(err))
+			s.closeProxy(pc)
+			return
+		}
+		pc.connected = true
+		log.Debug("upstream connected", slog.String("upstream", s.upstreamAddr))
+	}
+
+	err := pc.up.move()
+	if err == nil {
+		err = pc.down.move()
+	}
+	if err == nil && events&unix.EPOLLERR != 0 {
+		err = sockErr(fd)
+	}
+	if err != nil {
+		// a reset or a write to a closed peer is how most proxied connections end
+		if errors.Is(err, unix.ECONNRESET) || errors.Is(err, unix.EPIPE) {
+			log.Debug("proxied connection reset", logging.Err(err))
+		} else {
+			log.Warn("error relaying", logging.Err(err))
+		}
+		s.closeProxy(pc)
+		return
+	}
+	if pc.up.shut && pc.down.shut {
+		s.closeProxy(pc)
+	}
+}
+
+func sockErr(fd int) error {
+	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return unix.Errno(errno)
+	}
+	return nil
+}
+
+func (s *EchoServer) closeProxy(pc *proxyConn) {
+	delete(s.proxied, pc.client)
+	delete(s.proxied, pc.upstream)
+	unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_DEL, pc.upstream, nil)
+	pc.release()
+	s.closeClient(pc.client)
+}
+
+// release closes everything pc holds but the client, closeClient has that.
+func (pc *proxyConn) release() {
+	unix.Close(pc.upstream)
+	pc.up.release()
+	pc.down.release()
+}
+
+func (d *relayDir) initPipe() error {
+	if err := unix.Pipe2(d.pipe[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		d.pipe = [2]int{-1, -1}
+		return fmt.Errorf("pipe2: %w", err)
+	}
+	size, err := unix.FcntlInt(uintptr(d.pipe[0]), unix.F_GETPIPE_SZ, 0)
+	if err != nil {
+		d.release()
+		return fmt.Errorf("fcntl F_GETPIPE_SZ: %w", err)
+	}
+	d.pipeSize = size
+	return nil
+}
+
+func (d *relayDir) initCopy(segSize int) {
+	d.buf = ringbuf.New(bufferPool, segSize, RELAYLIMIT)
+}
+
+func (d *relayDir) release() {
+	for i, fd := range d.pipe {
+		if fd >= 0 {
+			unix.Close(fd)
+			d.pipe[i] = -1
+		}
+	}
+	if d.buf != nil {
+		d.buf.Release()
+	}
+}
+
+func (d *relayDir) pending() int {
+	if d.buf != nil {
+		return d.buf.Len()
+	}
+	return d.piped
+}
+
+// move writes what is pending and reads more, until neither gets anywhere, so every socket
+// it stops on has said EAGAIN or is waiting for the other to drain. Once from is done and
+// everything is written to is shut down for writing, its peer reads EOF while it may still
+// answer the other way.
+//
+// Splicing, a pipe full of small segments refuses more before it holds pipeSize bytes and
+// says EAGAIN like an empty socket would, the loop tries the socket again after writing.
+func (d *relayDir) move() error {
+	for {
+		progress := false
+		if d.pending() > 0 {
+			n, err := d.write()
+			if err != nil {
+				return err
+			}
+			d.relayed.Add(n)
+			progress = n > 0
+		}
+		if !d.eof {
+			n, err := d.read()
+			if err == io.EOF {
+				d.eof, progress = true, true
+			} else if err != nil {
+				return err
+			}
+			progress = progress || n > 0
+		}
+		if d.eof && d.pending() == 0 && !d.shut {
+			d.shut = true
+			// the peer may be gone already, then the other direction hears about it
+			unix.Shutdown(d.to, unix.SHUT_WR)
+		}
+		if !progress {
+			return nil
+		}
+	}
+}
+
+const spliceFlags = unix.SPLICE_F_MOVE | unix.SPLICE_F_NONBLOCK
+
+func (d *relayDir) read() (int, error) {
+	if d.buf != nil {
+		n, err := d.buf.ReadFromFd(d.from)
+		if err == ringbuf.ErrFull {
+			err = nil
+		}
+		return n, err
+	}
+	room := d.pipeSize - d.piped
+	if room == 0 {
+		return 0, nil
+	}
+	for {
+		n, err := unix.Splice(d.from, nil, d.pipe[1], nil, room, spliceFlags)
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, io.EOF
+		}
+		d.piped += int(n)
+		return int(n), nil
+	}
+}
+
+func (d *relayDir) write() (int, error) {
+	if d.buf != nil {
+		return d.buf.WriteToFd(d.to)
+	}
+	for {
+		n, err := unix.Splice(d.pipe[0], nil, d.to, nil, d.piped, spliceFlags)
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		d.piped -= int(n)
+		return int(n), nil
+	}
+}
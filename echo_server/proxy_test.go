@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+)
+
+// forEachRelay runs f with a proxy relaying by splice and by copy, on both trigger modes.
+func forEachRelay(t *testing.T, f func(t *testing.T, opts EchoServerOpts)) {
+	for _, relay := range []Relay{Splice, Copy} {
+		for _, trigger := range []loop.Trigger{loop.Level, loop.Edge} {
+			t.Run(string(relay)+"-"+string(trigger), func(t *testing.T) {
+				f(t, EchoServerOpts{Relay: relay, Trigger: trigger})
+			})
+		}
+	}
+}
+
+// startProxy runs a proxy in front of upstream.
+func startProxy(t *testing.T, opts EchoServerOpts, upstream string) *EchoServer {
+	t.Helper()
+	opts.Upstream = upstream
+	return startEchoServer(t, opts)
+}
+
+// listenUpstream runs serve on every connection to a loopback listener.
+func listenUpstream(t *testing.T, serve func(c net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// TestProxyRelays pushes more than a pipe and a buffer hold each way through the proxy to an
+// echo server, read slowly at first so the relay has to wait on its writer.
+func TestProxyRelays(t *testing.T) {
+	forEachRelay(t, func(t *testing.T, opts EchoServerOpts) {
+		echo := startEchoServer(t, EchoServerOpts{Trigger: opts.Trigger})
+		p := startProxy(t, opts, echo.Addr())
+		conn := dial(t, p.Addr())
+
+		data := bytes.Repeat([]byte("0123456789abcdef"), (4<<20)/16)
+		go conn.Write(data)
+		got := make([]byte, 0, len(data))
+		buf := make([]byte, 32<<10)
+		for len(got) < len(data) {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("after %d bytes: %v", len(got), err)
+			}
+			got = append(got, buf[:n]...)
+			if len(got) < 512<<10 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("relayed bytes differ")
+		}
+
+		var out strings.Builder
+		p.Metrics().WriteText(&out)
+		for _, want := range []string{
+			"echo_proxy_upstream_connects_total 1\n",
+			fmt.Sprintf("echo_proxy_upstream_bytes_total %d\n", len(data)),
+			fmt.Sprintf("echo_proxy_downstream_bytes_total %d\n", len(data)),
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("metrics missing %q", want)
+			}
+		}
+	})
+}
+
+// TestProxyHalfClose has an upstream that answers once it has read everything, the client's
+// shutdown has to reach it through the proxy and the answer come back after.
+func TestProxyHalfClose(t *testing.T) {
+	forEachRelay(t, func(t *testing.T, opts EchoServerOpts) {
+		upstream := listenUpstream(t, func(c net.Conn) {
+			n, _ := io.Copy(io.Discard, c)
+			fmt.Fprintf(c, "read %d bytes", n)
+		})
+		p := startProxy(t, opts, upstream)
+		conn := dial(t, p.Addr())
+
+		conn.Write(bytes.Repeat([]byte("x"), 200<<10))
+		conn.(*net.TCPConn).CloseWrite()
+		got, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("read %d bytes", 200<<10); string(got) != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+		waitActive(t, p, 0)
+	})
+}
+
+// TestProxyUpstreamRefuses closes the client when the upstream cannot be reached.
+func TestProxyUpstreamRefuses(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+	p := startProxy(t, EchoServerOpts{}, dead)
+
+	conn := dial(t, p.Addr())
+	conn.Write([]byte("anyone?"))
+	if n, err := conn.Read(make([]byte, 8)); err == nil {
+		t.Fatalf("read %d bytes from a dead upstream", n)
+	}
+	waitActive(t, p, 0)
+	if n := p.metrics.proxyConnectErrors.Value(); n != 1 {
+		t.Fatalf("%d connect errors", n)
+	}
+}
+
+// TestProxyUpstreamCloses resets the upstream side, the client hears about it.
+func TestProxyUpstreamCloses(t *testing.T) {
+	upstream := listenUpstream(t, func(c net.Conn) {
+		io.WriteString(c, "bye")
+		c.(*net.TCPConn).SetLinger(0)
+	})
+	p := startProxy(t, EchoServerOpts{}, upstream)
+
+	got, _ := io.ReadAll(dial(t, p.Addr()))
+	if len(got) > 3 {
+		t.Fatalf("got %q", got)
+	}
+	waitActive(t, p, 0)
+}
+
+func TestNewEchoServerProxyErrors(t *testing.T) {
+	for _, opts := range []EchoServerOpts{
+		{Upstream: "localhost:9000"},
+		{Upstream: "127.0.0.1"},
+		{Upstream: "127.0.0.1:0"},
+		{Upstream: "127.0.0.1:9000", Relay: "sendfile"},
+	} {
+		opts.Addr = "127.0.0.1"
+		if s, err := NewEchoServer(&opts); err == nil {
+			s.Close()
+			t.Errorf("no error for %+v", opts)
+		}
+	}
+}
+
+// waitActive waits for the server to have n clients, the loop closes them after the test sees EOF.
+func waitActive(t *testing.T, s *EchoServer, n float64) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); s.metrics.active.Value() != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v connections open, want %v", s.metrics.active.Value(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/ringbuf"
+	"golang.org/x/sys/unix"
+)
+
+// Protocol is what the server does with a connection or a datagram.
+type Protocol string
+
+const (
+	Echo    Protocol = "echo"    // RFC 862, everything read is sent back
+	Discard Protocol = "discard" // RFC 863, everything read is dropped
+	Chargen Protocol = "chargen" // RFC 864, lines of characters for as long as the client reads
+	Daytime Protocol = "daytime" // RFC 867, the time as text, then close
+)
+
+// ParseProtocol accepts echo, discard, chargen or daytime.
+func ParseProtocol(s string) (Protocol, error) {
+	switch Protocol(s) {
+	case Echo, Discard, Chargen, Daytime:
+		return Protocol(s), nil
+	}
+	return "", fmt.Errorf("unknown protocol %q, want echo, discard, chargen or daytime", s)
+}
+
+// Service is a port the server answers on besides EchoServerOpts.Port, with its protocol.
+type Service struct {
+	Protocol Protocol
+	Port     int // 0 picks a free port, see EchoServer.ServiceAddr
+}
+
+// listener is a listening tcp socket or a bound udp one.
+type listener struct {
+	fd    int
+	proto Protocol
+	udp   bool
+	proxy bool // connections go to EchoServerOpts.Upstream
+}
+
+// conn is a client connected to the epoll loop.
+type conn struct {
+	peer   string
+	proto  Protocol
+	events uint32 // what epoll waits for, see EchoServer.arm
+
+	out    *ringbuf.Buffer // echoed bytes the client has yet to take, nil while there are none
+	readAt time.Time       // when out last went from empty to not
+	eof    bool            // the client is done sending, close once out is written
+
+	off int // where chargen goes on in chargenPattern
+}
+
+// connEvents is what a connection of proto waits for, chargen writes whenever there is room.
+func connEvents(proto Protocol) uint32 {
+	if proto == Chargen {
+		return eventTypes | unix.EPOLLOUT
+	}
+	return eventTypes
+}
+
+const (
+	CHARGENLINE   = 72 // characters per line, and a CRLF
+	chargenChars  = 95 // printable ascii, ' ' to '~'
+	chargenPeriod = chargenChars * (CHARGENLINE + 2)
+)
+
+// chargenPattern is the RFC 864 pattern twice over, line i starts at character i, so any
+// offset in the first period has a full period after it to write in one go.
+var chargenPattern = func() []byte {
+	p := make([]byte, 0, 2*chargenPeriod)
+	for range 2 {
+		for line := range chargenChars {
+			for i := range CHARGENLINE {
+				p = append(p, byte(' '+(line+i)%chargenChars))
+			}
+			p = append(p, '\r', '\n')
+		}
+	}
+	return p
+}()
+
+// daytime is the RFC 867 answer, the format is up to the server.
+func daytime() []byte {
+	return time.Now().AppendFormat(nil, "Monday, January 2, 2006 15:04:05-MST\r\n")
+}
+
+// discard reads and drops, until EAGAIN when edge triggered and loop.LEVELREADS times when
+// level triggered.
+func (s *EchoServer) discard(fd int) {
+	buf := bufferPool.Get(s.bufSize)
+	defer bufferPool.Put(buf)
+	reads := s.trigger.Reads()
+	for i := 0; reads == 0 || i < reads; i++ {
+		n, err := unix.Read(fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if err != unix.EAGAIN {
+				s.connLog(fd).Warn("error reading from connection", logging.Err(err))
+				s.closeClient(fd)
+			}
+			return
+		}
+		if n == 0 {
+			s.closeClient(fd)
+			return
+		}
+		s.metrics.bytesRead.Add(n)
+	}
+}
+
+// chargen handles a chargen connection. Whatever the client sends is dropped, and it gets the
+// pattern for as long as its socket has room, EPOLLOUT says when it has some again: until
+// EAGAIN when edge triggered, loop.LEVELREADS writes when level triggered, a client reading
+// as fast as it can then shares the loop with the others. It ends when the client closes or
+// shuts down its side.
+func (s *EchoServer) chargen(fd int, c *conn, events uint32) {
+	if events&(unix.EPOLLIN|unix.EPOLLRDHUP) != 0 {
+		if s.discard(fd); s.conns[fd] != c {
+			return
+		}
+		if events&unix.EPOLLRDHUP != 0 {
+			s.closeClient(fd)
+			return
+		}
+	}
+	if events&unix.EPOLLOUT == 0 {
+		return
+	}
+	writes := s.trigger.Reads()
+	for i := 0; writes == 0 || i < writes; i++ {
+		n, err := unix.Write(fd, chargenPattern[c.off:c.off+chargenPeriod])
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if err != unix.EAGAIN {
+				s.connLog(fd).Debug("chargen client gone", logging.Err(err))
+				s.closeClient(fd)
+			}
+			return
+		}
+		c.off = (c.off + n) % chargenPeriod
+		s.metrics.bytesWritten.Add(n)
+	}
+}
+
+// answerDatagram turns datagram i of the batch into the reply proto sends, echo leaves it as
+// it is. Chargen answers each with the next line of the pattern.
+func (s *EchoServer) answerDatagram(proto Protocol, i int) {
+	b := s.batch
+	switch proto {
+	case Chargen:
+		off := s.chargenLine * (CHARGENLINE + 2)
+		s.chargenLine = (s.chargenLine + 1) % chargenChars
+		b.SetLen(i, copy(b.Data(i)[:cap(b.Data(i))], chargenPattern[off:off+CHARGENLINE+2]))
+	case Daytime:
+		b.SetLen(i, copy(b.Data(i)[:cap(b.Data(i))], daytime()))
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+)
+
+// startServices runs a server with discard, chargen and daytime beside echo.
+func startServices(t *testing.T, opts EchoServerOpts) *EchoServer {
+	t.Helper()
+	opts.Services = []Service{{Protocol: Discard}, {Protocol: Chargen}, {Protocol: Daytime}}
+	return startEchoServer(t, opts)
+}
+
+func TestChargenPattern(t *testing.T) {
+	lines := strings.Split(string(chargenPattern), "\r\n")
+	if len(lines) != 2*chargenChars+1 {
+		t.Fatalf("%d lines", len(lines))
+	}
+	if lines[0] != ` !"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\]^_`+"`"+`abcdefg` {
+		t.Fatalf("first line %q", lines[0])
+	}
+	for i, line := range lines[:2*chargenChars] {
+		if len(line) != CHARGENLINE || line[0] != byte(' '+i%chargenChars) {
+			t.Fatalf("line %d: %q", i, line)
+		}
+	}
+}
+
+// TestChargen reads slowly first, the server may only write as the socket drains, and then
+// fast, what arrives has to be the pattern without a gap either way.
+func TestChargen(t *testing.T) {
+	forEachLoop(t, func(t *testing.T, opts EchoServerOpts) {
+		if opts.Backend == loop.Uring {
+			t.Skip("services are epoll only")
+		}
+		s := startServices(t, opts)
+		conn := dial(t, s.ServiceAddr(Chargen))
+
+		const want = 4 << 20
+		got := make([]byte, 0, want)
+		buf := make([]byte, 16<<10)
+		for len(got) < want {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("after %d bytes: %v", len(got), err)
+			}
+			got = append(got, buf[:n]...)
+			if len(got) < 256<<10 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		for off := 0; off < len(got); off += chargenPeriod {
+			end := min(off+chargenPeriod, len(got))
+			if !bytes.Equal(got[off:end], chargenPattern[:end-off]) {
+				t.Fatalf("pattern broken in the period at %d", off)
+			}
+		}
+
+		// the connection ends when the client does
+		conn.Close()
+		waitActive(t, s, 0)
+	})
+}
+
+func TestDiscardAndDaytime(t *testing.T) {
+	forEachNetwork(t, func(t *testing.T, network Network) {
+		s := startServices(t, EchoServerOpts{Network: network})
+
+		if network == TCP {
+			conn := dial(t, s.ServiceAddr(Discard))
+			conn.Write(bytes.Repeat([]byte("x"), 100<<10))
+			waitFor(t, "bytes discarded", func() bool { return s.metrics.bytesRead.Value() == 100<<10 })
+			conn.Close()
+			waitActive(t, s, 0)
+
+			day, err := io.ReadAll(dial(t, s.ServiceAddr(Daytime)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkDaytime(t, day)
+			return
+		}
+
+		conn := dialUDP(t, s.ServiceAddr(Discard))
+		conn.Write([]byte("into the void"))
+		waitFor(t, "datagram discarded", func() bool { return s.metrics.datagramsRead.Value() == 1 })
+		if s.metrics.datagramsWritten.Value() != 0 {
+			t.Fatal("discard answered")
+		}
+
+		conn = dialUDP(t, s.ServiceAddr(Daytime))
+		conn.Write(nil)
+		buf := make([]byte, 128)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDaytime(t, buf[:n])
+
+		conn = dialUDP(t, s.ServiceAddr(Chargen))
+		for line := range 3 {
+			conn.Write([]byte("more"))
+			n, err := conn.Read(buf)
+			off := line * (CHARGENLINE + 2)
+			if err != nil || !bytes.Equal(buf[:n], chargenPattern[off:off+CHARGENLINE+2]) {
+				t.Fatalf("chargen datagram %d: %q, %v", line, buf[:n], err)
+			}
+		}
+	})
+}
+
+func checkDaytime(t *testing.T, day []byte) {
+	t.Helper()
+	got, err := time.Parse("Monday, January 2, 2006 15:04:05-MST\r\n", string(day))
+	if err != nil {
+		t.Fatalf("daytime %q: %v", day, err)
+	}
+	if d := time.Since(got); d < -time.Minute || d > time.Minute {
+		t.Fatalf("daytime %q is off by %v", day, d)
+	}
+}
+
+func forEachNetwork(t *testing.T, f func(t *testing.T, network Network)) {
+	for _, network := range []Network{TCP, UDP} {
+		t.Run(string(network), func(t *testing.T) { f(t, network) })
+	}
+}
+
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !ok(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewEchoServerServiceErrors(t *testing.T) {
+	opts := EchoServerOpts{Addr: "127.0.0.1", Services: []Service{{Protocol: "qotd"}}}
+	if s, err := NewEchoServer(&opts); err == nil {
+		s.Close()
+		t.Error("no error for an unknown protocol")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"golang.org/x/sys/unix"
+)
+
+// Network is what the echo server listens for.
+type Network string
+
+const (
+	TCP  Network = "tcp"
+	UDP  Network = "udp"
+	Both Network = "both" // tcp and udp on the same port
+)
+
+// ParseNetwork accepts tcp, udp or both. An empty s gives an empty Network, the server then
+// picks its own default.
+func ParseNetwork(s string) (Network, error) {
+	switch Network(s) {
+	case "":
+		return "", nil
+	case TCP, UDP, Both:
+		return Network(s), nil
+	}
+	return "", fmt.Errorf("unknown network %q, want tcp, udp or both", s)
+}
+
+const (
+	UDPBATCH       = 32    // datagrams per recvmmsg and sendmmsg
+	UDPMAXDATAGRAM = 65507 // the most an ipv4 datagram carries, no datagram is cut short
+)
+
+// bindUDP binds l's datagram socket to port.
+func (s *EchoServer) bindUDP(l *listener, port int) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("udp socket: %w", err)
+	}
+	l.fd = fd
+	addr := s.addr
+	addr.Port = port
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return fmt.Errorf("setsockopt SO_REUSEADDR: %w", err)
+	}
+	if err := unix.Bind(fd, &addr); err != nil {
+		return fmt.Errorf("udp bind: %w", err)
+	}
+	return nil
+}
+
+// datagrams answers every datagram to where it came from, a batch at a time, until EAGAIN
+// when edge triggered and loop.LEVELREADS batches when level triggered. Datagrams the socket
+// has no room for are dropped, as udp would, and discard answers none.
+func (s *EchoServer) datagrams(l *listener) {
+	b := s.batch
+	reads := s.trigger.Reads()
+	for i := 0; reads == 0 || i < reads; i++ {
+		n, err := b.Recv(l.fd)
+		if err != nil {
+			s.log.Warn("error receiving datagrams", logging.Err(err))
+			return
+		}
+		if n == 0 {
+			return
+		}
+		readAt := time.Now()
+		s.metrics.datagramsRead.Add(n)
+		for j := range n {
+			s.metrics.bytesRead.Add(len(b.Data(j)))
+			s.answerDatagram(l.proto, j)
+		}
+		if l.proto == Discard {
+			continue
+		}
+
+		for sent := 0; sent < n; {
+			k, err := b.Send(l.fd, sent)
+			if err != nil {
+				// sendmmsg fails on the first datagram it cannot send, skip that one
+				s.log.Debug("error answering datagram", slog.String("peer", b.Peer(sent).String()), logging.Err(err))
+				s.metrics.datagramsDropped.Inc()
+				sent++
+				continue
+			}
+			if k == 0 {
+				s.metrics.datagramsDropped.Add(n - sent)
+				break
+			}
+			for j := sent; j < sent+k; j++ {
+				s.metrics.bytesWritten.Add(len(b.Data(j)))
+			}
+			s.metrics.datagramsWritten.Add(k)
+			sent += k
+		}
+		s.metrics.echoDuration.ObserveSince(readAt)
+		s.log.Debug("answered datagrams", slog.String("protocol", string(l.proto)), slog.Int("datagrams", n))
+	}
+}
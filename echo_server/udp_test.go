@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+)
+
+func dialUDP(t *testing.T, addr string) *net.UDPConn {
+	t.Helper()
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// TestEchoServerUDP has many clients send datagrams at once, each gets its own back, and
+// then the biggest a datagram gets on its own, many of those would overflow the socket.
+func TestEchoServerUDP(t *testing.T) {
+	for _, trigger := range []loop.Trigger{loop.Level, loop.Edge} {
+		t.Run(string(trigger), func(t *testing.T) {
+			s := startEchoServer(t, EchoServerOpts{Network: UDP, Trigger: trigger})
+
+			const clients, each = 8, 2 * UDPBATCH
+			errC := make(chan error, clients)
+			for i := range clients {
+				conn := dialUDP(t, s.Addr())
+				go func() {
+					buf := make([]byte, 64)
+					for j := range each {
+						msg := fmt.Appendf(nil, "client %d datagram %d", i, j)
+						conn.Write(msg)
+						n, err := conn.Read(buf)
+						if err != nil {
+							errC <- fmt.Errorf("client %d datagram %d: %w", i, j, err)
+							return
+						}
+						if !bytes.Equal(buf[:n], msg) {
+							errC <- fmt.Errorf("client %d got %d bytes back for %d", i, n, len(msg))
+							return
+						}
+					}
+					errC <- nil
+				}()
+			}
+			for range clients {
+				if err := <-errC; err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := s.metrics.datagramsWritten.Value(); n != clients*each {
+				t.Fatalf("echoed %d datagrams, want %d", n, clients*each)
+			}
+
+			conn := dialUDP(t, s.Addr())
+			msg := bytes.Repeat([]byte("0123456789"), UDPMAXDATAGRAM/10)
+			conn.Write(msg)
+			buf := make([]byte, UDPMAXDATAGRAM+1)
+			if n, err := conn.Read(buf); err != nil || !bytes.Equal(buf[:n], msg) {
+				t.Fatalf("got %d bytes back for %d: %v", n, len(msg), err)
+			}
+		})
+	}
+}
+
+// TestEchoServerBoth echoes tcp and udp on the one port, a port 0 server included.
+func TestEchoServerBoth(t *testing.T) {
+	s := startEchoServer(t, EchoServerOpts{Network: Both})
+
+	tcp := dial(t, s.Addr())
+	udp := dialUDP(t, s.Addr())
+	tcp.Write([]byte("stream"))
+	udp.Write([]byte("datagram"))
+	got := make([]byte, 64)
+	if _, err := io.ReadFull(tcp, got[:6]); err != nil || string(got[:6]) != "stream" {
+		t.Fatalf("tcp got %q, %v", got[:6], err)
+	}
+	if n, err := udp.Read(got); err != nil || string(got[:n]) != "datagram" {
+		t.Fatalf("udp got %q, %v", got[:n], err)
+	}
+
+	// the loop counts a datagram once sendmmsg is back, the client may have it before that
+	waitFor(t, "the datagram counted", func() bool { return s.metrics.datagramsWritten.Value() == 1 })
+	var out strings.Builder
+	s.Metrics().WriteText(&out)
+	for _, want := range []string{
+		"echo_connections_accepted_total 1\n",
+		"echo_datagrams_received_total 1\n",
+		"echo_read_bytes_total 14\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestNewEchoServerNetworkErrors(t *testing.T) {
+	for _, opts := range []EchoServerOpts{
+		{Network: "sctp"},
+		{Network: UDP, Upstream: "127.0.0.1:9000"},
+	} {
+		opts.Addr = "127.0.0.1"
+		if s, err := NewEchoServer(&opts); err == nil {
+			s.Close()
+			t.Errorf("no error for %+v", opts)
+		}
+	}
+}
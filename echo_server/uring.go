@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/uring"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	URINGENTRIES = 1024
+	URINGBUFFERS = 1024 // provided recv buffers, EchoServerOpts.BufferSize each
+)
+
+// uringChunk is a received buffer waiting to be sent back.
+type uringChunk struct {
+	bid    uint16
+	n      int
+	readAt time.Time
+}
+
+// uringConn is a connection on the io_uring loop, its bytes are echoed straight out of the
+// buffer they were received in, one send in flight at a time so they go back in order.
+type uringConn struct {
+	gen     uint32
+	queue   []uringChunk
+	sending bool
+	eof     bool // recv ended, close once the queue is sent
+	closing bool // closed while a send was in flight, see uringLoop.close
+}
+
+type uringLoop struct {
+	s     *EchoServer
+	ring  *uring.Ring
+	bufs  *uring.BufRing
+	conns map[int]*uringConn
+	gen   uint32
+
+	starved []int // connections whose recv ran out of buffers, re-armed as buffers come back
+}
+
+// serveUring is Serve on io_uring: multishot accept, multishot recv into provided buffers
+// and a send per received chunk.
+func (s *EchoServer) serveUring() error {
+	ring, err := uring.New(URINGENTRIES)
+	if err != nil {
+		return fmt.Errorf("setting up io_uring: %w", err)
+	}
+	defer ring.Close()
+	bufs, err := ring.RegisterBufRing(0, URINGBUFFERS, s.bufSize)
+	if err != nil {
+		return fmt.Errorf("registering recv buffers: %w", err)
+	}
+	defer bufs.Close()
+
+	l := &uringLoop{s: s, ring: ring, bufs: bufs, conns: make(map[int]*uringConn)}
+	if err := l.armAccept(); err != nil {
+		return err
+	}
+	if err := l.armWake(); err != nil {
+		return err
+	}
+
+	for {
+		if err := ring.SubmitAndWait(); err != nil {
+			return fmt.Errorf("error waiting for completions: %w", err)
+		}
+		var stop bool
+		var loopErr error
+		n := ring.Completions(func(cqe *uring.CQE) {
+			if stop || loopErr != nil {
+				l.recycle(cqe)
+				return
+			}
+			stop, loopErr = l.complete(cqe)
+		})
+		s.metrics.wakeups.Inc()
+		s.metrics.eventsPerWakeup.Observe(float64(n))
+		if stop || loopErr != nil {
+			return loopErr
+		}
+	}
+}
+
+func (l *uringLoop) armAccept() error {
+	sqe, err := l.ring.GetSQE()
+	if err != nil {
+		return err
+	}
+	uring.PrepAcceptMultishot(sqe, l.s.Fd, unix.SOCK_CLOEXEC, uring.UserData(uring.OpAccept, l.s.Fd, 0))
+	return nil
+}
+
+func (l *uringLoop) armWake() error {
+	sqe, err := l.ring.GetSQE()
+	if err != nil {
+		return err
+	}
+	uring.PrepRead(sqe, l.s.wakeFd, l.s.uringWake[:], uring.UserData(uring.OpRead, l.s.wakeFd, 0))
+	return nil
+}
+
+func (l *uringLoop) armRecv(fd int, c *uringConn) error {
+	sqe, err := l.ring.GetSQE()
+	if err != nil {
+		return err
+	}
+	uring.PrepRecvMultishot(sqe, fd, l.bufs.Group(), uring.UserData(uring.OpRecv, fd, c.gen))
+	return nil
+}
+
+// recycle hands back the buffer of a completion nobody is going to read.
+func (l *uringLoop) recycle(cqe *uring.CQE) {
+	if bid, ok := cqe.BufferID(); ok {
+		l.bufs.Recycle(bid)
+	}
+}
+
+// complete handles one completion, stop is set when Close asked the loop to return.
+func (l *uringLoop) complete(cqe *uring.CQE) (stop bool, err error) {
+	op, fd, gen := uring.SplitUserData(cqe.UserData)
+	switch op {
+	case uring.OpRead:
+		return true, nil
+	case uring.OpAccept:
+		return false, l.accepted(cqe)
+	}
+
+	c, ok := l.conns[fd]
+	if !ok || c.gen != gen {
+		// a completion for a connection already closed, the fd may be someone else's by now
+		l.recycle(cqe)
+		return false, nil
+	}
+	switch op {
+	case uring.OpRecv:
+		return false, l.received(fd, c, cqe)
+	case uring.OpSend:
+		return false, l.sent(fd, c, cqe)
+	}
+	return false, nil
+}
+
+func (l *uringLoop) accepted(cqe *uring.CQE) error {
+	if cqe.Flags&uring.CqeMore == 0 {
+		if err := l.armAccept(); err != nil {
+			return err
+		}
+	}
+	if err := cqe.Err(); err != nil {
+		l.s.log.Error("error accepting connection", logging.Err(err))
+		return nil
+	}
+
+	fd := int(cqe.Res)
+	peer := "unknown"
+	if sa, err := unix.Getpeername(fd); err == nil {
+		peer = sockaddrString(sa)
+	}
+	l.gen++
+	c := &uringConn{gen: l.gen}
+	if err := l.armRecv(fd, c); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	l.conns[fd] = c
+	l.s.conns[fd] = &conn{peer: peer, proto: Echo}
+	l.s.connLog(fd).Debug("new connection")
+	l.s.metrics.accepted.Inc()
+	l.s.metrics.active.Inc()
+	return nil
+}
+
+func (l *uringLoop) received(fd int, c *uringConn, cqe *uring.CQE) error {
+	if c.closing {
+		l.recycle(cqe)
+		return nil
+	}
+	more := cqe.Flags&uring.CqeMore != 0
+	if err := cqe.Err(); err != nil {
+		if errors.Is(err, unix.ENOBUFS) {
+			// every buffer is waiting on a slow reader, try again once one comes back
+			l.starved = append(l.starved, fd)
+			return nil
+		}
+		l.s.connLog(fd).Warn("error reading from connection", logging.Err(err))
+		l.close(fd, c)
+		return nil
+	}
+	if cqe.Res == 0 {
+		c.eof = true
+		if !c.sending {
+			l.close(fd, c)
+		}
+		return nil
+	}
+
+	bid, _ := cqe.BufferID()
+	l.s.metrics.bytesRead.Add(int(cqe.Res))
+	c.queue = append(c.queue, uringChunk{bid: bid, n: int(cqe.Res), readAt: time.Now()})
+	if !more {
+		if err := l.armRecv(fd, c); err != nil {
+			return err
+		}
+	}
+	if !c.sending {
+		return l.send(fd, c)
+	}
+	return nil
+}
+
+func (l *uringLoop) send(fd int, c *uringConn) error {
+	sqe, err := l.ring.GetSQE()
+	if err != nil {
+		return err
+	}
+	chunk := c.queue[0]
+	uring.PrepSend(sqe, fd, l.bufs.Buffer(chunk.bid, chunk.n), uring.UserData(uring.OpSend, fd, c.gen))
+	c.sending = true
+	return nil
+}
+
+func (l *uringLoop) sent(fd int, c *uringConn, cqe *uring.CQE) error {
+	c.sending = false
+	chunk := c.queue[0]
+	c.queue = c.queue[1:]
+	l.giveBack(chunk.bid)
+	if c.closing {
+		l.close(fd, c)
+		return nil
+	}
+
+	if cqe.Res > 0 {
+		l.s.metrics.bytesWritten.Add(int(cqe.Res))
+	}
+	if err := cqe.Err(); err != nil || int(cqe.Res) != chunk.n {
+		l.s.connLog(fd).Warn("error writing to connection", logging.Err(err), slog.Int("sent", int(cqe.Res)))
+		l.close(fd, c)
+		return nil
+	}
+	l.s.metrics.echoDuration.ObserveSince(chunk.readAt)
+	l.s.connLog(fd).Debug("echoed", logging.Bytes(chunk.n))
+
+	if len(c.queue) > 0 {
+		return l.send(fd, c)
+	}
+	if c.eof {
+		l.close(fd, c)
+	}
+	return nil
+}
+
+// giveBack recycles a buffer and wakes a connection that was waiting for one.
+func (l *uringLoop) giveBack(bid uint16) {
+	l.bufs.Recycle(bid)
+	for len(l.starved) > 0 {
+		fd := l.starved[0]
+		l.starved = l.starved[1:]
+		if c, ok := l.conns[fd]; ok {
+			l.armRecv(fd, c)
+			return
+		}
+	}
+}
+
+// close drops the connection. A recv still armed ends with the shutdown and its completion
+// finds no connection, a send still in flight holds the fd open until it completes, so the
+// fd cannot be handed to a new connection while the kernel still has the old one's buffer.
+func (l *uringLoop) close(fd int, c *uringConn) {
+	unix.Shutdown(fd, unix.SHUT_RDWR)
+	if c.sending {
+		c.closing = true
+		return
+	}
+	for _, chunk := range c.queue {
+		l.giveBack(chunk.bid)
+	}
+	delete(l.conns, fd)
+	l.s.closeClient(fd)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	server "github.com/toastsandwich/epoll-learn/http1.0_server"
+	"github.com/toastsandwich/epoll-learn/pkg/accesslog"
+	"github.com/toastsandwich/epoll-learn/pkg/config"
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+)
+
+// Config is everything the server can be told, in a -config file or by flag, see
+// -print-config for the keys and defaults.
+type Config struct {
+	Listen struct {
+		Addr string `config:"addr" flag:"addr" help:"ipv4 address to listen on"`
+		Port int    `config:"port" flag:"port" help:"port to listen on"`
+	} `config:"listen"`
+	Admin struct {
+		Addr string `config:"addr" flag:"admin-addr" help:"ipv4 address serving /metrics"`
+		Port int    `config:"port" flag:"admin-port" help:"port serving /metrics"`
+		// owner only, see package control
+		Socket string `config:"socket" flag:"admin-socket" help:"unix socket taking control commands, empty for none"`
+	} `config:"admin"`
+
+	Timeouts struct {
+		Read  time.Duration `config:"read" flag:"read-timeout" reload:"live" help:"how long a connection may wait for its next request, 0 for no limit"`
+		Write time.Duration `config:"write" flag:"write-timeout" reload:"live" help:"how long a queued response may go without being written, 0 for no limit"`
+		Drain time.Duration `config:"drain" flag:"drain-timeout" reload:"live" help:"how long an upgraded process lets connections finish"`
+	} `config:"timeouts"`
+
+	Loop struct {
+		Backend loop.Backend `config:"backend" flag:"backend" help:"event loop, epoll or io_uring"`
+		Trigger loop.Trigger `config:"trigger" flag:"trigger" help:"epoll trigger mode, edge or level"`
+		OneShot bool         `config:"oneshot" flag:"oneshot" help:"register connections with EPOLLONESHOT, re-armed once handled"`
+		Pollers int          `config:"pollers" flag:"pollers" help:"goroutines waiting on epoll, more than 1 needs -oneshot"`
+		Workers int          `config:"workers" flag:"workers" help:"goroutines running handlers, 0 for one per cpu"`
+	} `config:"loop"`
+
+	Buffers struct {
+		ReadLimit      int `config:"read_limit" flag:"read-buffer-limit" help:"largest request in bytes, 0 for the default"`
+		WriteLimit     int `config:"write_limit" flag:"write-buffer-limit" help:"most unsent response bytes per connection, 0 for the default"`
+		WriteHighWater int `config:"write_high_water" flag:"write-high-water" help:"unsent bytes that stop reading a connection, 0 for the default"`
+		WriteLowWater  int `config:"write_low_water" flag:"write-low-water" help:"unsent bytes that resume reading it, 0 for the default"`
+	} `config:"buffers"`
+
+	Limits struct {
+		MaxConns  int            `config:"max_conns" flag:"max-conns" reload:"live" help:"most open connections, 0 for no limit"`
+		OverLimit loop.OverLimit `config:"over_limit" flag:"over-limit" reload:"live" help:"past -max-conns, reject with a 503 or pause accepting"`
+	} `config:"limits"`
+
+	Proxy struct {
+		Prefix    string         `config:"prefix" flag:"proxy-prefix" help:"path prefix forwarded to the upstreams, empty for none"`
+		Upstreams string         `config:"upstreams" flag:"proxy-upstreams" help:"comma separated ipv4 host:port upstreams"`
+		Balance   server.Balance `config:"balance" flag:"proxy-balance" help:"round_robin or least_conns"`
+		Timeout   time.Duration  `config:"timeout" flag:"proxy-timeout" help:"how long an upstream has to answer"`
+		MaxIdle   int            `config:"max_idle" flag:"proxy-max-idle" help:"idle connections kept per upstream, 0 for the default"`
+	} `config:"proxy"`
+
+	AccessLog struct {
+		Path    string           `config:"path" flag:"access-log" help:"file getting a line per request, empty for none"`
+		Format  accesslog.Format `config:"format" flag:"access-log-format" help:"common, combined or json"`
+		MaxSize int              `config:"max_size" flag:"access-log-max-size" help:"bytes before the file is rotated, 0 never rotates"`
+		Backups int              `config:"backups" flag:"access-log-backups" help:"rotated files kept, 0 for the default"`
+	} `config:"access_log"`
+
+	TLS config.TLS `config:"tls"`
+	Log config.Log `config:"log"`
+}
+
+func defaultConfig() Config {
+	var c Config
+	c.Listen.Addr, c.Listen.Port = "0.0.0.0", 8080
+	c.Admin.Addr, c.Admin.Port = "127.0.0.1", 9100
+	c.Admin.Socket = "/tmp/epoll-learn-http.sock"
+	c.Timeouts.Read, c.Timeouts.Write = time.Second, time.Second
+	c.Timeouts.Drain = 30 * time.Second
+	c.Loop.Backend, c.Loop.Trigger = loop.Epoll, loop.Edge
+	c.Loop.Pollers = 1
+	c.Limits.OverLimit = loop.Reject
+	c.Proxy.Balance = server.RoundRobin
+	c.Proxy.Timeout = server.PROXYTIMEOUT
+	c.AccessLog.Format = accesslog.Combined
+	c.AccessLog.MaxSize = 100 << 20
+	c.AccessLog.Backups = accesslog.BACKUPS
+	c.Log.Format = "text"
+	return c
+}
+
+func (c *Config) Validate() error {
+	for _, err := range []error{
+		config.Addr("listen.addr", c.Listen.Addr),
+		config.Port("listen.port", c.Listen.Port),
+		config.Addr("admin.addr", c.Admin.Addr),
+		config.Port("admin.port", c.Admin.Port),
+		config.NotNegative("loop.workers", c.Loop.Workers),
+		config.NotNegative("buffers.read_limit", c.Buffers.ReadLimit),
+		config.NotNegative("buffers.write_limit", c.Buffers.WriteLimit),
+		config.NotNegative("buffers.write_high_water", c.Buffers.WriteHighWater),
+		config.NotNegative("buffers.write_low_water", c.Buffers.WriteLowWater),
+		config.NotNegative("limits.max_conns", c.Limits.MaxConns),
+		config.NotNegative("proxy.max_idle", c.Proxy.MaxIdle),
+		config.NotNegative("access_log.max_size", c.AccessLog.MaxSize),
+		config.NotNegative("access_log.backups", c.AccessLog.Backups),
+		c.TLS.Validate(),
+		c.Log.Validate(),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	for key, d := range map[string]time.Duration{
+		"timeouts.read": c.Timeouts.Read, "timeouts.write": c.Timeouts.Write, "timeouts.drain": c.Timeouts.Drain,
+	} {
+		if d < 0 {
+			return config.Errorf(key, "%v, want 0 or more", d)
+		}
+	}
+	if _, err := loop.ParseBackend(string(c.Loop.Backend)); err != nil {
+		return config.Errorf("loop.backend", "%v", err)
+	}
+	if _, err := loop.ParseTrigger(string(c.Loop.Trigger)); err != nil {
+		return config.Errorf("loop.trigger", "%v", err)
+	}
+	if c.Loop.Pollers < 1 {
+		return config.Errorf("loop.pollers", "%d, want 1 or more", c.Loop.Pollers)
+	}
+	if c.Loop.Pollers > 1 && !c.Loop.OneShot {
+		return config.Errorf("loop.pollers", "%d pollers need loop.oneshot", c.Loop.Pollers)
+	}
+	// the server checks these again with its defaults filled in, these name the key
+	b := c.Buffers
+	if b.WriteLowWater != 0 && b.WriteHighWater != 0 && b.WriteLowWater >= b.WriteHighWater {
+		return config.Errorf("buffers.write_low_water", "%d, want below buffers.write_high_water %d", b.WriteLowWater, b.WriteHighWater)
+	}
+	if b.WriteHighWater != 0 && b.WriteLimit != 0 && b.WriteHighWater > b.WriteLimit {
+		return config.Errorf("buffers.write_high_water", "%d, want at most buffers.write_limit %d", b.WriteHighWater, b.WriteLimit)
+	}
+	if _, err := loop.ParseOverLimit(string(c.Limits.OverLimit)); err != nil {
+		return config.Errorf("limits.over_limit", "%v", err)
+	}
+	if _, err := server.ParseBalance(string(c.Proxy.Balance)); err != nil {
+		return config.Errorf("proxy.balance", "%v", err)
+	}
+	if c.Proxy.Timeout < 0 {
+		return config.Errorf("proxy.timeout", "%v, want 0 or more", c.Proxy.Timeout)
+	}
+	if c.Proxy.Prefix != "" {
+		if !strings.HasPrefix(c.Proxy.Prefix, "/") {
+			return config.Errorf("proxy.prefix", "%q, want a path starting with /", c.Proxy.Prefix)
+		}
+		if c.Loop.Backend != loop.Epoll {
+			return config.Errorf("proxy.prefix", "the proxy needs loop.backend epoll")
+		}
+		if len(c.upstreams()) == 0 {
+			return config.Errorf("proxy.upstreams", "none to proxy %s to", c.Proxy.Prefix)
+		}
+		for _, up := range c.upstreams() {
+			if ap, err := netip.ParseAddrPort(up); err != nil || !ap.Addr().Is4() {
+				return config.Errorf("proxy.upstreams", "%q, want an ipv4 host:port", up)
+			}
+		}
+	}
+	if _, err := accesslog.ParseFormat(string(c.AccessLog.Format)); err != nil {
+		return config.Errorf("access_log.format", "%v", err)
+	}
+	return nil
+}
+
+func (c *Config) upstreams() []string {
+	var ups []string
+	for up := range strings.SplitSeq(c.Proxy.Upstreams, ",") {
+		if up = strings.TrimSpace(up); up != "" {
+			ups = append(ups, up)
+		}
+	}
+	return ups
+}
+
+// proxyOpts returns the proxy options, nil when nothing is proxied.
+func (c *Config) proxyOpts() *server.ProxyOpts {
+	if c.Proxy.Prefix == "" {
+		return nil
+	}
+	return &server.ProxyOpts{
+		Upstreams: c.upstreams(),
+		Balance:   c.Proxy.Balance,
+		Timeout:   c.Proxy.Timeout,
+		MaxIdle:   c.Proxy.MaxIdle,
+	}
+}
+
+// openAccessLog opens the access log file, nil when there is none.
+func (c *Config) openAccessLog(log *slog.Logger) (*accesslog.File, error) {
+	if c.AccessLog.Path == "" {
+		return nil, nil
+	}
+	return accesslog.OpenFile(c.AccessLog.Path, accesslog.FileOpts{
+		MaxSize: int64(c.AccessLog.MaxSize),
+		Backups: c.AccessLog.Backups,
+		Logger:  log,
+	})
+}
+
+// opts returns the server options for c, listenFd is 0 to bind.
+func (c *Config) opts(listenFd int) *server.HTTPServerOpts {
+	return &server.HTTPServerOpts{
+		Addr:     c.Listen.Addr,
+		Port:     c.Listen.Port,
+		ListenFd: listenFd,
+
+		ReadTimeout:  c.Timeouts.Read,
+		WriteTimeout: c.Timeouts.Write,
+
+		Workers: c.Loop.Workers,
+		Backend: c.Loop.Backend,
+		Trigger: c.Loop.Trigger,
+		OneShot: c.Loop.OneShot,
+		Pollers: c.Loop.Pollers,
+
+		ReadBufferLimit:  c.Buffers.ReadLimit,
+		WriteBufferLimit: c.Buffers.WriteLimit,
+		WriteHighWater:   c.Buffers.WriteHighWater,
+		WriteLowWater:    c.Buffers.WriteLowWater,
+
+		MaxConns:  c.Limits.MaxConns,
+		OverLimit: c.Limits.OverLimit,
+	}
+}
+
+// reload reads the config again on SIGHUP and applies what can change while serving, the
+// log level, timeouts and limits, all of it or none. Other changes are logged as needing
+// a restart and left as they were, cfg is what runs.
+func reload(src *config.Source, cfg *Config, s *server.HTTPServer, level *slog.LevelVar, log *slog.Logger) {
+	next := defaultConfig()
+	if err := src.Read(&next); err != nil {
+		log.Error("error reloading config, keeping the running one", logging.Err(err))
+		return
+	}
+	running := *cfg
+	applied, restart := config.Reload(&running, &next)
+	if len(restart) > 0 {
+		log.Warn("config changes need a restart", slog.Any("keys", restart))
+	}
+	if len(applied) == 0 {
+		log.Info("config reloaded, nothing to apply")
+		return
+	}
+	if err := s.Reload(running.opts(0)); err != nil {
+		log.Error("error applying config, keeping the running one", logging.Err(err))
+		return
+	}
+	level.Set(running.Log.Level)
+	*cfg = running
+	log.Info("config reloaded", slog.Any("applied", applied))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/config"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+)
+
+func readConfig(t *testing.T, file string, args ...string) (Config, error) {
+	t.Helper()
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "httpd.toml")
+		os.WriteFile(path, []byte(file), 0o600)
+		args = append([]string{"-config", path}, args...)
+	}
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("httpd", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	_, err := config.FromArgs(fs, args, &cfg)
+	return cfg, err
+}
+
+func TestConfig(t *testing.T) {
+	cfg, err := readConfig(t, `
+[listen]
+port = 8181
+[loop]
+oneshot = true
+pollers = 4
+[limits]
+over_limit = "pause"
+`, "-port", "8282", "-read-timeout", "5s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := cfg.opts(0)
+	if opts.Port != 8282 || opts.Pollers != 4 || !opts.OneShot || opts.OverLimit != loop.Pause ||
+		opts.ReadTimeout != 5*time.Second || opts.WriteTimeout != time.Second {
+		t.Fatalf("opts %+v", opts)
+	}
+}
+
+func TestConfigErrorsNameTheKey(t *testing.T) {
+	for _, tc := range []struct {
+		file string
+		args []string
+		key  string
+	}{
+		{"[loop]\npollers = 2\n", nil, "loop.pollers"},
+		{"[loop]\nbackend = \"kqueue\"\n", nil, "loop.backend"},
+		{"[listen]\naddr = \"localhost\"\n", nil, "listen.addr"},
+		{"[buffers]\nwrite_high_water = 100\nwrite_low_water = 100\n", nil, "buffers.write_low_water"},
+		{"", []string{"-admin-port", "70000"}, "admin.port"},
+		{"", []string{"-max-conns", "-1"}, "limits.max_conns"},
+		{"", []string{"-tls-cert", "cert.pem"}, "tls.cert"},
+		{"", []string{"-log-format", "xml"}, "log.format"},
+		{"[access_log]\nformat = \"apache\"\n", nil, "access_log.format"},
+		{"[proxy]\nprefix = \"/api/\"\n", nil, "proxy.upstreams"},
+		{"", []string{"-proxy-prefix", "/api/", "-proxy-upstreams", "localhost:80"}, "proxy.upstreams"},
+		{"", []string{"-proxy-prefix", "/api/", "-proxy-upstreams", "127.0.0.1:81", "-backend", "io_uring"}, "proxy.prefix"},
+	} {
+		var ke *config.KeyError
+		if _, err := readConfig(t, tc.file, tc.args...); !errors.As(err, &ke) || ke.Key != tc.key {
+			t.Errorf("%q %v: %v, want an error naming %s", tc.file, tc.args, err, tc.key)
+		}
+	}
+}
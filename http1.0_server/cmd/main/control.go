@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+
+	server "github.com/toastsandwich/epoll-learn/http1.0_server"
+	"github.com/toastsandwich/epoll-learn/pkg/control"
+)
+
+// listenControl serves the control socket at path, shutdown sends on stopC for main to
+// drain as for an upgrade.
+func listenControl(path string, s *server.HTTPServer, level *slog.LevelVar, log *slog.Logger, stopC chan<- struct{}) (*control.Server, error) {
+	ctl, err := control.Listen(path, log)
+	if err != nil {
+		return nil, err
+	}
+	ctl.HandleConns(s.Conns, s.Kick)
+	ctl.HandleLogLevel(level)
+	ctl.Handle("stats", "buffer pool and worker queue counters", func(w io.Writer, args []string) error {
+		fmt.Fprintf(w, "conns %d\n", len(s.Conns()))
+		fmt.Fprintf(w, "worker queues %v\n", s.QueueLens())
+		return control.WritePoolStats(w, "buffer", server.PoolStats())
+	})
+	ctl.Handle("shutdown", "let open connections finish, then exit", func(w io.Writer, args []string) error {
+		select {
+		case stopC <- struct{}{}:
+		default:
+			return fmt.Errorf("already shutting down")
+		}
+		_, err := io.WriteString(w, "draining\n")
+		return err
+	})
+	return ctl, nil
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
-	"time"
 
 	server "github.com/toastsandwich/epoll-learn/http1.0_server"
+	"github.com/toastsandwich/epoll-learn/pkg/accesslog"
+	"github.com/toastsandwich/epoll-learn/pkg/config"
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/systemd"
+	"github.com/toastsandwich/epoll-learn/pkg/upgrade"
 	"golang.org/x/sys/unix"
 )
 
@@ -17,26 +23,163 @@ import (
 // 3. Design a worker pool
 
 func main() {
-	s, err := server.NewHTTPServer(&server.HTTPServerOpts{
-		Addr: "0.0.0.0",
-		Port: 8080,
+	cfg := defaultConfig()
+	src, err := config.FromArgs(flag.CommandLine, os.Args[1:], &cfg)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading config:", err)
+		os.Exit(2)
+	}
+	if src.PrintConfig {
+		config.Print(os.Stdout, &cfg)
+		return
+	}
+
+	level := new(slog.LevelVar)
+	log := logging.New(cfg.Log.Options(level))
 
-		ReadTimeout:  1 * time.Second,
-		WriteTimeout: 1 * time.Second,
+	// started by SIGUSR2 in an older process, its listeners are ours
+	upg, err := upgrade.New()
+	if err != nil {
+		log.Error("error reading upgrade environment", logging.Err(err))
+		os.Exit(1)
+	}
+	listenFd, _ := upg.Fd("http")
+	adminFd, _ := upg.Fd("admin")
+	// or socket activated, FileDescriptorName=http and admin, a lone socket needs no name
+	activated, err := systemd.Listeners()
+	if err != nil {
+		log.Error("error reading systemd listeners", logging.Err(err))
+		os.Exit(1)
+	}
+	if listenFd == 0 {
+		listenFd = systemd.Named(activated, "http")
+		if listenFd == 0 && len(activated) == 1 {
+			listenFd = activated[0].Fd
+		}
+	}
+	if adminFd == 0 {
+		adminFd = systemd.Named(activated, "admin")
+	}
+
+	accessLog, err := cfg.openAccessLog(log)
+	if err != nil {
+		log.Error("error opening access log", logging.Err(err))
+		os.Exit(1)
+	}
+	opts := cfg.opts(listenFd)
+	opts.Logger = log
+	if accessLog != nil {
+		// closed after the server, its last responses get their lines
+		defer accessLog.Close()
+		opts.AccessLog = accesslog.New(accessLog, cfg.AccessLog.Format)
+	}
+	s, err := server.NewHTTPServer(opts)
+	if err != nil {
+		log.Error("error creating server", logging.Err(err))
+		os.Exit(1)
+	}
+	s.HandleFunc("/", func(res *server.Response, req *server.Request) {
+		res.WriteString("hello from epoll\n")
 	})
+	if popts := cfg.proxyOpts(); popts != nil {
+		p, err := s.NewProxy(popts)
+		if err != nil {
+			log.Error("error creating proxy", logging.Err(err))
+			os.Exit(1)
+		}
+		s.HandlePrefix(cfg.Proxy.Prefix, p.Handle)
+	}
+
+	admin, err := server.NewHTTPServer(&server.HTTPServerOpts{Addr: cfg.Admin.Addr, Port: cfg.Admin.Port, ListenFd: adminFd, Workers: 1, Logger: log})
 	if err != nil {
-		log.Fatal(err)
+		log.Error("error creating admin server", logging.Err(err))
+		os.Exit(1)
+	}
+	s.Metrics().GoRuntime()
+	admin.HandleFunc("/metrics", server.MetricsHandler(s.Metrics()))
+	if accessLog != nil {
+		accessLog.RegisterMetrics(s.Metrics(), "http")
+	}
+	go func() {
+		if err := admin.ListenAndServe(); err != nil {
+			log.Error("admin server stopped", logging.Err(err))
+		}
+	}()
+	defer admin.Close()
+
+	stopC := make(chan struct{}, 1)
+	if cfg.Admin.Socket != "" {
+		ctl, err := listenControl(cfg.Admin.Socket, s, level, log, stopC)
+		if err != nil {
+			log.Error("error creating control socket", logging.Err(err))
+			os.Exit(1)
+		}
+		go func() {
+			if err := ctl.Serve(); err != nil {
+				log.Error("control socket stopped", logging.Err(err))
+			}
+		}()
+		defer ctl.Close()
 	}
 
 	sigC := make(chan os.Signal, 1)
-	signal.Notify(sigC, unix.SIGINT, unix.SIGTERM)
+	signal.Notify(sigC, unix.SIGINT, unix.SIGTERM, unix.SIGUSR2, unix.SIGHUP)
 
-	go func() {
-		if err := s.ListenAndServe(); err != nil {
-			fmt.Println(err)
+	errC := make(chan error, 1)
+	go func() { errC <- s.ListenAndServe() }()
+	if err := upg.Ready(); err != nil {
+		log.Error("error telling the old process we are up", logging.Err(err))
+	}
+	if _, err := systemd.Notify(systemd.READY); err != nil {
+		log.Warn("error notifying systemd", logging.Err(err))
+	}
+	stopWatchdog := make(chan struct{})
+	defer close(stopWatchdog)
+	if _, err := systemd.Watchdog(stopWatchdog); err != nil {
+		log.Warn("error starting systemd watchdog", logging.Err(err))
+	}
+
+	for {
+		select {
+		case sig := <-sigC:
+			if sig == unix.SIGHUP {
+				systemd.Notify(systemd.RELOADING)
+				reload(src, &cfg, s, level, log)
+				systemd.Notify(systemd.READY)
+				continue
+			}
+			if sig == unix.SIGUSR2 {
+				// a new binary takes the listeners, this one drains and exits
+				pid, err := upg.Upgrade(map[string]int{"http": s.Fd, "admin": admin.Fd})
+				if err != nil {
+					log.Error("upgrade failed, still serving", logging.Err(err))
+					continue
+				}
+				log.Info("upgraded, draining", slog.Int("pid", pid))
+				// the child is the service now, NotifyAccess=all lets it say so
+				systemd.Notify(fmt.Sprintf("MAINPID=%d", pid))
+				admin.Close()
+				s.Shutdown(cfg.Timeouts.Drain)
+				return
+			}
+			log.Info("shutting down", slog.String("signal", sig.String()))
+			systemd.Notify(systemd.STOPPING)
+			s.Close()
+			return
+		case <-stopC:
+			log.Info("shutting down, draining", slog.Duration("timeout", cfg.Timeouts.Drain))
+			systemd.Notify(systemd.STOPPING)
+			admin.Close()
+			s.Shutdown(cfg.Timeouts.Drain)
+			return
+		case err := <-errC:
+			if err != nil {
+				log.Error("server stopped", logging.Err(err))
+			}
 			return
 		}
-	}()
-	<-sigC
-	s.Close()
+	}
 }
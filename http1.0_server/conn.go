@@ -1,100 +1,369 @@
 package server
 
 import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/toastsandwich/epoll-learn/http1.0_server/pkg/pool"
+	"github.com/toastsandwich/epoll-learn/pkg/control"
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+	"github.com/toastsandwich/epoll-learn/pkg/pool"
+	"github.com/toastsandwich/epoll-learn/pkg/ringbuf"
 	"golang.org/x/sys/unix"
 )
 
-func OnReadable(c *Conn) (int, error) {
-	totalBytes := 0
-	for {
-		stop, n, err := c.Recv()
-		if err != nil {
-			return totalBytes, err
-		}
-		if stop {
-			break
-		}
-		totalBytes += n
-	}
-	return totalBytes, nil
+const (
+	// segment size of the connection ring buffers, most requests fit in one
+	CONNBUFFERSIZE = 8192
+
+	// a read buffer this big holds the largest request requestLen accepts
+	DEFAULTREADLIMIT  = MAXHEADERSIZE + MAXBODYSIZE
+	DEFAULTWRITELIMIT = 4 << 20
+
+	// ReplyVec copies pieces smaller than this into the write buffer, an iovec of its own
+	// costs more than the copy
+	VECCOPYSIZE = 1024
+)
+
+// buffers backs every connection's ring buffers, segments are zeroed when they come back.
+var buffers = pool.New(true)
+
+// OnReadable reads the socket into c.ReadBuffer with at most reads readv calls, 0 drains it.
+// it stops early with ringbuf.ErrFull.
+func OnReadable(c *Conn, reads int) (int, error) {
+	n, err := c.ReadBuffer.ReadFromFdN(c.fd, reads)
+	c.bytesRead.Add(int64(n))
+	return n, err
 }
 
+// OnWriteable flushes c.WriteBuffer until it is empty or the socket would block, c.mu must be held.
 func OnWriteable(c *Conn) (int, error) {
-	totalBytes := 0
-	for {
-		stop, n, err := c.Send()
-		if err != nil {
-			return totalBytes, err
-		}
-		if stop {
-			break
-		}
-		totalBytes += n
-	}
-	return totalBytes, nil
+	n, err := c.WriteBuffer.WriteToFd(c.fd)
+	c.bytesWritten.Add(int64(n))
+	return n, err
 }
 
 type Conn struct {
-	// One request at a time
-	ReadBuffer  []byte
-	WriteBuffer []byte
+	// ReadBuffer holds bytes read but not yet handed to a worker as a complete request,
+	// only the poller handling the connection touches it.
+	ReadBuffer *ringbuf.Buffer
+	// WriteBuffer holds responses waiting for the socket.
+	WriteBuffer *ringbuf.Buffer
 
-	fd      int // conn fd
-	epollfd int // epoll loop
+	fd      int    // conn fd
+	peer    string // remote address
+	epollfd int    // epoll loop
+	trigger loop.Trigger
+	oneshot bool // registered with EPOLLONESHOT, see HTTPServerOpts.OneShot
 
 	aliveAt time.Time
+	// under mu. idleAt is when the connection last had nothing left to write, the read
+	// timeout counts from there, writeAt is when bytes last were queued into an empty
+	// WriteBuffer or left it, the write timeout counts from there, see HTTPServer.expire.
+	idleAt, writeAt time.Time
+	timedOut        bool
+
+	// counted by the loop, read by the control socket, see HTTPServer.Conns
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+
+	log *slog.Logger // scoped with fd and peer
+
+	// held while reading. with oneshot the next event may go to another poller, epoll
+	// keeps them apart but only a lock orders their ReadBuffer access in Go's memory model.
+	rmu sync.Mutex
+
+	// workers append to WriteBuffer while the loop flushes it, mu guards both along with closed.
+	mu     sync.Mutex
+	closed bool
+	// set once a response says the connection is done, the loop closes it after flushing.
+	closeAfterWrite bool
+	// reading stops while WriteBuffer holds more than highWater bytes, and starts again
+	// once it is down to lowWater, see HTTPServerOpts.WriteHighWater. 0 never stops.
+	highWater, lowWater int
+	paused              bool
+	onPause             func() // counts pauses, set by the server
+	// requests a worker did not serve because output was above the high water mark, and
+	// the framing error after them, served in order once output drains, see Conn.hold.
+	held    [][]byte
+	heldBad error
+	heldAt  time.Time
+	// a handler answers later, what comes after is held until it has, see Response.Later
+	awaiting bool
+	// requests handed to a worker and not served yet, see HTTPServer.submit
+	busy int
+
+	// kick tells a loop other than epoll that WriteBuffer has bytes, see HTTPServer.serveUring.
+	kick func(c *Conn)
 }
 
-func NewConn(fd int) *Conn {
-	c := &Conn{}
+// NewConn sets up a connection whose buffers grow up to readLimit and writeLimit bytes.
+func NewConn(fd, epollfd, readLimit, writeLimit int, log *slog.Logger) *Conn {
+	c := &Conn{fd: fd, epollfd: epollfd, log: log}
 
-	c.ReadBuffer = pool.GetBuffer()
-	c.WriteBuffer = pool.GetBuffer()
+	c.ReadBuffer = ringbuf.New(buffers, CONNBUFFERSIZE, readLimit)
+	c.WriteBuffer = ringbuf.New(buffers, CONNBUFFERSIZE, writeLimit)
 
 	c.aliveAt = time.Now()
+	c.idleAt = c.aliveAt
 	return c
 }
 
-// Send and Recv both return an extra parameter to notify loop to continue
-func (c *Conn) Recv() (bool, int, error) {
-	n, err := unix.Read(c.fd, c.ReadBuffer)
-	if err != nil {
-		if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
-			return true, 0, nil
+// Reply queues p for writing and asks the loop to watch for EPOLLOUT, see ReplyVec.
+func (c *Conn) Reply(p []byte, closeAfter bool) error {
+	return c.ReplyVec([][]byte{p}, closeAfter)
+}
+
+// ReplyVec queues bufs for writing and asks the loop to watch for EPOLLOUT, they go out
+// with one writev. Pieces under VECCOPYSIZE are copied, larger ones are queued as they
+// are and must not change until written.
+// safe to call from workers, it is a no-op once the connection is closed or closing.
+// if bufs do not fit in the write buffer they are dropped, the connection is closed once
+// what is queued is flushed, and ringbuf.ErrFull is returned.
+func (c *Conn) ReplyVec(bufs [][]byte, closeAfter bool) error {
+	total := 0
+	for _, p := range bufs {
+		total += len(p)
+	}
+
+	c.mu.Lock()
+	// nothing goes out after the response that ends the connection
+	if c.closed || c.closeAfterWrite {
+		c.mu.Unlock()
+		return nil
+	}
+	var full error
+	if total > c.WriteBuffer.Free() {
+		// the client is not reading, flush what is queued and let it go
+		c.log.Warn("write buffer full, closing connection", slog.Int("queued", c.WriteBuffer.Len()))
+		full = ringbuf.ErrFull
+		closeAfter = true
+	} else {
+		if c.WriteBuffer.Len() == 0 {
+			c.writeAt = time.Now()
+		}
+		for _, p := range bufs {
+			if len(p) < VECCOPYSIZE {
+				c.WriteBuffer.Write(p)
+			} else {
+				c.WriteBuffer.Append(p)
+			}
 		}
-		return true, 0, err
 	}
-	return false, n, nil
+	c.closeAfterWrite = closeAfter
+
+	if c.kick != nil {
+		c.mu.Unlock()
+		c.kick(c)
+		return full
+	}
+	if c.highWater > 0 && !c.paused && c.WriteBuffer.Len() > c.highWater {
+		// the client sends faster than it reads, leave the rest in its socket for now
+		c.paused = true
+		c.log.Debug("output above high water, pausing reads", slog.Int("queued", c.WriteBuffer.Len()))
+		if c.onPause != nil {
+			c.onPause()
+		}
+	}
+	defer c.mu.Unlock()
+	// disarmed until the worker re-arms it, with EPOLLOUT since WriteBuffer has bytes
+	if c.oneshot {
+		return full
+	}
+	// remember now EPOLLOUT is one of interested events
+	if err := c.modify(true); err != nil {
+		return err
+	}
+	return full
+}
+
+// events returns what to register for, EPOLLOUT if out, EPOLLIN unless reads are paused.
+// c.mu must be held.
+func (c *Conn) events(out bool) uint32 {
+	events := uint32(EVENT_IN_ERR)
+	switch {
+	case c.paused:
+		// no EPOLLRDHUP either, level triggered it would be reported until read
+		events = EVENT_OUT_ERR
+	case out:
+		events = EVENT_IN_OUT_ERR
+	}
+	if c.oneshot {
+		events |= unix.EPOLLONESHOT
+	}
+	return c.trigger.Events(events)
 }
 
-func (c *Conn) SendJob() {
-	job := Job{}
+// modify sets the connection's events, see Conn.events. c.mu must be held, Close holds it
+// too, so the fd cannot have been closed and handed to a new connection yet.
+func (c *Conn) modify(out bool) error {
+	if c.closed {
+		return nil
+	}
+	return unix.EpollCtl(c.epollfd, unix.EPOLL_CTL_MOD, c.fd, &unix.EpollEvent{
+		Events: c.events(out),
+		Fd:     int32(c.fd),
+	})
 }
 
-func (c *Conn) Send() (bool, int, error) {
-	if len(c.WriteBuffer) == 0 {
-		return true, 0, nil
+// hold keeps reqs and bad for later if output is above the high water mark, a response is
+// awaited, or earlier requests are held already, they have to go out first. it reports
+// whether it kept them.
+func (c *Conn) hold(reqs [][]byte, bad error, readAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused && !c.awaiting && len(c.held) == 0 && c.heldBad == nil {
+		return false
+	}
+	if c.heldAt.IsZero() {
+		c.heldAt = readAt
+	}
+	c.held = append(c.held, reqs...)
+	if bad != nil {
+		c.heldBad = bad
 	}
+	return true
+}
+
+// await marks a response coming later, the connection is busy and holds what follows until
+// answered.
+func (c *Conn) await() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy++
+	c.awaiting = true
+}
+
+// answered ends what await started, it reports whether requests were held meanwhile that
+// can be served now.
+func (c *Conn) answered() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy--
+	c.awaiting = false
+	return !c.paused && (len(c.held) > 0 || c.heldBad != nil)
+}
+
+// takeHeld returns and forgets what hold kept.
+func (c *Conn) takeHeld() (reqs [][]byte, bad error, readAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reqs, bad, readAt = c.held, c.heldBad, c.heldAt
+	c.held, c.heldBad, c.heldAt = nil, nil, time.Time{}
+	return reqs, bad, readAt
+}
+
+// readable reports whether reads are on, they are off above the high water mark and once
+// the connection is closed.
+func (c *Conn) readable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.paused && !c.closed
+}
 
-	n, err := unix.Write(c.fd, c.WriteBuffer)
-	if err != nil {
-		if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
-			return true, 0, nil
+// info describes the connection for the control socket, see HTTPServer.Conns.
+func (c *Conn) info() control.ConnInfo {
+	c.mu.Lock()
+	state := "idle"
+	switch {
+	case c.closed || c.closeAfterWrite:
+		state = "closing"
+	case c.paused:
+		state = "paused"
+	case c.busy > 0:
+		state = "serving"
+	case c.WriteBuffer.Len() > 0:
+		state = "writing"
+	}
+	c.mu.Unlock()
+	return control.ConnInfo{
+		Fd:           c.fd,
+		Peer:         c.peer,
+		Age:          time.Since(c.aliveAt),
+		BytesRead:    c.bytesRead.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+		State:        state,
+	}
+}
+
+// idle reports whether the connection has nothing to read, write or serve, closing it
+// loses nothing. the caller keeps reads out, with rmu or by being the io_uring loop.
+func (c *Conn) idle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closed && c.busy == 0 && c.ReadBuffer.Len() == 0 && c.WriteBuffer.Len() == 0 &&
+		len(c.held) == 0 && c.heldBad == nil
+}
+
+// wrote records n bytes leaving WriteBuffer for the timeouts, c.mu must be held.
+func (c *Conn) wrote(n int) {
+	if n <= 0 {
+		return
+	}
+	c.writeAt = time.Now()
+	if c.WriteBuffer.Len() == 0 {
+		c.idleAt = c.writeAt
+	}
+}
+
+// expired reports what the connection waited on for too long, "request" past read with
+// nothing to write or serve, "write" past write with a response the client does not take,
+// or "" if neither. 0 is no limit. a connection expires once, the loop closes it after.
+func (c *Conn) expired(now time.Time, read, write time.Duration) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	why := ""
+	switch {
+	case c.closed || c.timedOut:
+	case c.WriteBuffer.Len() > 0:
+		if write > 0 && now.Sub(c.writeAt) > write {
+			why = "write"
 		}
-		return true, 0, err
+	case read > 0 && c.busy == 0 && len(c.held) == 0 && c.heldBad == nil && now.Sub(c.idleAt) > read:
+		why = "request"
 	}
-	if n < len(c.WriteBuffer) {
-		c.WriteBuffer = c.WriteBuffer[n:]
-		return false, n, nil
+	c.timedOut = why != ""
+	return why
+}
+
+// drained resumes reads once WriteBuffer is down to the low water mark, it reports whether
+// it did. c.mu must be held.
+func (c *Conn) drained() bool {
+	if !c.paused || c.WriteBuffer.Len() > c.lowWater {
+		return false
+	}
+	c.paused = false
+	c.log.Debug("output below low water, resuming reads", slog.Int("queued", c.WriteBuffer.Len()))
+	return true
+}
+
+// rearm re-enables a oneshot connection once whoever got its event is done with it, with
+// EPOLLOUT while WriteBuffer has bytes or the connection is to be closed.
+// it is a no-op without oneshot or once closed.
+func (c *Conn) rearm() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.oneshot {
+		return
+	}
+	// EPOLLOUT also lets the loop close a connection done with nothing left to write
+	if err := c.modify(c.WriteBuffer.Len() > 0 || c.closeAfterWrite); err != nil {
+		c.log.Error("error re-arming connection", logging.Err(err))
 	}
-	return false, n, err
 }
 
 func (c *Conn) Close() {
-	pool.PutBuffer(c.ReadBuffer)
-	pool.PutBuffer(c.WriteBuffer)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	c.ReadBuffer.Release()
+	c.WriteBuffer.Release()
+	unix.EpollCtl(c.epollfd, unix.EPOLL_CTL_DEL, c.fd, nil)
 	unix.Close(c.fd)
 }
@@ -2,4 +2,9 @@ module github.com/toastsandwich/epoll-learn/http1.0_server
 
 go 1.25.3
 
-require golang.org/x/sys v0.37.0
+require (
+	github.com/toastsandwich/epoll-learn/pkg v0.0.0
+	golang.org/x/sys v0.37.0
+)
+
+replace github.com/toastsandwich/epoll-learn/pkg => ../pkg
@@ -2,10 +2,23 @@ package server
 
 import (
 	"bytes"
+	"cmp"
 	"fmt"
 	"sync"
 )
 
+const (
+	MAXHEADERSIZE = 8192
+	MAXBODYSIZE   = 1 << 20
+)
+
+// errRequestTooLarge is for a request that does not fit in the connection's read buffer.
+var errRequestTooLarge = fmt.Errorf("error parsing (request too large)")
+
+// errTransferEncoding is for a request with a Transfer-Encoding, bodies are only framed by
+// Content-Length here, it is answered with a 501 and not read past.
+var errTransferEncoding = fmt.Errorf("error parsing (transfer encoding not implemented)")
+
 type header struct {
 	Key   []byte
 	Value []byte
@@ -36,6 +49,8 @@ type Request struct {
 	Path    []byte
 	Headers headers
 	Body    []byte // optional
+
+	RemoteAddr string // host:port of the client
 }
 
 var reqPool = sync.Pool{
@@ -47,6 +62,7 @@ var reqPool = sync.Pool{
 func getRequest() *Request {
 	r := reqPool.Get().(*Request)
 	r.Version, r.Path, r.Method, r.Headers, r.Body = nil, nil, nil, nil, nil
+	r.RemoteAddr = ""
 	return r
 }
 
@@ -68,24 +84,23 @@ func parseRequest(p []byte) (*Request, error) {
 		return nil, fmt.Errorf("error parsing (no info line)")
 	}
 
-	methodTill := bytes.IndexByte(firstLine, ' ')
-	if methodTill == -1 {
+	method, rest, found := bytes.Cut(firstLine, []byte(" "))
+	if !found || len(method) == 0 {
 		return nil, fmt.Errorf("error parsing (no method)")
 	}
 
-	pathTill := bytes.IndexByte(firstLine[methodTill+1:], ' ') + (methodTill + 1)
-	if pathTill == -1 {
+	path, version, found := bytes.Cut(rest, []byte(" "))
+	if !found || len(path) == 0 {
 		return nil, fmt.Errorf("error parsing (no path)")
 	}
 
-	versTill := len(firstLine[pathTill+1:]) + (pathTill + 1)
-	if versTill == -1 {
+	if !bytes.HasPrefix(version, []byte("HTTP/")) {
 		return nil, fmt.Errorf("error parsing (no version)")
 	}
 
-	req.Method = p[:methodTill]
-	req.Path = p[methodTill:pathTill]
-	req.Version = p[pathTill:versTill]
+	req.Method = method
+	req.Path = path
+	req.Version = version
 
 	headerLine, body, _ := bytes.Cut(restLines, []byte("\r\n\r\n"))
 	for len(headerLine) > 0 {
@@ -115,13 +130,272 @@ func parseRequest(p []byte) (*Request, error) {
 	return req, nil
 }
 
+// KeepAlive reports whether the client wants the connection kept open after the response.
+// HTTP/1.0 closes unless asked not to, HTTP/1.1 stays open unless asked to close.
+func (r *Request) KeepAlive() bool {
+	conn := r.Headers.Get([]byte("Connection"))
+	if bytes.Equal(r.Version, []byte("HTTP/1.0")) {
+		return bytes.EqualFold(conn, []byte("keep-alive"))
+	}
+	return !bytes.EqualFold(conn, []byte("close"))
+}
+
+// requestLen returns the length of the first complete request in p,
+// or 0 when more bytes are needed. Content-Length may repeat with the same value, two
+// values are an error, a proxy in front could have framed the request by the other one.
+// So is Transfer-Encoding, a chunked body would be taken for the next request.
+func requestLen(p []byte) (int, error) {
+	end := bytes.Index(p, []byte("\r\n\r\n"))
+	if end == -1 {
+		if len(p) > MAXHEADERSIZE {
+			return 0, fmt.Errorf("error parsing (headers too large)")
+		}
+		return 0, nil
+	}
+	end += 4
+
+	length, seen := 0, false
+	for _, line := range bytes.Split(p[:end], []byte("\r\n")) {
+		key, val, found := bytes.Cut(line, []byte(":"))
+		if !found {
+			continue
+		}
+		key = bytes.TrimSpace(key)
+		if bytes.EqualFold(key, []byte("Transfer-Encoding")) {
+			return 0, errTransferEncoding
+		}
+		if !bytes.EqualFold(key, []byte("Content-Length")) {
+			continue
+		}
+		n, ok := contentLength(bytes.TrimSpace(val))
+		if !ok || n > MAXBODYSIZE {
+			return 0, fmt.Errorf("error parsing (bad content length)")
+		}
+		if seen && n != length {
+			return 0, fmt.Errorf("error parsing (conflicting content lengths)")
+		}
+		length, seen = n, true
+	}
+
+	if len(p) < end+length {
+		return 0, nil
+	}
+	return end + length, nil
+}
+
+// contentLength parses a Content-Length value, ASCII digits only as RFC 9110 has it, no
+// sign. it reports false for anything else, or for more digits than an int surely holds.
+func contentLength(val []byte) (int, bool) {
+	if len(val) == 0 || len(val) > 18 {
+		return 0, false
+	}
+	n := 0
+	for _, b := range val {
+		if b < '0' || b > '9' {
+			return 0, false
+		}
+		n = n*10 + int(b-'0')
+	}
+	return n, true
+}
+
 func toBytes(req *Request) []byte {
 	return []byte("done")
 }
 
 type Response struct {
+	Status  int
+	Headers headers
+	Body    []byte
+
+	chunks [][]byte // sent after Body as they are, see WriteChunk
+	// answers a HEAD, the head goes out without Body and chunks, see bodyless
+	headOnly bool
+	later    *later // set by Later
+}
+
+func (r *Response) SetHeader(k, v string) {
+	for i := range r.Headers {
+		if bytes.EqualFold(r.Headers[i].Key, []byte(k)) {
+			r.Headers[i].Value = []byte(v)
+			return
+		}
+	}
+	r.Headers.Add([]byte(k), []byte(v))
+}
+
+func (r *Response) Write(p []byte) (int, error) {
+	r.Body = append(r.Body, p...)
+	return len(p), nil
+}
+
+func (r *Response) WriteString(s string) (int, error) {
+	r.Body = append(r.Body, s...)
+	return len(s), nil
+}
+
+// WriteChunk queues p after the body without copying it, for large content that is already
+// in memory such as file chunks. p must not change until the response has been written.
+func (r *Response) WriteChunk(p []byte) {
+	if len(p) > 0 {
+		r.chunks = append(r.chunks, p)
+	}
+}
+
+// Later lets the handler answer after it returns, from any goroutine, by filling in the
+// response and calling finish. The worker is free for other connections meanwhile, the
+// requests after this one on its connection wait for the answer. The response is not
+// the handler's to touch after finish, nor to replace as a whole before.
+func (r *Response) Later() (finish func()) {
+	r.later = &later{}
+	return r.later.finish
+}
+
+// later meets the handler finishing a response with the server waiting for it, whichever
+// comes second queues it.
+type later struct {
+	mu    sync.Mutex
+	done  bool
+	reply func()
+}
+
+func (l *later) finish() {
+	l.mu.Lock()
+	if l.done {
+		l.mu.Unlock()
+		return
+	}
+	l.done = true
+	reply := l.reply
+	l.mu.Unlock()
+	if reply != nil {
+		reply()
+	}
+}
+
+// wait has finish run reply and reports true, or false if the handler has finished
+// already, the caller replies itself then.
+func (l *later) wait(reply func()) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done {
+		return false
+	}
+	l.reply = reply
+	return true
+}
+
+func (r *Response) contentLength() int {
+	n := len(r.Body)
+	for _, c := range r.chunks {
+		n += len(c)
+	}
+	return n
+}
+
+// bodyless reports whether the response goes out without a body, answering a HEAD or with
+// a 1xx, 204 or 304 status.
+func (r *Response) bodyless() bool {
+	status := cmp.Or(r.Status, 200)
+	return r.headOnly || status/100 == 1 || status == 204 || status == 304
+}
+
+// head renders the status line and headers. Content-Length is worked out from the body,
+// except that 1xx and 204 have none and HEAD and 304 keep one the handler set, a proxied
+// response has the upstream's. A 304 without one says nothing, a HEAD the body's length.
+func (r *Response) head() []byte {
+	status := cmp.Or(r.Status, 200)
+	length := r.contentLength()
+	var set []byte
+	if r.bodyless() {
+		set = r.Headers.Get([]byte("Content-Length"))
+	}
+
+	b := make([]byte, 0, 128)
+	b = fmt.Appendf(b, "HTTP/1.0 %d %s\r\n", status, statusText(status))
+	hasType := false
+	for _, h := range r.Headers {
+		if bytes.EqualFold(h.Key, []byte("Content-Length")) {
+			continue
+		}
+		hasType = hasType || bytes.EqualFold(h.Key, []byte("Content-Type"))
+		b = append(b, h.Key...)
+		b = append(b, ": "...)
+		b = append(b, h.Value...)
+		b = append(b, "\r\n"...)
+	}
+	if !hasType && length > 0 && status != 204 && status != 304 {
+		b = append(b, "Content-Type: text/plain; charset=utf-8\r\n"...)
+	}
+	switch {
+	case status/100 == 1 || status == 204:
+	case set != nil:
+		b = append(b, "Content-Length: "...)
+		b = append(b, set...)
+		b = append(b, "\r\n"...)
+	case status != 304:
+		b = fmt.Appendf(b, "Content-Length: %d\r\n", length)
+	}
+	return append(b, "\r\n"...)
+}
+
+// segments is the response as it goes on the wire, the head then the body and chunks
+// untouched, so the connection can writev them instead of joining them first.
+func (r *Response) segments() [][]byte {
+	segs := make([][]byte, 0, 2+len(r.chunks))
+	segs = append(segs, r.head())
+	if r.bodyless() {
+		return segs
+	}
+	if len(r.Body) > 0 {
+		segs = append(segs, r.Body)
+	}
+	return append(segs, r.chunks...)
 }
 
 func toByte(res *Response) []byte {
-	return []byte{}
+	return bytes.Join(res.segments(), nil)
+}
+
+func statusText(code int) string {
+	switch code {
+	case 200:
+		return "OK"
+	case 201:
+		return "Created"
+	case 204:
+		return "No Content"
+	case 301:
+		return "Moved Permanently"
+	case 302:
+		return "Found"
+	case 304:
+		return "Not Modified"
+	case 400:
+		return "Bad Request"
+	case 401:
+		return "Unauthorized"
+	case 403:
+		return "Forbidden"
+	case 404:
+		return "Not Found"
+	case 405:
+		return "Method Not Allowed"
+	case 413:
+		return "Payload Too Large"
+	case 431:
+		return "Request Header Fields Too Large"
+	case 500:
+		return "Internal Server Error"
+	case 501:
+		return "Not Implemented"
+	case 502:
+		return "Bad Gateway"
+	case 503:
+		return "Service Unavailable"
+	case 504:
+		return "Gateway Timeout"
+	default:
+		return "Unknown"
+	}
 }
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	req, err := parseRequest([]byte("GET /hello.txt HTTP/1.0\r\nUser-Agent: TestClient\r\nHost:  example.com \r\n\r\nbody"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req.Method) != "GET" || string(req.Path) != "/hello.txt" || string(req.Version) != "HTTP/1.0" {
+		t.Fatalf("bad request line: %q %q %q", req.Method, req.Path, req.Version)
+	}
+	if got := req.Headers.Get([]byte("user-agent")); string(got) != "TestClient" {
+		t.Fatalf("User-Agent = %q", got)
+	}
+	if got := req.Headers.Get([]byte("Host")); string(got) != "example.com" {
+		t.Fatalf("Host = %q", got)
+	}
+	if string(req.Body) != "body" {
+		t.Fatalf("Body = %q", req.Body)
+	}
+}
+
+func TestParseRequestErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"GET / HTTP/1.0",
+		"GET\r\n\r\n",
+		"GET /\r\n\r\n",
+		" / HTTP/1.0\r\n\r\n",
+		"GET  HTTP/1.0\r\n\r\n",
+		"GET / FTP/1.0\r\n\r\n",
+	} {
+		if _, err := parseRequest([]byte(in)); err == nil {
+			t.Errorf("parseRequest(%q) did not fail", in)
+		}
+	}
+}
+
+func TestRequestLen(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		err  bool
+	}{
+		{"GET / HTTP/1.0\r\n", 0, false},
+		{"GET / HTTP/1.0\r\n\r\n", 18, false},
+		{"GET / HTTP/1.0\r\n\r\nGET /next", 18, false},
+		{"POST / HTTP/1.0\r\nContent-Length: 4\r\n\r\nab", 0, false},
+		{"POST / HTTP/1.0\r\ncontent-length: 4\r\n\r\nabcdGET", 42, false},
+		{"POST / HTTP/1.0\r\nContent-Length: -1\r\n\r\n", 0, true},
+		{"POST / HTTP/1.0\r\nContent-Length: x\r\n\r\n", 0, true},
+		{"POST / HTTP/1.0\r\nContent-Length: +5\r\n\r\nhello", 0, true},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", 0, true},
+		{"POST / HTTP/1.1\r\nContent-Length: 5\r\ntransfer-encoding: chunked\r\n\r\n0\r\n\r\n", 0, true},
+		{"POST / HTTP/1.0\r\nContent-Length: -0\r\n\r\n", 0, true},
+		{"POST / HTTP/1.0\r\nContent-Length: 1 2\r\n\r\n", 0, true},
+		{"POST / HTTP/1.0\r\nContent-Length: 99999999999999999999\r\n\r\n", 0, true},
+		{"POST / HTTP/1.0\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\nab", 59, false},
+		{"POST / HTTP/1.0\r\nContent-Length: 2\r\nContent-Length: 0\r\n\r\nab", 0, true},
+		{"POST / HTTP/1.0\r\nContent-Length: 0\r\ncontent-length: 2\r\n\r\n", 0, true},
+		{string(bytes.Repeat([]byte("a"), MAXHEADERSIZE+1)), 0, true},
+	}
+	for _, tt := range tests {
+		n, err := requestLen([]byte(tt.in))
+		if (err != nil) != tt.err || n != tt.want {
+			t.Errorf("requestLen(%q) = %d, %v, want %d, err %v", tt.in, n, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"GET / HTTP/1.0\r\n\r\n", false},
+		{"GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n", true},
+		{"GET / HTTP/1.1\r\n\r\n", true},
+		{"GET / HTTP/1.1\r\nConnection: close\r\n\r\n", false},
+	}
+	for _, tt := range tests {
+		req, err := parseRequest([]byte(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.KeepAlive(); got != tt.want {
+			t.Errorf("KeepAlive(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestToByte(t *testing.T) {
+	res := &Response{Status: 404}
+	res.SetHeader("X-Test", "1")
+	res.SetHeader("x-test", "2")
+	res.WriteString("nope")
+
+	want := "HTTP/1.0 404 Not Found\r\nX-Test: 2\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 4\r\n\r\nnope"
+	if got := string(toByte(res)); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestResponseSegments(t *testing.T) {
+	res := &Response{}
+	res.WriteString("ab")
+	chunk := []byte("cdef")
+	res.WriteChunk(chunk)
+	res.WriteChunk(nil)
+
+	segs := res.segments()
+	if len(segs) != 3 || string(segs[1]) != "ab" || &segs[2][0] != &chunk[0] {
+		t.Fatalf("segments %q, want head, body and the chunk itself", segs)
+	}
+	want := "HTTP/1.0 200 OK\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 6\r\n\r\nabcdef"
+	if got := string(toByte(res)); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// TestResponseBodyless sends no body for HEAD, 204 and 304, HEAD and 304 keep a
+// Content-Length that was set and 204 never has one.
+func TestResponseBodyless(t *testing.T) {
+	for _, tt := range []struct {
+		res  Response
+		body string
+		want string
+	}{
+		{Response{headOnly: true}, "body", "HTTP/1.0 200 OK\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 4\r\n\r\n"},
+		{Response{headOnly: true, Headers: headers{{[]byte("Content-Length"), []byte("1234")}}}, "",
+			"HTTP/1.0 200 OK\r\nContent-Length: 1234\r\n\r\n"},
+		{Response{Status: 204, Headers: headers{{[]byte("Content-Length"), []byte("3")}}}, "abc", "HTTP/1.0 204 No Content\r\n\r\n"},
+		{Response{Status: 304}, "", "HTTP/1.0 304 Not Modified\r\n\r\n"},
+		{Response{Status: 304, Headers: headers{{[]byte("Content-Length"), []byte("1234")}}}, "",
+			"HTTP/1.0 304 Not Modified\r\nContent-Length: 1234\r\n\r\n"},
+		// anything else works its length out again
+		{Response{Headers: headers{{[]byte("Content-Length"), []byte("1234")}}}, "abc",
+			"HTTP/1.0 200 OK\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 3\r\n\r\nabc"},
+	} {
+		tt.res.WriteString(tt.body)
+		if got := string(toByte(&tt.res)); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add([]byte("GET /hello.txt HTTP/1.0\r\nUser-Agent: TestClient\r\n\r\n"))
+	f.Add([]byte("POST /x HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc"))
+	f.Add([]byte("GET / HTTP/1.0\r\n:\r\nbad header\r\n\r\n"))
+	f.Add([]byte("GET\r\n"))
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		req, err := parseRequest(p)
+		if err != nil {
+			return
+		}
+		if len(req.Method) == 0 || len(req.Path) == 0 || !bytes.HasPrefix(req.Version, []byte("HTTP/")) {
+			t.Fatalf("accepted bad request line: %q %q %q", req.Method, req.Path, req.Version)
+		}
+		for _, h := range req.Headers {
+			if !bytes.Equal(h.Key, bytes.TrimSpace(h.Key)) || !bytes.Equal(h.Value, bytes.TrimSpace(h.Value)) {
+				t.Fatalf("untrimmed header %q: %q", h.Key, h.Value)
+			}
+		}
+		req.KeepAlive()
+		putRequest(req)
+	})
+}
+
+func FuzzRequestLen(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.0\r\n\r\n"))
+	f.Add([]byte("POST / HTTP/1.0\r\nContent-Length: 4\r\n\r\nabcd"))
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		n, err := requestLen(p)
+		if err != nil {
+			return
+		}
+		if n < 0 || n > len(p) {
+			t.Fatalf("requestLen = %d for %d bytes", n, len(p))
+		}
+	})
+}
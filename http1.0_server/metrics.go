@@ -0,0 +1,72 @@
+package server
+
+import "github.com/toastsandwich/epoll-learn/pkg/metrics"
+
+type serverMetrics struct {
+	accepted        *metrics.Counter
+	bytesRead       *metrics.Counter
+	bytesWritten    *metrics.Counter
+	wakeups         *metrics.Counter
+	eventsPerWakeup *metrics.Histogram
+	requestDuration *metrics.Histogram
+	readPauses      *metrics.Counter
+	rejected        *metrics.Counter
+	shed            *metrics.Counter
+	acceptPauses    *metrics.Counter
+	timedOut        *metrics.Counter
+}
+
+func newServerMetrics(reg *metrics.Registry, s *HTTPServer) *serverMetrics {
+	m := &serverMetrics{
+		accepted:        reg.Counter("http_connections_accepted_total", "Connections accepted by the HTTP server."),
+		bytesRead:       reg.Counter("http_read_bytes_total", "Bytes read from HTTP connections."),
+		bytesWritten:    reg.Counter("http_written_bytes_total", "Bytes written to HTTP connections."),
+		wakeups:         reg.Counter("http_epoll_wakeups_total", "Times epoll_wait returned with events."),
+		eventsPerWakeup: reg.Histogram("http_epoll_events_per_wakeup", "Events returned by a single epoll_wait.", metrics.ExponentialBuckets(1, 2, 11)),
+		requestDuration: reg.Histogram("http_request_duration_seconds", "Time from reading a request to queueing its response.", metrics.LatencyBuckets),
+		readPauses:      reg.Counter("http_read_pauses_total", "Times a connection stopped being read for output above the high water mark."),
+		rejected:        reg.Counter("http_connections_rejected_total", "Connections turned away with a 503 over the connection limit."),
+		shed:            reg.Counter("http_connections_shed_total", "Pending connections dropped because the process ran out of file descriptors."),
+		acceptPauses:    reg.Counter("http_accept_pauses_total", "Times accepting stopped at the connection limit."),
+		timedOut:        reg.Counter("http_connections_timed_out_total", "Connections closed past the read or write timeout."),
+	}
+	reg.GaugeFunc("http_connections_active", "Connections in ActiveConnMap.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(len(s.ActiveConnMap))
+	})
+	buffers.RegisterMetrics(reg, "http")
+	return m
+}
+
+// MetricsHandler serves reg in the Prometheus text format, mount it on an admin server.
+func MetricsHandler(reg *metrics.Registry) HandlerFunc {
+	return func(res *Response, req *Request) {
+		res.SetHeader("Content-Type", metrics.ContentType)
+		if err := reg.WriteText(res); err != nil {
+			*res = Response{Status: 500}
+			res.WriteString(err.Error() + "\n")
+		}
+	}
+}
+
+type proxyMetrics struct {
+	requests    *metrics.Counter
+	errors      *metrics.Counter
+	connsOpened *metrics.Counter
+}
+
+// newProxyMetrics is registered once per server, by its first Proxy.
+func newProxyMetrics(reg *metrics.Registry, s *HTTPServer) *proxyMetrics {
+	m := &proxyMetrics{
+		requests:    reg.Counter("http_proxy_requests_total", "Requests forwarded to an upstream."),
+		errors:      reg.Counter("http_proxy_errors_total", "Proxied requests answered with a 502 or 504."),
+		connsOpened: reg.Counter("http_proxy_upstream_connections_opened_total", "Upstream connections opened, the rest reused from the pool."),
+	}
+	reg.GaugeFunc("http_proxy_upstream_connections", "Open upstream connections, idle or busy.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(len(s.upstreamConns))
+	})
+	return m
+}
@@ -0,0 +1,800 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+	"golang.org/x/sys/unix"
+)
+
+// Balance is how a Proxy picks the upstream for a request.
+type Balance string
+
+const (
+	// RoundRobin takes the upstreams in turn.
+	RoundRobin Balance = "round_robin"
+	// LeastConns takes the upstream with the fewest requests in flight, in turn among equals.
+	LeastConns Balance = "least_conns"
+)
+
+// ParseBalance accepts round_robin or least_conns. An empty s gives an empty Balance, the
+// proxy then picks its own default.
+func ParseBalance(s string) (Balance, error) {
+	switch Balance(s) {
+	case "":
+		return "", nil
+	case RoundRobin, LeastConns:
+		return Balance(s), nil
+	}
+	return "", fmt.Errorf("unknown balance %q, want round_robin or least_conns", s)
+}
+
+const (
+	// how long an upstream has to take a connection, the request and answer it, checked
+	// every TIMEOUTINTERVAL
+	PROXYTIMEOUT = 30 * time.Second
+	// idle connections kept per upstream
+	PROXYMAXIDLE = 16
+	// failures in a row that mark an upstream down
+	PROXYMAXFAILS = 3
+	// how long an upstream stays down before a request tries it again
+	PROXYDOWNFOR = 10 * time.Second
+	// what the proxy reads from an upstream per read call
+	PROXYREADSIZE = 16 << 10
+)
+
+var (
+	errNoUpstream      = errors.New("no upstream available")
+	errUpstreamTimeout = errors.New("upstream timed out")
+	// nothing was sent, the request can go to another upstream
+	errUpstreamConnect = errors.New("connecting to upstream")
+	// a pooled connection the upstream closed before answering, the request is sent again
+	errUpstreamStale = errors.New("upstream closed an idle connection")
+	// as errUpstreamStale but the upstream may have run the request, it is not sent again
+	// unless its method is idempotent
+	errUpstreamLost = errors.New("upstream closed a pooled connection after the request was sent")
+)
+
+type ProxyOpts struct {
+	Upstreams []string // ipv4 host:port
+	Balance   Balance  // defaults to RoundRobin
+
+	Timeout  time.Duration // defaults to PROXYTIMEOUT
+	MaxIdle  int           // defaults to PROXYMAXIDLE
+	MaxFails int           // defaults to PROXYMAXFAILS
+	DownFor  time.Duration // defaults to PROXYDOWNFOR
+}
+
+// Proxy forwards requests to upstream HTTP servers. Upstream sockets are non-blocking and
+// polled by the server's own epoll loop, edge triggered whatever the server's Trigger, and
+// a connection that answered in full with keep-alive goes back to a per upstream pool.
+// The worker is free once the request is on its way, the poller that reads the answer
+// queues the response, see Response.Later.
+type Proxy struct {
+	s   *HTTPServer
+	ups []*upstream
+
+	balance  Balance
+	timeout  time.Duration
+	maxIdle  int
+	maxFails int
+	downFor  time.Duration
+	next     atomic.Uint64 // where RoundRobin and LeastConns start looking
+}
+
+type upstream struct {
+	addr string
+	sa   unix.SockaddrInet4
+
+	mu        sync.Mutex
+	idle      []*upstreamConn
+	active    int // requests in flight
+	fails     int // in a row
+	downUntil time.Time
+}
+
+// NewProxy returns a proxy to opts.Upstreams polled by s, mount its Handle with HandleFunc
+// or HandlePrefix. It needs the epoll backend.
+func (s *HTTPServer) NewProxy(opts *ProxyOpts) (*Proxy, error) {
+	if s.backend != loop.Epoll {
+		return nil, fmt.Errorf("the proxy needs the epoll backend, not %s", s.backend)
+	}
+	if len(opts.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams to proxy to")
+	}
+	if _, err := ParseBalance(string(opts.Balance)); err != nil {
+		return nil, err
+	}
+	if opts.Timeout < 0 || opts.MaxIdle < 0 || opts.MaxFails < 0 || opts.DownFor < 0 {
+		return nil, fmt.Errorf("proxy timeout %v, max idle %d, max fails %d, down for %v, want 0 for the defaults or more",
+			opts.Timeout, opts.MaxIdle, opts.MaxFails, opts.DownFor)
+	}
+	p := &Proxy{
+		s:        s,
+		balance:  cmp.Or(opts.Balance, RoundRobin),
+		timeout:  cmp.Or(opts.Timeout, PROXYTIMEOUT),
+		maxIdle:  cmp.Or(opts.MaxIdle, PROXYMAXIDLE),
+		maxFails: cmp.Or(opts.MaxFails, PROXYMAXFAILS),
+		downFor:  cmp.Or(opts.DownFor, PROXYDOWNFOR),
+	}
+	for _, addr := range opts.Upstreams {
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil || !ap.Addr().Is4() {
+			return nil, fmt.Errorf("invalid upstream %q, want an ipv4 host:port", addr)
+		}
+		p.ups = append(p.ups, &upstream{addr: addr, sa: unix.SockaddrInet4{Port: int(ap.Port()), Addr: ap.Addr().As4()}})
+	}
+	s.proxyMetricsOnce.Do(func() { s.proxyMetrics = newProxyMetrics(s.reg, s) })
+	return p, nil
+}
+
+// Handle forwards req to an upstream and answers with what it said, 502 when no upstream
+// could answer and 504 when the one asked took longer than Timeout. It returns once the
+// request is sent, or is waiting for its connection, and answers later.
+func (p *Proxy) Handle(res *Response, req *Request) {
+	p.s.proxyMetrics.requests.Inc()
+	f := &forward{
+		p:        p,
+		res:      res,
+		req:      req,
+		head:     bytes.Equal(req.Method, []byte("HEAD")),
+		retry:    idempotent(req.Method),
+		deadline: time.Now().Add(p.timeout),
+		finish:   res.Later(),
+	}
+	f.try()
+}
+
+// forward is a request on its way through the proxy, from Handle to the response.
+type forward struct {
+	p        *Proxy
+	res      *Response
+	req      *Request
+	head     bool
+	retry    bool // safe to send again once an upstream may have run it
+	deadline time.Time
+	finish   func()
+
+	up    *upstream // the one trying
+	tries int
+}
+
+// try sends the request to the next upstream, the answer comes to done.
+func (f *forward) try() {
+	f.tries++
+	if f.up = f.p.pick(); f.up == nil {
+		f.answer(nil, errNoUpstream)
+		return
+	}
+	uc, err := f.p.conn(f.up)
+	if err != nil {
+		f.done(nil, upstreamResult{err: err})
+		return
+	}
+	uc.start(f.p.request(f.req, f.up), f)
+}
+
+// done takes what uc, nil if it never opened, made of the request. a pooled connection can
+// turn out closed and an upstream can refuse to connect, the request goes again, to the next
+// upstream when that one refused. see lost for when a closed pooled connection is retried.
+func (f *forward) done(uc *upstreamConn, r upstreamResult) {
+	f.p.done(f.up, r.err)
+	if r.err == nil && r.keepAlive {
+		f.p.release(uc)
+	}
+	if (errors.Is(r.err, errUpstreamStale) || errors.Is(r.err, errUpstreamConnect)) && f.tries <= len(f.p.ups) {
+		f.try()
+		return
+	}
+	f.answer(r.raw, r.err)
+}
+
+// answer fills in the response from raw, or from err, and hands it to the server.
+func (f *forward) answer(raw []byte, err error) {
+	if err == nil {
+		err = parseResponse(f.res, raw, f.head)
+	}
+	if err != nil {
+		f.p.s.proxyMetrics.errors.Inc()
+		f.p.s.log.Warn("proxy error", slog.String("path", string(f.req.Path)), upstreamAttr(f.up), logging.Err(err))
+		// not *f.res = Response{...}, the server may still be reading res.later
+		f.res.Status, f.res.Headers, f.res.Body = 502, nil, nil
+		if errors.Is(err, errUpstreamTimeout) {
+			f.res.Status = 504
+		}
+		f.res.WriteString(statusText(f.res.Status) + "\n")
+	}
+	f.finish()
+}
+
+func upstreamAttr(up *upstream) slog.Attr {
+	if up == nil {
+		return slog.String("upstream", "")
+	}
+	return slog.String("upstream", up.addr)
+}
+
+// hop by hop headers, they are about one connection and not passed on, and Content-Length
+// which the sender works out again
+var hopHeaders = [][]byte{
+	[]byte("Connection"), []byte("Keep-Alive"), []byte("Proxy-Authenticate"), []byte("Proxy-Authorization"),
+	[]byte("Proxy-Connection"), []byte("TE"), []byte("Trailer"), []byte("Transfer-Encoding"), []byte("Upgrade"),
+	[]byte("Content-Length"),
+}
+
+func hopHeader(k []byte) bool {
+	for _, h := range hopHeaders {
+		if bytes.EqualFold(k, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// request renders req as sent upstream, HTTP/1.1 and kept alive, with the client added to
+// X-Forwarded-For and X-Forwarded-Proto set to http, whatever the client said. The client's
+// Host goes along, up is the Host of a request without one.
+func (p *Proxy) request(req *Request, up *upstream) []byte {
+	b := make([]byte, 0, 256+len(req.Body))
+	b = append(b, req.Method...)
+	b = append(b, ' ')
+	b = append(b, req.Path...)
+	b = append(b, " HTTP/1.1\r\n"...)
+	var forwarded []byte
+	for _, h := range req.Headers {
+		switch {
+		case hopHeader(h.Key):
+			continue
+		case bytes.EqualFold(h.Key, []byte("X-Forwarded-For")):
+			forwarded = h.Value
+			continue
+		case bytes.EqualFold(h.Key, []byte("X-Forwarded-Proto")):
+			// any client can send one, only we know how it reached us
+			continue
+		}
+		b = append(b, h.Key...)
+		b = append(b, ": "...)
+		b = append(b, h.Value...)
+		b = append(b, "\r\n"...)
+	}
+	client := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	b = append(b, "X-Forwarded-For: "...)
+	if len(forwarded) > 0 {
+		b = append(b, forwarded...)
+		b = append(b, ", "...)
+	}
+	b = append(b, client...)
+	// we only speak plain http
+	b = append(b, "\r\nX-Forwarded-Proto: http\r\n"...)
+	if len(req.Body) > 0 {
+		b = fmt.Appendf(b, "Content-Length: %d\r\n", len(req.Body))
+	}
+	if len(req.Headers.Get([]byte("Host"))) == 0 {
+		b = append(b, "Host: "...)
+		b = append(b, up.addr...)
+		b = append(b, "\r\n"...)
+	}
+	b = append(b, "Connection: keep-alive\r\n\r\n"...)
+	return append(b, req.Body...)
+}
+
+// pick chooses an upstream that is not down and counts a request in flight on it, nil
+// when every upstream is down.
+func (p *Proxy) pick() *upstream {
+	now := time.Now()
+	start := int(p.next.Add(1) - 1)
+	var best *upstream
+	bestActive := 0
+	for i := range p.ups {
+		up := p.ups[(start+i)%len(p.ups)]
+		up.mu.Lock()
+		down, active := now.Before(up.downUntil), up.active
+		up.mu.Unlock()
+		if down {
+			continue
+		}
+		if p.balance == RoundRobin {
+			best = up
+			break
+		}
+		if best == nil || active < bestActive {
+			best, bestActive = up, active
+		}
+	}
+	if best != nil {
+		best.mu.Lock()
+		best.active++
+		best.mu.Unlock()
+	}
+	return best
+}
+
+// done ends the request picked up for, an error that is the upstream's counts towards
+// marking it down.
+func (p *Proxy) done(up *upstream, err error) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.active--
+	switch {
+	case err == nil:
+		up.fails = 0
+		return
+	case errors.Is(err, errUpstreamStale), errors.Is(err, errUpstreamLost), errors.Is(err, ErrServerClosed):
+		return
+	}
+	up.fails++
+	if up.fails >= p.maxFails && !time.Now().Before(up.downUntil) {
+		up.downUntil = time.Now().Add(p.downFor)
+		p.s.log.Warn("upstream down", slog.String("upstream", up.addr), slog.Int("fails", up.fails), slog.Duration("for", p.downFor))
+	}
+}
+
+// conn takes an idle connection to up or starts connecting a new one.
+func (p *Proxy) conn(up *upstream) (*upstreamConn, error) {
+	up.mu.Lock()
+	if n := len(up.idle); n > 0 {
+		uc := up.idle[n-1]
+		up.idle = up.idle[:n-1]
+		up.mu.Unlock()
+		return uc, nil
+	}
+	up.mu.Unlock()
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("upstream socket: %w", err)
+	}
+	unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+	if err := unix.Connect(fd, &up.sa); err != nil && err != unix.EINPROGRESS {
+		unix.Close(fd)
+		return nil, fmt.Errorf("%w: %w", errUpstreamConnect, err)
+	}
+	uc := &upstreamConn{fd: fd, p: p, up: up}
+	p.s.mu.Lock()
+	if p.s.closed {
+		p.s.mu.Unlock()
+		unix.Close(fd)
+		return nil, ErrServerClosed
+	}
+	p.s.upstreamConns[fd] = uc
+	p.s.mu.Unlock()
+	// registered once for everything, edge triggered events come once per change
+	if err := unix.EpollCtl(p.s.epollFd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{
+		Fd:     int32(fd),
+		Events: unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLRDHUP | unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLET,
+	}); err != nil {
+		uc.mu.Lock()
+		uc.fail(err)
+		uc.unlock()
+		return nil, fmt.Errorf("adding upstream to epoll: %w", err)
+	}
+	p.s.proxyMetrics.connsOpened.Inc()
+	return uc, nil
+}
+
+// release puts a connection that answered in full back in its upstream's pool.
+func (p *Proxy) release(uc *upstreamConn) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if uc.closed {
+		return
+	}
+	uc.reused = true
+	up := uc.up
+	up.mu.Lock()
+	if len(up.idle) >= p.maxIdle {
+		up.mu.Unlock()
+		uc.fail(nil)
+		return
+	}
+	up.idle = append(up.idle, uc)
+	up.mu.Unlock()
+}
+
+type upstreamResult struct {
+	raw       []byte
+	keepAlive bool
+	err       error
+}
+
+// upstreamConn is a connection to an upstream, idle in its pool or carrying one request.
+// the worker that sent the request, the poller reporting events and the server looking
+// for timeouts share it under mu.
+type upstreamConn struct {
+	fd int
+	p  *Proxy
+	up *upstream
+
+	mu        sync.Mutex
+	connected bool
+	reused    bool // answered a request before, see errUpstreamStale
+	sent      bool // some of the request reached the socket, see lost
+	closed    bool
+	err       error  // why it closed
+	out       []byte // request bytes not written yet
+	in        []byte // response bytes read so far
+	fwd       *forward
+	deadline  time.Time // fwd's, see HTTPServer.expireUpstreams
+	// fwd's answer once there is one, run by unlock outside mu
+	answer func()
+}
+
+// start sends out for f, the request is written right away when the socket takes it and by
+// the poller on EPOLLOUT when it does not, the answer goes to f.done.
+func (uc *upstreamConn) start(out []byte, f *forward) {
+	uc.mu.Lock()
+	defer uc.unlock()
+	uc.fwd, uc.deadline, uc.out, uc.in, uc.sent = f, f.deadline, out, nil, false
+	if uc.closed {
+		// failed connecting before the request came, or closed by the upstream while idle
+		uc.finish(upstreamResult{err: uc.err})
+		return
+	}
+	if uc.connected {
+		uc.flush()
+	}
+}
+
+// unlock releases mu, then hands the request its answer if it got one meanwhile, the answer
+// may put the connection back in the pool or try another.
+func (uc *upstreamConn) unlock() {
+	answer := uc.answer
+	uc.answer = nil
+	uc.mu.Unlock()
+	if answer != nil {
+		answer()
+	}
+}
+
+// event handles what epoll reported for the connection, on a poller.
+func (uc *upstreamConn) event(events uint32) {
+	uc.mu.Lock()
+	defer uc.unlock()
+	if uc.closed {
+		return
+	}
+	if !uc.connected && events&(unix.EPOLLOUT|unix.EPOLLERR|unix.EPOLLHUP) != 0 {
+		if errno, err := unix.GetsockoptInt(uc.fd, unix.SOL_SOCKET, unix.SO_ERROR); err != nil || errno != 0 {
+			uc.fail(fmt.Errorf("%w: %w", errUpstreamConnect, cmp.Or(err, error(unix.Errno(errno)))))
+			return
+		}
+		uc.connected = true
+	}
+	if uc.connected && len(uc.out) > 0 {
+		if !uc.flush() {
+			return
+		}
+	}
+	if events&(unix.EPOLLIN|unix.EPOLLRDHUP|unix.EPOLLHUP|unix.EPOLLERR) != 0 {
+		uc.read()
+	}
+}
+
+// flush writes what is left of the request until EAGAIN, false if the connection failed.
+// callers hold mu.
+func (uc *upstreamConn) flush() bool {
+	for len(uc.out) > 0 {
+		n, err := unix.Write(uc.fd, uc.out)
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN {
+			return true
+		}
+		if err != nil {
+			uc.fail(uc.lost(err))
+			return false
+		}
+		uc.out = uc.out[n:]
+		uc.sent = uc.sent || n > 0
+	}
+	return true
+}
+
+// read reads until EAGAIN and answers the request once the response is complete.
+// callers hold mu.
+func (uc *upstreamConn) read() {
+	eof := false
+	for !eof {
+		if len(uc.in) > uc.p.s.writeLimit {
+			uc.fail(fmt.Errorf("upstream response over the write buffer limit %d", uc.p.s.writeLimit))
+			return
+		}
+		uc.in = slices.Grow(uc.in, PROXYREADSIZE)
+		n, err := unix.Read(uc.fd, uc.in[len(uc.in):cap(uc.in)])
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN {
+			break
+		}
+		if err != nil {
+			uc.fail(uc.lost(err))
+			return
+		}
+		eof = n == 0
+		uc.in = uc.in[:len(uc.in)+n]
+	}
+	if uc.fwd == nil {
+		// an idle connection has nothing to say, it can only be closing
+		uc.fail(nil)
+		return
+	}
+	n, keepAlive, err := responseLen(uc.in, uc.fwd.head, eof)
+	switch {
+	case err != nil:
+		uc.fail(err)
+	case n > 0:
+		keepAlive = keepAlive && !eof && n == len(uc.in)
+		uc.finish(upstreamResult{raw: uc.in[:n], keepAlive: keepAlive})
+		uc.in = nil
+		if !keepAlive {
+			uc.fail(nil)
+		}
+	case eof:
+		uc.fail(uc.lost(errors.New("upstream closed mid response")))
+	}
+}
+
+// lost is err, or errUpstreamStale when a pooled connection failed before answering and the
+// request can go again: none of it was written, or its method is idempotent. a request the
+// upstream may have run is lost with errUpstreamLost and answered with 502.
+func (uc *upstreamConn) lost(err error) error {
+	switch {
+	case !uc.reused || len(uc.in) > 0:
+		return err
+	case uc.fwd == nil || !uc.sent || uc.fwd.retry:
+		return errUpstreamStale
+	}
+	return errUpstreamLost
+}
+
+// idempotent is whether a request with method can be run twice, RFC 9110 9.2.2.
+func idempotent(method []byte) bool {
+	switch string(method) {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// finish answers the request with r once mu is released, see unlock. callers hold mu.
+func (uc *upstreamConn) finish(r upstreamResult) {
+	if f := uc.fwd; f != nil {
+		uc.answer = func() { f.done(uc, r) }
+		uc.fwd = nil
+	}
+}
+
+// fail answers the request with err, if there is one, and closes the connection.
+// callers hold mu.
+func (uc *upstreamConn) fail(err error) {
+	if err == nil {
+		err = errUpstreamStale
+	}
+	uc.finish(upstreamResult{err: err})
+	if uc.closed {
+		return
+	}
+	uc.closed, uc.err = true, err
+
+	up := uc.up
+	up.mu.Lock()
+	for i, idle := range up.idle {
+		if idle == uc {
+			up.idle = append(up.idle[:i], up.idle[i+1:]...)
+			break
+		}
+	}
+	up.mu.Unlock()
+
+	s := uc.p.s
+	// out of the map before the fd is closed and can be reused
+	s.mu.Lock()
+	if s.upstreamConns[uc.fd] == uc {
+		delete(s.upstreamConns, uc.fd)
+	}
+	s.mu.Unlock()
+	unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_DEL, uc.fd, nil)
+	unix.Close(uc.fd)
+}
+
+// responseLen returns the length of the complete response at the start of p, 0 when more
+// bytes are needed, and whether the upstream keeps the connection open after it. A response
+// without a length ends when the upstream closes, eof.
+func responseLen(p []byte, head, eof bool) (n int, keepAlive bool, err error) {
+	end := bytes.Index(p, []byte("\r\n\r\n"))
+	if end == -1 {
+		if len(p) > MAXHEADERSIZE {
+			return 0, false, fmt.Errorf("upstream response headers too large")
+		}
+		return 0, false, nil
+	}
+	end += 4
+
+	line, rest, _ := bytes.Cut(p[:end], []byte("\r\n"))
+	version, status, err := statusLine(line)
+	if err != nil {
+		return 0, false, err
+	}
+	keepAlive = bytes.Equal(version, []byte("HTTP/1.1"))
+	contentLength, chunked := -1, false
+	for _, h := range bytes.Split(rest, []byte("\r\n")) {
+		key, val, found := bytes.Cut(h, []byte(":"))
+		if !found {
+			continue
+		}
+		key, val = bytes.TrimSpace(key), bytes.TrimSpace(val)
+		switch {
+		case bytes.EqualFold(key, []byte("Content-Length")):
+			contentLength, err = strconv.Atoi(string(val))
+			if err != nil || contentLength < 0 {
+				return 0, false, fmt.Errorf("upstream sent a bad content length %q", val)
+			}
+		case bytes.EqualFold(key, []byte("Transfer-Encoding")):
+			chunked = bytes.EqualFold(val, []byte("chunked"))
+		case bytes.EqualFold(key, []byte("Connection")):
+			if bytes.EqualFold(val, []byte("close")) {
+				keepAlive = false
+			} else if bytes.EqualFold(val, []byte("keep-alive")) {
+				keepAlive = true
+			}
+		}
+	}
+
+	switch {
+	case head || status/100 == 1 || status == 204 || status == 304:
+		return end, keepAlive, nil
+	case chunked:
+		n, err := chunkedLen(p[end:])
+		if n == 0 || err != nil {
+			return 0, false, err
+		}
+		return end + n, keepAlive, nil
+	case contentLength >= 0:
+		if len(p) < end+contentLength {
+			return 0, false, nil
+		}
+		return end + contentLength, keepAlive, nil
+	}
+	// read to the end, the connection goes with it
+	if eof {
+		return len(p), false, nil
+	}
+	return 0, false, nil
+}
+
+// chunkedLen returns the length of the chunked body at the start of p, trailers included,
+// or 0 when more bytes are needed.
+func chunkedLen(p []byte) (int, error) {
+	off := 0
+	for {
+		i := bytes.Index(p[off:], []byte("\r\n"))
+		if i == -1 {
+			return 0, nil
+		}
+		sizeField, _, _ := bytes.Cut(p[off:off+i], []byte(";"))
+		size, err := strconv.ParseInt(string(bytes.TrimSpace(sizeField)), 16, 32)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("upstream sent a bad chunk size %q", sizeField)
+		}
+		off += i + 2
+		if size == 0 {
+			break
+		}
+		off += int(size) + 2
+		if off > len(p) {
+			return 0, nil
+		}
+	}
+	// trailers, up to an empty line
+	for {
+		i := bytes.Index(p[off:], []byte("\r\n"))
+		if i == -1 {
+			return 0, nil
+		}
+		off += i + 2
+		if i == 0 {
+			return off, nil
+		}
+	}
+}
+
+func statusLine(line []byte) (version []byte, status int, err error) {
+	version, rest, _ := bytes.Cut(line, []byte(" "))
+	code, _, _ := bytes.Cut(rest, []byte(" "))
+	status, err = strconv.Atoi(string(code))
+	if !bytes.HasPrefix(version, []byte("HTTP/1.")) || err != nil || status < 100 || status > 999 {
+		return nil, 0, fmt.Errorf("upstream sent a bad status line %q", line)
+	}
+	return version, status, nil
+}
+
+// parseResponse fills res from raw, a complete response as responseLen measured it. Hop by
+// hop headers stay behind and a chunked body is joined, res gets a Content-Length of its own
+// unless it has no body, then the upstream's is the length of the one it did not send.
+func parseResponse(res *Response, raw []byte, head bool) error {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	line, rest, _ := bytes.Cut(raw[:end], []byte("\r\n"))
+	_, status, err := statusLine(line)
+	if err != nil {
+		return err
+	}
+	res.Status = status
+	keepLength := head || status == 304
+	chunked := false
+	for _, h := range bytes.Split(rest, []byte("\r\n")) {
+		key, val, found := bytes.Cut(h, []byte(":"))
+		if !found {
+			continue
+		}
+		key, val = bytes.TrimSpace(key), bytes.TrimSpace(val)
+		if bytes.EqualFold(key, []byte("Transfer-Encoding")) {
+			chunked = bytes.EqualFold(val, []byte("chunked"))
+		}
+		if hopHeader(key) && !(keepLength && bytes.EqualFold(key, []byte("Content-Length"))) {
+			continue
+		}
+		res.Headers.Add(key, val)
+	}
+	body := raw[end+4:]
+	if head || !chunked {
+		res.Body = body
+		return nil
+	}
+	for {
+		sizeLine, rest, _ := bytes.Cut(body, []byte("\r\n"))
+		sizeField, _, _ := bytes.Cut(sizeLine, []byte(";"))
+		size, _ := strconv.ParseInt(string(bytes.TrimSpace(sizeField)), 16, 32)
+		if size == 0 {
+			return nil
+		}
+		res.Body = append(res.Body, rest[:size]...)
+		body = rest[size+2:]
+	}
+}
+
+// failUpstreams closes every upstream connection, requests waiting on one get ErrServerClosed.
+func (s *HTTPServer) failUpstreams() {
+	for _, uc := range s.upstreams() {
+		uc.mu.Lock()
+		uc.fail(ErrServerClosed)
+		uc.unlock()
+	}
+}
+
+// expireUpstreams fails the requests whose upstream took longer than the proxy's Timeout.
+func (s *HTTPServer) expireUpstreams(now time.Time) {
+	for _, uc := range s.upstreams() {
+		uc.mu.Lock()
+		if uc.fwd != nil && now.After(uc.deadline) {
+			uc.fail(errUpstreamTimeout)
+		}
+		uc.unlock()
+	}
+}
+
+func (s *HTTPServer) upstreams() []*upstreamConn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ucs := make([]*upstreamConn, 0, len(s.upstreamConns))
+	for _, uc := range s.upstreamConns {
+		ucs = append(ucs, uc)
+	}
+	return ucs
+}
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+)
+
+// upstream starts an HTTP server answering with its name, the path and the forwarding
+// headers it got.
+func upstreamServer(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", name)
+		fmt.Fprintf(w, "%s %s %s for=%s proto=%s", name, r.Method, r.URL, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"))
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func upstreamAddr(u *httptest.Server) string { return u.Listener.Addr().String() }
+
+func startProxy(t *testing.T, opts *ProxyOpts) (*HTTPServer, *Proxy) {
+	t.Helper()
+	s := startHTTPServerOpts(t, &HTTPServerOpts{Workers: 4})
+	p, err := s.NewProxy(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.HandlePrefix("/api/", p.Handle)
+	return s, p
+}
+
+// get sends a GET on conn and reads the response.
+func get(t *testing.T, conn net.Conn, path string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\n%s\r\n", path, strings.Join(headers, ""))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	return res, string(body)
+}
+
+func TestProxyRoundRobin(t *testing.T) {
+	a, b := upstreamServer(t, "a"), upstreamServer(t, "b")
+	s, _ := startProxy(t, &ProxyOpts{Upstreams: []string{upstreamAddr(a), upstreamAddr(b)}})
+
+	conn := dial(t, s)
+	var got []string
+	for i := range 4 {
+		res, body := get(t, conn, fmt.Sprintf("/api/x?i=%d", i), "X-Forwarded-For: 10.0.0.1\r\n", "X-Forwarded-Proto: https\r\n")
+		if res.StatusCode != 200 || res.Header.Get("X-Upstream") == "" {
+			t.Fatalf("%d: %v %q", i, res.Status, body)
+		}
+		want := fmt.Sprintf(" GET /api/x?i=%d for=10.0.0.1, 127.0.0.1 proto=http", i)
+		if !strings.HasSuffix(body, want) {
+			t.Fatalf("got %q, want it to end in %q", body, want)
+		}
+		got = append(got, body[:1])
+	}
+	if strings.Join(got, "") != "abab" && strings.Join(got, "") != "baba" {
+		t.Fatalf("upstreams in turn: %v", got)
+	}
+	// one connection to each upstream, reused after
+	if n := s.proxyMetrics.connsOpened.Value(); n != 2 {
+		t.Fatalf("opened %d upstream connections", n)
+	}
+
+	// the exact route is still served here
+	if res, _ := get(t, conn, "/hello"); res.Header.Get("X-Upstream") != "" {
+		t.Fatal("/hello proxied")
+	}
+}
+
+// TestProxyLeastConns keeps one request busy on a slow upstream, the next go to the other.
+func TestProxyLeastConns(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "slow")
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+	fast := upstreamServer(t, "fast")
+	s, p := startProxy(t, &ProxyOpts{Upstreams: []string{upstreamAddr(slow), upstreamAddr(fast)}, Balance: LeastConns})
+
+	busy := dial(t, s)
+	fmt.Fprint(busy, "GET /api/slow HTTP/1.1\r\n\r\n")
+	waitFor(t, "the slow upstream busy", func() bool {
+		p.ups[0].mu.Lock()
+		defer p.ups[0].mu.Unlock()
+		return p.ups[0].active == 1
+	})
+	conn := dial(t, s)
+	for range 3 {
+		if _, body := get(t, conn, "/api/"); !strings.HasPrefix(body, "fast ") {
+			t.Fatalf("went to the busy upstream: %q", body)
+		}
+	}
+}
+
+// TestProxyFreesWorker keeps a request waiting on a slow upstream with one worker, the
+// worker serves other connections, and requests behind it on the same connection are
+// answered after it.
+func TestProxyFreesWorker(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "slow")
+	}))
+	t.Cleanup(slow.Close)
+	s := startHTTPServerOpts(t, &HTTPServerOpts{Workers: 1})
+	p, err := s.NewProxy(&ProxyOpts{Upstreams: []string{upstreamAddr(slow)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.HandlePrefix("/api/", p.Handle)
+
+	busy := dial(t, s)
+	fmt.Fprint(busy, "GET /api/slow HTTP/1.1\r\n\r\nGET /hello HTTP/1.1\r\n\r\n")
+	waitFor(t, "the request upstream", func() bool {
+		p.ups[0].mu.Lock()
+		defer p.ups[0].mu.Unlock()
+		return p.ups[0].active == 1
+	})
+	hello(t, dial(t, s))
+
+	close(release)
+	r := bufio.NewReader(busy)
+	for _, want := range []string{"slow", "hello\n"} {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, _ := io.ReadAll(res.Body); string(body) != want {
+			t.Fatalf("got %q, want %q", body, want)
+		}
+	}
+}
+
+// TestProxyUpstreamDown sends requests to a dead upstream and a live one, the dead one is
+// retried around and marked down.
+func TestProxyUpstreamDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+	live := upstreamServer(t, "live")
+	s, p := startProxy(t, &ProxyOpts{Upstreams: []string{dead, upstreamAddr(live)}, MaxFails: 1, DownFor: time.Minute})
+
+	conn := dial(t, s)
+	for range 4 {
+		if res, body := get(t, conn, "/api/"); res.StatusCode != 200 || !strings.HasPrefix(body, "live ") {
+			t.Fatalf("%s %q", res.Status, body)
+		}
+	}
+	up := p.ups[0]
+	up.mu.Lock()
+	down := time.Now().Before(up.downUntil)
+	up.mu.Unlock()
+	if !down {
+		t.Fatal("refusing upstream not marked down")
+	}
+	// after the first refusal nobody tries it
+	if n := s.proxyMetrics.connsOpened.Value(); n != 2 {
+		t.Fatalf("opened %d upstream connections", n)
+	}
+
+	live.Close()
+	if res, _ := get(t, conn, "/api/"); res.StatusCode != 502 {
+		t.Fatalf("every upstream gone: %s", res.Status)
+	}
+}
+
+func TestProxyTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(hang.Close)
+	t.Cleanup(func() { close(release) })
+	s, _ := startProxy(t, &ProxyOpts{Upstreams: []string{upstreamAddr(hang)}, Timeout: 100 * time.Millisecond})
+
+	if res, _ := get(t, dial(t, s), "/api/"); res.StatusCode != 504 {
+		t.Fatalf("got %s", res.Status)
+	}
+}
+
+// TestProxyStaleConn closes the pooled connection upstream side between two requests, the
+// second is sent again on a new one.
+func TestProxyStaleConn(t *testing.T) {
+	u := upstreamServer(t, "u")
+	s, _ := startProxy(t, &ProxyOpts{Upstreams: []string{upstreamAddr(u)}})
+	conn := dial(t, s)
+	get(t, conn, "/api/")
+	u.CloseClientConnections()
+	waitFor(t, "the pooled connection closed", func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return len(s.upstreamConns) == 0
+	})
+	if res, body := get(t, conn, "/api/"); res.StatusCode != 200 || !strings.HasPrefix(body, "u ") {
+		t.Fatalf("%s %q", res.Status, body)
+	}
+}
+
+// TestProxyChunked passes on a body the upstream streamed chunked, with a length of its own.
+func TestProxyChunked(t *testing.T) {
+	part := strings.Repeat("x", 8<<10)
+	u := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for range 8 {
+			io.WriteString(w, part)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(u.Close)
+	s, _ := startProxy(t, &ProxyOpts{Upstreams: []string{upstreamAddr(u)}})
+
+	res, body := get(t, dial(t, s), "/api/")
+	if res.StatusCode != 200 || body != strings.Repeat(part, 8) || res.ContentLength != int64(len(body)) {
+		t.Fatalf("%s, %d bytes, length %d", res.Status, len(body), res.ContentLength)
+	}
+	if res.Header.Get("Content-Type") != "application/octet-stream" || res.Header.Get("Transfer-Encoding") != "" {
+		t.Fatalf("headers %v", res.Header)
+	}
+}
+
+// TestProxyBodyless passes on the upstream's Content-Length for HEAD and 304 without a body,
+// the connection stays in step for the request after.
+func TestProxyBodyless(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(r)
+			if err != nil {
+				return
+			}
+			switch req.URL.Path {
+			case "/api/304":
+				io.WriteString(conn, "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\nContent-Length: 1234\r\n\r\n")
+			case "/api/204":
+				io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+			default:
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 1234\r\n\r\n")
+			}
+		}
+	}()
+	s, _ := startProxy(t, &ProxyOpts{Upstreams: []string{ln.Addr().String()}})
+
+	conn := dial(t, s)
+	r := bufio.NewReader(conn)
+	for _, tt := range []struct {
+		method, path string
+		status       int
+		length       string
+	}{
+		{"HEAD", "/api/", 200, "1234"},
+		{"GET", "/api/304", 304, "1234"},
+		{"GET", "/api/204", 204, ""},
+	} {
+		fmt.Fprintf(conn, "%s %s HTTP/1.1\r\n\r\n", tt.method, tt.path)
+		res, err := http.ReadResponse(r, &http.Request{Method: tt.method})
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.status || res.Header.Get("Content-Length") != tt.length {
+			t.Fatalf("%s %s: %s, length %q", tt.method, tt.path, res.Status, res.Header.Get("Content-Length"))
+		}
+	}
+	fmt.Fprint(conn, "GET /hello HTTP/1.1\r\n\r\n")
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(res.Body); string(body) != "hello\n" {
+		t.Fatalf("after them got %q", body)
+	}
+}
+
+// TestProxyNoResend answers 502 when a pooled connection closes after taking a POST, the
+// upstream may have run it and it is not sent again.
+func TestProxyNoResend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var posts atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(r)
+					if err != nil {
+						return
+					}
+					io.Copy(io.Discard, req.Body)
+					if req.Method == "POST" {
+						// ran it, then went away without a word
+						posts.Add(1)
+						return
+					}
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+				}
+			}()
+		}
+	}()
+	s, _ := startProxy(t, &ProxyOpts{Upstreams: []string{ln.Addr().String()}})
+
+	conn := dial(t, s)
+	if res, body := get(t, conn, "/api/"); res.StatusCode != 200 || body != "ok" {
+		t.Fatalf("%s %q", res.Status, body)
+	}
+	fmt.Fprint(conn, "POST /api/ HTTP/1.1\r\nContent-Length: 4\r\n\r\nbody")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 502 {
+		t.Fatalf("got %s, want 502", res.Status)
+	}
+	if n := posts.Load(); n != 1 {
+		t.Fatalf("upstream ran the POST %d times", n)
+	}
+}
+
+func TestResponseLen(t *testing.T) {
+	for _, tt := range []struct {
+		in        string
+		head, eof bool
+		complete  bool
+		keepAlive bool
+	}{
+		{"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi", false, false, true, true},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nh", false, false, false, false},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n", true, false, true, true},
+		{"HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nhi", false, false, true, false},
+		{"HTTP/1.0 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nhi", false, false, true, true},
+		{"HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nhi", false, false, true, false},
+		{"HTTP/1.1 204 No Content\r\n\r\n", false, false, true, true},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n\r\n", false, false, true, true},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n", false, false, false, false},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-Sum: 1\r\n\r\n", false, false, true, true},
+		{"HTTP/1.1 200 OK\r\n\r\nuntil eof", false, false, false, false},
+		{"HTTP/1.1 200 OK\r\n\r\nuntil eof", false, true, true, false},
+	} {
+		want := 0
+		if tt.complete {
+			want = len(tt.in)
+		}
+		n, keepAlive, err := responseLen([]byte(tt.in), tt.head, tt.eof)
+		if err != nil || n != want || keepAlive != tt.keepAlive {
+			t.Errorf("%q: %d, %v, %v, want %d, %v", tt.in, n, keepAlive, err, want, tt.keepAlive)
+		}
+	}
+	for _, in := range []string{
+		"SPDY 200 OK\r\n\r\n",
+		"HTTP/1.1 2xx OK\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+	} {
+		if _, _, err := responseLen([]byte(in), false, false); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+}
+
+func TestNewProxyErrors(t *testing.T) {
+	s, err := NewHTTPServer(&HTTPServerOpts{Addr: "127.0.0.1", Logger: logging.Discard()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, opts := range []ProxyOpts{
+		{},
+		{Upstreams: []string{"localhost:80"}},
+		{Upstreams: []string{"127.0.0.1:80"}, Balance: "random"},
+		{Upstreams: []string{"127.0.0.1:80"}, Timeout: -1},
+	} {
+		if _, err := s.NewProxy(&opts); err == nil {
+			t.Errorf("no error for %+v", opts)
+		}
+	}
+}
@@ -1,25 +1,95 @@
 package server
 
 import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"runtime"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/toastsandwich/epoll-learn/http1.0_server/pkg/pool"
+	"github.com/toastsandwich/epoll-learn/pkg/accesslog"
+	"github.com/toastsandwich/epoll-learn/pkg/control"
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+	"github.com/toastsandwich/epoll-learn/pkg/metrics"
+	"github.com/toastsandwich/epoll-learn/pkg/pool"
+	"github.com/toastsandwich/epoll-learn/pkg/ringbuf"
 	"golang.org/x/sys/unix"
 )
 
+// events the loop registers for, the trigger mode adds EPOLLET to them, see loop.Trigger.Events
 const (
-	EVENT_IN_OUT_ET_ERR = unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLET | unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLRDHUP
-	EVENT_IN_ET_ERR     = unix.EPOLLIN | unix.EPOLLET | unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLRDHUP
+	EVENT_IN_OUT_ERR = unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLRDHUP
+	EVENT_IN_ERR     = unix.EPOLLIN | unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLRDHUP
+	EVENT_OUT_ERR    = unix.EPOLLOUT | unix.EPOLLERR | unix.EPOLLHUP
 )
 
+var ErrServerClosed = errors.New("http server closed")
+
+type HandlerFunc func(res *Response, req *Request)
+
 type HTTPServerOpts struct {
 	Addr string
-	Port int
+	Port int // 0 picks a free port, see HTTPServer.Addr
+	// ListenFd is a listening socket to serve on instead of binding Addr and Port, one
+	// handed over by the process being upgraded, see package upgrade. 0 binds.
+	ListenFd int
 
+	// ReadTimeout closes a connection that has waited this long for its next request,
+	// counted from accepting it or from its last response leaving. WriteTimeout closes one
+	// whose queued response has not moved for this long. 0 is no limit for either.
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+
+	Workers int // defaults to runtime.NumCPU()
+
+	// Backend picks the event loop, epoll by default. io_uring falls back to epoll with a
+	// warning when the kernel lacks something it needs.
+	Backend loop.Backend
+	// Trigger is how epoll reports ready sockets, edge by default. Edge triggered the loop
+	// drains every socket until EAGAIN, level triggered it reads loop.LEVELREADS times per
+	// connection and accepts loop.LEVELACCEPTS connections per wakeup.
+	Trigger loop.Trigger
+	// OneShot registers connections with EPOLLONESHOT, an event disarms the connection until
+	// the poller that got it, or the worker it handed requests to, is done and re-arms it.
+	// no two goroutines ever handle the same connection at once, so Pollers can be above 1.
+	OneShot bool
+	// Pollers is how many goroutines call EpollWait on the one epoll fd, 1 by default.
+	// more than one needs OneShot.
+	Pollers int
+
+	// per connection buffer caps in bytes, the buffers grow from the pool up to them.
+	// a request that does not fit in ReadBufferLimit is refused, a response that does
+	// not fit in WriteBufferLimit closes the connection.
+	ReadBufferLimit  int // defaults to DEFAULTREADLIMIT
+	WriteBufferLimit int // defaults to DEFAULTWRITELIMIT
+
+	// a connection whose unflushed output goes above WriteHighWater bytes is not read
+	// until it is down to WriteLowWater, a client pipelining faster than it reads waits in
+	// its own socket instead of our memory. epoll only.
+	WriteHighWater int // defaults to a quarter of WriteBufferLimit
+	WriteLowWater  int // defaults to a quarter of WriteHighWater
+
+	// MaxConns caps open connections, 0 leaves them uncapped. OverLimit is what happens past
+	// it, by default loop.Reject: the connection gets a 503 and is closed. loop.Pause stops
+	// accepting until a connection closes, new clients wait in the listen backlog.
+	MaxConns  int
+	OverLimit loop.OverLimit
+
+	// AccessLog gets a line per response once it is queued, from the worker that served it.
+	// nil logs no requests.
+	AccessLog *accesslog.Logger
+
+	Logger  *slog.Logger      // defaults to logging.Default()
+	Metrics *metrics.Registry // defaults to a registry of its own, see HTTPServer.Metrics
 }
 
 type HTTPServer struct {
@@ -27,11 +97,52 @@ type HTTPServer struct {
 
 	Fd      int // server fd
 	epollFd int
+	wakeFd  int // eventfd used by Close to stop the loop
 
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
+	backend loop.Backend
+	trigger loop.Trigger
+	oneshot bool
+	pollers int
+	// connections with responses for the io_uring loop, see HTTPServer.kick
+	kickMu      sync.Mutex
+	kicked      []*Conn
+	kickPending bool
+	// the io_uring loop reads wakeFd into it, the kernel writes it after the call that asked,
+	// so it lives here on the heap where the loop goroutine's stack cannot move it away
+	uringWake [8]byte
+
+	ReadTimeout  time.Duration // under mu, see Reload
+	WriteTimeout time.Duration // under mu, see Reload
+
+	readLimit, writeLimit int
+	highWater, lowWater   int
+
+	maxConns     int            // under mu, see Reload
+	overLimit    loop.OverLimit // under mu, see Reload
+	acceptPaused bool           // the listener is out of epoll for loop.Pause, under mu
+	// closed to accept and drop a connection when out of descriptors, see loop.SpareFd
+	spare *loop.SpareFd
 
 	ActiveConnMap map[int]*Conn
+	// connections to proxy upstreams, polled with the clients, see Proxy
+	upstreamConns    map[int]*upstreamConn
+	proxyMetrics     *proxyMetrics
+	proxyMetricsOnce sync.Once
+
+	routes   map[string]HandlerFunc
+	prefixes []prefixRoute // longest first
+	jm       *JobManager
+
+	log       *slog.Logger
+	accessLog *accesslog.Logger
+	reg       *metrics.Registry
+	metrics   *serverMetrics
+
+	serving bool
+	closed  bool
+	done    chan struct{}
+	// set by Shutdown, responses close their connection from then on
+	draining atomic.Bool
 
 	mu sync.RWMutex
 }
@@ -39,43 +150,158 @@ type HTTPServer struct {
 func NewHTTPServer(opts *HTTPServerOpts) (*HTTPServer, error) {
 	server := &HTTPServer{}
 
-	fmt.Sscanf(opts.Addr, "%d.%d.%d.%d", server.sockAddr.Addr[0], server.sockAddr.Addr[1], server.sockAddr.Addr[2], server.sockAddr.Addr[3])
-	server.sockAddr.Port = opts.Port
+	if opts.ListenFd == 0 {
+		addr, err := netip.ParseAddr(opts.Addr)
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("invalid ipv4 address %q", opts.Addr)
+		}
+		server.sockAddr.Addr = addr.As4()
+		server.sockAddr.Port = opts.Port
+	}
 
 	server.ActiveConnMap = make(map[int]*Conn)
+	server.upstreamConns = make(map[int]*upstreamConn)
+	server.routes = make(map[string]HandlerFunc)
+	server.done = make(chan struct{})
 
 	server.ReadTimeout = opts.ReadTimeout
 	server.WriteTimeout = opts.WriteTimeout
 
-	if err := server.initSocket(); err != nil {
+	server.readLimit = cmp.Or(opts.ReadBufferLimit, DEFAULTREADLIMIT)
+	server.writeLimit = cmp.Or(opts.WriteBufferLimit, DEFAULTWRITELIMIT)
+	server.highWater = cmp.Or(opts.WriteHighWater, server.writeLimit/4)
+	server.lowWater = cmp.Or(opts.WriteLowWater, server.highWater/4)
+	if server.lowWater >= server.highWater || server.highWater > server.writeLimit {
+		return nil, fmt.Errorf("write water marks %d/%d, want low below high and high at most the write buffer limit %d",
+			server.lowWater, server.highWater, server.writeLimit)
+	}
+
+	if opts.MaxConns < 0 {
+		return nil, fmt.Errorf("max connections %d, want 0 for no limit or more", opts.MaxConns)
+	}
+	server.maxConns = opts.MaxConns
+	if _, err := loop.ParseOverLimit(string(opts.OverLimit)); err != nil {
 		return nil, err
 	}
-	if err := server.setUpEPolling(); err != nil {
+	server.overLimit = cmp.Or(opts.OverLimit, loop.Reject)
+
+	server.log = opts.Logger
+	if server.log == nil {
+		server.log = logging.Default()
+	}
+
+	server.accessLog = opts.AccessLog
+
+	server.reg = opts.Metrics
+	if server.reg == nil {
+		server.reg = metrics.NewRegistry()
+	}
+	server.metrics = newServerMetrics(server.reg, server)
+
+	server.trigger = cmp.Or(opts.Trigger, loop.Edge)
+	server.oneshot = opts.OneShot
+	server.pollers = cmp.Or(opts.Pollers, 1)
+	if server.pollers > 1 && !server.oneshot {
+		return nil, fmt.Errorf("%d pollers need OneShot, two of them could get events for one connection", server.pollers)
+	}
+	var err error
+	server.backend, err = loop.Resolve(opts.Backend)
+	if err != nil {
+		server.log.Warn("io_uring unavailable, using epoll", logging.Err(err))
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	server.spare, err = loop.NewSpareFd()
+	if err != nil {
 		return nil, err
 	}
+	if opts.ListenFd != 0 {
+		if err := loop.AdoptListener(opts.ListenFd); err != nil {
+			server.spare.Close()
+			return nil, fmt.Errorf("adopting listener: %w", err)
+		}
+		server.Fd = opts.ListenFd
+	} else if err := server.initSocket(); err != nil {
+		server.spare.Close()
+		return nil, fmt.Errorf("setting up listener on %s:%d: %w", opts.Addr, opts.Port, err)
+	}
+	if err := server.setUpEPolling(); err != nil {
+		server.spare.Close()
+		unix.Close(server.Fd)
+		return nil, fmt.Errorf("setting up epoll: %w", err)
+	}
+	server.jm = NewJobManager(workers)
 	return server, nil
 }
 
+// HandleFunc registers h for requests whose path (without the query) is exactly path.
+func (s *HTTPServer) HandleFunc(path string, h HandlerFunc) {
+	s.mu.Lock()
+	s.routes[path] = h
+	s.mu.Unlock()
+}
+
+// HandlePrefix registers h for requests whose path starts with prefix, such as a Proxy
+// for /api/. An exact HandleFunc path wins, then the longest prefix.
+func (s *HTTPServer) HandlePrefix(prefix string, h HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prefixes = slices.DeleteFunc(s.prefixes, func(r prefixRoute) bool { return r.prefix == prefix })
+	s.prefixes = append(s.prefixes, prefixRoute{prefix, h})
+	slices.SortStableFunc(s.prefixes, func(a, b prefixRoute) int { return len(b.prefix) - len(a.prefix) })
+}
+
+type prefixRoute struct {
+	prefix string
+	h      HandlerFunc
+}
+
+// Metrics returns the registry the server reports to.
+func (s *HTTPServer) Metrics() *metrics.Registry { return s.reg }
+
+// Addr returns the address the server is bound to, useful when Port was 0.
+func (s *HTTPServer) Addr() string {
+	sa, err := unix.Getsockname(s.Fd)
+	if err != nil {
+		return ""
+	}
+	return sockaddrString(sa)
+}
+
 func (s *HTTPServer) initSocket() error {
 
 	sockfd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP)
 	if err != nil {
-		return err
+		return fmt.Errorf("socket: %w", err)
 	}
 
 	if err := unix.SetsockoptInt(sockfd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
-		return err
+		unix.Close(sockfd)
+		return fmt.Errorf("setsockopt SO_REUSEADDR: %w", err)
 	}
 	if err := unix.SetsockoptInt(sockfd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
-		return err
+		unix.Close(sockfd)
+		return fmt.Errorf("setsockopt SO_REUSEPORT: %w", err)
 	}
 
 	if err := unix.SetNonblock(sockfd, true); err != nil {
-		return err
+		unix.Close(sockfd)
+		return fmt.Errorf("set nonblock: %w", err)
 	}
 
 	if err := unix.Bind(sockfd, &s.sockAddr); err != nil {
-		return err
+		unix.Close(sockfd)
+		return fmt.Errorf("bind: %w", err)
+	}
+
+	// listening right away means the kernel queues connections that arrive before ListenAndServe
+	if err := unix.Listen(sockfd, 2048); err != nil {
+		unix.Close(sockfd)
+		return fmt.Errorf("listen: %w", err)
 	}
 
 	s.Fd = sockfd
@@ -85,41 +311,75 @@ func (s *HTTPServer) initSocket() error {
 func (s *HTTPServer) setUpEPolling() error {
 	epollFd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
 	if err != nil {
-		return err
+		return fmt.Errorf("epoll_create1: %w", err)
 	}
 
 	// first event always given to http server.
 	event := &unix.EpollEvent{
 		Fd:     int32(s.Fd),
-		Events: EVENT_IN_ET_ERR,
+		Events: s.events(EVENT_IN_ERR),
 	}
 
 	if err := unix.EpollCtl(epollFd, unix.EPOLL_CTL_ADD, s.Fd, event); err != nil {
-		return err
+		unix.Close(epollFd)
+		return fmt.Errorf("adding listener to epoll: %w", err)
 	}
+
+	wakeFd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(epollFd)
+		return fmt.Errorf("eventfd: %w", err)
+	}
+	if err := unix.EpollCtl(epollFd, unix.EPOLL_CTL_ADD, wakeFd, &unix.EpollEvent{
+		Fd:     int32(wakeFd),
+		Events: unix.EPOLLIN,
+	}); err != nil {
+		unix.Close(wakeFd)
+		unix.Close(epollFd)
+		return fmt.Errorf("adding eventfd to epoll: %w", err)
+	}
+
 	s.epollFd = epollFd
+	s.wakeFd = wakeFd
 	return nil
 }
 
+// accept takes pending connections until EAGAIN, or as many as the trigger mode allows per
+// wakeup, or until MaxConns with loop.Pause.
 func (s *HTTPServer) accept() {
-	for {
-		cfd, _, err := unix.Accept(s.Fd)
+	accepts := s.trigger.Accepts()
+	for i := 0; accepts == 0 || i < accepts; i++ {
+		if s.pauseAccepting() {
+			break
+		}
+		cfd, sa, err := unix.Accept4(s.Fd, loop.AcceptFlags)
 		if err != nil {
 			if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
 				break
 			}
-			fmt.Println("error accepting new connection:", err)
-			continue
+			if err == unix.EINTR || err == unix.ECONNABORTED {
+				continue
+			}
+			if loop.OutOfFds(err) && s.shed(err) {
+				continue
+			}
+			s.log.Error("error accepting new connection", logging.Err(err))
+			break
 		}
-		fmt.Println("new connection!!")
-
-		if err := unix.SetNonblock(cfd, true); err != nil {
-			fmt.Println(err)
+		if s.full() {
+			s.reject(cfd, sockaddrString(sa))
 			continue
 		}
 
 		// create conn and add it to conn map
-		conn := NewConn(cfd)
+		peer := sockaddrString(sa)
+		conn := NewConn(cfd, s.epollFd, s.readLimit, s.writeLimit, logging.Conn(s.log, cfd, peer))
+		conn.peer = peer
+		conn.trigger, conn.oneshot = s.trigger, s.oneshot
+		conn.highWater, conn.lowWater = s.highWater, s.lowWater
+		conn.onPause = s.metrics.readPauses.Inc
+		conn.log.Debug("new connection")
+		s.metrics.accepted.Inc()
 		s.mu.Lock()
 		s.ActiveConnMap[cfd] = conn
 		s.mu.Unlock()
@@ -127,22 +387,148 @@ func (s *HTTPServer) accept() {
 		// hand off cfd as intrested in epoll instance
 		clientEvent := &unix.EpollEvent{
 			Fd:     int32(cfd),
-			Events: EVENT_IN_ET_ERR,
+			Events: s.events(EVENT_IN_ERR),
 		}
 
 		if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_ADD, cfd, clientEvent); err != nil {
-			fmt.Println("error setting controls for new client connection:", err)
+			conn.log.Error("error setting controls for new client connection", logging.Err(err))
+			s.closeConn(conn)
 		}
 	}
 }
 
+// events returns the epoll events to register for, with the trigger mode and oneshot applied.
+func (s *HTTPServer) events(events uint32) uint32 {
+	if s.oneshot {
+		events |= unix.EPOLLONESHOT
+	}
+	return s.trigger.Events(events)
+}
+
+// full reports whether MaxConns connections are open.
+func (s *HTTPServer) full() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return atLimit(len(s.ActiveConnMap), s.maxConns)
+}
+
+// atLimit reports whether conns open connections are at maxConns, 0 is no limit.
+func atLimit(conns, maxConns int) bool {
+	return maxConns > 0 && conns >= maxConns
+}
+
+// limits returns MaxConns and OverLimit as last set, for the io_uring loop.
+func (s *HTTPServer) limits() (int, loop.OverLimit) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maxConns, s.overLimit
+}
+
+// serverFull is what a connection past MaxConns gets with loop.Reject.
+var serverFull = func() []byte {
+	res := &Response{Status: 503}
+	res.SetHeader("Connection", "close")
+	res.WriteString("too many connections\n")
+	return toByte(res)
+}()
+
+// reject turns away a connection past MaxConns. one write, a fresh socket's send buffer
+// takes the whole response, and whatever the client sent meanwhile is not read.
+func (s *HTTPServer) reject(fd int, peer string) {
+	unix.Write(fd, serverFull)
+	unix.Close(fd)
+	s.metrics.rejected.Inc()
+	s.log.Debug("too many connections, rejected", slog.String(logging.KeyPeer, peer))
+}
+
+// shed drops a pending connection after accept failed with err for want of descriptors,
+// see loop.SpareFd. it reports whether one was dropped and accepting can go on.
+func (s *HTTPServer) shed(err error) bool {
+	s.log.Warn("out of file descriptors, dropping a pending connection", logging.Err(err))
+	if !s.spare.Shed(s.Fd) {
+		return false
+	}
+	s.metrics.shed.Inc()
+	return true
+}
+
+// pauseAccepting takes the listener out of epoll once MaxConns connections are open with
+// loop.Pause, it reports whether it did. resumeAccepting puts it back.
+func (s *HTTPServer) pauseAccepting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.overLimit != loop.Pause || !atLimit(len(s.ActiveConnMap), s.maxConns) {
+		return false
+	}
+	if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_DEL, s.Fd, nil); err != nil {
+		s.log.Error("error pausing accepts", logging.Err(err))
+		return false
+	}
+	s.acceptPaused = true
+	s.metrics.acceptPauses.Inc()
+	s.log.Debug("connection limit reached, pausing accepts", slog.Int("conns", len(s.ActiveConnMap)))
+	return true
+}
+
+// rearmListener re-enables accepting after a oneshot event on the listener, unless
+// pauseAccepting took it out of epoll meanwhile.
+func (s *HTTPServer) rearmListener() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.acceptPaused {
+		return
+	}
+	if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_MOD, s.Fd, &unix.EpollEvent{
+		Fd:     int32(s.Fd),
+		Events: s.events(EVENT_IN_ERR),
+	}); err != nil {
+		s.log.Error("error re-arming listener", logging.Err(err))
+	}
+}
+
 func (s *HTTPServer) ListenAndServe() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.serving = true
+	s.mu.Unlock()
+	defer close(s.done)
+	defer s.cleanup()
 
-	if err := unix.Listen(s.Fd, 2048); err != nil {
-		return err
+	s.log.Info("server online", slog.String("addr", s.Addr()), slog.String("backend", string(s.backend)))
+	// stopped before cleanup, what it expires may still hand work to the workers
+	var expiring sync.WaitGroup
+	stop := make(chan struct{})
+	expiring.Go(func() { s.expire(stop) })
+	defer expiring.Wait()
+	defer close(stop)
+	if s.backend == loop.Uring {
+		return s.serveUring()
+	}
+	if s.pollers == 1 {
+		return s.poll()
+	}
+
+	errC := make(chan error, s.pollers)
+	for range s.pollers {
+		go func() { errC <- s.poll() }()
+	}
+	var err error
+	for range s.pollers {
+		if perr := <-errC; perr != nil && err == nil {
+			err = perr
+			// the others only stop for the eventfd
+			s.wake()
+		}
 	}
+	return err
+}
 
-	fmt.Println("server online")
+// poll waits on the epoll fd and handles what it reports until Close, with OneShot several
+// goroutines run it at once.
+func (s *HTTPServer) poll() error {
 	epollEvents := make([]unix.EpollEvent, 1000)
 
 	for {
@@ -151,107 +537,629 @@ func (s *HTTPServer) ListenAndServe() error {
 			if err == unix.EINTR {
 				continue
 			}
-			return fmt.Errorf("error during epoll wait:%v", err)
+			return fmt.Errorf("error during epoll wait: %w", err)
 		}
+		s.metrics.wakeups.Inc()
+		s.metrics.eventsPerWakeup.Observe(float64(n))
 		for i := range n {
 			e := epollEvents[i]
 
-			switch {
-			case e.Fd == int32(s.Fd):
+			switch int(e.Fd) {
+			case s.wakeFd:
+				// never read, it stays readable and every poller sees it
+				return nil
+			case s.Fd:
 				s.accept()
-
-			case e.Events&(unix.EPOLLERR|unix.EPOLLHUP|unix.EPOLLRDHUP) != 0:
-				s.mu.RLock()
-				if conn, ok := s.ActiveConnMap[int(e.Fd)]; ok {
-					conn.Close()
-					delete(s.ActiveConnMap, int(e.Fd))
+				if s.oneshot {
+					s.rearmListener()
 				}
-				s.mu.RUnlock()
+				continue
+			}
 
-				errno, err := unix.GetsockoptInt(int(e.Fd), unix.SOL_SOCKET, unix.SO_ERROR)
-				if err != nil {
-					return err
+			s.mu.RLock()
+			conn, ok := s.ActiveConnMap[int(e.Fd)]
+			uc := s.upstreamConns[int(e.Fd)]
+			s.mu.RUnlock()
+			if uc != nil {
+				uc.event(e.Events)
+				continue
+			}
+			if !ok {
+				continue
+			}
+
+			if e.Events&(unix.EPOLLERR|unix.EPOLLHUP) != 0 {
+				s.closeConn(conn)
+				continue
+			}
+			// writes first, once requests are dispatched a oneshot connection belongs to the worker
+			dispatched := false
+			if e.Events&unix.EPOLLOUT != 0 {
+				var open bool
+				if open, dispatched = s.handleWrite(conn); !open {
+					continue
 				}
-				err = unix.Errno(errno)
-
-				fmt.Printf("errored for fd=%d err=%v\n", e.Fd, err)
-
-			case e.Events&(unix.EPOLLIN) != 0:
-				for {
-					buf := pool.GetBuffer()
-					n, err := unix.Read(int(e.Fd), buf)
-					if err != nil {
-						if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
-							break
-						}
-					}
-					if n == -1 {
-						break
-					}
-					fmt.Println("read", n, "bytes worth data")
-					// send this buffer to worker
-					// work should parse the data, clean it and send a response back
-					// worker will also change the event for OUT
-					//
-
-					data := make([]byte, n)
-					copy(data, buf[:n])
-					pool.PutBuffer(buf)
-					// remember now EPOLLOUT is one of interested events
-					if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_MOD, int(e.Fd), &unix.EpollEvent{
-						Events: EVENT_IN_OUT_ET_ERR,
-						Fd:     e.Fd,
-					}); err != nil {
-						fmt.Println("error modifying intrest list:", err)
-					}
-					s.jm.toInChan(int(e.Fd), data)
+			}
+			// peer hang up still leaves its last bytes to read, reading ends with EOF and closes.
+			if e.Events&(unix.EPOLLIN|unix.EPOLLRDHUP) != 0 && !(s.oneshot && dispatched) {
+				open, read := s.handleRead(conn)
+				if !open {
+					continue
 				}
-			case e.Events&unix.EPOLLOUT != 0:
-				for {
-					data := MasterRecords.Submit(int(e.Fd))
-					if data == nil {
-						continue
-					}
-					written := 0
-					for written < len(data) {
-						n, err := unix.Write(int(e.Fd), data)
-						if err != nil {
-							if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
-								MasterRecords.Add(int(e.Fd), data[n:])
-								break
-							}
-							if err == unix.ECONNRESET || err == unix.EPIPE {
-								s.CloseClient(int(e.Fd))
-							}
-							fmt.Println("error writing data:", err)
-							continue
-						}
-						written += n
-					}
-					// after submit, update event list
-					if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_MOD, int(e.Fd), &unix.EpollEvent{
-						Fd:     e.Fd,
-						Events: EVENT_IN_ET_ERR,
-					}); err != nil {
-						fmt.Println("err modifying event:", err)
-					}
+				dispatched = dispatched || read
+			}
+			// a worker with requests re-arms once it has served them
+			if s.oneshot && !dispatched {
+				conn.rearm()
+			}
+		}
+	}
+}
+
+// handleRead reads the connection, until EAGAIN when edge triggered and loop.LEVELREADS
+// times when level triggered, and hands every complete request to a worker.
+// open is false if the connection got closed, dispatched is true if a worker got requests.
+func (s *HTTPServer) handleRead(c *Conn) (open, dispatched bool) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	// paused by a worker after this event was reported, resuming re-arms EPOLLIN
+	if !c.readable() {
+		return true, false
+	}
+	readAt := time.Now()
+	var reqs [][]byte
+	var bad error
+	for {
+		n, err := OnReadable(c, s.trigger.Reads())
+		if n > 0 {
+			c.log.Debug("read from connection", logging.Bytes(n))
+			s.metrics.bytesRead.Add(n)
+		}
+		full := err == ringbuf.ErrFull
+		if err != nil && !full {
+			if err != io.EOF {
+				c.log.Warn("error reading from connection", logging.Err(err))
+			}
+			s.closeConn(c)
+			return false, false
+		}
 
+		reqs, bad = frameRequests(c, reqs, full)
+		// edge triggered, the socket may still have bytes that did not fit and no event
+		// comes for them. level triggered, the next wakeup reads them.
+		if !full || bad != nil || s.trigger == loop.Level {
+			break
+		}
+	}
+	return true, s.dispatch(c, reqs, bad, readAt)
+}
+
+// frameRequests moves every complete request out of c.ReadBuffer and appends it to reqs.
+// full says the buffer has no room left, if nothing could be framed then nothing ever will.
+func frameRequests(c *Conn, reqs [][]byte, full bool) ([][]byte, error) {
+	framed := len(reqs)
+	for c.ReadBuffer.Len() > 0 {
+		in := c.ReadBuffer.Peek(c.ReadBuffer.Len())
+		n, err := requestLen(in)
+		if err != nil {
+			c.ReadBuffer.Discard(c.ReadBuffer.Len())
+			return reqs, err
+		}
+		if n == 0 {
+			break
+		}
+		reqs = append(reqs, append([]byte(nil), in[:n]...))
+		c.ReadBuffer.Discard(n)
+	}
+	// a full buffer without a whole request in it never will hold one
+	if full && len(reqs) == framed {
+		c.ReadBuffer.Discard(c.ReadBuffer.Len())
+		return reqs, errRequestTooLarge
+	}
+	return reqs, nil
+}
+
+// dispatch hands framed requests, and the error that ended framing if any, to the connection's
+// worker. it returns false if there was nothing to hand over.
+func (s *HTTPServer) dispatch(c *Conn, reqs [][]byte, bad error, readAt time.Time) bool {
+	if len(reqs) == 0 && bad == nil {
+		return false
+	}
+	// send this buffer to worker
+	// work should parse the data, clean it and send a response back
+	// worker will also change the event for OUT
+	s.submit(c, func() {
+		s.serve(c, reqs, bad, readAt)
+		c.rearm()
+	})
+	return true
+}
+
+// submit runs f on c's worker, c is busy until it returns, see Conn.idle.
+func (s *HTTPServer) submit(c *Conn, f func()) {
+	s.jm.Submit(c.fd, busyJob(c, f))
+}
+
+// busyJob is f for c's worker, c is busy from now until f returns.
+func busyJob(c *Conn, f func()) ConnJob {
+	c.mu.Lock()
+	c.busy++
+	c.mu.Unlock()
+	return func() {
+		f()
+		c.mu.Lock()
+		c.busy--
+		c.mu.Unlock()
+	}
+}
+
+// handleWrite flushes the connection's WriteBuffer, and once it drains below the low water
+// mark hands the requests held meanwhile back to the worker.
+// open is false if the connection got closed, dispatched is true if a worker got requests.
+func (s *HTTPServer) handleWrite(c *Conn) (open, dispatched bool) {
+	c.mu.Lock()
+	if c.closed {
+		// closed by Shutdown after this event was reported
+		c.mu.Unlock()
+		return false, false
+	}
+	n, err := OnWriteable(c)
+	if n > 0 {
+		c.log.Debug("wrote to connection", logging.Bytes(n))
+		s.metrics.bytesWritten.Add(n)
+	}
+	c.wrote(n)
+	if err != nil {
+		c.log.Warn("error writing to connection", logging.Err(err))
+	}
+	flushed := c.WriteBuffer.Len() == 0
+	closeNow := flushed && c.closeAfterWrite
+	resumed := c.drained()
+	// a oneshot connection gets its events back when it is re-armed
+	if err == nil && (flushed || resumed) && !closeNow && !c.oneshot {
+		// after submit, update event list
+		if err := c.modify(!flushed); err != nil {
+			c.log.Error("error modifying event", logging.Err(err))
+		}
+	}
+	held := resumed && !c.awaiting && (len(c.held) > 0 || c.heldBad != nil)
+	c.mu.Unlock()
+
+	if err != nil || closeNow {
+		s.closeConn(c)
+		return false, false
+	}
+	if held {
+		s.serveHeld(c)
+	}
+	return true, held
+}
+
+// serve runs on a worker, requests of one connection are served in order.
+// bad is set when the bytes after reqs could not be framed, the connection is closed after answering.
+// readAt is when the bytes were read, request latency is measured from there.
+// above the high water mark what is left is held until the loop has drained the connection.
+func (s *HTTPServer) serve(c *Conn, reqs [][]byte, bad error, readAt time.Time) {
+	for i, raw := range reqs {
+		if c.hold(reqs[i:], bad, readAt) {
+			return
+		}
+		req, err := parseRequest(raw)
+		if err != nil {
+			s.badRequest(c, err, readAt)
+			return
+		}
+		req.RemoteAddr = c.peer
+
+		res := &Response{}
+		s.route(res, req)
+
+		// a draining server lets the client know to go elsewhere next time
+		keepAlive := req.KeepAlive() && !s.draining.Load()
+		if res.later != nil {
+			// the requests after it are held until the handler answers
+			c.await()
+			if res.later.wait(func() { s.answerLater(c, req, res, keepAlive, readAt) }) {
+				if !keepAlive {
+					return
 				}
+				continue
 			}
+			c.answered()
+		}
+		if err := s.reply(c, req, res, keepAlive, readAt); err != nil || !keepAlive {
+			return
+		}
+	}
+	if bad != nil && !c.hold(nil, bad, readAt) {
+		s.badRequest(c, bad, readAt)
+	}
+}
+
+// reply queues res, the answer to req, on c and returns ReplyVec's error.
+func (s *HTTPServer) reply(c *Conn, req *Request, res *Response, keepAlive bool, readAt time.Time) error {
+	res.headOnly = bytes.Equal(req.Method, []byte("HEAD"))
+	if keepAlive {
+		res.SetHeader("Connection", "keep-alive")
+	} else {
+		res.SetHeader("Connection", "close")
+	}
+	segs := res.segments()
+	err := c.ReplyVec(segs, !keepAlive)
+	s.metrics.requestDuration.ObserveSince(readAt)
+	s.logAccess(c, req, res.Status, segs, readAt)
+	putRequest(req)
+	return err
+}
+
+// answerLater queues a response its handler finished after returning, on whichever goroutine
+// finished it, and serves what the connection held meanwhile, see Response.Later.
+func (s *HTTPServer) answerLater(c *Conn, req *Request, res *Response, keepAlive bool, readAt time.Time) {
+	err := s.reply(c, req, res, keepAlive, readAt)
+	if c.answered() && err == nil && keepAlive {
+		// the worker re-arms a oneshot connection once it has served them
+		s.serveHeld(c)
+		return
+	}
+	// the worker re-armed a oneshot connection without EPOLLOUT when it let go of it
+	c.rearm()
+}
+
+// serveHeld hands the requests c held back to its worker, behind whatever the worker has
+// queued, it holds those too while any are held. it runs on the poller or on a worker, the
+// one finishing a Later, and never waits for room in the worker's queue.
+func (s *HTTPServer) serveHeld(c *Conn) {
+	s.jm.TrySubmit(c.fd, busyJob(c, func() {
+		reqs, bad, readAt := c.takeHeld()
+		s.serve(c, reqs, bad, readAt)
+		c.rearm()
+	}))
+}
+
+// badRequest answers a request that could not be framed or parsed and closes the
+// connection, with a 400, or a 501 for errTransferEncoding.
+func (s *HTTPServer) badRequest(c *Conn, err error, readAt time.Time) {
+	res := &Response{Status: 400}
+	if errors.Is(err, errTransferEncoding) {
+		res.Status = 501
+	}
+	res.SetHeader("Connection", "close")
+	res.WriteString(err.Error() + "\n")
+	segs := res.segments()
+	c.ReplyVec(segs, true)
+	s.logAccess(c, nil, res.Status, segs, readAt)
+}
+
+// logAccess writes the access log line for a response queued on c, req is nil when the
+// request could not be parsed.
+func (s *HTTPServer) logAccess(c *Conn, req *Request, status int, segs [][]byte, readAt time.Time) {
+	if s.accessLog == nil {
+		return
+	}
+	e := accesslog.Entry{Time: readAt, Peer: c.peer, Status: cmp.Or(status, 200), Duration: time.Since(readAt)}
+	for _, p := range segs {
+		e.Bytes += len(p)
+	}
+	if req != nil {
+		e.Method, e.Path, e.Proto = req.Method, req.Path, req.Version
+		e.Referer = req.Headers.Get([]byte("Referer"))
+		e.UserAgent = req.Headers.Get([]byte("User-Agent"))
+	}
+	s.accessLog.Log(&e)
+}
+
+func (s *HTTPServer) route(res *Response, req *Request) {
+	path, _, _ := bytes.Cut(req.Path, []byte("?"))
+
+	s.mu.RLock()
+	h, ok := s.routes[string(path)]
+	for _, r := range s.prefixes {
+		if ok {
+			break
 		}
+		h, ok = r.h, bytes.HasPrefix(path, []byte(r.prefix))
+	}
+	s.mu.RUnlock()
+	if !ok {
+		res.Status = 404
+		res.WriteString("404 page not found\n")
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Error("handler panic", slog.String("path", string(path)), slog.Any("panic", r))
+			*res = Response{Status: 500}
+			res.WriteString("internal server error\n")
+		}
+	}()
+	h(res, req)
+}
+
+func (s *HTTPServer) closeConn(c *Conn) {
+	s.mu.Lock()
+	if s.ActiveConnMap[c.fd] == c {
+		delete(s.ActiveConnMap, c.fd)
+	}
+	s.resumeAccepting()
+	s.mu.Unlock()
+	c.Close()
+	c.log.Debug("connection closed", slog.Int64("bytes_read", c.bytesRead.Load()), slog.Int64("bytes_written", c.bytesWritten.Load()))
+}
+
+// resumeAccepting puts the listener paused by pauseAccepting back in epoll once below
+// MaxConns, or once Reload lifted the limit or stopped pausing. callers hold mu.
+func (s *HTTPServer) resumeAccepting() {
+	if !s.acceptPaused || s.draining.Load() {
+		return
+	}
+	if s.overLimit == loop.Pause && atLimit(len(s.ActiveConnMap), s.maxConns) {
+		return
+	}
+	// level or edge triggered, epoll reports a backlog that built up while paused
+	if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_ADD, s.Fd, &unix.EpollEvent{
+		Fd:     int32(s.Fd),
+		Events: s.events(EVENT_IN_ERR),
+	}); err != nil {
+		s.log.Error("error resuming accepts", logging.Err(err))
+		return
+	}
+	s.acceptPaused = false
+	s.log.Debug("below connection limit, resuming accepts")
+}
+
+func sockaddrString(sa unix.Sockaddr) string {
+	if a, ok := sa.(*unix.SockaddrInet4); ok {
+		return netip.AddrPortFrom(netip.AddrFrom4(a.Addr), uint16(a.Port)).String()
+	}
+	return "unknown"
+}
+
+// cleanup closes every connection and releases the loop, it runs when ListenAndServe returns.
+func (s *HTTPServer) cleanup() {
+	s.mu.Lock()
+	conns := make([]*Conn, 0, len(s.ActiveConnMap))
+	for _, c := range s.ActiveConnMap {
+		conns = append(conns, c)
+	}
+	s.ActiveConnMap = make(map[int]*Conn)
+	s.mu.Unlock()
+
+	// workers waiting on an upstream give up before they are waited for
+	s.failUpstreams()
+	s.jm.Close()
+	for _, c := range conns {
+		c.Close()
 	}
+	unix.Close(s.Fd)
+	unix.Close(s.wakeFd)
+	unix.Close(s.epollFd)
+	s.spare.Close()
 }
 
+// Close stops the loop and waits for it to return, closing every connection.
 func (s *HTTPServer) Close() error {
-	if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_DEL, s.Fd, nil); err != nil {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	serving := s.serving
+	s.mu.Unlock()
+
+	if !serving {
+		s.cleanup()
+		return nil
+	}
+	if err := s.wake(); err != nil {
 		return err
 	}
-	return unix.Close(s.Fd)
+	<-s.done
+	return nil
 }
 
-func (s *HTTPServer) CloseClient(fd int) error {
-	if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_DEL, fd, nil); err != nil {
+// Reload applies the options that can change while serving, ReadTimeout, WriteTimeout,
+// MaxConns and OverLimit, all at once or not at all. Open connections get the new timeouts
+// from the next check on, see HTTPServer.expire. The others need a new server and are
+// ignored. Open connections are kept, past a lowered MaxConns they are left to close on
+// their own, and accepting resumes if the limit it paused at is gone.
+func (s *HTTPServer) Reload(opts *HTTPServerOpts) error {
+	if opts.MaxConns < 0 {
+		return fmt.Errorf("max connections %d, want 0 for no limit or more", opts.MaxConns)
+	}
+	if _, err := loop.ParseOverLimit(string(opts.OverLimit)); err != nil {
 		return err
 	}
-	return unix.Close(fd)
+	s.mu.Lock()
+	s.ReadTimeout, s.WriteTimeout = opts.ReadTimeout, opts.WriteTimeout
+	s.maxConns = opts.MaxConns
+	s.overLimit = cmp.Or(opts.OverLimit, loop.Reject)
+	if s.backend == loop.Epoll {
+		s.resumeAccepting()
+	}
+	s.mu.Unlock()
+	if s.backend == loop.Uring {
+		// the loop owns its accept, it looks at the new limits when woken
+		return s.wake()
+	}
+	return nil
+}
+
+// Shutdown stops accepting and lets the open connections finish, for an upgrade to a new
+// process, see package upgrade. Responses close their connection from now on and idle
+// connections are closed, what is still open after timeout is closed as Close does.
+// It returns once ListenAndServe has.
+func (s *HTTPServer) Shutdown(timeout time.Duration) error {
+	s.mu.Lock()
+	serving := s.serving && !s.closed
+	s.mu.Unlock()
+	if !serving || !s.draining.CompareAndSwap(false, true) {
+		return s.Close()
+	}
+	s.log.Info("draining connections", slog.Int("conns", s.conns()), slog.Duration("timeout", timeout))
+
+	if s.backend != loop.Uring {
+		s.stopAccepting()
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		s.closeIdle()
+		if s.conns() == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(DRAININTERVAL)
+	}
+	if n := s.conns(); n > 0 {
+		s.log.Warn("drain timed out, closing connections", slog.Int("conns", n))
+	}
+	return s.Close()
+}
+
+// DRAININTERVAL is how often Shutdown looks for connections gone idle.
+const DRAININTERVAL = 10 * time.Millisecond
+
+func (s *HTTPServer) conns() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.ActiveConnMap)
+}
+
+// stopAccepting takes the listener out of epoll for good, the process taking over accepts.
+func (s *HTTPServer) stopAccepting() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.acceptPaused {
+		return
+	}
+	if err := unix.EpollCtl(s.epollFd, unix.EPOLL_CTL_DEL, s.Fd, nil); err != nil {
+		s.log.Error("error stopping accepts", logging.Err(err))
+		return
+	}
+	s.acceptPaused = true
+}
+
+// closeIdle closes connections with nothing to read, write or serve. the io_uring loop
+// does it itself when woken, it owns its connections.
+func (s *HTTPServer) closeIdle() {
+	if s.backend == loop.Uring {
+		s.wake()
+		return
+	}
+	s.mu.RLock()
+	conns := make([]*Conn, 0, len(s.ActiveConnMap))
+	for _, c := range s.ActiveConnMap {
+		conns = append(conns, c)
+	}
+	s.mu.RUnlock()
+	for _, c := range conns {
+		// rmu keeps a poller from reading a request in between
+		c.rmu.Lock()
+		if c.idle() {
+			s.closeConn(c)
+		}
+		c.rmu.Unlock()
+	}
+}
+
+// wake makes wakeFd readable, every poller returns.
+func (s *HTTPServer) wake() error {
+	var one [8]byte
+	binary.NativeEndian.PutUint64(one[:], 1)
+	_, err := unix.Write(s.wakeFd, one[:])
+	return err
+}
+
+func (s *HTTPServer) CloseClient(fd int) error {
+	s.mu.RLock()
+	c, ok := s.ActiveConnMap[fd]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no connection with fd %d", fd)
+	}
+	s.closeConn(c)
+	return nil
+}
+
+// Conns describes the open connections, for the control socket.
+func (s *HTTPServer) Conns() []control.ConnInfo {
+	s.mu.RLock()
+	conns := make([]*Conn, 0, len(s.ActiveConnMap))
+	for _, c := range s.ActiveConnMap {
+		conns = append(conns, c)
+	}
+	s.mu.RUnlock()
+	infos := make([]control.ConnInfo, len(conns))
+	for i, c := range conns {
+		infos[i] = c.info()
+	}
+	return infos
+}
+
+// Kick hangs up on the connection fd from any goroutine, unlike CloseClient it only shuts
+// the socket down and the loop owning it sees the hangup and closes it as any other.
+func (s *HTTPServer) Kick(fd int) error {
+	// closeConn takes the fd out of the map before closing it, it is still ours under mu
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.ActiveConnMap[fd]; !ok {
+		return fmt.Errorf("no connection with fd %d", fd)
+	}
+	return unix.Shutdown(fd, unix.SHUT_RDWR)
 }
+
+// TIMEOUTINTERVAL is how often the server looks for connections past ReadTimeout or
+// WriteTimeout, and upstreams past their proxy's Timeout, they time out up to this much later.
+const TIMEOUTINTERVAL = 100 * time.Millisecond
+
+// expire hangs up on connections past their timeouts until stop is closed, see
+// Conn.expired. like Kick it only shuts the socket down, the loop owning it closes it.
+func (s *HTTPServer) expire(stop <-chan struct{}) {
+	t := time.NewTicker(TIMEOUTINTERVAL)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			s.expireConns(now)
+			s.expireUpstreams(now)
+		}
+	}
+}
+
+func (s *HTTPServer) expireConns(now time.Time) {
+	s.mu.RLock()
+	read, write := s.ReadTimeout, s.WriteTimeout
+	if read <= 0 && write <= 0 {
+		s.mu.RUnlock()
+		return
+	}
+	conns := make([]*Conn, 0, len(s.ActiveConnMap))
+	for _, c := range s.ActiveConnMap {
+		conns = append(conns, c)
+	}
+	s.mu.RUnlock()
+	for _, c := range conns {
+		why := c.expired(now, read, write)
+		if why == "" {
+			continue
+		}
+		c.log.Debug("connection timed out", slog.String("waiting_for", why))
+		s.metrics.timedOut.Inc()
+		// closeConn takes the fd out of the map before closing it, it is still c's under mu
+		s.mu.RLock()
+		if s.ActiveConnMap[c.fd] == c {
+			unix.Shutdown(c.fd, unix.SHUT_RDWR)
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// QueueLens is how many jobs wait on each worker.
+func (s *HTTPServer) QueueLens() []int {
+	return s.jm.Lens()
+}
+
+// PoolStats are the counters of the pool backing every connection's buffers.
+func PoolStats() pool.Stats { return buffers.Stats() }
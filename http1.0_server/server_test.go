@@ -0,0 +1,906 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/accesslog"
+	"github.com/toastsandwich/epoll-learn/pkg/bench"
+	"github.com/toastsandwich/epoll-learn/pkg/control"
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+	"github.com/toastsandwich/epoll-learn/pkg/uring"
+	"golang.org/x/sys/unix"
+)
+
+// testBackend, testTrigger and testPollers are the loop the servers under test run on,
+// TestHTTPServerUring, TestHTTPServerLevelTriggered and TestHTTPServerOneShot rerun
+// serverSuite with them changed. more than one poller turns on OneShot.
+var (
+	testBackend = loop.Epoll
+	testTrigger = loop.Edge
+	testPollers = 1
+)
+
+func startHTTPServer(t testing.TB) *HTTPServer {
+	t.Helper()
+	return startHTTPServerOpts(t, &HTTPServerOpts{})
+}
+
+// startHTTPServerOpts fills in a loopback address, a free port, two workers unless set and a silent logger.
+func startHTTPServerOpts(t testing.TB, opts *HTTPServerOpts) *HTTPServer {
+	t.Helper()
+	opts.Addr, opts.Port, opts.Workers, opts.Logger = "127.0.0.1", 0, cmp.Or(opts.Workers, 2), logging.Discard()
+	opts.Backend, opts.Trigger = testBackend, testTrigger
+	opts.Pollers, opts.OneShot = testPollers, testPollers > 1
+	s, err := NewHTTPServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.HandleFunc("/hello", func(res *Response, req *Request) {
+		res.WriteString("hello\n")
+	})
+	s.HandleFunc("/echo", func(res *Response, req *Request) {
+		res.Write(req.Body)
+	})
+	s.HandleFunc("/chunks", func(res *Response, req *Request) {
+		res.WriteString("head ")
+		res.WriteChunk(bytes.Repeat([]byte("a"), 64<<10))
+		res.WriteChunk(bytes.Repeat([]byte("b"), 64<<10))
+	})
+	s.HandleFunc("/big", func(res *Response, req *Request) {
+		res.WriteChunk(bigBody)
+	})
+	s.HandleFunc("/panic", func(res *Response, req *Request) {
+		panic("boom")
+	})
+	s.HandleFunc("/slow", func(res *Response, req *Request) {
+		time.Sleep(100 * time.Millisecond)
+		res.WriteString("slow\n")
+	})
+
+	errC := make(chan error, 1)
+	go func() { errC <- s.ListenAndServe() }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-errC; err != nil {
+			t.Errorf("ListenAndServe: %v", err)
+		}
+	})
+	return s
+}
+
+// bigBody is what /big answers with, queued as is rather than copied.
+var bigBody = bytes.Repeat([]byte("big body "), (256<<10)/9)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func dial(t *testing.T, s *HTTPServer) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", s.Addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHTTPServerGet(t *testing.T) {
+	s := startHTTPServer(t)
+
+	res, err := http.Get("http://" + s.Addr() + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(body) != "hello\n" {
+		t.Fatalf("got %d %q", res.StatusCode, body)
+	}
+}
+
+func TestHTTPServerNotFoundAndPanic(t *testing.T) {
+	s := startHTTPServer(t)
+
+	for path, want := range map[string]int{"/missing": 404, "/panic": 500, "/hello?x=1": 200} {
+		res, err := http.Get("http://" + s.Addr() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("%s: got %d, want %d", path, res.StatusCode, want)
+		}
+	}
+}
+
+func TestHTTPServerHTTP10Closes(t *testing.T) {
+	s := startHTTPServer(t)
+	conn := dial(t, s)
+
+	fmt.Fprint(conn, "GET /hello HTTP/1.0\r\n\r\n")
+	all, err := io.ReadAll(conn) // the server closes after one response
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(all), "HTTP/1.0 200 OK\r\n") || !strings.HasSuffix(string(all), "\r\n\r\nhello\n") {
+		t.Fatalf("unexpected response %q", all)
+	}
+	waitFor(t, "connection to be dropped", func() bool { return s.conns() == 0 })
+}
+
+func TestHTTPServerPipelinedKeepAlive(t *testing.T) {
+	s := startHTTPServer(t)
+	conn := dial(t, s)
+
+	// one write holding three requests, the second body split from its headers
+	fmt.Fprint(conn, "GET /hello HTTP/1.1\r\n\r\nPOST /echo HTTP/1.1\r\nContent-Length: 5\r\n\r\nab")
+	time.Sleep(20 * time.Millisecond)
+	fmt.Fprint(conn, "cdeGET /missing HTTP/1.1\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	for _, want := range []struct {
+		code int
+		body string
+	}{{200, "hello\n"}, {200, "abcde"}, {404, "404 page not found\n"}} {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != want.code || string(body) != want.body {
+			t.Fatalf("got %d %q, want %d %q", res.StatusCode, body, want.code, want.body)
+		}
+	}
+	if s.conns() != 1 {
+		t.Fatalf("keep-alive connection was closed")
+	}
+}
+
+// TestHTTPServerParseError answers a request that does not parse, and one framed by two
+// different lengths, with a 400 and closes the connection.
+func TestHTTPServerParseError(t *testing.T) {
+	s := startHTTPServer(t)
+	for _, req := range []string{
+		"NONSENSE\r\n\r\n",
+		"POST /echo HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 0\r\n\r\nhello",
+	} {
+		conn := dial(t, s)
+		fmt.Fprint(conn, req)
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 400 {
+			t.Fatalf("%q got %d, want 400", req, res.StatusCode)
+		}
+		waitFor(t, "connection to be dropped", func() bool { return s.conns() == 0 })
+	}
+}
+
+// TestHTTPServerTransferEncoding answers a request with a Transfer-Encoding, with or
+// without a Content-Length next to it, with a 501, the body is not served as a request.
+func TestHTTPServerTransferEncoding(t *testing.T) {
+	s := startHTTPServer(t)
+	smuggled := "GET /hello HTTP/1.1\r\n\r\n"
+	body := fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(smuggled), smuggled)
+	for _, req := range []string{
+		"POST /echo HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + body,
+		fmt.Sprintf("POST /echo HTTP/1.1\r\nContent-Length: %d\r\nTransfer-Encoding: chunked\r\n\r\n", len(body)) + body,
+	} {
+		conn := dial(t, s)
+		fmt.Fprint(conn, req)
+		all, _ := io.ReadAll(conn)
+		if !strings.HasPrefix(string(all), "HTTP/1.0 501 ") || strings.Count(string(all), "HTTP/1.0 ") != 1 {
+			t.Fatalf("%q got %q", req, all)
+		}
+		waitFor(t, "connection to be dropped", func() bool { return s.conns() == 0 })
+	}
+}
+
+func TestHTTPServerDisconnect(t *testing.T) {
+	s := startHTTPServer(t)
+
+	for range 10 {
+		conn := dial(t, s)
+		fmt.Fprint(conn, "GET /hel") // half a request, then gone
+		conn.Close()
+	}
+	waitFor(t, "connections to be dropped", func() bool { return s.conns() == 0 })
+
+	res, err := http.Get("http://" + s.Addr() + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
+
+func TestHTTPServerClose(t *testing.T) {
+	s, err := NewHTTPServer(&HTTPServerOpts{Addr: "127.0.0.1", Logger: logging.Discard()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := s.ListenAndServe(); err != ErrServerClosed {
+		t.Fatalf("ListenAndServe after Close = %v", err)
+	}
+}
+
+func TestHTTPServerMetrics(t *testing.T) {
+	s := startHTTPServer(t)
+	s.HandleFunc("/metrics", MetricsHandler(s.Metrics()))
+
+	for range 3 {
+		res, err := http.Get("http://" + s.Addr() + "/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	res, err := http.Get("http://" + s.Addr() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	for _, want := range []string{
+		"http_connections_accepted_total ",
+		"http_connections_active ",
+		"http_request_duration_seconds_count 3\n",
+		"http_epoll_wakeups_total ",
+		"http_buffer_pool_gets_total ",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestHTTPServerLargeBody(t *testing.T) {
+	s := startHTTPServer(t)
+	conn := dial(t, s)
+
+	// spans many read buffer segments both ways, and a second request follows in the same write
+	body := strings.Repeat("0123456789abcdef", MAXBODYSIZE/16)
+	fmt.Fprintf(conn, "POST /echo HTTP/1.1\r\nContent-Length: %d\r\n\r\n%sGET /hello HTTP/1.1\r\n\r\n", len(body), body)
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(res.Body)
+	if string(got) != body {
+		t.Fatalf("echoed %d bytes, want %d", len(got), len(body))
+	}
+	res, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(res.Body)
+	if string(got) != "hello\n" {
+		t.Fatalf("second response %q", got)
+	}
+}
+
+func TestHTTPServerBufferLimits(t *testing.T) {
+	s := startHTTPServerOpts(t, &HTTPServerOpts{ReadBufferLimit: 4096, WriteBufferLimit: 1024})
+
+	t.Run("request too large", func(t *testing.T) {
+		conn := dial(t, s)
+		// exactly fills the read buffer, nothing left unread to turn the close into a reset
+		head := "POST /echo HTTP/1.1\r\nContent-Length: 5000\r\n\r\n"
+		fmt.Fprint(conn, head+strings.Repeat("x", 4096-len(head)))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Fatalf("got %d, want 400", res.StatusCode)
+		}
+	})
+
+	t.Run("response too large", func(t *testing.T) {
+		conn := dial(t, s)
+		fmt.Fprintf(conn, "POST /echo HTTP/1.1\r\nContent-Length: 1000\r\n\r\n%s", strings.Repeat("x", 1000))
+		// the echo does not fit with its headers, nothing is sent and the connection goes
+		all, err := io.ReadAll(conn)
+		if err != nil || len(all) != 0 {
+			t.Fatalf("read %q, %v, want a bare close", all, err)
+		}
+	})
+}
+
+func TestHTTPServerChunks(t *testing.T) {
+	s := startHTTPServer(t)
+
+	res, err := http.Get("http://" + s.Addr() + "/chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	want := "head " + strings.Repeat("a", 64<<10) + strings.Repeat("b", 64<<10)
+	if string(body) != want || res.ContentLength != int64(len(want)) {
+		t.Fatalf("got %d bytes, content length %d, want %d", len(body), res.ContentLength, len(want))
+	}
+}
+
+// TestHTTPServerManyConns opens more connections at once than a level triggered loop accepts
+// per wakeup, each writing more pipelined requests than it reads per wakeup, every one has
+// to be answered in either mode.
+func TestHTTPServerManyConns(t *testing.T) {
+	s := startHTTPServer(t)
+
+	const conns, reqs = 2 * loop.LEVELACCEPTS, 20
+	// a body of its own per request, responses out of order would show
+	body := func(i int) string { return strings.Repeat(string(rune('a'+i%26)), CONNBUFFERSIZE) }
+	var pipeline strings.Builder
+	for i := range reqs {
+		fmt.Fprintf(&pipeline, "POST /echo HTTP/1.1\r\nContent-Length: %d\r\n\r\n%s", CONNBUFFERSIZE, body(i))
+	}
+
+	errC := make(chan error, conns)
+	for range conns {
+		conn := dial(t, s)
+		go func() {
+			if _, err := io.WriteString(conn, pipeline.String()); err != nil {
+				errC <- err
+				return
+			}
+			r := bufio.NewReader(conn)
+			for i := range reqs {
+				res, err := http.ReadResponse(r, nil)
+				if err != nil {
+					errC <- fmt.Errorf("response %d: %w", i, err)
+					return
+				}
+				got, _ := io.ReadAll(res.Body)
+				if string(got) != body(i) {
+					errC <- fmt.Errorf("response %d: echoed %d bytes, not the request's %d", i, len(got), CONNBUFFERSIZE)
+					return
+				}
+			}
+			errC <- nil
+		}()
+	}
+	for range conns {
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestHTTPServerBackpressure pipelines far more output than the write buffer holds and does
+// not read any of it for a while, reads pause at the high water mark instead of the
+// responses piling up until the connection is dropped.
+func TestHTTPServerBackpressure(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		trigger loop.Trigger
+		pollers int
+	}{
+		{"edge", loop.Edge, 1},
+		{"level", loop.Level, 1},
+		{"oneshot", loop.Edge, 4},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testTrigger, testPollers = tt.trigger, tt.pollers
+			defer func() { testTrigger, testPollers = loop.Edge, 1 }()
+			s := startHTTPServer(t)
+			conn := dial(t, s)
+			// keep the kernel from soaking up most of it
+			conn.(*net.TCPConn).SetReadBuffer(64 << 10)
+
+			const reqs = 100 // 25MiB of responses against a 4MiB write buffer
+			for range reqs {
+				fmt.Fprint(conn, "GET /big HTTP/1.1\r\n\r\n")
+				time.Sleep(time.Millisecond)
+			}
+			waitFor(t, "reads to pause", func() bool { return s.metrics.readPauses.Value() > 0 })
+
+			r := bufio.NewReader(conn)
+			for i := range reqs {
+				res, err := http.ReadResponse(r, nil)
+				if err != nil {
+					t.Fatalf("response %d: %v", i, err)
+				}
+				n, _ := io.Copy(io.Discard, res.Body)
+				if n != int64(len(bigBody)) {
+					t.Fatalf("response %d: %d bytes, want %d", i, n, len(bigBody))
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPServerWaterMarks(t *testing.T) {
+	for _, opts := range []HTTPServerOpts{
+		{WriteHighWater: 100, WriteLowWater: 100},
+		{WriteBufferLimit: 1000, WriteHighWater: 2000},
+	} {
+		opts.Addr, opts.Logger = "127.0.0.1", logging.Discard()
+		if _, err := NewHTTPServer(&opts); err == nil {
+			t.Errorf("no error for high %d, low %d and limit %d", opts.WriteHighWater, opts.WriteLowWater, opts.WriteBufferLimit)
+		}
+	}
+}
+
+// hello sends a keep-alive GET /hello on conn and reads the response.
+func hello(t *testing.T, conn net.Conn) {
+	t.Helper()
+	fmt.Fprint(conn, "GET /hello HTTP/1.1\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(body) != "hello\n" {
+		t.Fatalf("got %d %q", res.StatusCode, body)
+	}
+}
+
+func TestHTTPServerMaxConnsReject(t *testing.T) {
+	s := startHTTPServerOpts(t, &HTTPServerOpts{MaxConns: 2})
+	first := dial(t, s)
+	hello(t, first)
+	hello(t, dial(t, s))
+
+	// turned away without sending anything, the 503 then EOF
+	all, err := io.ReadAll(dial(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(all), "HTTP/1.0 503 Service Unavailable\r\n") || !strings.HasSuffix(string(all), "too many connections\n") {
+		t.Fatalf("over the limit got %q", all)
+	}
+
+	first.Close()
+	waitFor(t, "a connection to close", func() bool { return s.conns() == 1 })
+	hello(t, dial(t, s))
+
+	var out strings.Builder
+	s.Metrics().WriteText(&out)
+	if !strings.Contains(out.String(), "http_connections_rejected_total 1\n") {
+		t.Errorf("metrics do not count the rejection:\n%s", out.String())
+	}
+}
+
+func TestHTTPServerMaxConnsPause(t *testing.T) {
+	s := startHTTPServerOpts(t, &HTTPServerOpts{MaxConns: 2, OverLimit: loop.Pause})
+	first := dial(t, s)
+	hello(t, first)
+	hello(t, dial(t, s))
+
+	// the third waits in the backlog, its request unanswered until a slot frees up
+	third := dial(t, s)
+	fmt.Fprint(third, "GET /hello HTTP/1.1\r\n\r\n")
+	third.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := third.Read(make([]byte, 1)); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("served over the limit: %d, %v", n, err)
+	}
+	if n := s.conns(); n != 2 {
+		t.Fatalf("%d connections open, limit 2", n)
+	}
+
+	first.Close()
+	third.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(third), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("after a slot freed up got %d", res.StatusCode)
+	}
+}
+
+// TestHTTPServerReload lifts the limit a connection waits on, then brings one back with
+// loop.Reject, the connections open meanwhile are kept.
+func TestHTTPServerReload(t *testing.T) {
+	s := startHTTPServerOpts(t, &HTTPServerOpts{MaxConns: 1, OverLimit: loop.Pause})
+	first := dial(t, s)
+	hello(t, first)
+	second := dial(t, s)
+	fmt.Fprint(second, "GET /hello HTTP/1.1\r\n\r\n")
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := second.Read(make([]byte, 1)); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("served over the limit: %d, %v", n, err)
+	}
+
+	if err := s.Reload(&HTTPServerOpts{ReadTimeout: 5 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(second), nil)
+	if err != nil || res.StatusCode != 200 {
+		t.Fatalf("after lifting the limit: %v, %v", res, err)
+	}
+
+	if err := s.Reload(&HTTPServerOpts{MaxConns: 2}); err != nil {
+		t.Fatal(err)
+	}
+	all, _ := io.ReadAll(dial(t, s))
+	if !strings.HasPrefix(string(all), "HTTP/1.0 503 ") {
+		t.Fatalf("over the reloaded limit got %q", all)
+	}
+	hello(t, first)
+
+	if err := s.Reload(&HTTPServerOpts{MaxConns: 10, OverLimit: "drop"}); err == nil {
+		t.Fatal("no error reloading a bad over limit behaviour")
+	}
+	if n, _ := s.limits(); n != 2 {
+		t.Fatalf("a failed reload changed the limit to %d", n)
+	}
+}
+
+// TestHTTPServerKick lists the open connections and kicks one, the loop closes it.
+func TestHTTPServerKick(t *testing.T) {
+	s := startHTTPServer(t)
+	first, second := dial(t, s), dial(t, s)
+	hello(t, first)
+	hello(t, second)
+	var conns []control.ConnInfo
+	waitFor(t, "both connections listed idle", func() bool {
+		conns = s.Conns()
+		return len(conns) == 2 && conns[0].State == "idle" && conns[1].State == "idle"
+	})
+	local := first.LocalAddr().String()
+	var fd int
+	for _, c := range conns {
+		if c.BytesRead == 0 || c.BytesWritten == 0 {
+			t.Fatalf("nothing counted for %+v", c)
+		}
+		if c.Peer == local {
+			fd = c.Fd
+		}
+	}
+	if fd == 0 {
+		t.Fatalf("no connection from %s in %+v", local, conns)
+	}
+
+	if err := s.Kick(fd); err != nil {
+		t.Fatal(err)
+	}
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := first.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("kicked connection read %d, %v", n, err)
+	}
+	waitFor(t, "the kicked connection to close", func() bool { return s.conns() == 1 })
+	hello(t, second)
+	if err := s.Kick(fd); err == nil {
+		t.Fatal("kicked a closed connection")
+	}
+}
+
+// TestHTTPServerReadTimeout closes a connection that sends nothing once a reload gives it a
+// ReadTimeout, one that keeps asking stays open past it.
+func TestHTTPServerReadTimeout(t *testing.T) {
+	s := startHTTPServer(t)
+	quiet, asking := dial(t, s), dial(t, s)
+	time.Sleep(300 * time.Millisecond)
+	if n := s.conns(); n != 2 {
+		t.Fatalf("%d connections open without a timeout", n)
+	}
+
+	hello(t, asking)
+	if err := s.Reload(&HTTPServerOpts{ReadTimeout: 300 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	for range 6 {
+		hello(t, asking)
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n, err := quiet.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("quiet connection read %d, %v", n, err)
+	}
+	waitFor(t, "the quiet connection to close", func() bool { return s.conns() == 1 })
+	if n := s.metrics.timedOut.Value(); n != 1 {
+		t.Fatalf("%d connections timed out", n)
+	}
+	hello(t, asking)
+}
+
+// TestHTTPServerWriteTimeout closes a connection that stops reading its responses.
+func TestHTTPServerWriteTimeout(t *testing.T) {
+	s := startHTTPServerOpts(t, &HTTPServerOpts{WriteTimeout: 300 * time.Millisecond})
+	conn := dial(t, s)
+	conn.(*net.TCPConn).SetReadBuffer(64 << 10)
+	// 10MiB of responses, more than the kernel takes for a client that reads none of it
+	for range 40 {
+		fmt.Fprint(conn, "GET /big HTTP/1.1\r\n\r\n")
+	}
+	waitFor(t, "the connection to time out", func() bool { return s.metrics.timedOut.Value() == 1 })
+	waitFor(t, "the connection to close", func() bool { return s.conns() == 0 })
+	n, _ := io.Copy(io.Discard, conn)
+	if n >= 40*int64(len(bigBody)) {
+		t.Fatalf("read all %d bytes", n)
+	}
+}
+
+// TestHTTPServerAccessLog serves a request, a 404 and one that does not parse, each gets a line.
+func TestHTTPServerAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	fl, err := accesslog.OpenFile(path, accesslog.FileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fl.Close() })
+	s := startHTTPServerOpts(t, &HTTPServerOpts{AccessLog: accesslog.New(fl, accesslog.Combined)})
+
+	conn := dial(t, s)
+	fmt.Fprint(conn, "GET /hello?x=1 HTTP/1.1\r\nUser-Agent: test \"agent\"\r\nReferer: /start\r\n\r\n")
+	if res, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || res.StatusCode != 200 {
+		t.Fatalf("%v, %v", res, err)
+	}
+	for _, req := range []string{"GET /missing HTTP/1.0\r\n\r\n", "nonsense\r\n\r\n"} {
+		conn := dial(t, s)
+		fmt.Fprint(conn, req)
+		io.ReadAll(conn)
+	}
+
+	var log string
+	waitFor(t, "3 access log lines", func() bool {
+		b, _ := os.ReadFile(path)
+		log = string(b)
+		return strings.Count(log, "\n") == 3
+	})
+	for _, want := range []string{
+		`"GET /hello?x=1 HTTP/1.1" 200 `,
+		`"/start" "test \"agent\""`,
+		`"GET /missing HTTP/1.0" 404 `,
+		`"-" 400 `,
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("no %s in\n%s", want, log)
+		}
+	}
+	if strings.Count(log, "127.0.0.1 - - [") != 3 {
+		t.Errorf("lines not from 127.0.0.1\n%s", log)
+	}
+}
+
+func TestHTTPServerLimitOpts(t *testing.T) {
+	for _, opts := range []HTTPServerOpts{
+		{MaxConns: -1},
+		{MaxConns: 10, OverLimit: "drop"},
+	} {
+		opts.Addr, opts.Logger = "127.0.0.1", logging.Discard()
+		if _, err := NewHTTPServer(&opts); err == nil {
+			t.Errorf("no error for max connections %d over limit %q", opts.MaxConns, opts.OverLimit)
+		}
+	}
+}
+
+// TestHTTPServerShutdown drains with one idle keep-alive connection and one waiting for a
+// slow response, the idle one is closed, the other gets its response with Connection: close.
+func TestHTTPServerShutdown(t *testing.T) {
+	s := startHTTPServer(t)
+	idle, busy := dial(t, s), dial(t, s)
+	hello(t, idle)
+	fmt.Fprint(busy, "GET /slow HTTP/1.1\r\n\r\n")
+	waitFor(t, "the slow request to be read", func() bool { return s.metrics.bytesRead.Value() > 0 })
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(5 * time.Second) }()
+
+	if n, err := idle.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("idle connection during drain: %d, %v, want EOF", n, err)
+	}
+	all, err := io.ReadAll(busy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(all), "Connection: close\r\n") || !strings.HasSuffix(string(all), "slow\n") {
+		t.Fatalf("response during drain %q", all)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.DialTimeout("tcp", s.Addr(), time.Second); err == nil {
+		t.Fatal("accepting after Shutdown")
+	}
+}
+
+// TestHTTPServerShutdownTimeout leaves half a request on a connection, it is never idle
+// and Shutdown closes it once the timeout is up.
+func TestHTTPServerShutdownTimeout(t *testing.T) {
+	s := startHTTPServer(t)
+	conn := dial(t, s)
+	fmt.Fprint(conn, "GET /hello HTTP/1.1\r\n")
+	waitFor(t, "the half request to be read", func() bool { return s.metrics.bytesRead.Value() > 0 })
+
+	start := time.Now()
+	if err := s.Shutdown(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("Shutdown returned after %v, before the timeout", d)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection open after Shutdown")
+	}
+}
+
+// TestHTTPServerListenFd serves on a listener opened elsewhere, as handed over by an upgrade.
+func TestHTTPServerListenFd(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	unix.Listen(fd, 16)
+	s := startHTTPServerOpts(t, &HTTPServerOpts{ListenFd: fd})
+	if s.Fd != fd {
+		t.Fatalf("serving on fd %d, handed %d", s.Fd, fd)
+	}
+	hello(t, dial(t, s))
+
+	if _, err := NewHTTPServer(&HTTPServerOpts{ListenFd: 1, Logger: logging.Discard()}); err == nil {
+		t.Fatal("adopted stdout as a listener")
+	}
+}
+
+// serverSuite is what TestHTTPServerUring, TestHTTPServerLevelTriggered and TestHTTPServerOneShot rerun.
+var serverSuite = []struct {
+	name string
+	test func(*testing.T)
+}{
+	{"Get", TestHTTPServerGet},
+	{"NotFoundAndPanic", TestHTTPServerNotFoundAndPanic},
+	{"HTTP10Closes", TestHTTPServerHTTP10Closes},
+	{"PipelinedKeepAlive", TestHTTPServerPipelinedKeepAlive},
+	{"ParseError", TestHTTPServerParseError},
+	{"TransferEncoding", TestHTTPServerTransferEncoding},
+	{"Disconnect", TestHTTPServerDisconnect},
+	{"Close", TestHTTPServerClose},
+	{"Metrics", TestHTTPServerMetrics},
+	{"LargeBody", TestHTTPServerLargeBody},
+	{"BufferLimits", TestHTTPServerBufferLimits},
+	{"Chunks", TestHTTPServerChunks},
+	{"ManyConns", TestHTTPServerManyConns},
+	{"MaxConnsReject", TestHTTPServerMaxConnsReject},
+	{"MaxConnsPause", TestHTTPServerMaxConnsPause},
+	{"Reload", TestHTTPServerReload},
+	{"Kick", TestHTTPServerKick},
+	{"ReadTimeout", TestHTTPServerReadTimeout},
+	{"WriteTimeout", TestHTTPServerWriteTimeout},
+	{"AccessLog", TestHTTPServerAccessLog},
+	{"Shutdown", TestHTTPServerShutdown},
+	{"ShutdownTimeout", TestHTTPServerShutdownTimeout},
+}
+
+func TestHTTPServerUring(t *testing.T) {
+	if err := uring.Supported(); err != nil {
+		t.Skip(err)
+	}
+	testBackend = loop.Uring
+	defer func() { testBackend = loop.Epoll }()
+
+	for _, tt := range serverSuite {
+		t.Run(tt.name, tt.test)
+	}
+}
+
+func TestHTTPServerLevelTriggered(t *testing.T) {
+	testTrigger = loop.Level
+	defer func() { testTrigger = loop.Edge }()
+
+	for _, tt := range serverSuite {
+		t.Run(tt.name, tt.test)
+	}
+}
+
+func TestHTTPServerOneShot(t *testing.T) {
+	testPollers = 4
+	defer func() { testPollers = 1 }()
+
+	for _, trigger := range []loop.Trigger{loop.Edge, loop.Level} {
+		t.Run(string(trigger), func(t *testing.T) {
+			testTrigger = trigger
+			defer func() { testTrigger = loop.Edge }()
+
+			for _, tt := range serverSuite {
+				t.Run(tt.name, tt.test)
+			}
+		})
+	}
+}
+
+func TestHTTPServerPollersNeedOneShot(t *testing.T) {
+	_, err := NewHTTPServer(&HTTPServerOpts{Addr: "127.0.0.1", Pollers: 2, Logger: logging.Discard()})
+	if err == nil {
+		t.Fatal("expected an error for several pollers without OneShot")
+	}
+}
+
+// BenchmarkHTTPServer sends keep-alive GETs on one connection per goroutine, against each
+// loop and, for comparison, net/http serving the same answer, see package bench.
+func BenchmarkHTTPServer(b *testing.B) {
+	for _, tt := range []struct {
+		name    string
+		backend loop.Backend // empty for net/http
+		pollers int
+	}{
+		{"epoll", loop.Epoll, 1},
+		{"epoll-oneshot", loop.Epoll, 4},
+		{"io_uring", loop.Uring, 1},
+		{"net_http", "", 0},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			var addr string
+			if tt.backend == "" {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer ln.Close()
+				go bench.ServeHTTP(ln)
+				addr = ln.Addr().String()
+			} else {
+				if tt.backend == loop.Uring {
+					if err := uring.Supported(); err != nil {
+						b.Skip(err)
+					}
+				}
+				testBackend, testPollers = tt.backend, tt.pollers
+				defer func() { testBackend, testPollers = loop.Epoll, 1 }()
+				addr = startHTTPServer(b).Addr()
+			}
+			var hist bench.Histogram
+			b.ReportAllocs()
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for pb.Next() {
+					start := time.Now()
+					fmt.Fprint(conn, "GET /hello HTTP/1.1\r\nHost: bench\r\n\r\n")
+					res, err := http.ReadResponse(r, nil)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(io.Discard, res.Body)
+					res.Body.Close()
+					hist.Record(time.Since(start))
+				}
+			})
+			hist.Report(b)
+		})
+	}
+}
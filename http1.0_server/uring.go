@@ -0,0 +1,474 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/loop"
+	"github.com/toastsandwich/epoll-learn/pkg/uring"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	URINGENTRIES = 4096
+	URINGBUFFERS = 1024 // provided recv buffers, CONNBUFFERSIZE each
+
+	// most sends linked into one chain, the rest goes when the chain completes
+	URINGMAXLINKED = 16
+)
+
+// uringConn is what the io_uring loop keeps for a connection beside its Conn.
+type uringConn struct {
+	c   *Conn
+	gen uint32
+
+	inflight int   // sends and the shutdown the kernel still holds
+	sending  []int // lengths of the sends in flight, in chain order
+	failed   bool  // a send in the chain failed, the rest come back cancelled
+	shutdown bool  // the chain ended in a shutdown, the response that closes is out
+	closing  bool  // closed while the kernel held WriteBuffer bytes, see uringLoop.close
+}
+
+type uringLoop struct {
+	s     *HTTPServer
+	ring  *uring.Ring
+	bufs  *uring.BufRing
+	conns map[int]*uringConn
+	gen   uint32
+
+	// the multishot accept is cancelled at MaxConns with loop.Pause and submitted again once
+	// a connection closes, a new generation so a late completion of the old one is told apart
+	acceptGen    uint32
+	acceptPaused bool
+	draining     bool // accepting stopped for good, see HTTPServer.Shutdown
+
+	starved []int // connections whose recv ran out of buffers, re-armed as buffers come back
+	iovs    [][]byte
+}
+
+// kick queues c for the loop to flush and wakes it through the eventfd, workers call it from Reply.
+func (s *HTTPServer) kick(c *Conn) {
+	s.kickMu.Lock()
+	s.kicked = append(s.kicked, c)
+	wake := !s.kickPending
+	s.kickPending = true
+	s.kickMu.Unlock()
+
+	if wake {
+		var one [8]byte
+		binary.NativeEndian.PutUint64(one[:], 1)
+		unix.Write(s.wakeFd, one[:])
+	}
+}
+
+// serveUring is ListenAndServe on io_uring: multishot accept, multishot recv into provided
+// buffers, and responses sent as a chain of linked sends, ending in a linked shutdown when
+// the response closes the connection.
+func (s *HTTPServer) serveUring() error {
+	ring, err := uring.New(URINGENTRIES)
+	if err != nil {
+		return fmt.Errorf("setting up io_uring: %w", err)
+	}
+	defer ring.Close()
+	bufs, err := ring.RegisterBufRing(0, URINGBUFFERS, CONNBUFFERSIZE)
+	if err != nil {
+		return fmt.Errorf("registering recv buffers: %w", err)
+	}
+	defer bufs.Close()
+
+	l := &uringLoop{s: s, ring: ring, bufs: bufs, conns: make(map[int]*uringConn)}
+	if err := l.armAccept(); err != nil {
+		return err
+	}
+	if err := l.armWake(); err != nil {
+		return err
+	}
+
+	for {
+		if err := ring.SubmitAndWait(); err != nil {
+			return fmt.Errorf("error waiting for completions: %w", err)
+		}
+		var stop bool
+		var loopErr error
+		n := ring.Completions(func(cqe *uring.CQE) {
+			if stop || loopErr != nil {
+				l.recycle(cqe)
+				return
+			}
+			stop, loopErr = l.complete(cqe)
+		})
+		s.metrics.wakeups.Inc()
+		s.metrics.eventsPerWakeup.Observe(float64(n))
+		if stop || loopErr != nil {
+			return loopErr
+		}
+	}
+}
+
+func (l *uringLoop) armAccept() error {
+	sqe, err := l.ring.GetSQE()
+	if err != nil {
+		return err
+	}
+	uring.PrepAcceptMultishot(sqe, l.s.Fd, unix.SOCK_CLOEXEC, uring.UserData(uring.OpAccept, l.s.Fd, l.acceptGen))
+	return nil
+}
+
+// pauseAccepting cancels the multishot accept once MaxConns connections are open, see
+// loop.Pause. the kernel may complete a few more accepts before the cancel, they are rejected.
+func (l *uringLoop) pauseAccepting() error {
+	maxConns, overLimit := l.s.limits()
+	if overLimit != loop.Pause || l.acceptPaused || !atLimit(len(l.conns), maxConns) {
+		return nil
+	}
+	l.s.metrics.acceptPauses.Inc()
+	l.s.log.Debug("connection limit reached, pausing accepts", slog.Int("conns", len(l.conns)))
+	return l.cancelAccept()
+}
+
+// cancelAccept stops the multishot accept, a no-op if it is stopped already.
+func (l *uringLoop) cancelAccept() error {
+	if l.acceptPaused {
+		return nil
+	}
+	sqe, err := l.ring.GetSQE()
+	if err != nil {
+		return err
+	}
+	uring.PrepCancel(sqe, uring.UserData(uring.OpAccept, l.s.Fd, l.acceptGen), uring.UserData(uring.OpCancel, l.s.Fd, 0))
+	l.acceptPaused = true
+	return nil
+}
+
+// resumeAccepting submits a new multishot accept once below MaxConns again, or once
+// Reload lifted the limit or stopped pausing.
+func (l *uringLoop) resumeAccepting() {
+	if !l.acceptPaused || l.draining {
+		return
+	}
+	if maxConns, overLimit := l.s.limits(); overLimit == loop.Pause && atLimit(len(l.conns), maxConns) {
+		return
+	}
+	l.acceptGen++
+	if err := l.armAccept(); err != nil {
+		l.s.log.Error("error resuming accepts", logging.Err(err))
+		return
+	}
+	l.acceptPaused = false
+	l.s.log.Debug("below connection limit, resuming accepts")
+}
+
+func (l *uringLoop) armWake() error {
+	sqe, err := l.ring.GetSQE()
+	if err != nil {
+		return err
+	}
+	uring.PrepRead(sqe, l.s.wakeFd, l.s.uringWake[:], uring.UserData(uring.OpRead, l.s.wakeFd, 0))
+	return nil
+}
+
+func (l *uringLoop) armRecv(fd int, uc *uringConn) error {
+	sqe, err := l.ring.GetSQE()
+	if err != nil {
+		return err
+	}
+	uring.PrepRecvMultishot(sqe, fd, l.bufs.Group(), uring.UserData(uring.OpRecv, fd, uc.gen))
+	return nil
+}
+
+// recycle hands back the buffer of a completion nobody is going to read.
+func (l *uringLoop) recycle(cqe *uring.CQE) {
+	if bid, ok := cqe.BufferID(); ok {
+		l.giveBack(bid)
+	}
+}
+
+// giveBack recycles a buffer and wakes a connection that was waiting for one.
+func (l *uringLoop) giveBack(bid uint16) {
+	l.bufs.Recycle(bid)
+	for len(l.starved) > 0 {
+		fd := l.starved[0]
+		l.starved = l.starved[1:]
+		if uc, ok := l.conns[fd]; ok && !uc.closing {
+			l.armRecv(fd, uc)
+			return
+		}
+	}
+}
+
+// complete handles one completion, stop is set when Close asked the loop to return.
+func (l *uringLoop) complete(cqe *uring.CQE) (stop bool, err error) {
+	op, fd, gen := uring.SplitUserData(cqe.UserData)
+	switch op {
+	case uring.OpRead:
+		return l.woken()
+	case uring.OpAccept:
+		return false, l.accepted(cqe, gen)
+	case uring.OpCancel:
+		return false, nil
+	}
+
+	uc, ok := l.conns[fd]
+	if !ok || uc.gen != gen {
+		// a completion for a connection already closed, the fd may be someone else's by now
+		l.recycle(cqe)
+		return false, nil
+	}
+	switch op {
+	case uring.OpRecv:
+		return false, l.received(fd, uc, cqe)
+	case uring.OpSend, uring.OpShutdown:
+		return false, l.sent(fd, uc, op, cqe)
+	}
+	return false, nil
+}
+
+// woken runs when the eventfd is written, by Close or by a worker with a response.
+func (l *uringLoop) woken() (bool, error) {
+	l.s.mu.RLock()
+	closed := l.s.closed
+	l.s.mu.RUnlock()
+	if closed {
+		return true, nil
+	}
+
+	l.s.kickMu.Lock()
+	kicked := l.s.kicked
+	l.s.kicked = nil
+	l.s.kickPending = false
+	l.s.kickMu.Unlock()
+
+	if err := l.armWake(); err != nil {
+		return false, err
+	}
+	if l.s.draining.Load() {
+		if err := l.drain(); err != nil {
+			return false, err
+		}
+	}
+	// Reload may have lifted the limit
+	l.resumeAccepting()
+	for _, c := range kicked {
+		if uc, ok := l.conns[c.fd]; ok && uc.c == c {
+			if err := l.flush(c.fd, uc); err != nil {
+				return false, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// drain runs for Shutdown, accepting stops and idle connections are closed.
+func (l *uringLoop) drain() error {
+	if !l.draining {
+		l.draining = true
+		if err := l.cancelAccept(); err != nil {
+			return err
+		}
+	}
+	for fd, uc := range l.conns {
+		if !uc.closing && uc.inflight == 0 && uc.c.idle() {
+			l.close(fd, uc)
+		}
+	}
+	return nil
+}
+
+func (l *uringLoop) accepted(cqe *uring.CQE, gen uint32) error {
+	current := gen == l.acceptGen && !l.acceptPaused
+	if cqe.Flags&uring.CqeMore == 0 && current {
+		if err := l.armAccept(); err != nil {
+			return err
+		}
+	}
+	if err := cqe.Err(); err != nil {
+		switch {
+		case errors.Is(err, unix.ECANCELED) && !current:
+			// pauseAccepting's cancel
+		case loop.OutOfFds(err):
+			// the listener is still readable, the accept still armed
+			l.s.shed(err)
+		default:
+			l.s.log.Error("error accepting new connection", logging.Err(err))
+		}
+		return nil
+	}
+
+	fd := int(cqe.Res)
+	peer := "unknown"
+	if sa, err := unix.Getpeername(fd); err == nil {
+		peer = sockaddrString(sa)
+	}
+	if maxConns, _ := l.s.limits(); atLimit(len(l.conns), maxConns) {
+		l.s.reject(fd, peer)
+		return nil
+	}
+	c := NewConn(fd, -1, l.s.readLimit, l.s.writeLimit, logging.Conn(l.s.log, fd, peer))
+	c.peer = peer
+	c.kick = l.s.kick
+	l.gen++
+	uc := &uringConn{c: c, gen: l.gen}
+	if err := l.armRecv(fd, uc); err != nil {
+		c.Close()
+		return err
+	}
+	l.conns[fd] = uc
+	c.log.Debug("new connection")
+	l.s.metrics.accepted.Inc()
+	l.s.mu.Lock()
+	l.s.ActiveConnMap[fd] = c
+	l.s.mu.Unlock()
+	return l.pauseAccepting()
+}
+
+func (l *uringLoop) received(fd int, uc *uringConn, cqe *uring.CQE) error {
+	if uc.closing {
+		l.recycle(cqe)
+		return nil
+	}
+	c := uc.c
+	if err := cqe.Err(); err != nil {
+		if errors.Is(err, unix.ENOBUFS) {
+			// every buffer is taken, try again once one comes back
+			l.starved = append(l.starved, fd)
+			return nil
+		}
+		c.log.Warn("error reading from connection", logging.Err(err))
+		l.close(fd, uc)
+		return nil
+	}
+	if cqe.Res == 0 {
+		l.close(fd, uc)
+		return nil
+	}
+
+	readAt := time.Now()
+	bid, _ := cqe.BufferID()
+	p := l.bufs.Buffer(bid, int(cqe.Res))
+	c.bytesRead.Add(int64(len(p)))
+	c.log.Debug("read from connection", logging.Bytes(len(p)))
+	l.s.metrics.bytesRead.Add(len(p))
+
+	var reqs [][]byte
+	var bad error
+	for len(p) > 0 && bad == nil {
+		k := min(len(p), c.ReadBuffer.Free())
+		c.ReadBuffer.Write(p[:k])
+		p = p[k:]
+		reqs, bad = frameRequests(c, reqs, c.ReadBuffer.Free() == 0)
+	}
+	l.giveBack(bid)
+	l.s.dispatch(c, reqs, bad, readAt)
+
+	if cqe.Flags&uring.CqeMore == 0 {
+		return l.armRecv(fd, uc)
+	}
+	return nil
+}
+
+// flush sends what WriteBuffer holds as one chain of linked sends, a send that comes up
+// short breaks the chain so nothing after it goes out of order. When the chain carries the
+// last of a response that closes the connection it ends in a shutdown of the write side.
+func (l *uringLoop) flush(fd int, uc *uringConn) error {
+	if uc.inflight > 0 || uc.closing {
+		return nil // flushed again when the chain in flight completes
+	}
+	c := uc.c
+	c.mu.Lock()
+	l.iovs = c.WriteBuffer.Segments(l.iovs[:0], URINGMAXLINKED)
+	queued := 0
+	for _, p := range l.iovs {
+		queued += len(p)
+	}
+	last := queued == c.WriteBuffer.Len()
+	closeAfter := c.closeAfterWrite
+	c.mu.Unlock()
+
+	if len(l.iovs) == 0 {
+		if closeAfter {
+			l.close(fd, uc)
+		}
+		return nil
+	}
+
+	userData := func(op uint8) uint64 { return uring.UserData(op, fd, uc.gen) }
+	uc.sending = uc.sending[:0]
+	for i, p := range l.iovs {
+		sqe, err := l.ring.GetSQE()
+		if err != nil {
+			return err
+		}
+		uring.PrepSend(sqe, fd, p, userData(uring.OpSend))
+		if i < len(l.iovs)-1 || (last && closeAfter) {
+			sqe.Flags |= uring.SqeIOLink
+		}
+		uc.sending = append(uc.sending, len(p))
+	}
+	uc.inflight = len(l.iovs)
+	if last && closeAfter {
+		sqe, err := l.ring.GetSQE()
+		if err != nil {
+			return err
+		}
+		uring.PrepShutdown(sqe, fd, unix.SHUT_WR, userData(uring.OpShutdown))
+		uc.inflight++
+	}
+	clear(l.iovs)
+	return nil
+}
+
+func (l *uringLoop) sent(fd int, uc *uringConn, op uint8, cqe *uring.CQE) error {
+	c := uc.c
+	uc.inflight--
+	switch {
+	case op == uring.OpShutdown:
+		uc.shutdown = cqe.Err() == nil
+	case uc.failed || errors.Is(cqe.Err(), unix.ECANCELED):
+		// the chain broke before this one
+	default:
+		want := uc.sending[0]
+		uc.sending = uc.sending[1:]
+		if cqe.Res > 0 {
+			c.mu.Lock()
+			c.WriteBuffer.Discard(int(cqe.Res))
+			c.wrote(int(cqe.Res))
+			c.bytesWritten.Add(int64(cqe.Res))
+			c.mu.Unlock()
+			c.log.Debug("wrote to connection", logging.Bytes(int(cqe.Res)))
+			l.s.metrics.bytesWritten.Add(int(cqe.Res))
+		}
+		if int(cqe.Res) != want {
+			if !uc.closing {
+				c.log.Warn("error writing to connection", logging.Err(cqe.Err()), slog.Int("sent", int(cqe.Res)))
+			}
+			uc.failed = true
+		}
+	}
+	if uc.inflight > 0 {
+		return nil
+	}
+
+	if uc.closing || uc.failed || uc.shutdown {
+		uc.closing = false
+		l.close(fd, uc)
+		return nil
+	}
+	return l.flush(fd, uc)
+}
+
+// close shuts the socket down, which ends a recv still armed, and closes it once the kernel
+// holds none of its WriteBuffer, until then the fd is not free for a new connection either.
+func (l *uringLoop) close(fd int, uc *uringConn) {
+	unix.Shutdown(fd, unix.SHUT_RDWR)
+	if uc.inflight > 0 {
+		uc.closing = true
+		return
+	}
+	delete(l.conns, fd)
+	l.s.closeConn(uc.c)
+	l.resumeAccepting()
+}
@@ -4,38 +4,136 @@ import "sync"
 
 type ConnJob func()
 
+// JobManager runs jobs on N workers, jobs submitted with the same key always land on
+// the same worker so work for one connection is done in the order it was submitted.
 type JobManager struct {
 	N    int
-	JobQ chan ConnJob
+	JobQ []chan ConnJob
 
-	wg *sync.WaitGroup
+	// jobs TrySubmit found no room for, run once their worker's JobQ is empty
+	over []*overflow
+	wg   *sync.WaitGroup
+}
+
+type overflow struct {
+	mu   sync.Mutex
+	jobs []ConnJob
+	wake chan struct{} // the worker has overflow to run
 }
 
 func NewJobManager(n int) *JobManager {
 	j := &JobManager{
 		N:    n,
-		JobQ: make(chan ConnJob, 1024),
+		JobQ: make([]chan ConnJob, n),
+		over: make([]*overflow, n),
 		wg:   &sync.WaitGroup{},
 	}
 
-	for range n {
-		j.wg.Go(func() {
-			for job := range j.JobQ {
-				job()
-			}
-		})
+	for i := range n {
+		q := make(chan ConnJob, 1024)
+		o := &overflow{wake: make(chan struct{}, 1)}
+		j.JobQ[i], j.over[i] = q, o
+		j.wg.Go(func() { work(q, o) })
 	}
 	return j
 }
 
+// work runs q's jobs, and o's once q is empty, they were all submitted after what q held.
+func work(q chan ConnJob, o *overflow) {
+	for {
+		select {
+		case job, ok := <-q:
+			if !ok {
+				return
+			}
+			job()
+			continue
+		default:
+		}
+		o.mu.Lock()
+		jobs := o.jobs
+		o.jobs = nil
+		o.mu.Unlock()
+		for _, job := range jobs {
+			job()
+		}
+		if len(jobs) > 0 {
+			continue
+		}
+		select {
+		case job, ok := <-q:
+			if !ok {
+				return
+			}
+			job()
+		case <-o.wake:
+		}
+	}
+}
+
+// Submit queues job for key's worker, it blocks while that worker's queue is full.
+func (j *JobManager) Submit(key int, job ConnJob) {
+	o := j.over[key%j.N]
+	o.mu.Lock()
+	if len(o.jobs) > 0 {
+		// behind the overflow, not ahead of it
+		o.jobs = append(o.jobs, job)
+		o.mu.Unlock()
+		return
+	}
+	o.mu.Unlock()
+	j.JobQ[key%j.N] <- job
+}
+
+// TrySubmit queues job for key's worker without blocking, a full queue overflows to a list
+// the worker runs next. for the poller and the workers themselves, which must not wait on
+// a worker.
+func (j *JobManager) TrySubmit(key int, job ConnJob) {
+	o := j.over[key%j.N]
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.jobs) == 0 {
+		select {
+		case j.JobQ[key%j.N] <- job:
+			return
+		default:
+		}
+	}
+	o.jobs = append(o.jobs, job)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Lens is how many jobs wait on each worker.
+func (j *JobManager) Lens() []int {
+	lens := make([]int, j.N)
+	for i, q := range j.JobQ {
+		o := j.over[i]
+		o.mu.Lock()
+		lens[i] = len(q) + len(o.jobs)
+		o.mu.Unlock()
+	}
+	return lens
+}
+
 func (j *JobManager) FlushJobs() {
-	for len(j.JobQ) > 0 {
-		<-j.JobQ
+	for i, q := range j.JobQ {
+		o := j.over[i]
+		o.mu.Lock()
+		o.jobs = nil
+		o.mu.Unlock()
+		for len(q) > 0 {
+			<-q
+		}
 	}
 }
 
 func (j *JobManager) Close() {
 	j.FlushJobs()
-	close(j.JobQ)
+	for _, q := range j.JobQ {
+		close(q)
+	}
 	j.wg.Wait() // wait for in proc jobs to finish
 }
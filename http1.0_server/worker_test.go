@@ -0,0 +1,37 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestJobManagerTrySubmit fills a worker's queue from the worker itself, Submit would never
+// return, and checks jobs still run in the order they were submitted.
+func TestJobManagerTrySubmit(t *testing.T) {
+	jm := NewJobManager(1)
+	defer jm.Close()
+
+	const N = 3000
+	var got []int
+	done := make(chan struct{})
+	jm.Submit(0, func() {
+		for i := range N {
+			jm.TrySubmit(0, func() { got = append(got, i) })
+		}
+		// behind the overflow
+		jm.Submit(0, func() { close(done) })
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker is stuck")
+	}
+	want := make([]int, N)
+	for i := range want {
+		want[i] = i
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("ran %d jobs out of order", len(got))
+	}
+}
@@ -0,0 +1,206 @@
+// Package accesslog writes one line per request, in Common or Combined Log Format as
+// Apache and nginx do, or as JSON lines. Lines are formatted on the caller and handed to
+// a writer, a File writes them on a goroutine of its own so a slow disk never holds up
+// the event loop.
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Format is how a request is written.
+type Format string
+
+const (
+	// Common is the Common Log Format, host ident user [time] "request" status bytes, with
+	// the duration in microseconds appended as Apache's %D, log tools take it as an extra field.
+	Common Format = "common"
+	// Combined is Common with the referer and user agent before the duration.
+	Combined Format = "combined"
+	// JSON is one object per line.
+	JSON Format = "json"
+)
+
+// ParseFormat accepts common, combined or json. An empty s gives an empty Format, the
+// caller then picks its own default.
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case "":
+		return "", nil
+	case Common, Combined, JSON:
+		return Format(s), nil
+	}
+	return "", fmt.Errorf("unknown access log format %q, want common, combined or json", s)
+}
+
+// CLFTIME is how Common and Combined write the time.
+const CLFTIME = "02/Jan/2006:15:04:05 -0700"
+
+// Entry is one request. The byte slices are only read during Log, they can point into a
+// request buffer that is reused after.
+type Entry struct {
+	Time      time.Time // when the request was read
+	Peer      string    // host:port of the client
+	Method    []byte
+	Path      []byte
+	Proto     []byte
+	Status    int
+	Bytes     int // response bytes, status line and headers included
+	Referer   []byte
+	UserAgent []byte
+	Duration  time.Duration // from reading the request to queueing the response
+}
+
+type Logger struct {
+	w      io.Writer
+	format Format
+	bufs   sync.Pool
+}
+
+// New returns a Logger writing to w in format, Combined when empty. Every line is one
+// call to w.Write.
+func New(w io.Writer, format Format) *Logger {
+	if format == "" {
+		format = Combined
+	}
+	return &Logger{
+		w:      w,
+		format: format,
+		bufs:   sync.Pool{New: func() any { b := make([]byte, 0, 256); return &b }},
+	}
+}
+
+// Log writes e, it is safe to call from any goroutine.
+func (l *Logger) Log(e *Entry) {
+	bp := l.bufs.Get().(*[]byte)
+	b := Append((*bp)[:0], l.format, e)
+	l.w.Write(b)
+	*bp = b
+	l.bufs.Put(bp)
+}
+
+// Append appends e as a line in format to b.
+func Append(b []byte, format Format, e *Entry) []byte {
+	if format == JSON {
+		return appendJSON(b, e)
+	}
+	host := e.Peer
+	if h, _, err := net.SplitHostPort(e.Peer); err == nil {
+		host = h
+	}
+	b = appendOr(b, host)
+	b = append(b, " - - ["...)
+	b = e.Time.AppendFormat(b, CLFTIME)
+	b = append(b, "] \""...)
+	if len(e.Method) == 0 {
+		// a request that could not be parsed has no request line to show
+		b = append(b, '-')
+	} else {
+		b = appendEscaped(b, e.Method)
+		b = append(b, ' ')
+		b = appendEscaped(b, e.Path)
+		b = append(b, ' ')
+		b = appendEscaped(b, e.Proto)
+	}
+	b = append(b, "\" "...)
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, ' ')
+	if e.Bytes == 0 {
+		b = append(b, '-')
+	} else {
+		b = strconv.AppendInt(b, int64(e.Bytes), 10)
+	}
+	if format == Combined {
+		b = append(b, " \""...)
+		b = appendEscapedOr(b, e.Referer)
+		b = append(b, "\" \""...)
+		b = appendEscapedOr(b, e.UserAgent)
+		b = append(b, '"')
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, e.Duration.Microseconds(), 10)
+	return append(b, '\n')
+}
+
+func appendOr(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, '-')
+	}
+	return append(b, s...)
+}
+
+func appendEscapedOr(b, p []byte) []byte {
+	if len(p) == 0 {
+		return append(b, '-')
+	}
+	return appendEscaped(b, p)
+}
+
+// appendEscaped escapes quotes, backslashes and anything unprintable as Apache does, a
+// client cannot end the quoted field early or forge a line.
+func appendEscaped(b, p []byte) []byte {
+	for _, c := range p {
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20 || c >= 0x7f:
+			b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+const hex = "0123456789abcdef"
+
+func appendJSON(b []byte, e *Entry) []byte {
+	b = append(b, `{"time":"`...)
+	b = e.Time.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, `","peer":`...)
+	b = appendJSONString(b, []byte(e.Peer))
+	b = append(b, `,"method":`...)
+	b = appendJSONString(b, e.Method)
+	b = append(b, `,"path":`...)
+	b = appendJSONString(b, e.Path)
+	b = append(b, `,"proto":`...)
+	b = appendJSONString(b, e.Proto)
+	b = append(b, `,"status":`...)
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, `,"bytes":`...)
+	b = strconv.AppendInt(b, int64(e.Bytes), 10)
+	b = append(b, `,"referer":`...)
+	b = appendJSONString(b, e.Referer)
+	b = append(b, `,"user_agent":`...)
+	b = appendJSONString(b, e.UserAgent)
+	b = append(b, `,"duration_us":`...)
+	b = strconv.AppendInt(b, e.Duration.Microseconds(), 10)
+	return append(b, "}\n"...)
+}
+
+// appendJSONString quotes p as a JSON string, invalid UTF-8 becomes U+FFFD.
+func appendJSONString(b, p []byte) []byte {
+	b = append(b, '"')
+	for len(p) > 0 {
+		r, size := utf8.DecodeRune(p)
+		switch {
+		case r == '"' || r == '\\':
+			b = append(b, '\\', byte(r))
+		case r < 0x20:
+			b = append(b, `\u00`...)
+			b = append(b, hex[r>>4], hex[r&0xf])
+		case r == utf8.RuneError && size == 1:
+			b = append(b, `�`...)
+		default:
+			b = append(b, p[:size]...)
+		}
+		p = p[size:]
+	}
+	return append(b, '"')
+}
@@ -0,0 +1,138 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+)
+
+func entry() *Entry {
+	return &Entry{
+		Time:      time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		Peer:      "127.0.0.1:5000",
+		Method:    []byte("GET"),
+		Path:      []byte("/apache_pb.gif"),
+		Proto:     []byte("HTTP/1.0"),
+		Status:    200,
+		Bytes:     2326,
+		Referer:   []byte("http://www.example.com/start.html"),
+		UserAgent: []byte(`Mozilla/4.08 "quoted"` + "\n"),
+		Duration:  1500 * time.Microsecond,
+	}
+}
+
+func TestAppend(t *testing.T) {
+	for _, tt := range []struct {
+		format Format
+		want   string
+	}{
+		{Common, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 1500` + "\n"},
+		{Combined, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 \"quoted\"\x0a" 1500` + "\n"},
+	} {
+		if got := string(Append(nil, tt.format, entry())); got != tt.want {
+			t.Errorf("%s\n got %s\nwant %s", tt.format, got, tt.want)
+		}
+	}
+
+	// an unparsed request, nothing sent yet
+	e := &Entry{Time: entry().Time, Peer: "10.0.0.1:1", Status: 400}
+	if got, want := string(Append(nil, Combined, e)), `10.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "-" 400 - "-" "-" 0`+"\n"; got != want {
+		t.Errorf("bad request\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestAppendJSON(t *testing.T) {
+	e := entry()
+	e.Path = []byte("/\xff\x01")
+	line := Append(nil, JSON, e)
+	var got map[string]any
+	if err := json.Unmarshal(line, &got); err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+	if got["path"] != "/�\x01" || got["user_agent"] != "Mozilla/4.08 \"quoted\"\n" ||
+		got["status"] != 200.0 || got["duration_us"] != 1500.0 || got["peer"] != "127.0.0.1:5000" {
+		t.Fatalf("%s", line)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if f, err := ParseFormat("json"); f != JSON || err != nil {
+		t.Fatalf("json: %q, %v", f, err)
+	}
+	if _, err := ParseFormat("apache"); err == nil {
+		t.Fatal("no error for an unknown format")
+	}
+}
+
+func TestFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	fl, err := OpenFile(path, FileOpts{MaxSize: 100, Backups: 2, Logger: logging.Discard()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := New(fl, Common)
+	for i := range 20 {
+		e := entry()
+		e.Status = 200 + i
+		l.Log(e)
+	}
+	if err := fl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	last, _ := os.ReadFile(path)
+	if !strings.Contains(string(last), " 219 ") {
+		t.Fatalf("newest line not in %s: %q", path, last)
+	}
+	for _, name := range []string{path + ".1", path + ".2"} {
+		if b, err := os.ReadFile(name); err != nil || len(b) == 0 {
+			t.Fatalf("%s: %d bytes, %v", name, len(b), err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Fatal("kept more than 2 backups")
+	}
+	if fl.rotated.Load() == 0 || fl.Dropped() != 0 {
+		t.Fatalf("rotated %d, dropped %d", fl.rotated.Load(), fl.Dropped())
+	}
+}
+
+func TestFileDropsWhenBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	fl, err := OpenFile(path, FileOpts{Pending: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fmt.Fprintln(fl, "a line longer than ten bytes"); !errors.Is(err, ErrDropped) {
+		t.Fatalf("write past pending: %v", err)
+	}
+	fmt.Fprintln(fl, "short")
+	fl.Close()
+	if b, _ := os.ReadFile(path); string(b) != "short\n" || fl.Dropped() != 1 {
+		t.Fatalf("wrote %q, dropped %d", b, fl.Dropped())
+	}
+	if _, err := fl.Write([]byte("late\n")); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("write after close: %v", err)
+	}
+}
+
+func BenchmarkLog(b *testing.B) {
+	fl, err := OpenFile(filepath.Join(b.TempDir(), "access.log"), FileOpts{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fl.Close()
+	l := New(fl, Combined)
+	e := entry()
+	b.ReportAllocs()
+	for b.Loop() {
+		l.Log(e)
+	}
+}
@@ -0,0 +1,213 @@
+package accesslog
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/metrics"
+)
+
+const (
+	// bytes waiting for the writer before lines are dropped
+	PENDING = 1 << 20
+	// rotated files kept, path.1 the newest
+	BACKUPS = 5
+)
+
+// ErrDropped is what Write returns for a line that did not fit while the writer was behind.
+var ErrDropped = errors.New("access log writer behind, line dropped")
+
+type FileOpts struct {
+	// MaxSize is how big the file gets before it is rotated to path.1, path.1 to path.2 and
+	// so on, the oldest past Backups is removed. 0 never rotates, for logrotate with copytruncate.
+	MaxSize int64
+	Backups int // defaults to BACKUPS
+	Pending int // defaults to PENDING
+
+	Logger *slog.Logger // for write and rotation errors, defaults to logging.Default()
+}
+
+// File is an append only log file written on a goroutine of its own. Write copies the line
+// into a pending buffer and returns, when the writer falls PENDING bytes behind lines are
+// dropped and counted instead of waited for.
+type File struct {
+	path string
+	opts FileOpts
+
+	mu      sync.Mutex
+	pending []byte
+	closed  bool
+	wake    chan struct{} // closed by Close
+
+	// owned by the writer
+	f     *os.File
+	size  int64
+	spare []byte
+
+	dropped atomic.Int64
+	rotated atomic.Int64
+	done    chan struct{}
+	log     *slog.Logger
+}
+
+// OpenFile opens path for appending, creating it, and starts the writer.
+func OpenFile(path string, opts FileOpts) (*File, error) {
+	if opts.MaxSize < 0 || opts.Backups < 0 || opts.Pending < 0 {
+		return nil, fmt.Errorf("access log max size %d, backups %d, pending %d, want 0 for the defaults or more",
+			opts.MaxSize, opts.Backups, opts.Pending)
+	}
+	opts.Backups = cmp.Or(opts.Backups, BACKUPS)
+	opts.Pending = cmp.Or(opts.Pending, PENDING)
+	fl := &File{path: path, opts: opts, wake: make(chan struct{}, 1), done: make(chan struct{}), log: opts.Logger}
+	if fl.log == nil {
+		fl.log = logging.Default()
+	}
+	if err := fl.open(); err != nil {
+		return nil, err
+	}
+	go fl.run()
+	return fl, nil
+}
+
+func (fl *File) open() error {
+	f, err := os.OpenFile(fl.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("access log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("access log: %w", err)
+	}
+	fl.f, fl.size = f, fi.Size()
+	return nil
+}
+
+// Write queues p, which should be whole lines, and never blocks on the disk.
+func (fl *File) Write(p []byte) (int, error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.closed {
+		return 0, os.ErrClosed
+	}
+	if len(fl.pending)+len(p) > fl.opts.Pending {
+		fl.dropped.Add(int64(bytes.Count(p, []byte("\n"))))
+		return 0, ErrDropped
+	}
+	fl.pending = append(fl.pending, p...)
+	select {
+	case fl.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// Dropped is how many lines were dropped, the writer being behind or failing.
+func (fl *File) Dropped() int64 { return fl.dropped.Load() }
+
+// RegisterMetrics exports the dropped lines and rotations as <prefix>_access_log_*.
+func (fl *File) RegisterMetrics(reg *metrics.Registry, prefix string) {
+	reg.CounterFunc(prefix+"_access_log_dropped_total", "Access log lines dropped because the writer was behind or failing.", func() float64 {
+		return float64(fl.dropped.Load())
+	})
+	reg.CounterFunc(prefix+"_access_log_rotations_total", "Times the access log was rotated.", func() float64 {
+		return float64(fl.rotated.Load())
+	})
+}
+
+// Close writes what is pending, stops the writer and closes the file.
+func (fl *File) Close() error {
+	fl.mu.Lock()
+	if fl.closed {
+		fl.mu.Unlock()
+		return nil
+	}
+	fl.closed = true
+	close(fl.wake)
+	fl.mu.Unlock()
+	<-fl.done
+	return fl.f.Close()
+}
+
+func (fl *File) run() {
+	defer close(fl.done)
+	for range fl.wake {
+		fl.flush()
+	}
+	fl.flush()
+}
+
+// flush swaps the pending buffer for the spare one and writes it out.
+func (fl *File) flush() {
+	fl.mu.Lock()
+	chunk := fl.pending
+	fl.pending = fl.spare[:0]
+	fl.mu.Unlock()
+	if len(chunk) > 0 {
+		fl.write(chunk)
+	}
+	fl.spare = chunk
+}
+
+// write writes chunk, rotating between two lines whenever the next would take the file
+// past MaxSize.
+func (fl *File) write(chunk []byte) {
+	for len(chunk) > 0 {
+		n := len(chunk)
+		if room := fl.opts.MaxSize - fl.size; fl.opts.MaxSize > 0 && int64(n) > room {
+			n = bytes.LastIndexByte(chunk[:max(room, 0)], '\n') + 1
+			if n == 0 && fl.size > 0 {
+				if err := fl.rotate(); err != nil {
+					fl.log.Error("error rotating access log", slog.String("path", fl.path), logging.Err(err))
+					n = len(chunk)
+				} else {
+					continue
+				}
+			}
+			if n == 0 {
+				// a line longer than MaxSize gets a file of its own
+				n = bytes.IndexByte(chunk, '\n') + 1
+				if n == 0 {
+					n = len(chunk)
+				}
+			}
+		}
+		w, err := fl.f.Write(chunk[:n])
+		fl.size += int64(w)
+		if err != nil {
+			fl.dropped.Add(int64(bytes.Count(chunk[w:], []byte("\n"))))
+			fl.log.Error("error writing access log", slog.String("path", fl.path), logging.Err(err))
+			return
+		}
+		chunk = chunk[n:]
+	}
+}
+
+// rotate shifts path.N to path.N+1 and path to path.1, and starts a new path. on error
+// the current file is kept and grows past MaxSize.
+func (fl *File) rotate() error {
+	for i := fl.opts.Backups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", fl.path, i), fmt.Sprintf("%s.%d", fl.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(fl.path, fl.path+".1"); err != nil {
+		return err
+	}
+	old := fl.f
+	if err := fl.open(); err != nil {
+		// keep writing to the renamed file rather than nowhere
+		return err
+	}
+	old.Close()
+	fl.rotated.Add(1)
+	return nil
+}
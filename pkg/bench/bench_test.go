@@ -0,0 +1,116 @@
+package bench
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/metrics"
+)
+
+func listen(t *testing.T, serve func(net.Listener) error) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go serve(ln)
+	return ln.Addr().String()
+}
+
+func TestRunReferences(t *testing.T) {
+	for _, tt := range []struct {
+		workload Workload
+		serve    func(net.Listener) error
+	}{
+		{Echo, ServeEcho},
+		{HTTP, ServeHTTP},
+		{Chat, NewChatServer().Serve},
+	} {
+		t.Run(string(tt.workload), func(t *testing.T) {
+			c, err := Connect(Options{Workload: tt.workload, Addr: listen(t, tt.serve), Conns: 8})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			r := c.Run(200 * time.Millisecond)
+			if r.Requests == 0 || r.Errors != 0 || r.Conns != 8 {
+				t.Fatalf("%+v", r)
+			}
+			if r.P50 > r.P99 || r.P99 == 0 {
+				t.Fatalf("p50 %v p99 %v", r.P50, r.P99)
+			}
+		})
+	}
+}
+
+func TestConnectErrors(t *testing.T) {
+	addr := listen(t, ServeEcho)
+	for _, opts := range []Options{
+		{Workload: "ftp", Addr: addr, Conns: 1},
+		{Workload: Echo, Addr: addr},
+		{Workload: Chat, Addr: addr, Conns: 3},
+	} {
+		if c, err := Connect(opts); err == nil {
+			c.Close()
+			t.Errorf("no error for %+v", opts)
+		}
+	}
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln.Close()
+	if _, err := Connect(Options{Workload: Echo, Addr: ln.Addr().String(), Conns: 4}); err == nil {
+		t.Error("no error dialing a closed port")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+	for _, tt := range []struct {
+		p    float64
+		want time.Duration
+	}{{50, 500 * time.Millisecond}, {99, 990 * time.Millisecond}, {100, time.Second}} {
+		got := h.Percentile(tt.p)
+		if got < tt.want*94/100 || got > tt.want*106/100 {
+			t.Errorf("p%v %v, want about %v", tt.p, got, tt.want)
+		}
+	}
+	if h.Count() != 1000 {
+		t.Errorf("count %d", h.Count())
+	}
+}
+
+func TestReadMemory(t *testing.T) {
+	m, err := ReadMemory(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.RSS <= 0 || m.Peak < m.RSS {
+		t.Fatalf("%+v", m)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	reg := metrics.NewRegistry()
+	reg.GoRuntime()
+	reg.Counter("requests_total", "requests").Add(3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reg.WriteText(w) }))
+	defer srv.Close()
+
+	if v, err := Scrape(srv.URL, "requests_total"); v != 3 || err != nil {
+		t.Fatalf("requests_total %v, %v", v, err)
+	}
+	if v, err := Scrape(srv.URL, ALLOCS); v <= 0 || err != nil {
+		t.Fatalf("%s %v, %v", ALLOCS, v, err)
+	}
+	if _, err := Scrape(srv.URL, "missing"); err == nil {
+		t.Fatal("no error for a missing metric")
+	}
+}
@@ -0,0 +1,77 @@
+package bench
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Histogram records latencies in microseconds with log-linear buckets, 16 per power of two,
+// every percentile is within ~6% of the real value. Record is a few atomic adds, one
+// Histogram takes the samples of every client of a run.
+type Histogram struct {
+	counts [64 * 16]atomic.Uint64
+	total  atomic.Uint64
+	max    atomic.Int64
+}
+
+func bucketOf(us uint64) int {
+	if us < 16 {
+		return int(us)
+	}
+	exp := bits.Len64(us) - 5 // shift that leaves 5 significant bits, [16, 32)
+	return (exp+1)*16 + int(us>>exp) - 16
+}
+
+// bucketValue is the upper bound of bucket i in microseconds.
+func bucketValue(i int) uint64 {
+	if i < 16 {
+		return uint64(i)
+	}
+	exp := i/16 - 1
+	return (uint64(i%16+16+1) << exp) - 1
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	d = max(d, 0)
+	h.counts[bucketOf(uint64(d/time.Microsecond))].Add(1)
+	h.total.Add(1)
+	for m := h.max.Load(); int64(d) > m && !h.max.CompareAndSwap(m, int64(d)); m = h.max.Load() {
+	}
+}
+
+func (h *Histogram) Count() uint64 { return h.total.Load() }
+
+// Max is the longest latency recorded.
+func (h *Histogram) Max() time.Duration { return time.Duration(h.max.Load()) }
+
+// Percentile returns the latency under which p (0 to 100) percent of samples fall.
+func (h *Histogram) Percentile(p float64) time.Duration {
+	total, hmax := h.total.Load(), time.Duration(h.max.Load())
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(total))
+	if rank >= total {
+		return hmax
+	}
+	var seen uint64
+	for i := range h.counts {
+		seen += h.counts[i].Load()
+		if seen > rank {
+			return min(time.Duration(bucketValue(i))*time.Microsecond, hmax)
+		}
+	}
+	return hmax
+}
+
+// Reporter is what a benchmark reports extra metrics to, a *testing.B.
+type Reporter interface {
+	ReportMetric(n float64, unit string)
+}
+
+// Report adds the p50 and p99 to a benchmark's results, in nanoseconds.
+func (h *Histogram) Report(r Reporter) {
+	r.ReportMetric(float64(h.Percentile(50)), "p50-ns")
+	r.ReportMetric(float64(h.Percentile(99)), "p99-ns")
+}
@@ -0,0 +1,396 @@
+// Package bench loads a server with closed loop clients, each waits for its answer before the
+// next request, and measures requests per second and latency. It also has the net and
+// net/http servers the epoll ones are compared with, and reads what a server process costs,
+// its resident memory and the allocations it counts in /metrics. cmd/epollbench drives it.
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Workload is what the clients of a run do, one request is one round trip.
+type Workload string
+
+const (
+	Echo Workload = "echo" // Options.Size bytes written and the same read back
+	HTTP Workload = "http" // a keep-alive GET / and its response
+	Chat Workload = "chat" // a line to the other user of a two user room, and its answer
+)
+
+// ParseWorkload accepts echo, http or chat.
+func ParseWorkload(s string) (Workload, error) {
+	switch Workload(s) {
+	case Echo, HTTP, Chat:
+		return Workload(s), nil
+	}
+	return "", fmt.Errorf("unknown workload %q, want echo, http or chat", s)
+}
+
+const (
+	MESSAGESIZE    = 64    // default Options.Size
+	DIALERS        = 128   // connections dialed at once
+	PORTSPERSOURCE = 20000 // connections per loopback source address, under the ephemeral range
+	DIALTIMEOUT    = 10 * time.Second
+)
+
+type Options struct {
+	Workload Workload
+	Addr     string // host:port of the server
+	Conns    int    // chat wants an even number, its users talk in pairs
+	Size     int    // echo bytes per request, MESSAGESIZE by default
+}
+
+// Clients are the connections of a run, dialed and ready before the clock starts.
+type Clients struct {
+	opts    Options
+	clients []client
+	conns   []net.Conn
+	source  netip.Addr // the first loopback source address, invalid when Addr is not loopback
+}
+
+// client makes requests on one connection.
+type client interface {
+	roundTrip() error
+}
+
+// Connect dials opts.Conns connections to opts.Addr and readies them for the workload. A
+// loopback Addr gets its connections from 127.0.0.1 on, PORTSPERSOURCE per address, the
+// ephemeral ports of one address run out before 50k connections.
+func Connect(opts Options) (*Clients, error) {
+	if _, err := ParseWorkload(string(opts.Workload)); err != nil {
+		return nil, err
+	}
+	if opts.Conns <= 0 || opts.Workload == Chat && opts.Conns%2 != 0 {
+		return nil, fmt.Errorf("%d connections, want more than 0, and an even number for chat", opts.Conns)
+	}
+	opts.Size = cmp.Or(opts.Size, MESSAGESIZE)
+	c := &Clients{opts: opts, conns: make([]net.Conn, opts.Conns)}
+	if ap, err := netip.ParseAddrPort(opts.Addr); err == nil && ap.Addr().IsLoopback() {
+		c.source = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	}
+
+	// a chat pair is dialed together, its second user joins once the first is in the room
+	units, per := opts.Conns, 1
+	if opts.Workload == Chat {
+		units, per = opts.Conns/2, 2
+	}
+	c.clients = make([]client, units)
+	var (
+		next    atomic.Int64
+		errOnce sync.Once
+		failed  atomic.Bool
+		dialErr error
+		wg      sync.WaitGroup
+	)
+	for range min(DIALERS, units) {
+		wg.Go(func() {
+			for i := int(next.Add(1) - 1); i < units && !failed.Load(); i = int(next.Add(1) - 1) {
+				if err := c.connect(i, per); err != nil {
+					errOnce.Do(func() { dialErr = err })
+					failed.Store(true)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	if dialErr != nil {
+		c.Close()
+		return nil, dialErr
+	}
+	return c, nil
+}
+
+func (c *Clients) dial(i int) (net.Conn, error) {
+	d := net.Dialer{Timeout: DIALTIMEOUT}
+	if c.source.IsValid() {
+		src := c.source.As4()
+		src[3] += byte(i / PORTSPERSOURCE)
+		d.LocalAddr = &net.TCPAddr{IP: net.IP(src[:])}
+		d.Control = bindNoPort
+	}
+	conn, err := d.Dial("tcp", c.opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing connection %d: %w", i, err)
+	}
+	c.conns[i] = conn
+	return conn, nil
+}
+
+// bindNoPort leaves picking the source port to connect, which only needs the four tuple to
+// be unique. A port picked at bind is unique to the address, and the TIME_WAIT of an earlier
+// run's connections then runs the range out.
+func bindNoPort(network, address string, rc syscall.RawConn) error {
+	var err error
+	rc.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BIND_ADDRESS_NO_PORT, 1)
+	})
+	return err
+}
+
+// connect dials the per connections of unit i and makes its client.
+func (c *Clients) connect(i, per int) error {
+	conn, err := c.dial(i * per)
+	if err != nil {
+		return err
+	}
+	switch c.opts.Workload {
+	case Echo:
+		c.clients[i] = &echoClient{conn: conn, msg: bytes.Repeat([]byte("x"), c.opts.Size), buf: make([]byte, c.opts.Size)}
+	case HTTP:
+		c.clients[i] = &httpClient{conn: conn, r: bufio.NewReaderSize(conn, 512)}
+	case Chat:
+		room := "bench-" + strconv.Itoa(i)
+		conn.SetDeadline(time.Now().Add(DIALTIMEOUT))
+		asker := &chatClient{conn: conn, r: bufio.NewReaderSize(conn, 256)}
+		if err := asker.join(room); err != nil {
+			return fmt.Errorf("chat user %d joining: %w", i*per, err)
+		}
+		other, err := c.dial(i*per + 1)
+		if err != nil {
+			return err
+		}
+		other.SetDeadline(time.Now().Add(DIALTIMEOUT))
+		answerer := &chatClient{conn: other, r: bufio.NewReaderSize(other, 256)}
+		if err := answerer.join(room); err != nil {
+			return fmt.Errorf("chat user %d joining: %w", i*per+1, err)
+		}
+		// the first user sees the second join, both are in the room
+		if err := asker.waitJoined(1); err != nil {
+			return fmt.Errorf("chat user %d joining: %w", i*per, err)
+		}
+		asker.answerer = answerer
+		conn.SetDeadline(time.Time{})
+		other.SetDeadline(time.Time{})
+		c.clients[i] = asker
+	}
+	return nil
+}
+
+// Result is what a run measured, the latencies are of single requests.
+type Result struct {
+	Workload Workload      `json:"workload"`
+	Conns    int           `json:"conns"`
+	Requests uint64        `json:"requests"`
+	Errors   uint64        `json:"errors"`
+	Elapsed  time.Duration `json:"elapsed_ns"`
+	RPS      float64       `json:"requests_per_sec"`
+	P50      time.Duration `json:"p50_ns"`
+	P99      time.Duration `json:"p99_ns"`
+}
+
+// Run has every client make requests, each waiting for its answer before the next, for d.
+// A client whose connection fails stops and counts an error. The connections are left
+// mid request, Run is called once.
+func (c *Clients) Run(d time.Duration) *Result {
+	var (
+		hist     Histogram
+		requests atomic.Uint64
+		errs     atomic.Uint64
+		wg       sync.WaitGroup
+	)
+	start := time.Now()
+	end := start.Add(d)
+	for _, conn := range c.conns {
+		// whatever is still waiting for an answer after the run gives up soon after it
+		conn.SetDeadline(end.Add(time.Second))
+	}
+	for _, cl := range c.clients {
+		if a, ok := cl.(*chatClient); ok {
+			go a.answerer.answer()
+		}
+		wg.Go(func() {
+			for {
+				t := time.Now()
+				if t.After(end) {
+					return
+				}
+				if err := cl.roundTrip(); err != nil {
+					if time.Now().Before(end) {
+						errs.Add(1)
+					}
+					return
+				}
+				if done := time.Now(); !done.After(end) {
+					hist.Record(done.Sub(t))
+					requests.Add(1)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	return &Result{
+		Workload: c.opts.Workload,
+		Conns:    len(c.conns),
+		Requests: requests.Load(),
+		Errors:   errs.Load(),
+		Elapsed:  elapsed,
+		RPS:      float64(requests.Load()) / d.Seconds(),
+		P50:      hist.Percentile(50),
+		P99:      hist.Percentile(99),
+	}
+}
+
+// Close closes every connection.
+func (c *Clients) Close() {
+	for _, conn := range c.conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+type echoClient struct {
+	conn     net.Conn
+	msg, buf []byte
+}
+
+func (c *echoClient) roundTrip() error {
+	if _, err := c.conn.Write(c.msg); err != nil {
+		return err
+	}
+	for got := 0; got < len(c.buf); {
+		n, err := c.conn.Read(c.buf[got:])
+		if err != nil {
+			return err
+		}
+		got += n
+	}
+	return nil
+}
+
+var httpRequest = []byte("GET / HTTP/1.1\r\nHost: bench\r\n\r\n")
+
+type httpClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// roundTrip reads no more of the response than its status and Content-Length, a client
+// allocating per request would take cpu from the server it measures.
+func (c *httpClient) roundTrip() error {
+	if _, err := c.conn.Write(httpRequest); err != nil {
+		return err
+	}
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	if _, status, _ := bytes.Cut(line, []byte(" ")); !bytes.HasPrefix(status, []byte("200 ")) {
+		return fmt.Errorf("response %q", bytes.TrimSpace(line))
+	}
+	length := -1
+	for {
+		line, err := c.r.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			break
+		}
+		key, value, _ := bytes.Cut(line, []byte(":"))
+		if bytes.EqualFold(key, []byte("Content-Length")) {
+			if length, err = strconv.Atoi(string(bytes.TrimSpace(value))); err != nil {
+				return fmt.Errorf("content length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return errors.New("response without a content length")
+	}
+	_, err = c.r.Discard(length)
+	return err
+}
+
+// chatClient is one user of a chat pair. The asker sends ping and waits for the answerer's
+// pong, lines starting with * are the server's notices and skipped.
+type chatClient struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	answerer *chatClient // the other user, for the asker
+}
+
+var (
+	chatPing = []byte("ping\n")
+	chatPong = []byte("pong\n")
+	chatSays = []byte(" says, ")
+)
+
+// join moves the user to room, once the server says it joined.
+func (c *chatClient) join(room string) error {
+	if _, err := fmt.Fprintf(c.conn, "/join %s\n", room); err != nil {
+		return err
+	}
+	return c.waitJoined(1)
+}
+
+// waitJoined reads until n users joined.
+func (c *chatClient) waitJoined(n int) error {
+	for n > 0 {
+		line, err := c.r.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if bytes.HasPrefix(line, []byte("* ")) && bytes.Contains(line, []byte(" joined ")) {
+			n--
+		}
+	}
+	return nil
+}
+
+// readMessage reads until a line someone said, and returns what they said.
+func (c *chatClient) readMessage() ([]byte, error) {
+	for {
+		line, err := c.r.ReadSlice('\n')
+		if err != nil {
+			return nil, err
+		}
+		if _, said, ok := bytes.Cut(line, chatSays); ok && !bytes.HasPrefix(line, []byte("* ")) {
+			return said, nil
+		}
+	}
+}
+
+func (c *chatClient) roundTrip() error {
+	if _, err := c.conn.Write(chatPing); err != nil {
+		return err
+	}
+	said, err := c.readMessage()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(said, chatPong) {
+		return fmt.Errorf("got %q, want pong", said)
+	}
+	return nil
+}
+
+func (c *chatClient) answer() error {
+	for {
+		said, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(said, chatPing) {
+			return fmt.Errorf("got %q, want ping", said)
+		}
+		if _, err := c.conn.Write(chatPong); err != nil {
+			return err
+		}
+	}
+}
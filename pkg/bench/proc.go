@@ -0,0 +1,73 @@
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Memory is a process's resident set from /proc, now and at its peak.
+type Memory struct {
+	RSS  int64 `json:"rss_bytes"`
+	Peak int64 `json:"peak_rss_bytes"`
+}
+
+// ReadMemory reads VmRSS and VmHWM of process pid.
+func ReadMemory(pid int) (Memory, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return Memory{}, err
+	}
+	var m Memory
+	for line := range bytes.Lines(b) {
+		key, value, _ := bytes.Cut(line, []byte(":"))
+		var into *int64
+		switch string(key) {
+		case "VmRSS":
+			into = &m.RSS
+		case "VmHWM":
+			into = &m.Peak
+		default:
+			continue
+		}
+		kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(string(value)), " kB"), 10, 64)
+		if err != nil {
+			return Memory{}, fmt.Errorf("%s in /proc/%d/status: %w", key, pid, err)
+		}
+		*into = kb << 10
+	}
+	return m, nil
+}
+
+// ALLOCS is the metric servers count their heap allocations in, see metrics.Registry.GoRuntime.
+const ALLOCS = "go_gc_heap_allocs_objects_total"
+
+var scrapeClient = &http.Client{Timeout: 5 * time.Second}
+
+// Scrape reads the value of metric name from a Prometheus text endpoint.
+func Scrape(url, name string) (float64, error) {
+	res, err := scrapeClient.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("scraping %s: %s", url, res.Status)
+	}
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		metric, value, ok := strings.Cut(sc.Text(), " ")
+		if ok && metric == name {
+			return strconv.ParseFloat(value, 64)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, fmt.Errorf("scraping %s: %w", url, err)
+	}
+	return 0, fmt.Errorf("no %s at %s", name, url)
+}
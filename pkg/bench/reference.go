@@ -0,0 +1,168 @@
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// The reference servers are what each epoll server would be with the standard library, a
+// goroutine per connection blocked in Read. They keep the epoll servers' behaviour and data
+// structures so a comparison measures the io model and little else.
+
+// BUFFERSIZE is what a reference server reads at a time, the epoll servers' default too.
+const BUFFERSIZE = 4096
+
+// ServeEcho sends back whatever a connection sends until it closes, for every connection
+// ln accepts. It returns when ln is closed.
+func ServeEcho(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			// not io.Copy, a tcp to tcp copy would splice and skip the reads being compared
+			buf := make([]byte, BUFFERSIZE)
+			for {
+				n, err := c.Read(buf)
+				if n > 0 {
+					if _, err := c.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// HELLO is the reference http server's body, the epoll server answers "hello from epoll".
+const HELLO = "hello from net/http\n"
+
+// ServeHTTP answers every request on ln with HELLO, as the epoll server's main does.
+func ServeHTTP(ln net.Listener) error {
+	return (&http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, HELLO)
+	})}).Serve(ln)
+}
+
+type chatUser struct {
+	addr, nick, room string
+}
+
+func (u *chatUser) name() string {
+	if u.nick != "" {
+		return u.nick
+	}
+	return u.addr
+}
+
+// ChatServer is the chat server's line protocol, /nick and /join are commands and any other line
+// goes to everyone else in the room. Like the epoll server a broadcast walks every user.
+type ChatServer struct {
+	mu    sync.RWMutex
+	users map[net.Conn]*chatUser
+}
+
+func NewChatServer() *ChatServer { return &ChatServer{users: make(map[net.Conn]*chatUser)} }
+
+// Serve runs a user for every connection ln accepts, it returns when ln is closed.
+func (c *ChatServer) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		u := &chatUser{addr: conn.RemoteAddr().String()}
+		c.mu.Lock()
+		c.users[conn] = u
+		c.mu.Unlock()
+		go c.read(conn, u)
+	}
+}
+
+func (c *ChatServer) read(conn net.Conn, u *chatUser) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.users, conn)
+		c.mu.Unlock()
+		conn.Close()
+	}()
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, BUFFERSIZE), BUFFERSIZE)
+	for sc.Scan() {
+		c.handleLine(conn, u, bytes.TrimSuffix(sc.Bytes(), []byte("\r")))
+	}
+}
+
+func (c *ChatServer) handleLine(from net.Conn, u *chatUser, line []byte) {
+	if len(line) == 0 {
+		return
+	}
+	cmd, arg, _ := bytes.Cut(line, []byte(" "))
+	arg = bytes.TrimSpace(arg)
+	switch string(cmd) {
+	case "/nick":
+		if len(arg) == 0 {
+			from.Write([]byte("* usage: /nick <name>\n"))
+			return
+		}
+		c.mu.Lock()
+		old := u.name()
+		u.nick = string(arg)
+		c.mu.Unlock()
+		c.broadcast(nil, u.room, fmt.Sprintf("* %s is now known as %s\n", old, u.nick))
+
+	case "/join":
+		if len(arg) == 0 {
+			from.Write([]byte("* usage: /join <room>\n"))
+			return
+		}
+		room := string(arg)
+		if room == "lobby" {
+			room = ""
+		}
+		c.mu.Lock()
+		left := u.room
+		u.room = room
+		c.mu.Unlock()
+		if left == room {
+			return
+		}
+		c.broadcast(nil, left, fmt.Sprintf("* %s left %s\n", u.name(), roomName(left)))
+		c.broadcast(nil, room, fmt.Sprintf("* %s joined %s\n", u.name(), roomName(room)))
+
+	default:
+		c.broadcast(from, u.room, fmt.Sprintf("%s says, %s\n", u.name(), line))
+	}
+}
+
+func roomName(room string) string {
+	if room == "" {
+		return "lobby"
+	}
+	return room
+}
+
+// broadcast writes msg to everyone in room except from, nil includes everyone.
+func (c *ChatServer) broadcast(from net.Conn, room, msg string) {
+	c.mu.RLock()
+	to := make([]net.Conn, 0, len(c.users))
+	for conn, u := range c.users {
+		if conn != from && u.room == room {
+			to = append(to, conn)
+		}
+	}
+	c.mu.RUnlock()
+	for _, conn := range to {
+		conn.Write([]byte(msg))
+	}
+}
@@ -0,0 +1,52 @@
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// Server names the implementation a row measured.
+type Server string
+
+const (
+	Epoll Server = "epoll" // the repo's server for the workload
+	Net   Server = "net"   // the reference server, net or net/http
+)
+
+// Row is one server's run of one workload at one number of connections.
+type Row struct {
+	Server Server `json:"server"`
+	Result
+	AllocsPerRequest float64 `json:"allocs_per_request"`
+	Memory
+}
+
+// WriteText writes rows as a table, an epoll row's last column is its requests per second
+// over those of the net row of the same workload and connections.
+func WriteText(w io.Writer, rows []Row) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "workload\tconns\tserver\treq/s\tp50\tp99\tallocs/req\trss MB\tpeak MB\terrors\tvs net\t")
+	for _, r := range rows {
+		vs := "-"
+		if r.Server != Net {
+			for _, base := range rows {
+				if base.Server == Net && base.Workload == r.Workload && base.Conns == r.Conns && base.RPS > 0 {
+					vs = fmt.Sprintf("%.2fx", r.RPS/base.RPS)
+				}
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%.0f\t%v\t%v\t%.1f\t%.1f\t%.1f\t%d\t%s\t\n",
+			r.Workload, r.Conns, r.Server, r.RPS, r.P50.Round(time.Microsecond), r.P99.Round(time.Microsecond),
+			r.AllocsPerRequest, float64(r.RSS)/(1<<20), float64(r.Peak)/(1<<20), r.Errors, vs)
+	}
+	return tw.Flush()
+}
+
+func WriteJSON(w io.Writer, rows []Row) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
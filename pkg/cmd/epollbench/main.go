@@ -0,0 +1,299 @@
+// epollbench compares the epoll servers with the same servers written on net and net/http.
+// Every server runs in a process of its own, started fresh for each run, and is loaded over
+// loopback at each number of connections, the report has requests per second, p50 and p99
+// latency, heap allocations per request and resident memory side by side.
+//
+//	epollbench -repo . -conns 1000,10000,50000 -duration 10s
+//	epollbench -workloads echo -servers epoll,net -format json
+//
+// The epoll servers are built from -repo. 50k connections need twice as many open files,
+// the client's and the server's, check ulimit -n.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/bench"
+	"github.com/toastsandwich/epoll-learn/pkg/metrics"
+)
+
+// sources are where each epoll server's main package is, under -repo.
+var sources = map[bench.Workload]string{
+	bench.Echo: "echo_server",
+	bench.HTTP: "http1.0_server/cmd/main",
+	bench.Chat: "chat_server",
+}
+
+const READYTIMEOUT = 10 * time.Second
+
+type config struct {
+	workloads []bench.Workload
+	servers   []bench.Server
+	conns     []int
+	duration  time.Duration
+	size      int
+	repo      string
+	format    string
+}
+
+func main() {
+	var (
+		cfg                       config
+		workloads, servers, conns string
+		serve                     string
+		servePort, serveAdmin     int
+	)
+	flag.StringVar(&workloads, "workloads", "echo,http,chat", "comma separated workloads, echo, http or chat")
+	flag.StringVar(&servers, "servers", "epoll,net", "comma separated servers to compare, epoll or net")
+	flag.StringVar(&conns, "conns", "1000,10000,50000", "comma separated connection counts, a run each")
+	flag.DurationVar(&cfg.duration, "duration", 10*time.Second, "how long each run loads a server, once connected")
+	flag.IntVar(&cfg.size, "size", bench.MESSAGESIZE, "echo bytes per request")
+	flag.StringVar(&cfg.repo, "repo", ".", "root of the repository the epoll servers are built from")
+	flag.StringVar(&cfg.format, "format", "text", "report format, text or json")
+	flag.StringVar(&serve, "serve", "", "run the net reference server for a workload, how epollbench starts them")
+	flag.IntVar(&servePort, "port", 0, "port for -serve")
+	flag.IntVar(&serveAdmin, "admin-port", 0, "port serving /metrics for -serve")
+	flag.Parse()
+
+	if serve != "" {
+		err := serveReference(bench.Workload(serve), servePort, serveAdmin)
+		fmt.Fprintln(os.Stderr, "epollbench:", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.parse(workloads, servers, conns); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	rows, err := run(&cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "epollbench:", err)
+		os.Exit(1)
+	}
+	if cfg.format == "json" {
+		err = bench.WriteJSON(os.Stdout, rows)
+	} else {
+		err = bench.WriteText(os.Stdout, rows)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error writing report:", err)
+		os.Exit(1)
+	}
+}
+
+func (cfg *config) parse(workloads, servers, conns string) error {
+	for _, s := range strings.Split(workloads, ",") {
+		w, err := bench.ParseWorkload(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		cfg.workloads = append(cfg.workloads, w)
+	}
+	for _, s := range strings.Split(servers, ",") {
+		switch srv := bench.Server(strings.TrimSpace(s)); srv {
+		case bench.Epoll, bench.Net:
+			cfg.servers = append(cfg.servers, srv)
+		default:
+			return fmt.Errorf("unknown server %q, want epoll or net", s)
+		}
+	}
+	for _, s := range strings.Split(conns, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 || n%2 != 0 {
+			return fmt.Errorf("connection count %q, want an even number above 0", s)
+		}
+		cfg.conns = append(cfg.conns, n)
+	}
+	if cfg.duration <= 0 {
+		return fmt.Errorf("duration %v, want more than 0", cfg.duration)
+	}
+	if cfg.format != "text" && cfg.format != "json" {
+		return fmt.Errorf("format %q, want text or json", cfg.format)
+	}
+
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err == nil {
+		for _, n := range cfg.conns {
+			if uint64(n)+64 > lim.Max {
+				return fmt.Errorf("%d connections need more open files than the limit of %d, raise ulimit -n", n, lim.Max)
+			}
+		}
+	}
+	return nil
+}
+
+// run builds the epoll servers and measures every workload, connection count and server.
+func run(cfg *config) ([]bench.Row, error) {
+	bin, err := os.MkdirTemp("", "epollbench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(bin)
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []bench.Row
+	for _, w := range cfg.workloads {
+		epoll := filepath.Join(bin, string(w))
+		if slices.Contains(cfg.servers, bench.Epoll) {
+			build := exec.Command("go", "build", "-o", epoll, ".")
+			build.Dir = filepath.Join(cfg.repo, sources[w])
+			build.Stdout, build.Stderr = os.Stderr, os.Stderr
+			if err := build.Run(); err != nil {
+				return nil, fmt.Errorf("building the %s server: %w", w, err)
+			}
+		}
+		for _, n := range cfg.conns {
+			for _, srv := range cfg.servers {
+				port, admin, err := freePorts()
+				if err != nil {
+					return nil, err
+				}
+				var cmd *exec.Cmd
+				if srv == bench.Epoll {
+					cmd = exec.Command(epoll, epollArgs(w, port, admin)...)
+				} else {
+					cmd = exec.Command(self, "-serve", string(w), "-port", strconv.Itoa(port), "-admin-port", strconv.Itoa(admin))
+				}
+				row, err := measure(cfg, cmd, bench.Options{Workload: w, Addr: fmt.Sprintf("127.0.0.1:%d", port), Conns: n, Size: cfg.size}, admin)
+				if err != nil {
+					return nil, fmt.Errorf("%s with %d connections on %s: %w", w, n, srv, err)
+				}
+				row.Server = srv
+				fmt.Fprintf(os.Stderr, "%s %d %s: %.0f req/s, p99 %v\n", w, n, srv, row.RPS, row.P99)
+				rows = append(rows, *row)
+			}
+		}
+	}
+	return rows, nil
+}
+
+func epollArgs(w bench.Workload, port, admin int) []string {
+	args := []string{"-addr", "127.0.0.1", "-port", strconv.Itoa(port), "-admin-port", strconv.Itoa(admin), "-log-level", "warn"}
+	if w != bench.Echo {
+		// two servers must not fight over the default control socket
+		args = append(args, "-admin-socket", "")
+	}
+	if w == bench.HTTP {
+		// connections wait idle while the others are dialed
+		args = append(args, "-read-timeout", "0", "-write-timeout", "0")
+	}
+	return args
+}
+
+// measure starts the server cmd, connects, runs and reads what the run cost the server.
+func measure(cfg *config, cmd *exec.Cmd, opts bench.Options, admin int) (*bench.Row, error) {
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	scrape := fmt.Sprintf("http://127.0.0.1:%d/metrics", admin)
+	if err := waitReady(opts.Addr, scrape); err != nil {
+		return nil, err
+	}
+
+	clients, err := bench.Connect(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer clients.Close()
+	before, err := bench.Scrape(scrape, bench.ALLOCS)
+	if err != nil {
+		return nil, err
+	}
+	res := clients.Run(cfg.duration)
+	// read with every connection still open, what the server holds for them is resident
+	mem, err := bench.ReadMemory(cmd.Process.Pid)
+	if err != nil {
+		return nil, err
+	}
+	after, err := bench.Scrape(scrape, bench.ALLOCS)
+	if err != nil {
+		return nil, err
+	}
+
+	row := &bench.Row{Result: *res, Memory: mem}
+	if res.Requests > 0 {
+		row.AllocsPerRequest = (after - before) / float64(res.Requests)
+	}
+	return row, nil
+}
+
+// waitReady waits for the server to accept connections and serve its metrics.
+func waitReady(addr, scrape string) error {
+	deadline := time.Now().Add(READYTIMEOUT)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			if _, err = bench.Scrape(scrape, bench.ALLOCS); err == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("server not ready after %v: %w", READYTIMEOUT, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// freePorts returns two loopback ports nothing listens on, for a server about to take them.
+// Both are held until both are picked, one after the other could be the same port.
+func freePorts() (int, int, error) {
+	var ports [2]int
+	for i := range ports {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, 0, err
+		}
+		defer ln.Close()
+		ports[i] = ln.Addr().(*net.TCPAddr).Port
+	}
+	return ports[0], ports[1], nil
+}
+
+// serveReference runs the net server for w, with its allocations on /metrics as the epoll
+// servers have them.
+func serveReference(w bench.Workload, port, admin int) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	reg := metrics.NewRegistry()
+	reg.GoRuntime()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", metrics.ContentType)
+		reg.WriteText(rw)
+	})
+	go http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", admin), mux)
+
+	switch w {
+	case bench.Echo:
+		return bench.ServeEcho(ln)
+	case bench.HTTP:
+		return bench.ServeHTTP(ln)
+	case bench.Chat:
+		return bench.NewChatServer().Serve(ln)
+	}
+	return errors.New("unknown workload " + string(w))
+}
@@ -0,0 +1,33 @@
+// epollctl runs a command on a server's control socket, see package control.
+//
+//	epollctl -socket /tmp/epoll-learn-http.sock conns
+//	epollctl -socket /tmp/epoll-learn-chat.sock kick 12
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/toastsandwich/epoll-learn/pkg/control"
+)
+
+func main() {
+	socket := flag.String("socket", "/tmp/epoll-learn-http.sock", "control socket of the server, its admin.socket setting")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-socket path] command [args...], help lists the commands\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+	out, err := control.Call(*socket, args...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "epollctl:", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(out)
+}
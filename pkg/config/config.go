@@ -0,0 +1,349 @@
+// Package config loads a server's settings from a file and its command line. A file is
+// JSON, or the part of YAML and TOML a settings file needs: nested tables of strings,
+// numbers and booleans, no lists. Settings are addressed by dotted keys, "http.addr" is
+// addr in the http table, and bound onto a struct whose fields are tagged with them.
+// Flags given on the command line win over the file, the file over the struct's defaults.
+// Fields tagged reload:"live" can change while the server runs, see Reload.
+package config
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values are raw settings by dotted key, as read from a file or the command line.
+type Values map[string]string
+
+// KeyError is a setting that could not be used, Key names it.
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string { return e.Key + ": " + e.Err.Error() }
+func (e *KeyError) Unwrap() error { return e.Err }
+
+// Errorf returns a KeyError for key, for validation that runs after Bind.
+func Errorf(key, format string, args ...any) error {
+	return &KeyError{Key: key, Err: fmt.Errorf(format, args...)}
+}
+
+var ErrUnknownKey = errors.New("unknown setting")
+
+// Load reads the file at path, the format follows its extension: .json, .yaml or .yml,
+// and .toml.
+func Load(path string) (Values, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := Parse(data, strings.TrimPrefix(filepath.Ext(path), "."))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return v, nil
+}
+
+// Parse reads data in format, json, yaml, yml or toml.
+func Parse(data []byte, format string) (Values, error) {
+	switch format {
+	case "json":
+		return parseJSON(data)
+	case "yaml", "yml":
+		return parseYAML(data)
+	case "toml":
+		return parseTOML(data)
+	}
+	return nil, fmt.Errorf("unknown config format %q, want json, yaml or toml", format)
+}
+
+// Bind sets the fields of the struct dst points to from v, by their config tags. A field
+// holding a struct with a tag of its own is a table, its fields' keys go under it. Keys
+// no field has are an ErrUnknownKey, values that do not parse name their key too.
+func Bind(v Values, dst any) error {
+	fields := make(map[string]field)
+	for _, f := range fieldsOf(dst) {
+		fields[f.key] = f
+	}
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		f, ok := fields[key]
+		if !ok {
+			return &KeyError{Key: key, Err: ErrUnknownKey}
+		}
+		if err := set(f.v, v[key]); err != nil {
+			return &KeyError{Key: key, Err: err}
+		}
+	}
+	return nil
+}
+
+// field is a tagged struct field found by fieldsOf.
+type field struct {
+	key  string
+	help string
+	flag string // flag name, "" for none
+	live bool   // tagged reload:"live"
+	v    reflect.Value
+}
+
+// fieldsOf returns the tagged fields of the struct dst points to, in their order.
+func fieldsOf(dst any) []field {
+	var fields []field
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := range t.NumField() {
+			sf := t.Field(i)
+			key := sf.Tag.Get("config")
+			if key == "" {
+				continue
+			}
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			fv := v.Field(i)
+			if fv.Kind() == reflect.Struct && !isScalar(fv) {
+				walk(fv, key)
+				continue
+			}
+			fields = append(fields, field{
+				key:  key,
+				help: sf.Tag.Get("help"),
+				flag: sf.Tag.Get("flag"),
+				live: sf.Tag.Get("reload") == "live",
+				v:    fv,
+			})
+		}
+	}
+	walk(reflect.ValueOf(dst).Elem(), "")
+	return fields
+}
+
+// isScalar reports whether a struct typed value is set from one string, as time.Time would be.
+func isScalar(v reflect.Value) bool {
+	_, ok := v.Addr().Interface().(encoding.TextUnmarshaler)
+	return ok
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses raw into v by its type.
+func set(v reflect.Value, raw string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(raw))
+	}
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(strings.ReplaceAll(raw, "_", ""))
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// format is the inverse of set.
+func format(v reflect.Value) string {
+	if m, ok := v.Addr().Interface().(encoding.TextMarshaler); ok {
+		b, _ := m.MarshalText()
+		return string(b)
+	}
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// Reload copies the settings that differ in next and are tagged reload:"live" into cur,
+// both pointers to the same struct type. It returns their keys, and the keys of the other
+// differences, which cur keeps until a restart.
+func Reload(cur, next any) (applied, restart []string) {
+	nf := fieldsOf(next)
+	for i, f := range fieldsOf(cur) {
+		if format(f.v) == format(nf[i].v) {
+			continue
+		}
+		if !f.live {
+			restart = append(restart, f.key)
+			continue
+		}
+		f.v.Set(nf[i].v)
+		applied = append(applied, f.key)
+	}
+	return applied, restart
+}
+
+// Flags holds command line settings until Apply, so they go on top of the file whatever
+// the order they are read in.
+type Flags struct {
+	set Values
+}
+
+// NewFlags registers a flag on fs for every field of dst with a flag tag, its default is
+// the field's value now and its usage the help tag.
+func NewFlags(fs *flag.FlagSet, dst any) *Flags {
+	f := &Flags{set: make(Values)}
+	for _, fld := range fieldsOf(dst) {
+		if fld.flag == "" {
+			continue
+		}
+		fs.Var(&flagValue{f: f, field: fld, def: format(fld.v)}, fld.flag, fld.help)
+	}
+	return f
+}
+
+// Apply sets the fields of dst whose flags were given on the command line, dst is of the
+// type NewFlags was given.
+func (f *Flags) Apply(dst any) error {
+	return Bind(f.set, dst)
+}
+
+// Validator is a config that checks itself once bound, errors should name their key, see
+// Errorf.
+type Validator interface {
+	Validate() error
+}
+
+// Source is where a server's settings come from, the file named by -config and the flags
+// given, kept to read them again on a reload.
+type Source struct {
+	Path string // the -config file, "" for none
+	// PrintConfig is -print-config, the server should print its settings and exit
+	PrintConfig bool
+
+	flags *Flags
+}
+
+// FromArgs parses args into dst, a pointer to a struct holding the defaults, with a flag
+// for each field tagged with one plus -config and -print-config.
+func FromArgs(fs *flag.FlagSet, args []string, dst Validator) (*Source, error) {
+	src := &Source{flags: NewFlags(fs, dst)}
+	fs.StringVar(&src.Path, "config", "", "settings file, .json, .yaml or .toml, flags override it")
+	fs.BoolVar(&src.PrintConfig, "print-config", false, "print the effective settings as TOML and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return src, src.Read(dst)
+}
+
+// Read sets dst from the file then the flags and validates it, dst should hold the
+// defaults.
+func (s *Source) Read(dst Validator) error {
+	if s.Path != "" {
+		v, err := Load(s.Path)
+		if err != nil {
+			return err
+		}
+		if err := Bind(v, dst); err != nil {
+			return fmt.Errorf("%s: %w", s.Path, err)
+		}
+	}
+	if err := s.flags.Apply(dst); err != nil {
+		return err
+	}
+	return dst.Validate()
+}
+
+type flagValue struct {
+	f     *Flags
+	field field
+	def   string
+}
+
+func (v *flagValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.def
+}
+
+// Set checks raw parses into a scratch value, the field itself is set by Flags.Apply.
+func (v *flagValue) Set(raw string) error {
+	scratch := reflect.New(v.field.v.Type()).Elem()
+	if err := set(scratch, raw); err != nil {
+		return err
+	}
+	v.f.set[v.field.key] = raw
+	return nil
+}
+
+// IsBoolFlag lets -oneshot stand for -oneshot=true.
+func (v *flagValue) IsBoolFlag() bool { return v.field.v.Kind() == reflect.Bool }
+
+// Print writes the settings of the struct src points to as TOML, one table per section in
+// the struct's order, a file Load reads back to the same settings.
+func Print(w io.Writer, src any) error {
+	fields := fieldsOf(src)
+	// top level keys first, TOML puts everything after a header in its table
+	slices.SortStableFunc(fields, func(a, b field) int {
+		da, db := strings.Contains(a.key, "."), strings.Contains(b.key, ".")
+		switch {
+		case da == db:
+			return 0
+		case da:
+			return 1
+		}
+		return -1
+	})
+
+	table := ""
+	for i, f := range fields {
+		t, name := "", f.key
+		if j := strings.LastIndexByte(f.key, '.'); j >= 0 {
+			t, name = f.key[:j], f.key[j+1:]
+		}
+		if t != table {
+			sep := "\n"
+			if i == 0 {
+				sep = ""
+			}
+			if _, err := fmt.Fprintf(w, "%s[%s]\n", sep, t); err != nil {
+				return err
+			}
+			table = t
+		}
+		val := format(f.v)
+		if _, text := f.v.Addr().Interface().(encoding.TextMarshaler); text || (f.v.Kind() != reflect.Int && f.v.Kind() != reflect.Bool) {
+			val = strconv.Quote(val)
+		}
+		if _, err := fmt.Fprintf(w, "%s = %s\n", name, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Name string `config:"name" flag:"name" help:"a name"`
+	HTTP struct {
+		Addr    string        `config:"addr" flag:"addr" help:"listen address"`
+		Timeout time.Duration `config:"timeout" flag:"timeout"`
+		OneShot bool          `config:"oneshot" flag:"oneshot"`
+	} `config:"http"`
+	Limits struct {
+		MaxConns int `config:"max_conns" flag:"max-conns"`
+	} `config:"limits"`
+	Log struct {
+		Level slog.Level `config:"level" flag:"log-level"`
+	} `config:"log"`
+}
+
+func defaults() testConfig {
+	var c testConfig
+	c.Name = "test"
+	c.HTTP.Addr = "0.0.0.0:8080"
+	c.HTTP.Timeout = time.Second
+	return c
+}
+
+var want = Values{
+	"name":             "epoll # not a comment",
+	"http.addr":        "127.0.0.1:9000",
+	"http.timeout":     "250ms",
+	"http.oneshot":     "true",
+	"limits.max_conns": "1000",
+	"log.level":        "DEBUG",
+}
+
+var docs = map[string]string{
+	"json": `{
+  "name": "epoll # not a comment",
+  "http": {"addr": "127.0.0.1:9000", "timeout": "250ms", "oneshot": true},
+  "limits": {"max_conns": 1000},
+  "log": {"level": "DEBUG"}
+}`,
+	"yaml": `---
+# settings
+name: "epoll # not a comment"
+http:
+  addr: 127.0.0.1:9000   # loopback only
+  timeout: 250ms
+  oneshot: true
+
+limits:
+  max_conns: 1000
+log:
+    level: 'DEBUG'
+`,
+	"toml": `name = 'epoll # not a comment'
+log.level = "DEBUG"
+
+[http]
+addr = "127.0.0.1:9000" # loopback only
+timeout = "250ms"
+oneshot = true
+
+[limits]
+max_conns = 1000
+`,
+}
+
+func TestParse(t *testing.T) {
+	for format, doc := range docs {
+		t.Run(format, func(t *testing.T) {
+			v, err := Parse([]byte(doc), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(v, want) {
+				t.Fatalf("got %v\nwant %v", v, want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct{ format, doc, err string }{
+		{"yaml", "http:\n  - a\n", "lists"},
+		{"yaml", "http:\nname: x\n", "http has no value"},
+		{"yaml", "http:\n\taddr: x\n", "tab"},
+		{"yaml", "addr x\n", "line 1"},
+		{"yaml", "addr: \"x\n", "addr: unterminated"},
+		{"toml", "[http\n", "unterminated"},
+		{"toml", "ports = [1, 2]\n", "ports: lists"},
+		{"toml", "a = 1\na = 2\n", "a set twice"},
+		{"json", `{"http": {"ports": [1]}}`, "http.ports: lists"},
+		{"ini", "", "unknown config format"},
+	} {
+		if _, err := Parse([]byte(tc.doc), tc.format); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s %q: error %v, want one with %q", tc.format, tc.doc, err, tc.err)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	c := defaults()
+	if err := Bind(Values{"http.timeout": "3s", "log.level": "warn"}, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP.Timeout != 3*time.Second || c.Log.Level != slog.LevelWarn || c.HTTP.Addr != "0.0.0.0:8080" {
+		t.Fatalf("bound %+v", c)
+	}
+
+	for v, key := range map[*Values]string{
+		{"http.adr": "x"}:            "http.adr",
+		{"http.timeout": "3"}:        "http.timeout",
+		{"limits.max_conns": "lots"}: "limits.max_conns",
+		{"http": "x"}:                "http",
+	} {
+		var ke *KeyError
+		if err := Bind(*v, &c); !errors.As(err, &ke) || ke.Key != key {
+			t.Errorf("Bind(%v): %v, want an error naming %s", *v, err, key)
+		}
+	}
+}
+
+// TestFlagsOverFile loads a file between parsing the flags and applying them, as a main
+// does to find -config, the flags win.
+func TestFlagsOverFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.yaml")
+	os.WriteFile(path, []byte(docs["yaml"]), 0o600)
+
+	c := defaults()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := NewFlags(fs, &c)
+	if err := fs.Parse([]string{"-addr", ":7000", "-oneshot=false"}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Bind(v, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.Apply(&c); err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP.Addr != ":7000" || c.HTTP.OneShot || c.HTTP.Timeout != 250*time.Millisecond || c.Limits.MaxConns != 1000 {
+		t.Fatalf("merged %+v", c)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(&bytes.Buffer{})
+	NewFlags(fs, &c)
+	if err := fs.Parse([]string{"-timeout", "soon"}); err == nil {
+		t.Fatal("no error for a bad duration flag")
+	}
+}
+
+func TestPrint(t *testing.T) {
+	c := defaults()
+	Bind(want, &c)
+	var buf bytes.Buffer
+	if err := Print(&buf, &c); err != nil {
+		t.Fatal(err)
+	}
+	v, err := Parse(buf.Bytes(), "toml")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, buf.String())
+	}
+	if !maps.Equal(v, want) {
+		t.Fatalf("printed\n%s", buf.String())
+	}
+}
+
+func TestReload(t *testing.T) {
+	type reloadable struct {
+		Addr    string        `config:"addr"`
+		Timeout time.Duration `config:"timeout" reload:"live"`
+		Log     struct {
+			Level slog.Level `config:"level" reload:"live"`
+		} `config:"log"`
+	}
+	cur := reloadable{Addr: ":80", Timeout: time.Second}
+	next := reloadable{Addr: ":81", Timeout: 2 * time.Second}
+	next.Log.Level = slog.LevelDebug
+
+	applied, restart := Reload(&cur, &next)
+	if !slices.Equal(applied, []string{"timeout", "log.level"}) || !slices.Equal(restart, []string{"addr"}) {
+		t.Fatalf("applied %v, restart %v", applied, restart)
+	}
+	if cur.Addr != ":80" || cur.Timeout != 2*time.Second || cur.Log.Level != slog.LevelDebug {
+		t.Fatalf("reloaded %+v", cur)
+	}
+	if applied, restart := Reload(&cur, &cur); applied != nil || restart != nil {
+		t.Fatalf("no changes, applied %v, restart %v", applied, restart)
+	}
+}
@@ -0,0 +1,233 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errList = errors.New("lists are not supported")
+
+func parseJSON(data []byte) (Values, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	v := make(Values)
+	return v, flatten(v, "", doc)
+}
+
+// flatten adds the scalars in table to v under prefix.
+func flatten(v Values, prefix string, table map[string]any) error {
+	for name, val := range table {
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+		switch val := val.(type) {
+		case map[string]any:
+			if err := flatten(v, key, val); err != nil {
+				return err
+			}
+		case []any:
+			return &KeyError{Key: key, Err: errList}
+		case nil:
+			return &KeyError{Key: key, Err: errors.New("null value")}
+		case string:
+			v[key] = val
+		default: // json.Number, bool
+			v[key] = fmt.Sprint(val)
+		}
+	}
+	return nil
+}
+
+// line is a line of a YAML or TOML file with its comment and indentation cut off.
+type line struct {
+	n      int
+	indent int
+	text   string
+}
+
+// lines splits data into lines, skipping blank ones and comments.
+func lines(data []byte) ([]line, error) {
+	var ls []line
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		raw := sc.Text()
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: indented with a tab", n)
+		}
+		text = strings.TrimSpace(stripComment(text))
+		if text == "" {
+			continue
+		}
+		ls = append(ls, line{n: n, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text})
+	}
+	return ls, sc.Err()
+}
+
+// stripComment cuts a # comment off s, one inside quotes is text.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// unquote returns the string a scalar stands for, "..." takes Go's escapes, which cover
+// YAML's and TOML's common ones, '...' is literal with ” for a quote.
+func unquote(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "\"") || strings.HasPrefix(s, "'"):
+		return "", fmt.Errorf("unterminated string %s", s)
+	case strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{"):
+		return "", errList
+	}
+	return s, nil
+}
+
+// parseYAML reads block mappings nested by indentation with scalar values, the settings
+// file part of YAML. Anchors, flow collections and sequences are refused.
+func parseYAML(data []byte) (Values, error) {
+	ls, err := lines(data)
+	if err != nil {
+		return nil, err
+	}
+	type table struct {
+		indent int
+		key    string
+	}
+	v := make(Values)
+	stack := []table{{indent: -1}}
+	// open is a key with nothing after its colon, the lines under it must be deeper
+	open := false
+	for _, l := range ls {
+		if l.text == "---" && l.indent == 0 {
+			continue
+		}
+		top := stack[len(stack)-1]
+		if open && l.indent <= top.indent {
+			return nil, fmt.Errorf("line %d: %s has no value", l.n, top.key)
+		}
+		for l.indent <= top.indent {
+			stack = stack[:len(stack)-1]
+			top = stack[len(stack)-1]
+		}
+		open = false
+		if strings.HasPrefix(l.text, "- ") || l.text == "-" {
+			return nil, fmt.Errorf("line %d: %w", l.n, errList)
+		}
+
+		name, val, ok := strings.Cut(l.text, ":")
+		if !ok || (val != "" && val[0] != ' ') {
+			return nil, fmt.Errorf("line %d: want key: value", l.n)
+		}
+		name, err := unquote(strings.TrimSpace(name))
+		if err != nil || name == "" {
+			return nil, fmt.Errorf("line %d: bad key", l.n)
+		}
+		key := name
+		if top.key != "" {
+			key = top.key + "." + name
+		}
+		if val = strings.TrimSpace(val); val == "" {
+			stack = append(stack, table{indent: l.indent, key: key})
+			open = true
+			continue
+		}
+		if strings.HasPrefix(val, "&") || strings.HasPrefix(val, "*") || strings.HasPrefix(val, "|") || strings.HasPrefix(val, ">") {
+			return nil, fmt.Errorf("line %d: %s: anchors and block scalars are not supported", l.n, key)
+		}
+		if v[key], err = unquote(val); err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.n, &KeyError{Key: key, Err: err})
+		}
+	}
+	if open {
+		return nil, fmt.Errorf("%s has no value", stack[len(stack)-1].key)
+	}
+	return v, nil
+}
+
+// parseTOML reads [tables] of key = value pairs, keys may be dotted. Arrays, inline
+// tables and multi-line strings are refused.
+func parseTOML(data []byte) (Values, error) {
+	ls, err := lines(data)
+	if err != nil {
+		return nil, err
+	}
+	v := make(Values)
+	table := ""
+	for _, l := range ls {
+		if strings.HasPrefix(l.text, "[") {
+			if strings.HasPrefix(l.text, "[[") {
+				return nil, fmt.Errorf("line %d: %w", l.n, errList)
+			}
+			if !strings.HasSuffix(l.text, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", l.n)
+			}
+			if table, err = tomlKey(l.text[1 : len(l.text)-1]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", l.n, err)
+			}
+			continue
+		}
+		name, val, ok := strings.Cut(l.text, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: want key = value", l.n)
+		}
+		key, err := tomlKey(name)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.n, err)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, dup := v[key]; dup {
+			return nil, fmt.Errorf("line %d: %s set twice", l.n, key)
+		}
+		val = strings.TrimSpace(val)
+		if strings.HasPrefix(val, `"""`) || strings.HasPrefix(val, "'''") {
+			return nil, fmt.Errorf("line %d: %s: multi-line strings are not supported", l.n, key)
+		}
+		if v[key], err = unquote(val); err != nil {
+			return nil, fmt.Errorf("line %d: %w", l.n, &KeyError{Key: key, Err: err})
+		}
+	}
+	return v, nil
+}
+
+// tomlKey joins the parts of a dotted key, each may be quoted.
+func tomlKey(s string) (string, error) {
+	parts := strings.Split(s, ".")
+	for i, p := range parts {
+		p, err := unquote(strings.TrimSpace(p))
+		if err != nil || p == "" {
+			return "", fmt.Errorf("bad key %q", strings.TrimSpace(s))
+		}
+		parts[i] = p
+	}
+	return strings.Join(parts, "."), nil
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"log/slog"
+	"net/netip"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+)
+
+// Log is the log table every server's config has.
+type Log struct {
+	Level  slog.Level `config:"level" flag:"log-level" reload:"live" help:"least severe level logged, debug, info, warn or error"`
+	Format string     `config:"format" flag:"log-format" help:"log line format, text or json"`
+}
+
+func (l *Log) Validate() error {
+	if l.Format != "text" && l.Format != "json" {
+		return Errorf("log.format", "%q, want text or json", l.Format)
+	}
+	return nil
+}
+
+// Options returns the logging options for l, level is set to l.Level and logged at.
+func (l *Log) Options(level *slog.LevelVar) logging.Options {
+	level.Set(l.Level)
+	return logging.Options{Level: level, JSON: l.Format == "json"}
+}
+
+// TLS names a certificate and its key. None of the servers speak TLS yet, Validate refuses
+// a config asking for it rather than serve plain text where TLS was wanted.
+type TLS struct {
+	Cert string `config:"cert" flag:"tls-cert" help:"PEM certificate chain, TLS is not supported yet"`
+	Key  string `config:"key" flag:"tls-key" help:"PEM private key for -tls-cert"`
+}
+
+func (t *TLS) Validate() error {
+	switch {
+	case t.Cert != "":
+		return Errorf("tls.cert", "TLS is not supported yet, terminate it in front of the server")
+	case t.Key != "":
+		return Errorf("tls.key", "TLS is not supported yet, terminate it in front of the server")
+	}
+	return nil
+}
+
+// Addr checks addr is an IPv4 address to bind, the servers only listen on IPv4.
+func Addr(key, addr string) error {
+	if a, err := netip.ParseAddr(addr); err != nil || !a.Is4() {
+		return Errorf(key, "%q, want an ipv4 address", addr)
+	}
+	return nil
+}
+
+// Port checks port fits in a port number, 0 picks a free one.
+func Port(key string, port int) error {
+	if port < 0 || port > 65535 {
+		return Errorf(key, "%d, want 0 to 65535", port)
+	}
+	return nil
+}
+
+// NotNegative checks n is 0, which means a default, or more.
+func NotNegative(key string, n int) error {
+	if n < 0 {
+		return Errorf(key, "%d, want 0 for the default or more", n)
+	}
+	return nil
+}
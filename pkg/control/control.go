@@ -0,0 +1,273 @@
+// Package control is a server's admin socket, a Unix stream socket taking one command per
+// connection: a line of space separated words, answered with OK or "error: " and the
+// reason on the first line, then the command's output until the server hangs up.
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/pool"
+)
+
+const (
+	OK        = "ok"
+	ERRPREFIX = "error: "
+	// how long a client has to send its command, and Call to get an answer
+	TIMEOUT = 5 * time.Second
+)
+
+var ErrUsage = errors.New("bad arguments")
+
+// Func runs a command with the words after its name, what it writes to w is the answer.
+type Func func(w io.Writer, args []string) error
+
+type command struct {
+	usage string
+	f     Func
+}
+
+type Server struct {
+	path string
+	ln   *net.UnixListener
+	// the socket file as bound, Close leaves a file some other process bound since alone
+	ino uint64
+
+	mu   sync.RWMutex
+	cmds map[string]command
+
+	log *slog.Logger
+	wg  sync.WaitGroup
+}
+
+// Listen binds path, only its owner can connect. A socket already at path is replaced,
+// after an upgrade the new process is the one answering.
+func Listen(path string, log *slog.Logger) (*Server, error) {
+	if log == nil {
+		log = logging.Default()
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("control: %s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("control: %w", err)
+	}
+	ln.SetUnlinkOnClose(false)
+	// not the umask, it is the whole process's
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("control: %w", err)
+	}
+	s := &Server{path: path, ln: ln, cmds: make(map[string]command), log: log}
+	if fi, err := os.Stat(path); err == nil {
+		s.ino = fi.Sys().(*syscall.Stat_t).Ino
+	}
+	s.Handle("help", "list commands", s.help)
+	return s, nil
+}
+
+// Handle adds the command name, usage is its arguments and what it does, for help.
+func (s *Server) Handle(name, usage string, f Func) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cmds[name] = command{usage: usage, f: f}
+}
+
+func (s *Server) help(w io.Writer, args []string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.cmds))
+	for name := range s.cmds {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\n", name, s.cmds[name].usage)
+	}
+	return tw.Flush()
+}
+
+// Serve answers commands until Close, each connection on a goroutine of its own.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.ln.AcceptUnix()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				s.wg.Wait()
+				return nil
+			}
+			return fmt.Errorf("control: %w", err)
+		}
+		s.wg.Go(func() { s.serve(conn) })
+	}
+}
+
+func (s *Server) serve(conn *net.UnixConn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(TIMEOUT))
+	line, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+
+	s.mu.RLock()
+	cmd, ok := s.cmds[args[0]]
+	s.mu.RUnlock()
+	var out bytes.Buffer
+	switch {
+	case !ok:
+		err = fmt.Errorf("unknown command %q, try help", args[0])
+	default:
+		s.log.Info("control command", slog.String("cmd", strings.Join(args, " ")))
+		err = cmd.f(&out, args[1:])
+		if errors.Is(err, ErrUsage) {
+			err = fmt.Errorf("usage: %s %s", args[0], cmd.usage)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "%s%v\n", ERRPREFIX, err)
+		return
+	}
+	fmt.Fprintln(conn, OK)
+	conn.Write(out.Bytes())
+}
+
+// Close stops Serve and removes the socket file, unless another process has bound path since.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	if fi, serr := os.Stat(s.path); serr == nil && fi.Sys().(*syscall.Stat_t).Ino == s.ino {
+		os.Remove(s.path)
+	}
+	return err
+}
+
+// Path is the socket file the server listens on.
+func (s *Server) Path() string { return s.path }
+
+// Call runs a command on the server at path and returns its output, an error answer is
+// returned as an error.
+func Call(path string, args ...string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", path, TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(TIMEOUT))
+	if _, err := fmt.Fprintln(conn, strings.Join(args, " ")); err != nil {
+		return nil, err
+	}
+	answer, err := io.ReadAll(conn)
+	if err != nil {
+		return nil, err
+	}
+	status, out, _ := bytes.Cut(answer, []byte("\n"))
+	switch {
+	case string(status) == OK:
+		return out, nil
+	case bytes.HasPrefix(status, []byte(ERRPREFIX)):
+		return nil, errors.New(string(status[len(ERRPREFIX):]))
+	}
+	return nil, fmt.Errorf("control: unexpected answer %q", status)
+}
+
+// HandleConns adds conns, listing what list returns, and kick <fd>, hanging up on a
+// connection with kick.
+func (s *Server) HandleConns(list func() []ConnInfo, kick func(fd int) error) {
+	s.Handle("conns", "list open connections", func(w io.Writer, args []string) error {
+		return WriteConns(w, list())
+	})
+	s.Handle("kick", "<fd>, hang up on a connection", func(w io.Writer, args []string) error {
+		if len(args) != 1 {
+			return ErrUsage
+		}
+		fd, err := strconv.Atoi(args[0])
+		if err != nil {
+			return ErrUsage
+		}
+		if err := kick(fd); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "kicked %d\n", fd)
+		return nil
+	})
+}
+
+// HandleLogLevel adds loglevel [level], showing level or setting it.
+func (s *Server) HandleLogLevel(level *slog.LevelVar) {
+	s.Handle("loglevel", "[debug|info|warn|error], show or set the log level", func(w io.Writer, args []string) error {
+		switch len(args) {
+		case 0:
+		case 1:
+			l, err := logging.ParseLevel(args[0])
+			if err != nil {
+				return err
+			}
+			level.Set(l)
+		default:
+			return ErrUsage
+		}
+		fmt.Fprintln(w, level.Level())
+		return nil
+	})
+}
+
+// ConnInfo is a connection as the conns command lists it.
+type ConnInfo struct {
+	Fd           int
+	Peer         string
+	Age          time.Duration
+	BytesRead    int64
+	BytesWritten int64
+	State        string
+}
+
+// WriteConns writes conns as a table by fd.
+func WriteConns(w io.Writer, conns []ConnInfo) error {
+	slices.SortFunc(conns, func(a, b ConnInfo) int { return a.Fd - b.Fd })
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FD\tPEER\tAGE\tREAD\tWRITTEN\tSTATE")
+	for _, c := range conns {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%s\n", c.Fd, c.Peer, c.Age.Truncate(time.Millisecond), c.BytesRead, c.BytesWritten, c.State)
+	}
+	return tw.Flush()
+}
+
+// WritePoolStats writes a buffer pool's counters, totals then one line per size class.
+func WritePoolStats(w io.Writer, name string, st pool.Stats) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%s pool\tSIZE\tGETS\tHITS\tMISSES\tPUTS\t\n", name)
+	fmt.Fprintf(tw, "total\t\t%d\t%d\t%d\t%d\t\n", st.Gets, st.Hits(), st.Misses, st.Puts)
+	for _, c := range st.Classes {
+		if c.Gets == 0 && c.Puts == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "\t%d\t%d\t%d\t%d\t%d\t\n", c.Size, c.Gets, c.Gets-c.Misses, c.Misses, c.Puts)
+	}
+	fmt.Fprintf(tw, "oversize\t\t%d\t\t\t\t\n", st.Oversize)
+	fmt.Fprintf(tw, "dropped\t\t\t\t\t%d\t\n", st.Dropped)
+	return tw.Flush()
+}
@@ -0,0 +1,190 @@
+package control
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/toastsandwich/epoll-learn/pkg/logging"
+	"github.com/toastsandwich/epoll-learn/pkg/pool"
+)
+
+func listen(t *testing.T, path string) *Server {
+	t.Helper()
+	s, err := Listen(path, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- s.Serve() }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return s
+}
+
+func TestCall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	s := listen(t, path)
+	s.Handle("echo", "<words>, says them back", func(w io.Writer, args []string) error {
+		if len(args) == 0 {
+			return ErrUsage
+		}
+		fmt.Fprintln(w, strings.Join(args, " "))
+		return nil
+	})
+
+	out, err := Call(path, "echo", "hello", "there")
+	if err != nil || string(out) != "hello there\n" {
+		t.Fatalf("echo: %q, %v", out, err)
+	}
+	if _, err := Call(path, "echo"); err == nil || err.Error() != "usage: echo <words>, says them back" {
+		t.Fatalf("echo without words: %v", err)
+	}
+	if _, err := Call(path, "reboot"); err == nil || !strings.Contains(err.Error(), `unknown command "reboot"`) {
+		t.Fatalf("unknown command: %v", err)
+	}
+	out, err = Call(path, "help")
+	if err != nil || !strings.Contains(string(out), "echo  <words>, says them back\n") {
+		t.Fatalf("help: %q, %v", out, err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("socket mode %v, want owner only", perm)
+	}
+}
+
+// TestListenTakesOver replaces the socket of a running server, as after an upgrade, and the
+// old server's Close leaves the new one's file alone.
+func TestListenTakesOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	old, err := Listen(path, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := listen(t, path)
+	s.Handle("who", "", func(w io.Writer, args []string) error {
+		_, err := io.WriteString(w, "new\n")
+		return err
+	})
+	old.Close()
+	if out, err := Call(path, "who"); err != nil || string(out) != "new\n" {
+		t.Fatalf("after the old server closed: %q, %v", out, err)
+	}
+
+	file := filepath.Join(filepath.Dir(path), "file")
+	os.WriteFile(file, nil, 0o600)
+	if _, err := Listen(file, nil); err == nil {
+		t.Fatal("replaced a regular file")
+	}
+}
+
+// TestListenKeepsUmask makes the socket owner only without touching the process's umask.
+func TestListenKeepsUmask(t *testing.T) {
+	old := syscall.Umask(0o002)
+	defer syscall.Umask(old)
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	listen(t, path)
+	if mask := syscall.Umask(0o002); mask != 0o002 {
+		t.Fatalf("umask %o after Listen, want 002", mask)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("socket mode %v, want owner only", perm)
+	}
+}
+
+func TestCommandWithoutNewline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	listen(t, path)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// no newline, the server answers once the client is done writing
+	io.WriteString(conn, "help")
+	conn.(*net.UnixConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(TIMEOUT))
+	out, _ := io.ReadAll(conn)
+	if !strings.HasPrefix(string(out), OK+"\n") {
+		t.Fatalf("got %q", out)
+	}
+}
+
+func TestWriteConnsAndPoolStats(t *testing.T) {
+	var b strings.Builder
+	WriteConns(&b, []ConnInfo{
+		{Fd: 9, Peer: "127.0.0.1:2", Age: 1500 * time.Microsecond, State: "idle"},
+		{Fd: 7, Peer: "127.0.0.1:1", Age: time.Minute, BytesRead: 10, BytesWritten: 20, State: "writing"},
+	})
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "7 ") || !strings.HasSuffix(lines[2], "idle") || !strings.Contains(lines[2], "1ms") {
+		t.Fatalf("conns table\n%s", b.String())
+	}
+
+	p := pool.New(false)
+	p.Put(p.Get(100))
+	b.Reset()
+	WritePoolStats(&b, "test", p.Stats())
+	if !strings.Contains(b.String(), "test pool") || !strings.Contains(b.String(), "total") {
+		t.Fatalf("pool stats\n%s", b.String())
+	}
+}
+
+func TestHandleConnsAndLogLevel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	s := listen(t, path)
+	var kicked int
+	s.HandleConns(func() []ConnInfo {
+		return []ConnInfo{{Fd: 5, Peer: "127.0.0.1:1", State: "idle"}}
+	}, func(fd int) error {
+		if fd != 5 {
+			return fmt.Errorf("no connection with fd %d", fd)
+		}
+		kicked = fd
+		return nil
+	})
+	level := new(slog.LevelVar)
+	s.HandleLogLevel(level)
+
+	if out, err := Call(path, "conns"); err != nil || !strings.Contains(string(out), "127.0.0.1:1") {
+		t.Fatalf("conns: %q, %v", out, err)
+	}
+	if _, err := Call(path, "kick", "6"); err == nil || err.Error() != "no connection with fd 6" {
+		t.Fatalf("kick 6: %v", err)
+	}
+	if _, err := Call(path, "kick", "five"); err == nil || !strings.HasPrefix(err.Error(), "usage: kick") {
+		t.Fatalf("kick five: %v", err)
+	}
+	if _, err := Call(path, "kick", "5"); err != nil || kicked != 5 {
+		t.Fatalf("kick 5: %v, kicked %d", err, kicked)
+	}
+
+	if out, err := Call(path, "loglevel", "debug"); err != nil || string(out) != "DEBUG\n" || level.Level() != slog.LevelDebug {
+		t.Fatalf("loglevel debug: %q, %v, level %v", out, err, level.Level())
+	}
+	if _, err := Call(path, "loglevel", "loud"); err == nil {
+		t.Fatal("set an unknown level")
+	}
+	if out, _ := Call(path, "loglevel"); string(out) != "DEBUG\n" {
+		t.Fatalf("loglevel after a bad level: %q", out)
+	}
+}
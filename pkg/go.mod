@@ -0,0 +1,5 @@
+module github.com/toastsandwich/epoll-learn/pkg
+
+go 1.25.2
+
+require golang.org/x/sys v0.37.0
@@ -0,0 +1,56 @@
+// Package logging is the slog setup shared by the servers, every log line about a
+// connection carries the same attribute keys so they can be grepped across servers.
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+// attribute keys used for connection scoped logging.
+const (
+	KeyFD    = "fd"
+	KeyPeer  = "peer"
+	KeyBytes = "bytes"
+	KeyErr   = "err"
+)
+
+type Options struct {
+	Writer io.Writer    // defaults to os.Stderr
+	Level  slog.Leveler // defaults to slog.LevelInfo, pass a *slog.LevelVar to change it at runtime
+	JSON   bool         // JSON lines instead of logfmt style text
+}
+
+func New(opts Options) *slog.Logger {
+	if opts.Writer == nil {
+		opts.Writer = os.Stderr
+	}
+	hopts := &slog.HandlerOptions{Level: opts.Level}
+	if opts.JSON {
+		return slog.New(slog.NewJSONHandler(opts.Writer, hopts))
+	}
+	return slog.New(slog.NewTextHandler(opts.Writer, hopts))
+}
+
+// Default is what servers use when they are not given a logger.
+func Default() *slog.Logger { return slog.Default() }
+
+// Discard drops everything, handy in tests.
+func Discard() *slog.Logger { return slog.New(slog.DiscardHandler) }
+
+// Conn returns a logger that tags every line with the connection's fd and peer address.
+func Conn(l *slog.Logger, fd int, peer string) *slog.Logger {
+	return l.With(slog.Int(KeyFD, fd), slog.String(KeyPeer, peer))
+}
+
+func Err(err error) slog.Attr { return slog.Any(KeyErr, err) }
+
+func Bytes(n int) slog.Attr { return slog.Int(KeyBytes, n) }
+
+// ParseLevel accepts debug, info, warn and error, as slog spells them.
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
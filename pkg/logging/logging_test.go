@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestConnAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	log := Conn(New(Options{Writer: &buf, JSON: true}), 7, "127.0.0.1:4000")
+	log.Info("read", Bytes(42), Err(errors.New("boom")))
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line[KeyFD] != 7.0 || line[KeyPeer] != "127.0.0.1:4000" || line[KeyBytes] != 42.0 || line[KeyErr] != "boom" {
+		t.Fatalf("unexpected line %v", line)
+	}
+}
+
+func TestLevelVar(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	log := New(Options{Writer: &buf, Level: level})
+
+	log.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("debug logged at info level: %q", buf.String())
+	}
+	l, err := ParseLevel("debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	level.Set(l)
+	log.Debug("shown")
+	if buf.Len() == 0 {
+		t.Fatal("debug not logged after lowering the level")
+	}
+}
@@ -0,0 +1,123 @@
+package loop
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is struct mmsghdr, Go pads it to the pointer alignment like C does.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// Batch receives datagrams with one recvmmsg and sends them with one sendmmsg, each in a
+// buffer of its own and with its own peer address. What Recv read is sent back to where it
+// came from unless the caller changes the payloads or peers in between, an echo is Recv and
+// then Send.
+//
+// A Batch is not safe for concurrent use.
+type Batch struct {
+	msgs  []mmsghdr
+	iovs  []unix.Iovec
+	addrs []unix.RawSockaddrInet4
+	bufs  [][]byte
+	n     int
+}
+
+// NewBatch returns a batch of size datagrams of at most bufSize bytes each, a longer one is
+// cut short and reported by Truncated.
+func NewBatch(size, bufSize int) *Batch {
+	b := &Batch{
+		msgs:  make([]mmsghdr, size),
+		iovs:  make([]unix.Iovec, size),
+		addrs: make([]unix.RawSockaddrInet4, size),
+		bufs:  make([][]byte, size),
+	}
+	mem := make([]byte, size*bufSize)
+	for i := range size {
+		b.bufs[i] = mem[i*bufSize : (i+1)*bufSize : (i+1)*bufSize]
+		b.iovs[i].Base = &b.bufs[i][0]
+		h := &b.msgs[i].hdr
+		h.Name = (*byte)(unsafe.Pointer(&b.addrs[i]))
+		h.Iov = &b.iovs[i]
+		h.SetIovlen(1)
+	}
+	return b
+}
+
+// Recv reads up to the batch size of datagrams from the non blocking fd, it returns 0 and
+// no error when there are none.
+func (b *Batch) Recv(fd int) (int, error) {
+	for i := range b.msgs {
+		b.iovs[i].SetLen(len(b.bufs[i]))
+		b.msgs[i].hdr.Namelen = unix.SizeofSockaddrInet4
+		b.msgs[i].hdr.Flags = 0
+	}
+	b.n = 0
+	n, err := mmsg(unix.SYS_RECVMMSG, fd, b.msgs)
+	if err != nil {
+		return 0, err
+	}
+	b.n = n
+	for i := range n {
+		b.iovs[i].SetLen(min(int(b.msgs[i].len), len(b.bufs[i])))
+	}
+	return n, nil
+}
+
+// Len is the number of datagrams Recv read.
+func (b *Batch) Len() int { return b.n }
+
+// Data returns datagram i, it may be changed in place.
+func (b *Batch) Data(i int) []byte { return b.bufs[i][:b.iovs[i].Len] }
+
+// SetLen makes datagram i n bytes long, at most the buffer size, for Send.
+func (b *Batch) SetLen(i, n int) { b.iovs[i].SetLen(min(n, len(b.bufs[i]))) }
+
+// Truncated reports whether datagram i was longer than its buffer.
+func (b *Batch) Truncated(i int) bool { return b.msgs[i].hdr.Flags&unix.MSG_TRUNC != 0 }
+
+// Peer returns the address datagram i came from, or goes to.
+func (b *Batch) Peer(i int) netip.AddrPort {
+	a := &b.addrs[i]
+	port := (*[2]byte)(unsafe.Pointer(&a.Port)) // network byte order
+	return netip.AddrPortFrom(netip.AddrFrom4(a.Addr), binary.BigEndian.Uint16(port[:]))
+}
+
+// SetPeer sends datagram i to ap.
+func (b *Batch) SetPeer(i int, ap netip.AddrPort) {
+	a := &b.addrs[i]
+	a.Family = unix.AF_INET
+	a.Addr = ap.Addr().As4()
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&a.Port))[:], ap.Port())
+	b.msgs[i].hdr.Namelen = unix.SizeofSockaddrInet4
+}
+
+// Send writes datagrams from to Len to the non blocking fd, and returns how many went. It
+// stops short when the socket buffer is full, the rest are the caller's to drop or retry.
+func (b *Batch) Send(fd int, from int) (int, error) {
+	if from >= b.n {
+		return 0, nil
+	}
+	return mmsg(unix.SYS_SENDMMSG, fd, b.msgs[from:b.n])
+}
+
+// mmsg calls recvmmsg or sendmmsg on msgs without waiting, EAGAIN is 0 datagrams.
+func mmsg(trap uintptr, fd int, msgs []mmsghdr) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(trap, uintptr(fd), uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), unix.MSG_DONTWAIT, 0, 0)
+		switch errno {
+		case 0:
+			return int(n), nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return 0, nil
+		}
+		return 0, errno
+	}
+}
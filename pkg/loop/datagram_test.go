@@ -0,0 +1,105 @@
+package loop
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// udpSocket returns a non blocking UDP socket bound to a free loopback port.
+func udpSocket(t *testing.T) (int, netip.AddrPort) {
+	t.Helper()
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	if err := unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	sa, _ := unix.Getsockname(fd)
+	return fd, netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), uint16(sa.(*unix.SockaddrInet4).Port))
+}
+
+func TestBatchEcho(t *testing.T) {
+	fd, addr := udpSocket(t)
+	b := NewBatch(8, 16)
+	if n, err := b.Recv(fd); n != 0 || err != nil {
+		t.Fatalf("Recv on an empty socket: %d, %v", n, err)
+	}
+
+	// three peers, one of them sending more than a buffer holds
+	var clients []*net.UDPConn
+	for _, msg := range []string{"one", "two", "seventeen bytes!!"} {
+		c, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		c.Write([]byte(msg))
+		clients = append(clients, c)
+	}
+	n, err := b.Recv(fd)
+	if err != nil || n != 3 {
+		t.Fatalf("Recv: %d, %v", n, err)
+	}
+	for i, c := range clients {
+		if b.Peer(i).String() != c.LocalAddr().String() {
+			t.Errorf("datagram %d from %v, want %v", i, b.Peer(i), c.LocalAddr())
+		}
+	}
+	if string(b.Data(0)) != "one" || b.Truncated(0) || string(b.Data(2)) != "seventeen bytes!" || !b.Truncated(2) {
+		t.Fatalf("got %q %v, %q %v", b.Data(0), b.Truncated(0), b.Data(2), b.Truncated(2))
+	}
+
+	// payloads change in place, and lengths shrink
+	copy(b.Data(1), "TWO")
+	b.SetLen(0, 2)
+	if sent, err := b.Send(fd, 0); sent != 3 || err != nil {
+		t.Fatalf("Send: %d, %v", sent, err)
+	}
+	for i, want := range []string{"on", "TWO", "seventeen bytes!"} {
+		buf := make([]byte, 32)
+		n, err := clients[i].Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("client %d got %q, %v, want %q", i, buf[:n], err, want)
+		}
+	}
+}
+
+func TestBatchSetPeer(t *testing.T) {
+	fd, addr := udpSocket(t)
+	other, otherAddr := udpSocket(t)
+	c, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("forward me"))
+
+	b := NewBatch(4, 64)
+	for deadline := time.Now().Add(2 * time.Second); b.Len() == 0; {
+		if _, err := b.Recv(fd); err != nil || time.Now().After(deadline) {
+			t.Fatalf("nothing received: %v", err)
+		}
+	}
+	b.SetPeer(0, otherAddr)
+	if b.Peer(0) != otherAddr {
+		t.Fatalf("peer %v, want %v", b.Peer(0), otherAddr)
+	}
+	b.Send(fd, 0)
+
+	got := NewBatch(1, 64)
+	for deadline := time.Now().Add(2 * time.Second); got.Len() == 0; {
+		if _, err := got.Recv(other); err != nil || time.Now().After(deadline) {
+			t.Fatalf("nothing forwarded: %v", err)
+		}
+	}
+	if string(got.Data(0)) != "forward me" || got.Peer(0) != addr {
+		t.Fatalf("got %q from %v", got.Data(0), got.Peer(0))
+	}
+}
@@ -0,0 +1,86 @@
+package loop
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// AcceptFlags makes accepted sockets non-blocking and close-on-exec in the accept4 call
+// itself, two fcntl calls fewer per connection.
+const AcceptFlags = unix.SOCK_NONBLOCK | unix.SOCK_CLOEXEC
+
+// OverLimit is what a server does with a connection past its connection limit.
+type OverLimit string
+
+const (
+	// Reject accepts the connection, tells the client the server is full and closes it.
+	Reject OverLimit = "reject"
+	// Pause stops polling the listener until a connection closes, clients wait in the
+	// listen backlog and then in the kernel's SYN queue.
+	Pause OverLimit = "pause"
+)
+
+// ParseOverLimit accepts reject or pause. An empty s gives an empty OverLimit, the server
+// then picks its own default.
+func ParseOverLimit(s string) (OverLimit, error) {
+	switch OverLimit(s) {
+	case "":
+		return "", nil
+	case Reject, Pause:
+		return OverLimit(s), nil
+	}
+	return "", fmt.Errorf("unknown over limit behaviour %q, want reject or pause", s)
+}
+
+// OutOfFds reports whether an accept failed because the process or the system ran out of
+// file descriptors, see SpareFd.
+func OutOfFds(err error) bool {
+	return errors.Is(err, unix.EMFILE) || errors.Is(err, unix.ENFILE)
+}
+
+// SpareFd is a descriptor kept open for the moment accept fails with EMFILE or ENFILE.
+// the pending connection stays in the backlog and the listener stays readable, level
+// triggered the loop would spin on it and edge triggered it would never hear of it again.
+// closing the spare makes room to accept that connection and close it straight away.
+type SpareFd struct {
+	fd int
+}
+
+// NewSpareFd opens /dev/null to hold a descriptor in reserve.
+func NewSpareFd() (*SpareFd, error) {
+	fd, err := unix.Open("/dev/null", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening spare fd: %w", err)
+	}
+	return &SpareFd{fd: fd}, nil
+}
+
+// Shed gives up the spare to accept one connection from lfd and close it, then takes the
+// spare back. it reports whether a connection was shed, false once the backlog is empty or
+// if even the spare did not make room, the next wakeup tries again.
+func (s *SpareFd) Shed(lfd int) bool {
+	if s.fd >= 0 {
+		unix.Close(s.fd)
+		s.fd = -1
+	}
+	nfd, _, err := unix.Accept4(lfd, AcceptFlags)
+	if err == nil {
+		unix.Close(nfd)
+	}
+	// someone else may take the descriptor in between, the next call retries
+	if fd, oerr := unix.Open("/dev/null", unix.O_RDONLY|unix.O_CLOEXEC, 0); oerr == nil {
+		s.fd = fd
+	}
+	return err == nil
+}
+
+func (s *SpareFd) Close() error {
+	if s.fd < 0 {
+		return nil
+	}
+	err := unix.Close(s.fd)
+	s.fd = -1
+	return err
+}
@@ -0,0 +1,93 @@
+package loop
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseOverLimit(t *testing.T) {
+	for s, want := range map[string]OverLimit{"": "", "reject": Reject, "pause": Pause} {
+		if got, err := ParseOverLimit(s); got != want || err != nil {
+			t.Errorf("ParseOverLimit(%q) = %q, %v, want %q", s, got, err, want)
+		}
+	}
+	if _, err := ParseOverLimit("drop"); err == nil {
+		t.Error("ParseOverLimit(drop) did not fail")
+	}
+}
+
+// TestSpareFdShed runs the process out of descriptors with a connection waiting, accept
+// fails with EMFILE until the spare makes room, and the client sees its connection closed.
+func TestSpareFdShed(t *testing.T) {
+	lfd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(lfd)
+	if err := unix.Bind(lfd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Listen(lfd, 8); err != nil {
+		t.Fatal(err)
+	}
+	sa, _ := unix.Getsockname(lfd)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sa.(*unix.SockaddrInet4).Port}
+
+	spare, err := NewSpareFd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spare.Close()
+
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// use up every descriptor below a lowered soft limit
+	var old unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &old); err != nil {
+		t.Fatal(err)
+	}
+	lim := old
+	lim.Cur = min(old.Cur, 1024)
+	if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &lim); err != nil {
+		t.Skip(err)
+	}
+	var fill []int
+	defer func() {
+		for _, fd := range fill {
+			unix.Close(fd)
+		}
+		unix.Setrlimit(unix.RLIMIT_NOFILE, &old)
+	}()
+	for {
+		fd, err := unix.Open("/dev/null", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			break
+		}
+		fill = append(fill, fd)
+	}
+
+	if _, _, err := unix.Accept4(lfd, AcceptFlags); !OutOfFds(err) {
+		t.Fatalf("accept with no descriptors left: %v, want EMFILE", err)
+	}
+	if !spare.Shed(lfd) {
+		t.Fatal("Shed did not accept the waiting connection")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read on a shed connection: %v, want EOF", err)
+	}
+	if spare.Shed(lfd) {
+		t.Fatal("Shed with nothing waiting reported a connection")
+	}
+	if spare.fd < 0 {
+		t.Fatal("spare not taken back after shedding")
+	}
+}
@@ -0,0 +1,29 @@
+package loop
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// AdoptListener checks that fd, inherited rather than opened by this process, is a
+// listening TCP socket and makes it non-blocking and close-on-exec, as the servers'
+// own listeners are. Whoever handed it over already bound it and called listen.
+func AdoptListener(fd int) error {
+	typ, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return fmt.Errorf("fd %d is not a socket: %w", fd, err)
+	}
+	listening, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+	if err != nil {
+		return fmt.Errorf("fd %d: getsockopt SO_ACCEPTCONN: %w", fd, err)
+	}
+	if typ != unix.SOCK_STREAM || listening == 0 {
+		return fmt.Errorf("fd %d is not a listening stream socket", fd)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return fmt.Errorf("fd %d: set nonblock: %w", fd, err)
+	}
+	unix.CloseOnExec(fd)
+	return nil
+}
@@ -0,0 +1,29 @@
+package loop
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestAdoptListener(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if err := AdoptListener(fd); err == nil {
+		t.Fatal("adopted a socket that is not listening")
+	}
+	unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+	unix.Listen(fd, 8)
+	if err := AdoptListener(fd); err != nil {
+		t.Fatal(err)
+	}
+	if flags, _ := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0); flags&unix.O_NONBLOCK == 0 {
+		t.Fatal("adopted listener is blocking")
+	}
+	if _, _, err := unix.Accept(fd); err != unix.EAGAIN {
+		t.Fatalf("accept on an empty adopted listener: %v, want EAGAIN", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Package loop names the event loops a server can run on, and how an epoll loop is told
+// about ready sockets. Either way the server looks the same from outside, only how it
+// waits on its sockets changes.
+package loop
+
+import (
+	"fmt"
+
+	"github.com/toastsandwich/epoll-learn/pkg/uring"
+	"golang.org/x/sys/unix"
+)
+
+type Backend string
+
+const (
+	Epoll Backend = "epoll" // readiness, the default
+	Uring Backend = "io_uring"
+)
+
+func ParseBackend(s string) (Backend, error) {
+	switch Backend(s) {
+	case "", Epoll:
+		return Epoll, nil
+	case Uring, "uring":
+		return Uring, nil
+	}
+	return "", fmt.Errorf("unknown loop backend %q, want epoll or io_uring", s)
+}
+
+// Resolve returns the backend to run for b, io_uring falls back to epoll when the kernel
+// lacks something it needs, err then says what.
+func Resolve(b Backend) (Backend, error) {
+	if b != Uring {
+		return Epoll, nil
+	}
+	if err := uring.Supported(); err != nil {
+		return Epoll, err
+	}
+	return Uring, nil
+}
+
+// Trigger is how epoll reports a ready fd.
+type Trigger string
+
+const (
+	// Edge reports a fd once each time it becomes ready, the loop reads, accepts and writes
+	// until EAGAIN or it never hears about what is left.
+	Edge Trigger = "edge"
+	// Level reports a fd for as long as it stays ready, the loop does a bounded amount of
+	// work per wakeup and leaves the rest to the next, one busy peer cannot starve the others.
+	Level Trigger = "level"
+)
+
+// per fd and wakeup bounds in level triggered mode
+const (
+	LEVELREADS   = 4
+	LEVELACCEPTS = 64
+)
+
+// ParseTrigger accepts edge or level, and et or lt. An empty s gives an empty Trigger,
+// the server then picks its own default.
+func ParseTrigger(s string) (Trigger, error) {
+	switch Trigger(s) {
+	case "":
+		return "", nil
+	case Edge, "et":
+		return Edge, nil
+	case Level, "lt":
+		return Level, nil
+	}
+	return "", fmt.Errorf("unknown trigger mode %q, want edge or level", s)
+}
+
+// Events returns events with EPOLLET added in edge triggered mode.
+func (t Trigger) Events(events uint32) uint32 {
+	if t == Edge {
+		return events | unix.EPOLLET
+	}
+	return events
+}
+
+// Reads is how many reads to do on a fd per wakeup, 0 is until EAGAIN.
+func (t Trigger) Reads() int {
+	if t == Edge {
+		return 0
+	}
+	return LEVELREADS
+}
+
+// Accepts is how many connections to accept per wakeup, 0 is until EAGAIN.
+func (t Trigger) Accepts() int {
+	if t == Edge {
+		return 0
+	}
+	return LEVELACCEPTS
+}
@@ -0,0 +1,212 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the
+// Prometheus text exposition format, without pulling in the Prometheus client.
+//
+// Everything is safe to update from any goroutine, updates are single atomic operations
+// so they can sit on the epoll loop's hot path.
+package metrics
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ContentType is what a scrape endpoint should answer with.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	metrics []metric
+	mu      sync.Mutex
+}
+
+func NewRegistry() *Registry { return &Registry{} }
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, old := range r.metrics {
+		if old.name() == m.name() {
+			panic("metrics: duplicate metric " + m.name())
+		}
+	}
+	r.metrics = append(r.metrics, m)
+	slices.SortFunc(r.metrics, func(a, b metric) int { return cmp.Compare(a.name(), b.name()) })
+}
+
+// WriteText writes every metric, sorted by name, in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+type desc struct {
+	n, help, typ string
+}
+
+func (d desc) name() string { return d.n }
+
+func (d desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.n, d.help, d.n, d.typ)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter only goes up.
+type Counter struct {
+	desc
+	v atomic.Uint64
+}
+
+func (r *Registry) Counter(name, help string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter"}}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc()          { c.v.Add(1) }
+func (c *Counter) Add(n int)     { c.v.Add(uint64(n)) }
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header(w)
+	fmt.Fprintf(w, "%s %d\n", c.n, c.v.Load())
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	desc
+	bits atomic.Uint64
+}
+
+func (r *Registry) Gauge(name, help string) *Gauge {
+	g := &Gauge{desc: desc{name, help, "gauge"}}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64) { g.bits.Store(math.Float64bits(v)) }
+func (g *Gauge) Inc()          { g.Add(1) }
+func (g *Gauge) Dec()          { g.Add(-1) }
+
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Value() float64 { return math.Float64frombits(g.bits.Load()) }
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.header(w)
+	fmt.Fprintf(w, "%s %s\n", g.n, formatFloat(g.Value()))
+}
+
+// funcMetric reads its value when scraped, for things the servers already count themselves.
+type funcMetric struct {
+	desc
+	f func() float64
+}
+
+func (r *Registry) GaugeFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{desc{name, help, "gauge"}, f})
+}
+
+func (r *Registry) CounterFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{desc{name, help, "counter"}, f})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.header(w)
+	fmt.Fprintf(w, "%s %s\n", m.n, formatFloat(m.f()))
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	desc
+	upper  []float64
+	counts []atomic.Uint64 // one per bucket plus +Inf
+	count  atomic.Uint64
+	sum    Gauge
+}
+
+// LatencyBuckets go from 50µs to ~3.3s, in seconds.
+var LatencyBuckets = ExponentialBuckets(0.00005, 2, 17)
+
+// ExponentialBuckets returns count upper bounds starting at start, each factor times the last.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	b := make([]float64, count)
+	for i := range b {
+		b[i] = start
+		start *= factor
+	}
+	return b
+}
+
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		desc:   desc{name, help, "histogram"},
+		upper:  slices.Sorted(slices.Values(buckets)),
+		counts: make([]atomic.Uint64, len(buckets)+1),
+	}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.upper, v)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(v)
+}
+
+func (h *Histogram) ObserveDuration(d time.Duration) { h.Observe(d.Seconds()) }
+
+// ObserveSince records the time elapsed since start, in seconds.
+func (h *Histogram) ObserveSince(start time.Time) { h.ObserveDuration(time.Since(start)) }
+
+func (h *Histogram) Count() uint64 { return h.count.Load() }
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w)
+	var cumulative uint64
+	for i, upper := range h.upper {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.n, formatFloat(upper), cumulative)
+	}
+	cumulative += h.counts[len(h.upper)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.n, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", h.n, formatFloat(h.sum.Value()))
+	fmt.Fprintf(w, "%s_count %d\n", h.n, cumulative)
+}
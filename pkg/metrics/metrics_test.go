@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_accepted_total", "Accepted connections.")
+	g := r.Gauge("test_active", "Active connections.")
+	h := r.Histogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	r.GaugeFunc("test_func", "From a func.", func() float64 { return 2.5 })
+
+	c.Add(3)
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(7)
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_accepted_total Accepted connections.
+# TYPE test_accepted_total counter
+test_accepted_total 3
+# HELP test_active Active connections.
+# TYPE test_active gauge
+test_active 1
+# HELP test_func From a func.
+# TYPE test_func gauge
+test_func 2.5
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 2
+test_latency_seconds_bucket{le="1"} 3
+test_latency_seconds_bucket{le="+Inf"} 4
+test_latency_seconds_sum 7.65
+test_latency_seconds_count 4
+`
+	if b.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("c_total", "c")
+	g := r.Gauge("g", "g")
+	h := r.Histogram("h", "h", LatencyBuckets)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range 1000 {
+				c.Inc()
+				g.Add(1)
+				h.Observe(0.001)
+			}
+		})
+	}
+	wg.Wait()
+	if c.Value() != 8000 || g.Value() != 8000 || h.Count() != 8000 {
+		t.Fatalf("lost updates: counter %d gauge %v histogram %d", c.Value(), g.Value(), h.Count())
+	}
+}
+
+func TestDuplicatePanics(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("x", "x")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a duplicate did not panic")
+		}
+	}()
+	r.Gauge("x", "x")
+}
+
+func TestGoRuntime(t *testing.T) {
+	r := NewRegistry()
+	r.GoRuntime()
+	var b strings.Builder
+	r.WriteText(&b)
+	for _, want := range []string{"\ngo_goroutines ", "\ngo_gc_heap_allocs_objects_total ", "# TYPE go_gc_heap_allocs_bytes_total counter\n"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("no %q in:\n%s", want, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "_total 0\n") {
+		t.Errorf("a runtime counter reads 0:\n%s", b.String())
+	}
+}
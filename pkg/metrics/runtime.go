@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"runtime"
+	"runtime/metrics"
+)
+
+// goRuntime maps the runtime/metrics samples a Registry exposes to their metric names.
+var goRuntime = []struct {
+	sample, name, help, kind string
+}{
+	{"/gc/heap/allocs:objects", "go_gc_heap_allocs_objects_total", "heap objects allocated since the process started", "counter"},
+	{"/gc/heap/allocs:bytes", "go_gc_heap_allocs_bytes_total", "bytes allocated on the heap since the process started", "counter"},
+	{"/memory/classes/total:bytes", "go_memory_total_bytes", "memory mapped by the Go runtime", "gauge"},
+}
+
+// GoRuntime adds the Go runtime's goroutines, heap allocations and mapped memory to r, a
+// benchmark divides the allocations by the requests served to get allocations per request.
+func (r *Registry) GoRuntime() {
+	r.GaugeFunc("go_goroutines", "goroutines that currently exist", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	for _, m := range goRuntime {
+		f := func() float64 {
+			s := []metrics.Sample{{Name: m.sample}}
+			metrics.Read(s)
+			if s[0].Value.Kind() != metrics.KindUint64 {
+				return 0
+			}
+			return float64(s[0].Value.Uint64())
+		}
+		r.register(&funcMetric{desc{m.name, m.help, m.kind}, f})
+	}
+}
@@ -0,0 +1,16 @@
+package pool
+
+import "github.com/toastsandwich/epoll-learn/pkg/metrics"
+
+// RegisterMetrics exports the pool's counters as <prefix>_buffer_pool_*.
+func (p *Pool) RegisterMetrics(reg *metrics.Registry, prefix string) {
+	reg.CounterFunc(prefix+"_buffer_pool_gets_total", "Buffers taken from the pool.", func() float64 {
+		return float64(p.Stats().Gets)
+	})
+	reg.CounterFunc(prefix+"_buffer_pool_misses_total", "Buffer pool gets that had to allocate.", func() float64 {
+		return float64(p.Stats().Misses)
+	})
+	reg.CounterFunc(prefix+"_buffer_pool_oversize_total", "Gets above the largest size class, never pooled.", func() float64 {
+		return float64(p.Stats().Oversize)
+	})
+}
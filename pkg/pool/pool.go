@@ -0,0 +1,129 @@
+// Package pool hands out byte buffers from size classes, 512 B up to 64 KiB,
+// each class backed by its own sync.Pool.
+//
+// Buffers are stored as a pointer to their first byte rather than as a []byte, a slice
+// header does not fit in an interface without being allocated, a pointer does, so Put
+// costs no allocation.
+package pool
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	MINSIZE = 512
+	MAXSIZE = 64 << 10
+
+	minShift   = 9 // log2(MINSIZE)
+	numClasses = 8 // 512, 1K, 2K, 4K, 8K, 16K, 32K, 64K
+)
+
+type class struct {
+	size int
+	pool sync.Pool
+
+	gets, misses, puts atomic.Uint64
+}
+
+type Pool struct {
+	Secure bool // zero buffers when they come back, so no data leaks between connections
+
+	classes [numClasses]class
+
+	oversize atomic.Uint64 // asks above MAXSIZE, never pooled
+	dropped  atomic.Uint64 // puts of buffers that did not come from a class
+}
+
+func New(secure bool) *Pool {
+	p := &Pool{Secure: secure}
+	for i := range p.classes {
+		c := &p.classes[i]
+		c.size = MINSIZE << i
+		c.pool.New = func() any {
+			c.misses.Add(1)
+			return unsafe.SliceData(make([]byte, c.size))
+		}
+	}
+	return p
+}
+
+// classOf returns the smallest class holding n bytes, or -1 if n is above MAXSIZE.
+func classOf(n int) int {
+	if n <= MINSIZE {
+		return 0
+	}
+	if n > MAXSIZE {
+		return -1
+	}
+	return bits.Len(uint(n-1)) - minShift
+}
+
+// Get returns a buffer of length n from the smallest class that fits it,
+// its capacity is the class size. Sizes above MAXSIZE are allocated and not pooled.
+func (p *Pool) Get(n int) []byte {
+	i := classOf(n)
+	if i < 0 {
+		p.oversize.Add(1)
+		return make([]byte, n)
+	}
+	c := &p.classes[i]
+	c.gets.Add(1)
+	return unsafe.Slice(c.pool.Get().(*byte), c.size)[:n]
+}
+
+// Put gives b back, b may be resliced but its capacity must be a class size,
+// anything else (grown by append, oversize) is left to the garbage collector.
+func (p *Pool) Put(b []byte) {
+	size := cap(b)
+	i := classOf(size)
+	if i < 0 || p.classes[i].size != size {
+		p.dropped.Add(1)
+		return
+	}
+	b = b[:size]
+	if p.Secure {
+		clear(b)
+	}
+	c := &p.classes[i]
+	c.puts.Add(1)
+	c.pool.Put(unsafe.SliceData(b))
+}
+
+type ClassStats struct {
+	Size   int
+	Gets   uint64
+	Misses uint64 // gets that had to allocate
+	Puts   uint64
+}
+
+type Stats struct {
+	Gets     uint64
+	Misses   uint64
+	Puts     uint64
+	Oversize uint64
+	Dropped  uint64
+	Classes  []ClassStats
+}
+
+// Hits is how many gets were served by a pooled buffer.
+func (s Stats) Hits() uint64 { return s.Gets - s.Misses }
+
+func (p *Pool) Stats() Stats {
+	s := Stats{
+		Oversize: p.oversize.Load(),
+		Dropped:  p.dropped.Load(),
+		Classes:  make([]ClassStats, numClasses),
+	}
+	for i := range p.classes {
+		c := &p.classes[i]
+		cs := ClassStats{Size: c.size, Gets: c.gets.Load(), Misses: c.misses.Load(), Puts: c.puts.Load()}
+		s.Classes[i] = cs
+		s.Gets += cs.Gets
+		s.Misses += cs.Misses
+		s.Puts += cs.Puts
+	}
+	return s
+}
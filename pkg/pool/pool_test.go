@@ -0,0 +1,84 @@
+package pool
+
+import "testing"
+
+func TestGetSizes(t *testing.T) {
+	p := New(false)
+	for _, tt := range []struct{ n, cap int }{
+		{0, 512}, {1, 512}, {512, 512}, {513, 1024}, {4096, 4096},
+		{4097, 8192}, {60000, 65536}, {MAXSIZE, MAXSIZE}, {MAXSIZE + 1, MAXSIZE + 1},
+	} {
+		b := p.Get(tt.n)
+		if len(b) != tt.n || cap(b) != tt.cap {
+			t.Errorf("Get(%d): len %d cap %d, want len %d cap %d", tt.n, len(b), cap(b), tt.n, tt.cap)
+		}
+		p.Put(b)
+	}
+	if s := p.Stats(); s.Oversize != 1 || s.Dropped != 1 {
+		t.Fatalf("oversize %d dropped %d, want 1 and 1", s.Oversize, s.Dropped)
+	}
+}
+
+func TestSecureZeroes(t *testing.T) {
+	p := New(true)
+	b := p.Get(1000)
+	for i := range b {
+		b[i] = 0xff
+	}
+	p.Put(b[:10]) // resliced buffers still come back whole
+
+	for range 10 {
+		b := p.Get(1024)
+		for i, v := range b {
+			if v != 0 {
+				t.Fatalf("byte %d is %x after a secure put", i, v)
+			}
+		}
+		p.Put(b)
+	}
+}
+
+func TestForeignBuffersDropped(t *testing.T) {
+	p := New(false)
+	p.Put(make([]byte, 100))
+	p.Put(append(p.Get(512), make([]byte, 600)...)) // grown past its class
+	if s := p.Stats(); s.Dropped != 2 || s.Puts != 0 {
+		t.Fatalf("dropped %d puts %d, want 2 and 0", s.Dropped, s.Puts)
+	}
+}
+
+func TestStats(t *testing.T) {
+	p := New(false)
+	b := p.Get(2000)
+	p.Put(b)
+	p.Get(2000)
+
+	s := p.Stats()
+	if s.Gets != 2 || s.Puts != 1 || s.Classes[2].Gets != 2 || s.Classes[2].Size != 2048 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if s.Hits()+s.Misses != s.Gets {
+		t.Fatalf("hits %d + misses %d != gets %d", s.Hits(), s.Misses, s.Gets)
+	}
+}
+
+func TestNoAllocs(t *testing.T) {
+	p := New(false)
+	p.Put(p.Get(4096))
+	allocs := testing.AllocsPerRun(1000, func() {
+		p.Put(p.Get(4096))
+	})
+	if allocs != 0 {
+		t.Fatalf("Get/Put allocated %.1f times per run", allocs)
+	}
+}
+
+func BenchmarkGetPut(b *testing.B) {
+	p := New(false)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.Put(p.Get(4096))
+		}
+	})
+}
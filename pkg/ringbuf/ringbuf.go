@@ -0,0 +1,297 @@
+// Package ringbuf is a byte queue made of segments, most of them taken from a pool.Pool.
+//
+// Bytes go in at the tail segment and come out of the head one, a segment that has been
+// read through goes back to the pool, so a connection only holds as much memory as it
+// has bytes queued, rounded up to a segment. The buffer never holds more than its limit.
+//
+// Besides copying into pooled segments a Buffer can queue a caller's slice as is, see
+// Append, and it talks to file descriptors with readv and writev so a response header
+// and its body leave in one syscall without being joined first.
+//
+// A Buffer is not safe for concurrent use.
+package ringbuf
+
+import (
+	"errors"
+	"io"
+
+	"github.com/toastsandwich/epoll-learn/pkg/pool"
+	"golang.org/x/sys/unix"
+)
+
+// IOVMAX caps the iovecs handed to one readv or writev, the kernel refuses more than 1024.
+const IOVMAX = 1024
+
+// ErrFull is returned when bytes do not fit under the buffer's limit.
+var ErrFull = errors.New("ringbuf: buffer full")
+
+// segment holds queued bytes in buf[r:w], pooled ones also take writes in buf[w:].
+type segment struct {
+	buf    []byte
+	r, w   int
+	pooled bool
+}
+
+type Buffer struct {
+	pool    *pool.Pool
+	segSize int
+	limit   int
+
+	segs []segment
+	n    int
+
+	scratch []byte   // Peek copies here when the bytes span segments
+	iovs    [][]byte // reused for every readv and writev
+}
+
+// New returns an empty buffer that takes segSize segments from p and holds at most limit bytes.
+// Nothing is taken from the pool until the first write.
+func New(p *pool.Pool, segSize, limit int) *Buffer {
+	return &Buffer{pool: p, segSize: segSize, limit: limit}
+}
+
+// Len is the number of bytes queued.
+func (b *Buffer) Len() int { return b.n }
+
+// Limit is the most bytes the buffer will hold.
+func (b *Buffer) Limit() int { return b.limit }
+
+// Free is how many more bytes fit under the limit.
+func (b *Buffer) Free() int { return b.limit - b.n }
+
+func (b *Buffer) grow() *segment {
+	b.segs = append(b.segs, segment{buf: b.pool.Get(b.segSize), pooled: true})
+	return &b.segs[len(b.segs)-1]
+}
+
+// tail returns the last segment if it still takes writes, else a new one from the pool.
+func (b *Buffer) tail() *segment {
+	if len(b.segs) > 0 {
+		if s := &b.segs[len(b.segs)-1]; s.pooled && s.w < len(s.buf) {
+			return s
+		}
+	}
+	return b.grow()
+}
+
+// head returns the queued bytes of the first segment.
+func (b *Buffer) head() []byte {
+	if len(b.segs) == 0 {
+		return nil
+	}
+	return b.segs[0].buf[b.segs[0].r:b.segs[0].w]
+}
+
+// Write queues a copy of p, all of it or nothing and ErrFull if p does not fit.
+func (b *Buffer) Write(p []byte) (int, error) {
+	if len(p) > b.Free() {
+		return 0, ErrFull
+	}
+	total := len(p)
+	for len(p) > 0 {
+		s := b.tail()
+		k := copy(s.buf[s.w:], p)
+		s.w += k
+		b.n += k
+		p = p[k:]
+	}
+	return total, nil
+}
+
+// Append queues p itself rather than a copy, it must not change until it has been read
+// through. Worth it for bodies, small pieces are cheaper copied with Write.
+func (b *Buffer) Append(p []byte) error {
+	if len(p) > b.Free() {
+		return ErrFull
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	b.segs = append(b.segs, segment{buf: p, w: len(p)})
+	b.n += len(p)
+	return nil
+}
+
+// Peek returns the next n bytes without consuming them, or all of them if fewer are queued.
+// The slice is only valid until the next call that changes the buffer.
+func (b *Buffer) Peek(n int) []byte {
+	n = min(n, b.n)
+	if h := b.head(); n <= len(h) {
+		return h[:n]
+	}
+	if cap(b.scratch) < n {
+		b.scratch = make([]byte, n)
+	}
+	p := b.scratch[:n]
+	off := 0
+	for _, s := range b.segs {
+		off += copy(p[off:], s.buf[s.r:s.w])
+		if off == n {
+			break
+		}
+	}
+	return p
+}
+
+// Discard drops the next n bytes, or all of them if fewer are queued, and returns how many went.
+// It walks segments the way a short writev leaves them, part way into one of them.
+func (b *Buffer) Discard(n int) int {
+	n = min(n, b.n)
+	left := n
+	for left > 0 {
+		s := &b.segs[0]
+		k := min(left, s.w-s.r)
+		s.r += k
+		b.n -= k
+		left -= k
+		if s.r == s.w && len(b.segs) > 1 {
+			b.release(s)
+			b.segs[0] = segment{}
+			b.segs = b.segs[1:]
+		}
+	}
+	if b.n == 0 {
+		b.reset()
+	}
+	return n
+}
+
+func (b *Buffer) release(s *segment) {
+	if s.pooled {
+		b.pool.Put(s.buf)
+	}
+}
+
+// reset keeps a single pooled segment around for the next bytes, an idle connection is the common case.
+func (b *Buffer) reset() {
+	keep := -1
+	for i := range b.segs {
+		if keep < 0 && b.segs[i].pooled {
+			keep = i
+			continue
+		}
+		b.release(&b.segs[i])
+		b.segs[i] = segment{}
+	}
+	if keep < 0 {
+		b.segs = b.segs[:0]
+		return
+	}
+	s := b.segs[keep]
+	s.r, s.w = 0, 0
+	b.segs = append(b.segs[:0], s)
+}
+
+// Release drops everything queued and gives every pooled segment back.
+func (b *Buffer) Release() {
+	for i := range b.segs {
+		b.release(&b.segs[i])
+		b.segs[i] = segment{}
+	}
+	b.segs = nil
+	b.n = 0
+	b.scratch = nil
+	b.iovs = nil
+}
+
+// Segments appends the queued bytes to iovs one slice per segment, at most max of them.
+// They stay valid until the next call that changes the buffer.
+func (b *Buffer) Segments(iovs [][]byte, max int) [][]byte {
+	for i := range b.segs {
+		if len(iovs) == max {
+			break
+		}
+		if s := &b.segs[i]; s.w > s.r {
+			iovs = append(iovs, s.buf[s.r:s.w])
+		}
+	}
+	return iovs
+}
+
+// ReadFromFd reads from the non blocking fd until it would block, with readv into the free
+// part of the tail segment and a fresh one, so a burst larger than the tail takes one syscall.
+// It returns io.EOF once the peer has closed and ErrFull when the limit is reached first,
+// the bytes read before either are queued all the same.
+//
+// Not ReadFrom, that name belongs to io.ReaderFrom and reads until EOF.
+func (b *Buffer) ReadFromFd(fd int) (int, error) {
+	return b.ReadFromFdN(fd, 0)
+}
+
+// ReadFromFdN is ReadFromFd stopping after reads readv calls, reads <= 0 is no bound.
+// It returns nil once the bound is hit, whether the fd has more or not.
+func (b *Buffer) ReadFromFdN(fd int, reads int) (int, error) {
+	total := 0
+	for i := 0; reads <= 0 || i < reads; i++ {
+		free := b.Free()
+		if free == 0 {
+			return total, ErrFull
+		}
+
+		// the tail's free part, and a fresh segment if that alone is less than fits
+		b.tail()
+		first := len(b.segs) - 1
+		if s := &b.segs[first]; len(s.buf)-s.w < free {
+			b.grow()
+		}
+
+		iovs := b.iovs[:0]
+		room := free
+		for i := first; i < len(b.segs) && room > 0; i++ {
+			s := &b.segs[i]
+			p := s.buf[s.w:min(len(s.buf), s.w+room)]
+			if len(p) == 0 {
+				continue
+			}
+			iovs = append(iovs, p)
+			room -= len(p)
+		}
+		b.iovs = iovs
+
+		n, err := unix.Readv(fd, iovs)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+				return total, nil
+			}
+			return total, err
+		}
+		if n == 0 {
+			return total, io.EOF
+		}
+		b.n += n
+		total += n
+		for i := first; i < len(b.segs) && n > 0; i++ {
+			s := &b.segs[i]
+			k := min(n, len(s.buf)-s.w)
+			s.w += k
+			n -= k
+		}
+	}
+	return total, nil
+}
+
+// WriteToFd writes queued bytes to the non blocking fd with writev until the buffer is empty
+// or the fd would block, a short write leaves the rest queued from where it stopped.
+func (b *Buffer) WriteToFd(fd int) (int, error) {
+	total := 0
+	for b.n > 0 {
+		b.iovs = b.Segments(b.iovs[:0], IOVMAX)
+		n, err := unix.Writev(fd, b.iovs)
+		clear(b.iovs) // they may point at an Append caller's slices
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+				return total, nil
+			}
+			return total, err
+		}
+		b.Discard(n)
+		total += n
+	}
+	return total, nil
+}
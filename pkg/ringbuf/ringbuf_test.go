@@ -0,0 +1,252 @@
+package ringbuf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/toastsandwich/epoll-learn/pkg/pool"
+	"golang.org/x/sys/unix"
+)
+
+func pattern(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i % 251)
+	}
+	return p
+}
+
+func socketpair(t *testing.T) (int, int) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+	})
+	return fds[0], fds[1]
+}
+
+func TestWritePeekDiscard(t *testing.T) {
+	p := pool.New(false)
+	b := New(p, 512, 4096)
+	data := pattern(1500)
+
+	if _, err := b.Write(data[:700]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write(data[700:]); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 1500 || len(b.segs) != 3 {
+		t.Fatalf("len %d segments %d, want 1500 and 3", b.Len(), len(b.segs))
+	}
+
+	// within the head segment, and across all three
+	if got := b.Peek(100); !bytes.Equal(got, data[:100]) {
+		t.Fatal("peek within a segment")
+	}
+	if got := b.Peek(2000); !bytes.Equal(got, data) {
+		t.Fatal("peek across segments")
+	}
+
+	if n := b.Discard(600); n != 600 {
+		t.Fatalf("discarded %d, want 600", n)
+	}
+	if len(b.segs) != 2 {
+		t.Fatalf("%d segments after reading through the first, want 2", len(b.segs))
+	}
+	if got := b.Peek(900); !bytes.Equal(got, data[600:]) {
+		t.Fatal("peek after discard")
+	}
+
+	if n := b.Discard(5000); n != 900 || b.Len() != 0 {
+		t.Fatalf("discarded %d leaving %d, want 900 and 0", n, b.Len())
+	}
+	if len(b.segs) != 1 {
+		t.Fatalf("%d segments once empty, want 1 kept", len(b.segs))
+	}
+
+	b.Release()
+	if s := p.Stats(); s.Gets != s.Puts {
+		t.Fatalf("gets %d puts %d, every segment should be back", s.Gets, s.Puts)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	b := New(pool.New(false), 512, 1000)
+	if _, err := b.Write(pattern(900)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.Write(pattern(101)); n != 0 || !errors.Is(err, ErrFull) {
+		t.Fatalf("write over the limit: %d, %v", n, err)
+	}
+	if b.Len() != 900 || b.Free() != 100 {
+		t.Fatalf("len %d free %d, a refused write must leave the buffer alone", b.Len(), b.Free())
+	}
+}
+
+func TestFd(t *testing.T) {
+	a, c := socketpair(t)
+	data := pattern(20000)
+
+	out := New(pool.New(false), 4096, 1<<20)
+	out.Write(data)
+	n, err := out.WriteToFd(a)
+	if err != nil || n != len(data) || out.Len() != 0 {
+		t.Fatalf("WriteToFd: %d, %v, %d left", n, err, out.Len())
+	}
+
+	in := New(pool.New(false), 4096, 1<<20)
+	n, err = in.ReadFromFd(c)
+	if err != nil || n != len(data) {
+		t.Fatalf("ReadFromFd: %d, %v", n, err)
+	}
+	if !bytes.Equal(in.Peek(in.Len()), data) {
+		t.Fatal("bytes changed on the way through")
+	}
+
+	unix.Close(a)
+	if _, err := in.ReadFromFd(c); err != io.EOF {
+		t.Fatalf("ReadFromFd after close: %v, want EOF", err)
+	}
+}
+
+func TestReadFromFdLimit(t *testing.T) {
+	a, c := socketpair(t)
+	unix.Write(a, pattern(3000))
+
+	b := New(pool.New(false), 512, 2000)
+	n, err := b.ReadFromFd(c)
+	if n != 2000 || !errors.Is(err, ErrFull) {
+		t.Fatalf("ReadFromFd: %d, %v, want 2000 and ErrFull", n, err)
+	}
+
+	// room again after the reader catches up, filling it exactly still reports full
+	b.Discard(1000)
+	if n, err := b.ReadFromFd(c); n != 1000 || !errors.Is(err, ErrFull) {
+		t.Fatalf("ReadFromFd after discard: %d, %v", n, err)
+	}
+	if !bytes.Equal(b.Peek(2000), pattern(3000)[1000:]) {
+		t.Fatal("wrong bytes after refilling")
+	}
+}
+
+func TestReadFromFdN(t *testing.T) {
+	a, c := socketpair(t)
+	unix.Write(a, pattern(3000))
+
+	// one readv fills the tail and one fresh segment, the rest stays in the socket
+	b := New(pool.New(false), 512, 1<<20)
+	if n, err := b.ReadFromFdN(c, 1); n != 1024 || err != nil {
+		t.Fatalf("ReadFromFdN 1: %d, %v, want 1024 and nil", n, err)
+	}
+	if n, err := b.ReadFromFdN(c, 0); n != 1976 || err != nil {
+		t.Fatalf("ReadFromFdN 0: %d, %v, want 1976 and nil", n, err)
+	}
+	if !bytes.Equal(b.Peek(b.Len()), pattern(3000)) {
+		t.Fatal("wrong bytes")
+	}
+}
+
+func TestWriteToFdWouldBlock(t *testing.T) {
+	a, c := socketpair(t)
+	b := New(pool.New(false), 64<<10, 16<<20)
+	data := pattern(8 << 20) // far more than a socket buffer holds
+	b.Write(data)
+
+	sent, err := b.WriteToFd(a)
+	if err != nil || sent == 0 || sent == len(data) || b.Len() != len(data)-sent {
+		t.Fatalf("WriteToFd: sent %d of %d, %v, %d left", sent, len(data), err, b.Len())
+	}
+
+	// drain the other side and finish, what arrives must be the bytes in order
+	got := make([]byte, 0, len(data))
+	buf := make([]byte, 64<<10)
+	for len(got) < len(data) {
+		if _, err := b.WriteToFd(a); err != nil {
+			t.Fatal(err)
+		}
+		n, err := unix.Read(c, buf)
+		if err != nil && err != unix.EAGAIN {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:max(n, 0)]...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("bytes out of order after a short write")
+	}
+}
+
+func TestAppendWritev(t *testing.T) {
+	a, c := socketpair(t)
+	p := pool.New(false)
+	b := New(p, 4096, 32<<20)
+
+	// header, borrowed body, trailer, many times over, enough that writev stops part way
+	var want []byte
+	body := pattern(100 << 10)
+	for i := range 64 {
+		head := []byte(fmt.Sprintf("header %d\r\n", i))
+		b.Write(head)
+		if err := b.Append(body); err != nil {
+			t.Fatal(err)
+		}
+		b.Write([]byte("\r\n"))
+		want = append(want, head...)
+		want = append(want, body...)
+		want = append(want, "\r\n"...)
+	}
+	if b.Len() != len(want) {
+		t.Fatalf("len %d, want %d", b.Len(), len(want))
+	}
+
+	got := make([]byte, 0, len(want))
+	buf := make([]byte, 48<<10)
+	for len(got) < len(want) {
+		if _, err := b.WriteToFd(a); err != nil {
+			t.Fatal(err)
+		}
+		n, err := unix.Read(c, buf)
+		if err != nil && err != unix.EAGAIN {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:max(n, 0)]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("bytes out of order across partially written iovecs")
+	}
+	if b.Len() != 0 {
+		t.Fatalf("%d bytes left queued", b.Len())
+	}
+
+	b.Release()
+	if s := p.Stats(); s.Gets != s.Puts {
+		t.Fatalf("gets %d puts %d, borrowed segments must not go to the pool", s.Gets, s.Puts)
+	}
+}
+
+func TestReadvSpansSegments(t *testing.T) {
+	a, c := socketpair(t)
+	data := pattern(3000)
+	unix.Write(a, data)
+
+	p := pool.New(false)
+	b := New(p, 1024, 1<<20)
+	b.Write(data[:1000]) // leaves 24 bytes in the tail
+
+	if n, err := b.ReadFromFd(c); n != len(data) || err != nil {
+		t.Fatalf("ReadFromFd: %d, %v", n, err)
+	}
+	if !bytes.Equal(b.Peek(b.Len()), append(data[:1000:1000], data...)) {
+		t.Fatal("wrong bytes after readv")
+	}
+	if b.Discard(b.Len()); len(b.segs) != 1 {
+		t.Fatalf("%d segments once empty, want 1 kept", len(b.segs))
+	}
+}
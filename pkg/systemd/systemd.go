@@ -0,0 +1,134 @@
+// Package systemd is the little of systemd's protocols a server needs to run from socket
+// units: listening sockets passed in LISTEN_FDS, and state changes sent to NOTIFY_SOCKET,
+// see sd_listen_fds(3) and sd_notify(3).
+package systemd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// LISTENFDSSTART is the first fd systemd passes, the rest follow it.
+const LISTENFDSSTART = 3
+
+// states for Notify
+const (
+	READY     = "READY=1"
+	STOPPING  = "STOPPING=1"
+	RELOADING = "RELOADING=1"
+	WATCHDOG  = "WATCHDOG=1"
+)
+
+// Listener is a socket systemd passed, Name is its FileDescriptorName= in the socket unit.
+type Listener struct {
+	Fd   int
+	Name string
+}
+
+// Listeners returns the sockets passed to this process, none if it was not socket activated
+// or they were meant for another process. The LISTEN_ variables are taken out of the
+// environment so a child does not think they are its own.
+func Listeners() ([]Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("systemd: bad LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	ls := make([]Listener, n)
+	for i := range ls {
+		ls[i].Fd = LISTENFDSSTART + i
+		if i < len(names) {
+			ls[i].Name = names[i]
+		}
+		unix.CloseOnExec(ls[i].Fd)
+	}
+	return ls, nil
+}
+
+// Named returns the fd of the listener called name, 0 if there is none.
+func Named(ls []Listener, name string) int {
+	for _, l := range ls {
+		if l.Name == name {
+			return l.Fd
+		}
+	}
+	return 0
+}
+
+// Notify sends state to systemd, several separated by newlines. It reports whether
+// there was anyone to tell, without NOTIFY_SOCKET it is a no-op.
+func Notify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return false, fmt.Errorf("systemd: socket: %w", err)
+	}
+	defer unix.Close(fd)
+	// a leading @ is an abstract socket, SockaddrUnix handles it
+	if err := unix.Sendto(fd, []byte(state), 0, &unix.SockaddrUnix{Name: addr}); err != nil {
+		return false, fmt.Errorf("systemd: notifying %s: %w", addr, err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval is how often systemd wants a WATCHDOG ping, 0 if it does not. WATCHDOG_PID
+// is taken out of the environment, a process this one hands over to pings in its place.
+func WatchdogInterval() (time.Duration, error) {
+	defer os.Unsetenv("WATCHDOG_PID")
+	v := os.Getenv("WATCHDOG_USEC")
+	if v == "" {
+		return 0, nil
+	}
+	if p := os.Getenv("WATCHDOG_PID"); p != "" {
+		if pid, err := strconv.Atoi(p); err != nil || pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+	usec, err := strconv.ParseUint(v, 10, 63)
+	if err != nil || usec == 0 {
+		return 0, fmt.Errorf("systemd: bad WATCHDOG_USEC %q", v)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// Watchdog pings systemd at half the interval it asked for until stop is closed. It
+// reports whether systemd asked for pings at all.
+func Watchdog(stop <-chan struct{}) (bool, error) {
+	interval, err := WatchdogInterval()
+	if err != nil || interval == 0 {
+		return false, err
+	}
+	go func() {
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				Notify(WATCHDOG)
+			}
+		}
+	}()
+	return true, nil
+}
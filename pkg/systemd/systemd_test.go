@@ -0,0 +1,124 @@
+package systemd
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeSystemd binds a datagram socket at addr and points NOTIFY_SOCKET at it, it returns
+// a function reading the next message.
+func fakeSystemd(t *testing.T, addr string) func() string {
+	t.Helper()
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	if err := unix.Bind(fd, &unix.SockaddrUnix{Name: addr}); err != nil {
+		t.Fatal(err)
+	}
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 2})
+	t.Setenv("NOTIFY_SOCKET", addr)
+	return func() string {
+		buf := make([]byte, 256)
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			t.Fatalf("nothing from Notify: %v", err)
+		}
+		return string(buf[:n])
+	}
+}
+
+func TestNotify(t *testing.T) {
+	for name, addr := range map[string]string{
+		"path":     filepath.Join(t.TempDir(), "notify"),
+		"abstract": "@epoll-learn-test-" + strconv.Itoa(os.Getpid()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			next := fakeSystemd(t, addr)
+			for _, state := range []string{READY, STOPPING, "STATUS=draining\nRELOADING=1"} {
+				if sent, err := Notify(state); !sent || err != nil {
+					t.Fatalf("Notify(%q): %v, %v", state, sent, err)
+				}
+				if got := next(); got != state {
+					t.Fatalf("systemd got %q, want %q", got, state)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyWithoutSystemd(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify(READY); sent || err != nil {
+		t.Fatalf("Notify without NOTIFY_SOCKET: %v, %v", sent, err)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "2")
+	t.Setenv("LISTEN_FDNAMES", "http:admin")
+	ls, err := Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 2 || ls[0] != (Listener{3, "http"}) || ls[1] != (Listener{4, "admin"}) {
+		t.Fatalf("listeners %v", ls)
+	}
+	if Named(ls, "admin") != 4 || Named(ls, "chat") != 0 {
+		t.Fatal("Named picked the wrong listener")
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("LISTEN_FDS left for children to find")
+	}
+}
+
+func TestListenersForAnotherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if ls, err := Listeners(); ls != nil || err != nil {
+		t.Fatalf("took another process's listeners: %v, %v", ls, err)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	next := fakeSystemd(t, filepath.Join(t.TempDir(), "notify"))
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	start := time.Now()
+	if on, err := Watchdog(stop); !on || err != nil {
+		t.Fatalf("Watchdog: %v, %v", on, err)
+	}
+	for range 2 {
+		if got := next(); got != WATCHDOG {
+			t.Fatalf("systemd got %q, want %q", got, WATCHDOG)
+		}
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Fatalf("two pings in %v, want one per 10ms", d)
+	}
+	if os.Getenv("WATCHDOG_PID") != "" {
+		t.Fatal("WATCHDOG_PID left for children to find")
+	}
+}
+
+func TestWatchdogOff(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if on, err := Watchdog(nil); on || err != nil {
+		t.Fatalf("Watchdog without WATCHDOG_USEC: %v, %v", on, err)
+	}
+	t.Setenv("WATCHDOG_USEC", "1000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if on, err := Watchdog(nil); on || err != nil {
+		t.Fatalf("Watchdog meant for another process: %v, %v", on, err)
+	}
+}
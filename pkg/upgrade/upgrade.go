@@ -0,0 +1,202 @@
+// Package upgrade hands a server's listening sockets to a new copy of its binary, for
+// deploys that drop no connections. The parent execs the child with the sockets as
+// inherited descriptors, the child adopts them instead of binding its own, tells the
+// parent once it accepts on them, and the parent stops accepting and drains.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// environment a child finds its inheritance in
+const (
+	ENVFDS   = "EPOLL_LEARN_UPGRADE_FDS"   // name:fd pairs, comma separated
+	ENVREADY = "EPOLL_LEARN_UPGRADE_READY" // fd of the pipe Ready writes to
+)
+
+// READYTIMEOUT is how long Upgrade waits for the child to call Ready.
+const READYTIMEOUT = 30 * time.Second
+
+var (
+	ErrNotReady  = errors.New("upgrade: child exited before it was ready")
+	ErrUpgrading = errors.New("upgrade: already upgrading")
+)
+
+// Upgrader is both ends of an upgrade, what the process inherited from its parent if it
+// has one, and Upgrade to start its own child.
+type Upgrader struct {
+	mu        sync.Mutex
+	inherited map[string]int
+	ready     *os.File // write end of the parent's pipe, until Ready
+	upgrading bool
+}
+
+// New reads what the parent left in the environment, and takes it out so it does not
+// leak into other processes this one starts. Without a parent there is nothing to read.
+func New() (*Upgrader, error) {
+	u := &Upgrader{inherited: make(map[string]int)}
+	defer os.Unsetenv(ENVFDS)
+	defer os.Unsetenv(ENVREADY)
+
+	if v := os.Getenv(ENVFDS); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			name, fdText, ok := strings.Cut(pair, ":")
+			fd, err := strconv.Atoi(fdText)
+			if !ok || err != nil || fd < 3 {
+				return nil, fmt.Errorf("upgrade: bad %s %q", ENVFDS, v)
+			}
+			unix.CloseOnExec(fd)
+			u.inherited[name] = fd
+		}
+	}
+	if v := os.Getenv(ENVREADY); v != "" {
+		fd, err := strconv.Atoi(v)
+		if err != nil || fd < 3 {
+			return nil, fmt.Errorf("upgrade: bad %s %q", ENVREADY, v)
+		}
+		unix.CloseOnExec(fd)
+		u.ready = os.NewFile(uintptr(fd), "upgrade-ready")
+	}
+	return u, nil
+}
+
+// Inherited reports whether the process was started by Upgrade.
+func (u *Upgrader) Inherited() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.ready != nil
+}
+
+// Fd returns the listener inherited under name and forgets it, it is the caller's from
+// here on. ok is false when nothing was handed over under that name.
+func (u *Upgrader) Fd(name string) (fd int, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	fd, ok = u.inherited[name]
+	delete(u.inherited, name)
+	return fd, ok
+}
+
+// Ready tells the parent the process accepts on what it inherited, the parent then stops
+// accepting and drains. Inherited listeners nobody asked for are closed. A no-op without
+// a parent.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for name, fd := range u.inherited {
+		unix.Close(fd)
+		delete(u.inherited, name)
+	}
+	if u.ready == nil {
+		return nil
+	}
+	_, err := u.ready.Write([]byte{1})
+	u.ready.Close()
+	u.ready = nil
+	if err != nil {
+		return fmt.Errorf("upgrade: telling the parent: %w", err)
+	}
+	return nil
+}
+
+// Upgrade starts the running binary again, same arguments, environment and stdio, with
+// listeners handed over under their names. It returns the child's pid once the child
+// called Ready, the caller then stops accepting and drains. If the child exits or does not
+// get ready within READYTIMEOUT it is killed and the caller carries on serving.
+func (u *Upgrader) Upgrade(listeners map[string]int) (int, error) {
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return 0, ErrUpgrading
+	}
+	u.upgrading = true
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("upgrade: finding the binary: %w", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("upgrade: pipe: %w", err)
+	}
+	defer r.Close()
+
+	// ExtraFiles become fds 3 and up in the child, dups so ours stay close-on-exec
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		dup, err := unix.FcntlInt(uintptr(listeners[name]), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			w.Close()
+			return 0, fmt.Errorf("upgrade: dup %s listener: %w", name, err)
+		}
+		files = append(files, os.NewFile(uintptr(dup), name))
+		pairs = append(pairs, fmt.Sprintf("%s:%d", name, 3+i))
+	}
+	files = append(files, w)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		ENVFDS+"="+strings.Join(pairs, ","),
+		ENVREADY+"="+strconv.Itoa(3+len(names)),
+	)
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("upgrade: starting %s: %w", exe, err)
+	}
+	// the child holds its copies now, EOF on r means it is gone without a word
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+
+	readyC := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		if n, _ := r.Read(b[:]); n == 1 {
+			readyC <- nil
+			return
+		}
+		readyC <- ErrNotReady
+	}()
+	select {
+	case err = <-readyC:
+	case <-time.After(READYTIMEOUT):
+		err = fmt.Errorf("upgrade: child not ready after %v", READYTIMEOUT)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
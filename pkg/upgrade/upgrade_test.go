@@ -0,0 +1,123 @@
+package upgrade
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// the test binary is its own child, testChild says what the child does
+const testChild = "UPGRADE_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(ENVREADY) != "" {
+		os.Exit(child(os.Getenv(testChild)))
+	}
+	os.Exit(m.Run())
+}
+
+// child adopts the listener named test, calls Ready and answers one connection, or with
+// mode fail exits without a word.
+func child(mode string) int {
+	u, err := New()
+	if err != nil || !u.Inherited() || mode == "fail" {
+		return 1
+	}
+	fd, ok := u.Fd("test")
+	if !ok {
+		return 1
+	}
+	if err := u.Ready(); err != nil {
+		return 1
+	}
+	cfd, _, err := unix.Accept(fd)
+	if err != nil {
+		return 1
+	}
+	unix.Write(cfd, []byte("hello from the child"))
+	unix.Close(cfd)
+	return 0
+}
+
+func listen(t *testing.T) (int, string) {
+	t.Helper()
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	if err := unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Listen(fd, 8); err != nil {
+		t.Fatal(err)
+	}
+	sa, _ := unix.Getsockname(fd)
+	return fd, (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sa.(*unix.SockaddrInet4).Port}).String()
+}
+
+func TestNewWithoutParent(t *testing.T) {
+	u, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Inherited() {
+		t.Fatal("inherited without a parent")
+	}
+	if _, ok := u.Fd("test"); ok {
+		t.Fatal("found a listener without a parent")
+	}
+	if err := u.Ready(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewBadEnv(t *testing.T) {
+	t.Setenv(ENVFDS, "test:x")
+	if _, err := New(); err == nil {
+		t.Fatal("no error for a bad fd list")
+	}
+}
+
+// TestUpgrade hands a listener to the child, the connection made after Upgrade returns is
+// answered by the child while the parent has not accepted anything.
+func TestUpgrade(t *testing.T) {
+	fd, addr := listen(t)
+	u, _ := New()
+	pid, err := u.Upgrade(map[string]int{"test": fd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid == os.Getpid() || pid == 0 {
+		t.Fatalf("child pid %d", pid)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "hello from the child" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestUpgradeChildFails(t *testing.T) {
+	fd, _ := listen(t)
+	t.Setenv(testChild, "fail")
+	u, _ := New()
+	if _, err := u.Upgrade(map[string]int{"test": fd}); !errors.Is(err, ErrNotReady) {
+		t.Fatalf("Upgrade with a failing child: %v, want ErrNotReady", err)
+	}
+	// the listener is still ours
+	if _, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,112 @@
+package uring
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// buf is struct io_uring_buf, the ring's tail lives in the resv field of the first one.
+type buf struct {
+	addr uint64
+	len  uint32
+	bid  uint16
+	resv uint16
+}
+
+type bufReg struct {
+	ringAddr    uint64
+	ringEntries uint32
+	bgid        uint16
+	flags       uint16
+	resv        [3]uint64
+}
+
+// BufRing is a group of equal sized buffers the kernel picks from for recv, a buffer is
+// the loop's from its completion until it hands it back with Recycle.
+type BufRing struct {
+	ring  *Ring
+	group uint16
+
+	mem     []byte // the shared ring of buf entries
+	entries []buf
+	mask    uint16
+	tail    uint16
+
+	bufs []byte // count buffers of size bytes each, in Go memory the kernel writes into
+	size int
+}
+
+// RegisterBufRing registers count buffers of size bytes as group, count must be a power of two.
+func (r *Ring) RegisterBufRing(group uint16, count, size int) (*BufRing, error) {
+	if count <= 0 || count > 1<<15 || count&(count-1) != 0 {
+		return nil, fmt.Errorf("uring: buffer count %d is not a power of two up to 32768", count)
+	}
+	mem, err := unix.Mmap(-1, 0, count*int(unsafe.Sizeof(buf{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANONYMOUS|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, fmt.Errorf("mmap buffer ring: %w", err)
+	}
+	b := &BufRing{
+		ring:    r,
+		group:   group,
+		mem:     mem,
+		entries: unsafe.Slice((*buf)(unsafe.Pointer(&mem[0])), count),
+		mask:    uint16(count - 1),
+		bufs:    make([]byte, count*size),
+		size:    size,
+	}
+
+	reg := bufReg{ringAddr: uint64(uintptr(unsafe.Pointer(&mem[0]))), ringEntries: uint32(count), bgid: group}
+	if _, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), registerPbufRing, uintptr(unsafe.Pointer(&reg)), 1, 0, 0); errno != 0 {
+		unix.Munmap(mem)
+		return nil, fmt.Errorf("%w: register buffer ring: %w", ErrUnsupported, errno)
+	}
+
+	for bid := range count {
+		b.add(uint16(bid))
+	}
+	b.publish()
+	return b, nil
+}
+
+func (b *BufRing) add(bid uint16) {
+	e := &b.entries[b.tail&b.mask]
+	e.addr = uint64(uintptr(unsafe.Pointer(&b.bufs[int(bid)*b.size])))
+	e.len = uint32(b.size)
+	e.bid = bid
+	b.tail++
+}
+
+// publish stores the tail for the kernel. It shares a 32 bit word with the first entry's bid,
+// written whole so the store is atomic, the loop is the only writer of both.
+func (b *BufRing) publish() {
+	word := (*uint32)(unsafe.Pointer(&b.entries[0].bid))
+	atomic.StoreUint32(word, uint32(b.tail)<<16|uint32(b.entries[0].bid))
+}
+
+// Buffer returns the first n bytes of buffer bid.
+func (b *BufRing) Buffer(bid uint16, n int) []byte {
+	off := int(bid) * b.size
+	return b.bufs[off : off+n : off+b.size]
+}
+
+// Recycle gives buffer bid back to the kernel.
+func (b *BufRing) Recycle(bid uint16) {
+	b.add(bid)
+	b.publish()
+}
+
+// Group is the buffer group id to recv with.
+func (b *BufRing) Group() uint16 { return b.group }
+
+func (b *BufRing) Close() error {
+	reg := bufReg{bgid: b.group}
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(b.ring.fd), unregisterPbufRng, uintptr(unsafe.Pointer(&reg)), 1, 0, 0)
+	unix.Munmap(b.mem)
+	if errno != 0 {
+		return fmt.Errorf("unregister buffer ring: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+// Package uring is the little of io_uring the servers need, on raw syscalls: a ring with its
+// submission and completion queues mapped in, a provided buffer ring for recv, and helpers
+// to fill in the operations the loops use.
+//
+// A Ring is driven by one goroutine, the one running the loop.
+package uring
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// operations, from include/uapi/linux/io_uring.h
+const (
+	OpNop      = 0
+	OpAccept   = 13
+	OpCancel   = 14
+	OpRead     = 22
+	OpSend     = 26
+	OpRecv     = 27
+	OpShutdown = 34
+)
+
+// sqe flags
+const (
+	SqeIOLink       = 1 << 2
+	SqeBufferSelect = 1 << 5
+)
+
+// cqe flags
+const (
+	CqeBuffer = 1 << 0 // the upper 16 bits hold the id of the provided buffer used
+	CqeMore   = 1 << 1 // a multishot request stays armed
+)
+
+const (
+	acceptMultishot = 1 << 0 // sqe ioprio for OpAccept
+	recvMultishot   = 1 << 1 // sqe ioprio for OpRecv
+
+	setupCQSize = 1 << 3
+	setupClamp  = 1 << 4
+
+	featSingleMmap = 1 << 0
+	featNoDrop     = 1 << 1
+
+	enterGetEvents = 1 << 0
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+
+	registerProbe     = 8
+	registerPbufRing  = 22
+	unregisterPbufRng = 23
+)
+
+var ErrUnsupported = errors.New("uring: not supported by this kernel")
+
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type params struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  sqringOffsets
+	cqOff                                                                  cqringOffsets
+}
+
+// SQE is a submission queue entry, the fields the operations here use.
+type SQE struct {
+	Opcode      uint8
+	Flags       uint8
+	Ioprio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	OpFlags     uint32
+	UserData    uint64
+	BufGroup    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	_           uint64
+}
+
+// CQE is a completion, Res is the syscall result or a negated errno.
+type CQE struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+// Err returns the errno of a failed completion, nil if it succeeded.
+func (c *CQE) Err() error {
+	if c.Res < 0 {
+		return unix.Errno(-c.Res)
+	}
+	return nil
+}
+
+// BufferID returns the provided buffer a recv landed in, ok is false if it used none.
+func (c *CQE) BufferID() (uint16, bool) {
+	return uint16(c.Flags >> 16), c.Flags&CqeBuffer != 0
+}
+
+type Ring struct {
+	fd int
+
+	sqMem, cqMem, sqeMem []byte
+
+	sqHead, sqTail *uint32
+	sqMask         uint32
+	sqEntries      uint32
+	sqArray        []uint32
+	sqes           []SQE
+
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           []CQE
+
+	// SQEs handed out by GetSQE but not yet published to the kernel
+	sqeHead, sqeTail uint32
+}
+
+func u32(mem []byte, off uint32) *uint32 { return (*uint32)(unsafe.Pointer(&mem[off])) }
+
+// New sets up a ring with room for entries submissions and eight times as many completions,
+// multishot accept and recv can post many completions for one submission.
+func New(entries uint32) (*Ring, error) {
+	p := params{flags: setupCQSize | setupClamp, cqEntries: entries * 8}
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+	r := &Ring{fd: int(fd)}
+	if p.features&featSingleMmap == 0 || p.features&featNoDrop == 0 {
+		r.Close()
+		return nil, ErrUnsupported
+	}
+
+	sqSize := p.sqOff.array + p.sqEntries*4
+	cqSize := p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(CQE{}))
+	size := max(sqSize, cqSize)
+
+	var err error
+	r.sqMem, err = unix.Mmap(r.fd, offSQRing, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("mmap rings: %w", err)
+	}
+	r.cqMem = r.sqMem // one mapping for both with featSingleMmap
+	r.sqeMem, err = unix.Mmap(r.fd, offSQEs, int(p.sqEntries)*int(unsafe.Sizeof(SQE{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("mmap sqes: %w", err)
+	}
+
+	r.sqHead = u32(r.sqMem, p.sqOff.head)
+	r.sqTail = u32(r.sqMem, p.sqOff.tail)
+	r.sqMask = *u32(r.sqMem, p.sqOff.ringMask)
+	r.sqEntries = *u32(r.sqMem, p.sqOff.ringEntries)
+	r.sqArray = unsafe.Slice(u32(r.sqMem, p.sqOff.array), p.sqEntries)
+	r.sqes = unsafe.Slice((*SQE)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+
+	r.cqHead = u32(r.cqMem, p.cqOff.head)
+	r.cqTail = u32(r.cqMem, p.cqOff.tail)
+	r.cqMask = *u32(r.cqMem, p.cqOff.ringMask)
+	r.cqes = unsafe.Slice((*CQE)(unsafe.Pointer(&r.cqMem[p.cqOff.cqes])), p.cqEntries)
+
+	r.sqeHead = atomic.LoadUint32(r.sqTail)
+	r.sqeTail = r.sqeHead
+	return r, nil
+}
+
+func (r *Ring) Close() error {
+	if r.sqeMem != nil {
+		unix.Munmap(r.sqeMem)
+	}
+	if r.sqMem != nil {
+		unix.Munmap(r.sqMem)
+	}
+	r.sqMem, r.cqMem, r.sqeMem = nil, nil, nil
+	return unix.Close(r.fd)
+}
+
+// GetSQE returns a zeroed entry to fill in, submitting what is queued first if the ring is full.
+func (r *Ring) GetSQE() (*SQE, error) {
+	if r.sqeTail-atomic.LoadUint32(r.sqHead) >= r.sqEntries {
+		if err := r.Submit(); err != nil {
+			return nil, err
+		}
+		if r.sqeTail-atomic.LoadUint32(r.sqHead) >= r.sqEntries {
+			return nil, unix.EBUSY
+		}
+	}
+	sqe := &r.sqes[r.sqeTail&r.sqMask]
+	*sqe = SQE{}
+	r.sqeTail++
+	return sqe, nil
+}
+
+// flush publishes the prepared entries and returns how many the kernel has yet to take.
+func (r *Ring) flush() uint32 {
+	tail := *r.sqTail
+	for ; r.sqeHead != r.sqeTail; r.sqeHead++ {
+		r.sqArray[tail&r.sqMask] = r.sqeHead & r.sqMask
+		tail++
+	}
+	atomic.StoreUint32(r.sqTail, tail)
+	return tail - atomic.LoadUint32(r.sqHead)
+}
+
+func (r *Ring) enter(submit, wait uint32, flags uint32) error {
+	for {
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(submit), uintptr(wait), uintptr(flags), 0, 0)
+		switch errno {
+		case 0:
+			return nil
+		case unix.EINTR:
+			continue
+		}
+		return fmt.Errorf("io_uring_enter: %w", errno)
+	}
+}
+
+// Submit hands every prepared entry to the kernel without waiting.
+func (r *Ring) Submit() error {
+	if n := r.flush(); n > 0 {
+		return r.enter(n, 0, 0)
+	}
+	return nil
+}
+
+// SubmitAndWait hands every prepared entry to the kernel and blocks until a completion is ready.
+func (r *Ring) SubmitAndWait() error {
+	return r.enter(r.flush(), 1, enterGetEvents)
+}
+
+// Completions calls f for every completion ready and returns how many there were.
+// f may prepare new entries.
+func (r *Ring) Completions(f func(cqe *CQE)) int {
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	n := 0
+	for ; head != tail; head++ {
+		cqe := r.cqes[head&r.cqMask]
+		f(&cqe)
+		n++
+		// let the kernel reuse the slot as soon as it is copied out
+		atomic.StoreUint32(r.cqHead, head+1)
+	}
+	return n
+}
+
+// UserData packs what a loop needs to route a completion: the operation, the fd,
+// and a generation that tells a closed connection from a new one on the same fd.
+func UserData(op uint8, fd int, gen uint32) uint64 {
+	return uint64(op)<<56 | uint64(gen&0xffffff)<<32 | uint64(uint32(fd))
+}
+
+func SplitUserData(u uint64) (op uint8, fd int, gen uint32) {
+	return uint8(u >> 56), int(int32(uint32(u))), uint32(u>>32) & 0xffffff
+}
+
+// PrepAcceptMultishot accepts connections on fd until cancelled, one completion each.
+func PrepAcceptMultishot(sqe *SQE, fd int, flags int, userData uint64) {
+	sqe.Opcode = OpAccept
+	sqe.Fd = int32(fd)
+	sqe.Ioprio = acceptMultishot
+	sqe.OpFlags = uint32(flags)
+	sqe.UserData = userData
+}
+
+// PrepRecvMultishot receives on fd into buffers picked from group until the connection
+// ends or the group runs dry, one completion per chunk.
+func PrepRecvMultishot(sqe *SQE, fd int, group uint16, userData uint64) {
+	sqe.Opcode = OpRecv
+	sqe.Fd = int32(fd)
+	sqe.Ioprio = recvMultishot
+	sqe.Flags = SqeBufferSelect
+	sqe.BufGroup = group
+	sqe.UserData = userData
+}
+
+// PrepSend sends all of p, a short count only comes back with an error.
+// p must stay put until the completion, on the heap and referenced, a goroutine stack moves.
+func PrepSend(sqe *SQE, fd int, p []byte, userData uint64) {
+	sqe.Opcode = OpSend
+	sqe.Fd = int32(fd)
+	sqe.Addr = uint64(uintptr(unsafe.Pointer(unsafe.SliceData(p))))
+	sqe.Len = uint32(len(p))
+	sqe.OpFlags = unix.MSG_WAITALL | unix.MSG_NOSIGNAL
+	sqe.UserData = userData
+}
+
+// PrepRead reads into p, which must stay put until the completion, as for PrepSend.
+func PrepRead(sqe *SQE, fd int, p []byte, userData uint64) {
+	sqe.Opcode = OpRead
+	sqe.Fd = int32(fd)
+	sqe.Addr = uint64(uintptr(unsafe.Pointer(unsafe.SliceData(p))))
+	sqe.Len = uint32(len(p))
+	sqe.Off = ^uint64(0) // current position, eventfds have none
+	sqe.UserData = userData
+}
+
+// PrepShutdown shuts down one or both directions of the socket fd.
+func PrepShutdown(sqe *SQE, fd int, how int, userData uint64) {
+	sqe.Opcode = OpShutdown
+	sqe.Fd = int32(fd)
+	sqe.Len = uint32(how)
+	sqe.UserData = userData
+}
+
+// PrepCancel cancels the request submitted with user data target, a multishot one stops
+// with a last completion of its own, -ECANCELED and no CqeMore.
+func PrepCancel(sqe *SQE, target uint64, userData uint64) {
+	sqe.Opcode = OpCancel
+	sqe.Fd = -1
+	sqe.Addr = target
+	sqe.UserData = userData
+}
+
+type probeOp struct {
+	op    uint8
+	resv  uint8
+	flags uint16
+	resv2 uint32
+}
+
+type probe struct {
+	lastOp uint8
+	opsLen uint8
+	resv   uint16
+	resv2  [3]uint32
+	ops    [256]probeOp
+}
+
+// Supported reports whether the kernel has everything the loops use, nil if it does.
+func Supported() error {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return err
+	}
+	var major, minor int
+	fmt.Sscanf(unix.ByteSliceToString(uts.Release[:]), "%d.%d", &major, &minor)
+	if major < 6 { // multishot recv came in 6.0
+		return fmt.Errorf("%w: kernel %d.%d, need 6.0", ErrUnsupported, major, minor)
+	}
+
+	r, err := New(8)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var p probe
+	if _, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), registerProbe, uintptr(unsafe.Pointer(&p)), 256, 0, 0); errno != 0 {
+		return fmt.Errorf("%w: probe: %w", ErrUnsupported, errno)
+	}
+	for _, op := range []uint8{OpAccept, OpCancel, OpRecv, OpSend, OpRead, OpShutdown} {
+		if op > p.lastOp || p.ops[op].flags&1 == 0 {
+			return fmt.Errorf("%w: opcode %d", ErrUnsupported, op)
+		}
+	}
+
+	br, err := r.RegisterBufRing(0, 2, 64)
+	if err != nil {
+		return err
+	}
+	return br.Close()
+}
@@ -0,0 +1,166 @@
+package uring
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func newRing(t *testing.T) *Ring {
+	t.Helper()
+	if err := Supported(); err != nil {
+		t.Skip(err)
+	}
+	r, err := New(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// wait submits and collects completions until n have arrived.
+func wait(t *testing.T, r *Ring, n int) []CQE {
+	t.Helper()
+	var got []CQE
+	for len(got) < n {
+		if err := r.SubmitAndWait(); err != nil {
+			t.Fatal(err)
+		}
+		r.Completions(func(cqe *CQE) { got = append(got, *cqe) })
+	}
+	return got
+}
+
+func TestUserData(t *testing.T) {
+	u := UserData(OpRecv, 12345, 0x1234567)
+	op, fd, gen := SplitUserData(u)
+	if op != OpRecv || fd != 12345 || gen != 0x234567 {
+		t.Fatalf("got %d %d %x", op, fd, gen)
+	}
+}
+
+func TestNops(t *testing.T) {
+	r := newRing(t)
+	// more than the ring holds, GetSQE submits to make room
+	for i := range 200 {
+		sqe, err := r.GetSQE()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sqe.Opcode = OpNop
+		sqe.UserData = uint64(i)
+	}
+	got := wait(t, r, 200)
+	for i, cqe := range got {
+		if cqe.UserData != uint64(i) || cqe.Res != 0 {
+			t.Fatalf("completion %d: %+v", i, cqe)
+		}
+	}
+}
+
+func TestRecvSend(t *testing.T) {
+	r := newRing(t)
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	br, err := r.RegisterBufRing(1, 4, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+
+	sqe, _ := r.GetSQE()
+	PrepRecvMultishot(sqe, fds[1], br.Group(), UserData(OpRecv, fds[1], 1))
+
+	// a chunk bigger than one buffer spreads over several completions
+	msg := []byte("the quick brown fox jumps over the lazy dog")
+	sqe, _ = r.GetSQE()
+	PrepSend(sqe, fds[0], msg, UserData(OpSend, fds[0], 1))
+
+	var recvd []byte
+	sent := false
+	for !sent || len(recvd) < len(msg) {
+		for _, cqe := range wait(t, r, 1) {
+			op, _, _ := SplitUserData(cqe.UserData)
+			switch op {
+			case OpSend:
+				if int(cqe.Res) != len(msg) {
+					t.Fatalf("send: %d", cqe.Res)
+				}
+				sent = true
+			case OpRecv:
+				if err := cqe.Err(); err != nil {
+					if errors.Is(err, unix.ENOBUFS) {
+						t.Fatal("ran out of buffers, they are recycled as they come")
+					}
+					t.Fatal(err)
+				}
+				bid, ok := cqe.BufferID()
+				if !ok {
+					t.Fatal("recv completion without a buffer")
+				}
+				recvd = append(recvd, br.Buffer(bid, int(cqe.Res))...)
+				br.Recycle(bid)
+				if cqe.Flags&CqeMore == 0 {
+					t.Fatal("multishot recv disarmed")
+				}
+			}
+		}
+	}
+	if !bytes.Equal(recvd, msg) {
+		t.Fatalf("got %q", recvd)
+	}
+}
+
+func TestAcceptMultishot(t *testing.T) {
+	r := newRing(t)
+	lfd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(lfd)
+	if err := unix.Bind(lfd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	unix.Listen(lfd, 16)
+	sa, _ := unix.Getsockname(lfd)
+
+	sqe, _ := r.GetSQE()
+	PrepAcceptMultishot(sqe, lfd, unix.SOCK_CLOEXEC, UserData(OpAccept, lfd, 0))
+	if err := r.Submit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		cfd, _ := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+		defer unix.Close(cfd)
+		if err := unix.Connect(cfd, sa); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, cqe := range wait(t, r, 3) {
+		if cqe.Res < 0 || cqe.Flags&CqeMore == 0 {
+			t.Fatalf("accept completion %+v", cqe)
+		}
+		unix.Close(int(cqe.Res))
+	}
+
+	// cancelled, the accept ends with ECANCELED and the cancel itself succeeds
+	sqe, _ = r.GetSQE()
+	PrepCancel(sqe, UserData(OpAccept, lfd, 0), UserData(OpCancel, lfd, 0))
+	for _, cqe := range wait(t, r, 2) {
+		switch op, _, _ := SplitUserData(cqe.UserData); {
+		case op == OpAccept && (!errors.Is(cqe.Err(), unix.ECANCELED) || cqe.Flags&CqeMore != 0):
+			t.Fatalf("cancelled accept completion %+v", cqe)
+		case op == OpCancel && cqe.Res != 0:
+			t.Fatalf("cancel completion %+v", cqe)
+		}
+	}
+}